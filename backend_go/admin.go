@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admin API for operating the backend without restarts: list and kill
+// execution sessions, drain before a deploy, reload CONFIG_FILE. Every
+// /admin/ endpoint requires "Authorization: Bearer $ADMIN_TOKEN" and the API
+// is off when ADMIN_TOKEN is unset.
+
+// liveSession is an execution WebSocket in progress
+type liveSession struct {
+	ID          string    `json:"id"`
+	RunID       string    `json:"run_id,omitempty"`
+	RequestID   string    `json:"request_id"`
+	Script      string    `json:"script"`
+	Executor    string    `json:"executor"`
+	Workspace   string    `json:"workspace,omitempty"`
+	Priority    string    `json:"priority"`
+	MaxDuration string    `json:"max_duration,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Remote      string    `json:"remote_addr"`
+	StartedAt   time.Time `json:"started_at"`
+
+	outbox *wsOutbox
+	status *sessionStatus
+	kill   func(reason string)
+}
+
+// sessionRegistry tracks the execution sessions in progress
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*liveSession
+}
+
+var liveSessions = &sessionRegistry{sessions: map[string]*liveSession{}}
+
+// draining stops new executions while the running ones finish
+var draining atomic.Bool
+
+func (reg *sessionRegistry) add(s *liveSession) {
+	if s.ID == "" {
+		s.ID = newID()
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.sessions[s.ID] = s
+}
+
+func (reg *sessionRegistry) remove(s *liveSession) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.sessions, s.ID)
+}
+
+func (reg *sessionRegistry) get(id string) (*liveSession, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	s, ok := reg.sessions[id]
+	return s, ok
+}
+
+// list returns the sessions, oldest first
+func (reg *sessionRegistry) list() []*liveSession {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	out := make([]*liveSession, 0, len(reg.sessions))
+	for _, s := range reg.sessions {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+func (reg *sessionRegistry) count() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.sessions)
+}
+
+// adminAuth lets through requests carrying the ADMIN_TOKEN bearer token
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			http.Error(w, "Admin API disabled, set ADMIN_TOKEN", http.StatusNotFound)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// registerAdminRoutes mounts the admin API; reload re-reads the config file
+func registerAdminRoutes(reload func() error) {
+	http.HandleFunc("/admin/sessions", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		type sessionInfo struct {
+			*liveSession
+			DurationSeconds float64       `json:"duration_seconds"`
+			Queue           *wsQueueStats `json:"queue,omitempty"`
+			Status          *statusReport `json:"status,omitempty"`
+		}
+		out := []sessionInfo{}
+		for _, s := range liveSessions.list() {
+			info := sessionInfo{liveSession: s, DurationSeconds: time.Since(s.StartedAt).Seconds()}
+			if s.outbox != nil {
+				stats := s.outbox.stats()
+				info.Queue = &stats
+			}
+			if s.status != nil {
+				rep := s.status.report()
+				info.Status = &rep
+			}
+			out = append(out, info)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": out, "draining": draining.Load()})
+	}))
+
+	// POST /admin/sessions/{id}/kill ends the run and disconnects its client
+	http.HandleFunc("/admin/sessions/", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/sessions/"), "/")
+		if action != "kill" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s, ok := liveSessions.get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		log.Printf("Admin: killing session %s (%s)", s.ID, s.Script)
+		s.kill("Killed by administrator")
+		writeJSON(w, http.StatusOK, map[string]string{"killed": s.ID})
+	}))
+
+	// GET reports the drain state; POST {"draining": bool} changes it
+	http.HandleFunc("/admin/drain", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Draining *bool `json:"draining"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Draining == nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"draining": true|false}`})
+				return
+			}
+			draining.Store(*req.Draining)
+			log.Printf("Admin: draining set to %v", *req.Draining)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"draining": draining.Load(), "active_sessions": liveSessions.count()})
+	}))
+
+	http.HandleFunc("/admin/reload", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			log.Printf("Admin: config reload failed: %v", err)
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Println("Admin: config reloaded")
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	}))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Typed client for the backend's own API, used by the models and datasets
+// commands. It talks to the backend rather than the Python service so the
+// commands go through the same routing, limits and logging as the frontend.
+
+// apiClient calls the API of a running backend
+type apiClient struct {
+	base string
+	http *http.Client
+}
+
+// newAPIClient returns a client for target, or for the local server on
+// LISTEN_ADDR when target is empty
+func newAPIClient(target string, timeout time.Duration) *apiClient {
+	if target == "" {
+		client, base := localClient(timeout)
+		return &apiClient{base: base, http: client}
+	}
+	return &apiClient{base: strings.TrimRight(target, "/"), http: &http.Client{Timeout: timeout}}
+}
+
+// apiError is a non-2xx answer from the backend or the Python service
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.Status)
+	}
+	return fmt.Sprintf("%s (status %d)", e.Message, e.Status)
+}
+
+// ModelSummary is an entry of /api/models
+type ModelSummary struct {
+	Name         string  `json:"path"`
+	LastModified float64 `json:"last_modified"`
+	P            float64 `json:"p"`
+	R            float64 `json:"r"`
+	MAP50        float64 `json:"map50"`
+	MAP50_95     float64 `json:"map50_95"`
+	HasReport    bool    `json:"has_report"`
+}
+
+// DatasetInfo is the answer of /api/dataset/{name}/info
+type DatasetInfo struct {
+	Name        string `json:"name"`
+	TotalImages int    `json:"total_images"`
+	Exists      bool   `json:"dataset_exists"`
+	Path        string `json:"dataset_path,omitempty"`
+}
+
+// DatasetFile is an uploaded target or background image of the custom dataset
+type DatasetFile struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Created  string `json:"created"`
+}
+
+// datasetNames are the datasets the Python service generates and trains on
+var datasetNames = []string{"synthetic", "custom"}
+
+// datasetUploadKinds are the images the custom dataset is generated from
+var datasetUploadKinds = map[string]string{"target": "targets", "background": "backgrounds"}
+
+// ListModels returns the trained models with their final metrics, only
+// those matching selector unless it is empty
+func (c *apiClient) ListModels(ctx context.Context, selector string) ([]ModelSummary, error) {
+	path := "/api/models"
+	if selector != "" {
+		path += "?label_selector=" + url.QueryEscape(selector)
+	}
+	var models []ModelSummary
+	err := c.do(ctx, http.MethodGet, path, nil, "", &models)
+	return models, err
+}
+
+// Model returns the file details, training config and metrics of a model
+func (c *apiClient) Model(ctx context.Context, name string) (*Model, error) {
+	var model Model
+	if err := c.do(ctx, http.MethodGet, modelPath(name, "info"), nil, "", &model); err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+// DownloadModel writes the weights of a model to w
+func (c *apiClient) DownloadModel(ctx context.Context, name string, w io.Writer) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+modelPath(name, "download"), nil)
+	if err != nil {
+		return 0, err
+	}
+	// Weights can take a while; the context bounds the download instead
+	client := *c.http
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, responseError(resp)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// ModelCard returns the markdown model card of a model
+func (c *apiClient) ModelCard(ctx context.Context, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+modelPath(name, "card"), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
+
+// DeleteModel removes a model along with its report and training summary
+func (c *apiClient) DeleteModel(ctx context.Context, name string) error {
+	body := map[string]string{"name": modelFileName(name)}
+	return c.do(ctx, http.MethodPost, "/api/model/delete", body, "", nil)
+}
+
+// DatasetStats returns the image count and location of a dataset
+func (c *apiClient) DatasetStats(ctx context.Context, name string) (*DatasetInfo, error) {
+	info := DatasetInfo{Name: name}
+	if err := c.do(ctx, http.MethodGet, "/api/dataset/"+url.PathEscape(name)+"/info", nil, "", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListDatasets returns the stats of every dataset, only those matching
+// selector unless it is empty
+func (c *apiClient) ListDatasets(ctx context.Context, selector string) ([]*DatasetInfo, error) {
+	names := datasetNames
+	if selector != "" {
+		var matched struct {
+			Items []labelledObject `json:"items"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/api/labels/dataset?selector="+url.QueryEscape(selector), nil, "", &matched); err != nil {
+			return nil, err
+		}
+		names = nil
+		for _, item := range matched.Items {
+			names = append(names, item.ID)
+		}
+	}
+	datasets := []*DatasetInfo{}
+	for _, name := range names {
+		info, err := c.DatasetStats(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s dataset: %w", name, err)
+		}
+		datasets = append(datasets, info)
+	}
+	return datasets, nil
+}
+
+// DatasetFiles returns the uploaded images of a kind ("target" or "background")
+func (c *apiClient) DatasetFiles(ctx context.Context, kind string) ([]DatasetFile, error) {
+	plural, ok := datasetUploadKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown upload kind %q, want target or background", kind)
+	}
+	answer := map[string][]DatasetFile{}
+	if err := c.do(ctx, http.MethodGet, "/api/dataset/custom/"+plural, nil, "", &answer); err != nil {
+		return nil, err
+	}
+	return answer[plural], nil
+}
+
+// UploadDatasetFile adds an image to the custom dataset's targets or
+// backgrounds and returns the name the service stored it under
+func (c *apiClient) UploadDatasetFile(ctx context.Context, kind, path string) (string, error) {
+	if _, ok := datasetUploadKinds[kind]; !ok {
+		return "", fmt.Errorf("unknown upload kind %q, want target or background", kind)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	// The service only accepts parts declared as images
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filepath.Base(path)))
+	header.Set("Content-Type", http.DetectContentType(data))
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	part.Write(data)
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	var answer struct {
+		Filename string `json:"filename"`
+	}
+	err = c.do(ctx, http.MethodPost, "/api/dataset/custom/upload/"+kind, &body, mw.FormDataContentType(), &answer)
+	return answer.Filename, err
+}
+
+// do sends a request and decodes the JSON answer into out. A body that is
+// not an io.Reader is sent as JSON.
+func (c *apiClient) do(ctx context.Context, method, path string, body interface{}, contentType string, out interface{}) error {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader, contentType = bytes.NewReader(data), "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return nil
+}
+
+// responseError reads the message of an error answer. The backend answers
+// {"error": ...}, the Python service {"detail": ...}.
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var answer struct {
+		Error  string `json:"error"`
+		Detail string `json:"detail"`
+	}
+	msg := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &answer) == nil {
+		switch {
+		case answer.Error != "":
+			msg = answer.Error
+		case answer.Detail != "":
+			msg = answer.Detail
+		}
+	}
+	return &apiError{Status: resp.StatusCode, Message: msg}
+}
+
+// modelPath returns the backend endpoint of a model action
+func modelPath(name, action string) string {
+	return "/api/model/" + url.PathEscape(strings.TrimSuffix(name, ".pt")) + "/" + action
+}
+
+// modelFileName accepts a model as listed (x.pt) or by id (x)
+func modelFileName(name string) string {
+	if strings.HasSuffix(name, ".pt") {
+		return name
+	}
+	return name + ".pt"
+}
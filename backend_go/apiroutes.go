@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// The Python service's API, by method and path pattern; GET /api/models is
+// registered with the label filter in main.go. Only these are
+// proxied, so a wrong method gets 405 with an Allow header from the mux
+// rather than a round trip to the service, and unknown paths get 404.
+// Training services that add endpoints of their own set PROXY_UNLISTED_API
+// to have every other /api/ path proxied as before.
+var pythonRoutes = []string{
+	"GET /api/model/report/{name}",
+	"GET /api/model/loaded",
+	"POST /api/model/load",
+	"POST /api/model/delete",
+	"POST /api/model/test",
+	"POST /api/model/detect",
+	"POST /api/pipeline/save",
+	"GET /api/pipeline/load",
+	"POST /api/script/execute",
+	"GET /api/process/active",
+
+	"GET /api/dataset/{kind}/info",
+	"GET /api/dataset/{kind}/images",
+	"GET /api/dataset/{kind}/image/{name}",
+	"GET /api/dataset/{kind}/image/{name}/with-boxes",
+	"GET /api/dataset/{kind}/image/{name}/labels",
+	"DELETE /api/dataset/{kind}/image/{name}",
+	"GET /api/dataset/custom/backgrounds",
+	"GET /api/dataset/custom/backgrounds/{name}",
+	"DELETE /api/dataset/custom/backgrounds/{name}",
+	"GET /api/dataset/custom/targets",
+	"GET /api/dataset/custom/targets/{name}",
+	"DELETE /api/dataset/custom/targets/{name}",
+	"POST /api/dataset/custom/upload/{kind}",
+	"POST /api/dataset/custom/generate",
+}
+
+// registerProxyRoutes adds the Python service's routes, answered through
+// the response cache
+func registerProxyRoutes(proxy http.Handler) {
+	cached := responses.Wrap(proxy)
+	for _, pattern := range pythonRoutes {
+		http.Handle(pattern, cached)
+	}
+	if os.Getenv("PROXY_UNLISTED_API") == "true" {
+		http.Handle("/api/", cached)
+	}
+}
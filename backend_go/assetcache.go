@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache headers and compression for frontend assets. Every file gets an ETag
+// from its content hash so repeat loads of the embedded modal revalidate with
+// a 304. Brotli and gzip are served from precompressed <file>.br / <file>.gz
+// siblings when present; otherwise text assets are gzipped on the fly.
+
+// compressibleTypes are the extensions worth compressing
+var compressibleTypes = map[string]bool{
+	".css": true, ".js": true, ".json": true, ".html": true, ".svg": true, ".map": true, ".txt": true,
+}
+
+// assetTypes are types missing from the system MIME tables on some hosts
+var assetTypes = map[string]string{
+	".js":    "text/javascript; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".map":   "application/json",
+	".wasm":  "application/wasm",
+	".svg":   "image/svg+xml",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".ico":   "image/x-icon",
+}
+
+// assetContentType returns the type of an asset by its extension, sniffing
+// the uncompressed body when the extension is not known
+func assetContentType(name string, body []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := assetTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); ext != "" && t != "" {
+		return t
+	}
+	return http.DetectContentType(body)
+}
+
+// cachedAsset is a file with its hash and compressed variants
+type cachedAsset struct {
+	modTime time.Time
+	size    int64
+	hash    string
+	body    []byte
+	gzip    []byte
+	brotli  []byte
+}
+
+var assetCache = struct {
+	sync.Mutex
+	files map[string]*cachedAsset
+}{files: map[string]*cachedAsset{}}
+
+// loadAsset reads name from fsys, reusing the cached copy while the file is unchanged
+func loadAsset(fsys fs.FS, key, name string) (*cachedAsset, error) {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	assetCache.Lock()
+	cached := assetCache.files[key]
+	assetCache.Unlock()
+	if cached != nil && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached, nil
+	}
+
+	body, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	asset := &cachedAsset{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		hash:    hex.EncodeToString(sum[:8]),
+		body:    body,
+	}
+	if compressibleTypes[path.Ext(name)] {
+		if br, err := fs.ReadFile(fsys, name+".br"); err == nil {
+			asset.brotli = br
+		}
+		if gz, err := fs.ReadFile(fsys, name+".gz"); err == nil {
+			asset.gzip = gz
+		} else {
+			asset.gzip = gzipBytes(body)
+		}
+	}
+
+	assetCache.Lock()
+	assetCache.files[key] = asset
+	assetCache.Unlock()
+	return asset, nil
+}
+
+// newCachedAsset wraps content generated by the backend, gzipped up front
+func newCachedAsset(body []byte, modTime time.Time) *cachedAsset {
+	sum := sha256.Sum256(body)
+	return &cachedAsset{
+		modTime: modTime,
+		size:    int64(len(body)),
+		hash:    hex.EncodeToString(sum[:8]),
+		body:    body,
+		gzip:    gzipBytes(body),
+	}
+}
+
+func gzipBytes(body []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(body)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// serveAsset writes the asset with ETag and Cache-Control headers, choosing
+// the smallest encoding the client accepts. Conditional and range requests
+// are handled by http.ServeContent.
+func serveAsset(w http.ResponseWriter, r *http.Request, name string, asset *cachedAsset, maxAge time.Duration) {
+	body, encoding := asset.body, ""
+	if asset.gzip != nil || asset.brotli != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		accepted := r.Header.Get("Accept-Encoding")
+		switch {
+		case asset.brotli != nil && acceptsEncoding(accepted, "br"):
+			body, encoding = asset.brotli, "br"
+		case asset.gzip != nil && acceptsEncoding(accepted, "gzip"):
+			body, encoding = asset.gzip, "gzip"
+		}
+	}
+
+	etag := asset.hash
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		etag += "-" + encoding
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	// http.ServeContent would sniff the encoded body
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", assetContentType(name, asset.body))
+	}
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, asset.modTime, bytes.NewReader(body))
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows coding
+func acceptsEncoding(header, coding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(fields[0]) != coding {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// assetMaxAge is how long browsers may reuse css/js without revalidating;
+// config files are always revalidated so edits show up immediately
+func assetMaxAge(dir string) time.Duration {
+	if dir == "config" {
+		return 0
+	}
+	if d, err := time.ParseDuration(os.Getenv("ASSET_CACHE_MAX_AGE")); err == nil {
+		return d
+	}
+	return 5 * time.Minute
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Frontend assets (module.html, css, js, config). Release builds embed them
+// with -tags embed (see assets_embed.go); FRONTEND_DIR serves files from disk
+// on top of the embedded copy so they can be edited without rebuilding.
+
+//go:generate sh -c "rm -rf frontend && cp -r ../frontend frontend"
+//go:generate sh -c "command -v brotli >/dev/null && find frontend -name '*.js' -o -name '*.css' | xargs brotli -kf || true"
+
+// embeddedFrontend is set by assets_embed.go when the assets are compiled in
+var embeddedFrontend fs.FS
+
+// frontendAssets is the file system the frontend handlers serve from, set in main
+var frontendAssets fs.FS = os.DirFS("./frontend")
+
+func frontendFS() fs.FS {
+	dir := os.Getenv("FRONTEND_DIR")
+	switch {
+	case embeddedFrontend == nil:
+		if dir == "" {
+			dir = "./frontend"
+		}
+		return os.DirFS(dir)
+	case dir != "":
+		log.Printf("Serving frontend from %s over the embedded assets", dir)
+		return overlayFS{os.DirFS(dir), embeddedFrontend}
+	default:
+		return embeddedFrontend
+	}
+}
+
+// overlayFS opens files from upper, falling back to lower when they do not exist there
+type overlayFS struct {
+	upper, lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.lower.Open(name)
+	}
+	return f, err
+}
+
+// staticHandler serves one asset directory (css, js, config) under /<dir>/.
+// Paths that could leave the directory are rejected before touching the file
+// system, and directories are never listed.
+func staticHandler(dir string) http.Handler {
+	return http.StripPrefix("/"+dir+"/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := cleanAssetPath(r.URL.Path)
+		if !ok {
+			log.Printf("Rejected asset path %q", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		root, err := fs.Sub(frontendAssets, dir)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if info, err := fs.Stat(root, name); err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		asset, err := loadAsset(root, dir+"/"+name, name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		serveAsset(w, r, name, asset, assetMaxAge(dir))
+	}))
+}
+
+// cleanAssetPath turns a request path into a file name relative to the asset
+// directory, refusing parent references, absolute or Windows-style paths and NUL bytes
+func cleanAssetPath(p string) (string, bool) {
+	if strings.ContainsAny(p, "\\\x00:") {
+		return "", false
+	}
+	name := strings.TrimPrefix(p, "/")
+	if strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	return name, fs.ValidPath(name) && name != "."
+}
@@ -0,0 +1,21 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Run `go generate` first to copy ../frontend next to the sources
+//
+//go:embed all:frontend
+var embeddedFiles embed.FS
+
+func init() {
+	sub, err := fs.Sub(embeddedFiles, "frontend")
+	if err != nil {
+		panic(err)
+	}
+	embeddedFrontend = sub
+}
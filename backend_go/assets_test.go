@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// newAssetServer serves the css, js and config handlers from a frontend
+// holding a file outside them that must never be reachable
+func newAssetServer(t *testing.T) *httptest.Server {
+	saved := frontendAssets
+	t.Cleanup(func() { frontendAssets = saved })
+	frontendAssets = fstest.MapFS{
+		"secret.txt":          {Data: []byte("TOP-SECRET")},
+		"module.html":         {Data: []byte("<html>TOP-SECRET</html>")},
+		"css/app.css":         {Data: []byte("body{}")},
+		"css/sub/theme.css":   {Data: []byte("h1{}")},
+		"js/app.js":           {Data: []byte("export {}")},
+		"config/actions.json": {Data: []byte(`{"actions":[]}`)},
+	}
+	mux := http.NewServeMux()
+	for _, dir := range []string{"css", "js", "config"} {
+		mux.Handle("GET /"+dir+"/", staticHandler(dir))
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// rawGet sends path as it is, without the client cleaning or escaping it
+func rawGet(t *testing.T, srv *httptest.Server, path string) (int, string) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", path)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestStaticHandlerServesAssets(t *testing.T) {
+	srv := newAssetServer(t)
+	for path, want := range map[string]string{
+		"/css/app.css":         "body{}",
+		"/css/sub/theme.css":   "h1{}",
+		"/js/app.js":           "export {}",
+		"/config/actions.json": `{"actions":[]}`,
+	} {
+		if status, body := rawGet(t, srv, path); status != http.StatusOK || body != want {
+			t.Errorf("GET %s = %d %q, want 200 %q", path, status, body, want)
+		}
+	}
+}
+
+func TestStaticHandlerRejectsTraversal(t *testing.T) {
+	srv := newAssetServer(t)
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"parent", "/css/../secret.txt"},
+		{"nested parent", "/css/sub/../../secret.txt"},
+		{"encoded dots", "/css/%2e%2e/secret.txt"},
+		{"mixed encoded dots", "/js/.%2e/secret.txt"},
+		{"encoded slash", "/css/..%2fsecret.txt"},
+		{"encoded dots and slash", "/css/%2e%2e%2fmodule.html"},
+		{"encoded backslash", "/css/..%5csecret.txt"},
+		{"backslash", `/css/..\secret.txt`},
+		{"leading encoded backslash", "/config/%5c..%5csecret.txt"},
+		{"NUL", "/css/app.css%00.png"},
+		{"NUL before parent", "/css/%00/../secret.txt"},
+		{"drive letter", "/css/C:/secret.txt"},
+		{"drive letter backslash", "/css/C:%5csecret.txt"},
+		{"absolute", "/css//secret.txt"},
+		{"encoded absolute", "/css/%2fsecret.txt"},
+		{"encoded absolute outside", "/config/%2fetc%2fpasswd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := rawGet(t, srv, tt.path)
+			if status == http.StatusOK || strings.Contains(body, "TOP-SECRET") {
+				t.Errorf("GET %s = %d %q, want it refused", tt.path, status, body)
+			}
+		})
+	}
+}
+
+func TestStaticHandlerListsNoDirectories(t *testing.T) {
+	srv := newAssetServer(t)
+	for _, path := range []string{"/css/", "/js/", "/config/", "/css/sub/", "/css/sub", "/css/.", "/js/./"} {
+		status, body := rawGet(t, srv, path)
+		if status == http.StatusOK || strings.Contains(body, "app.") || strings.Contains(body, "theme.css") {
+			t.Errorf("GET %s = %d %q, want no listing", path, status, body)
+		}
+	}
+}
+
+func TestCleanAssetPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"app.css", "app.css", true},
+		{"/sub/theme.css", "sub/theme.css", true},
+		{"../secret.txt", "", false},
+		{"sub/../../secret.txt", "", false},
+		{"..", "", false},
+		{`..\secret.txt`, "", false},
+		{"app.css\x00.png", "", false},
+		{"C:/secret.txt", "", false},
+		{"//etc/passwd", "", false},
+		{"", "", false},
+		{".", "", false},
+		{"sub/./theme.css", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cleanAssetPath(tt.in)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("cleanAssetPath(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Audit log for model governance: who changed what, and when. Every
+// state-changing API and admin call and every script execution is appended to
+// AUDIT_LOG_FILE (default DATA_DIR/audit.log, "off" disables it), one JSON
+// record per line. Each record carries the hash of the one before it, so
+// editing, removing or reordering records breaks the chain. Appends hold a
+// lock on the file and continue from its last record, so the old and new
+// process of an upgrade extend one chain. The record hash
+// is the hex SHA-256 of the record's compact JSON without its "hash" field;
+// the first record's prev_hash is 64 zeros. GET /admin/audit/export returns
+// a bundle that `training-backend audit verify` checks offline, signed with
+// AUDIT_SIGNING_KEY when that is set.
+
+const (
+	auditGenesisHash  = "0000000000000000000000000000000000000000000000000000000000000000"
+	auditBundleFormat = "training-audit-bundle/v1"
+)
+
+// Audit actions
+const (
+	AuditAPICall = "api_call"
+	AuditExecute = "script_execute"
+	AuditTimeout = "run_timeout"
+	// AuditNotebook is a kernel or terminal connection of a notebook server
+	AuditNotebook = "notebook_connect"
+)
+
+// auditRecord is one line of the audit log
+type auditRecord struct {
+	Seq       int64             `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target,omitempty"`
+	Actor     string            `json:"actor,omitempty"`
+	Remote    string            `json:"remote,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash,omitempty"`
+}
+
+// computeHash returns the hash of the record's content
+func (rec auditRecord) computeHash() string {
+	rec.Hash = ""
+	data, _ := json.Marshal(rec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditBundle is an exported stretch of the chain
+type auditBundle struct {
+	Format     string    `json:"format"`
+	ExportedAt time.Time `json:"exported_at"`
+	// Anchor is the prev_hash of the first record, Head the hash of the last
+	Anchor    string        `json:"anchor"`
+	Head      string        `json:"head"`
+	Count     int           `json:"count"`
+	Records   []auditRecord `json:"records"`
+	Signature string        `json:"signature,omitempty"`
+}
+
+// signingInput is what the signature covers; the chain binds the records to Head
+func (b *auditBundle) signingInput() string {
+	return strings.Join([]string{b.Format, b.Anchor, b.Head, strconv.Itoa(b.Count)}, "\n")
+}
+
+func auditSignature(key string, b *auditBundle) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(b.signingInput()))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAuditChain checks that every record hashes correctly and links to
+// the one before it, starting from anchor
+func verifyAuditChain(anchor string, records []auditRecord) error {
+	prev := anchor
+	for i, rec := range records {
+		if rec.PrevHash != prev {
+			return fmt.Errorf("record %d (seq %d): prev_hash does not match the record before it", i, rec.Seq)
+		}
+		if rec.computeHash() != rec.Hash {
+			return fmt.Errorf("record %d (seq %d): content does not match its hash", i, rec.Seq)
+		}
+		if i > 0 && rec.Seq != records[i-1].Seq+1 {
+			return fmt.Errorf("record %d (seq %d): sequence gap after seq %d", i, rec.Seq, records[i-1].Seq)
+		}
+		prev = rec.Hash
+	}
+	return nil
+}
+
+// auditLog appends records to the chain
+type auditLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	head string
+	// size is the file size after our last append; a different size means
+	// another process appended, and seq and head are read again
+	size int64
+}
+
+// audit is nil when AUDIT_LOG_FILE is "off"
+var audit *auditLog
+
+// openAuditLogFromEnv opens AUDIT_LOG_FILE, continuing its chain
+func openAuditLogFromEnv(dataDir string) (*auditLog, error) {
+	path := getEnv("AUDIT_LOG_FILE", filepath.Join(dataDir, "audit.log"))
+	if path == "off" {
+		return nil, nil
+	}
+	return openAuditLog(path)
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	records, err := readAuditRecords(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	a := &auditLog{path: path, head: auditGenesisHash}
+	if len(records) > 0 {
+		// A broken chain stays broken; say so, and keep appending after it
+		if err := verifyAuditChain(auditGenesisHash, records); err != nil {
+			log.Printf("WARNING: audit log %s fails verification: %v", path, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	a.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a.size = -1
+	return a, nil
+}
+
+// syncHead reads seq and head from the end of the file when another process
+// has appended since our last record; the file lock must be held
+func (a *auditLog) syncHead() error {
+	info, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == a.size {
+		return nil
+	}
+	// Records are at most 1MB, like decodeAuditRecords allows
+	start := max(info.Size()-1024*1024-1, 0)
+	tail := make([]byte, info.Size()-start)
+	if _, err := a.file.ReadAt(tail, start); err != nil && err != io.EOF {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	a.seq, a.head = 0, auditGenesisHash
+	if last := lines[len(lines)-1]; last != "" {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(last), &rec); err != nil {
+			return fmt.Errorf("last record: %w", err)
+		}
+		a.seq, a.head = rec.Seq, rec.Hash
+	}
+	a.size = info.Size()
+	return nil
+}
+
+// readAuditRecords reads an audit log file
+func readAuditRecords(path string) ([]auditRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeAuditRecords(f)
+}
+
+func decodeAuditRecords(r io.Reader) ([]auditRecord, error) {
+	var records []auditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Record appends a record; safe on a nil log
+func (a *auditLog) Record(rec auditRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	unlock, err := lockAuditFile(a.file)
+	if err != nil {
+		log.Printf("Audit record failed: %v", err)
+		return
+	}
+	defer unlock()
+	if err := a.syncHead(); err != nil {
+		log.Printf("Audit record failed: %v", err)
+		return
+	}
+	rec.Seq = a.seq + 1
+	rec.Time = time.Now().UTC()
+	rec.PrevHash = a.head
+	rec.Hash = rec.computeHash()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Audit record failed: %v", err)
+		return
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Audit record failed: %v", err)
+		return
+	}
+	// Governance records must survive a crash right after the call they describe
+	a.file.Sync()
+	a.seq, a.head = rec.Seq, rec.Hash
+	a.size += int64(len(data)) + 1
+}
+
+// RecordRequest appends a record about an HTTP request
+func (a *auditLog) RecordRequest(r *http.Request, action, target string, status int, details map[string]string) {
+	if a == nil {
+		return
+	}
+	rec := auditRecord{
+		Action:    action,
+		Target:    target,
+		Remote:    clientIP(r),
+		Status:    status,
+		RequestID: requestID(r),
+		Details:   details,
+	}
+	if id := identityFrom(r); id != nil {
+		rec.Actor = id.User()
+	} else if strings.HasPrefix(r.URL.Path, "/admin/") && status != http.StatusUnauthorized {
+		rec.Actor = "admin-token"
+	}
+	a.Record(rec)
+}
+
+// export returns the records between since and until (zero for no bound)
+func (a *auditLog) export(since, until time.Time) (*auditBundle, error) {
+	a.mu.Lock()
+	records, err := readAuditRecords(a.path)
+	a.mu.Unlock()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	b := &auditBundle{Format: auditBundleFormat, ExportedAt: time.Now().UTC(), Anchor: auditGenesisHash, Records: []auditRecord{}}
+	for i, rec := range records {
+		if !since.IsZero() && rec.Time.Before(since) || !until.IsZero() && !rec.Time.Before(until) {
+			continue
+		}
+		if len(b.Records) == 0 && i > 0 {
+			b.Anchor = records[i-1].Hash
+		}
+		b.Records = append(b.Records, rec)
+	}
+	b.Count = len(b.Records)
+	b.Head = b.Anchor
+	if b.Count > 0 {
+		b.Head = b.Records[b.Count-1].Hash
+	}
+	if key := os.Getenv("AUDIT_SIGNING_KEY"); key != "" {
+		b.Signature = auditSignature(key, b)
+	}
+	return b, nil
+}
+
+// auditedMethod reports whether a request changes state
+func auditedMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// withAudit records state-changing API and admin calls with their outcome.
+// Request bodies are never recorded; they may hold secrets.
+func withAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil || !auditedMethod(r.Method) || r.URL.Path == "/api/script/ws/token" ||
+			!strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		audit.RecordRequest(r, AuditAPICall, r.Method+" "+r.URL.Path, rec.status, nil)
+	})
+}
+
+// registerAuditRoutes mounts the export and verification endpoints on the admin API
+func registerAuditRoutes() {
+	// GET /admin/audit/export?since=&until= (RFC 3339) returns a verifiable bundle
+	http.HandleFunc("/admin/audit/export", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "audit log is off"})
+			return
+		}
+		var bounds [2]time.Time
+		for i, name := range []string{"since", "until"} {
+			if raw := r.URL.Query().Get(name); raw != "" {
+				t, err := time.Parse(time.RFC3339, raw)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": name + ": expected an RFC 3339 time"})
+					return
+				}
+				bounds[i] = t
+			}
+		}
+		bundle, err := audit.export(bounds[0], bounds[1])
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.json"`, bundle.ExportedAt.Format("20060102T150405Z")))
+		writeJSON(w, http.StatusOK, bundle)
+	}))
+
+	// GET /admin/audit/verify checks the whole log in place
+	http.HandleFunc("/admin/audit/verify", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "audit log is off"})
+			return
+		}
+		audit.mu.Lock()
+		records, err := readAuditRecords(audit.path)
+		audit.mu.Unlock()
+		if err == nil {
+			err = verifyAuditChain(auditGenesisHash, records)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"valid": false, "records": len(records), "error": err.Error()})
+			return
+		}
+		head := auditGenesisHash
+		if len(records) > 0 {
+			head = records[len(records)-1].Hash
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"valid": true, "records": len(records), "head": head})
+	}))
+}
+
+func newAuditCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Verify audit logs and exported audit bundles",
+		Args:  cobra.NoArgs,
+	}
+	var key string
+	verify := &cobra.Command{
+		Use:   "verify FILE",
+		Short: "Check the hash chain of an audit log or bundle, and its signature",
+		Long: `Checks an audit log file (audit.log) or a bundle from GET
+/admin/audit/export: every record must hash correctly and link to the one
+before it. A signed bundle is also checked against --key or
+AUDIT_SIGNING_KEY. Exits non-zero when verification fails.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			var bundle auditBundle
+			if json.Unmarshal(data, &bundle) != nil || bundle.Format == "" {
+				// Not a bundle: an audit log from its first record
+				records, err := decodeAuditRecords(strings.NewReader(string(data)))
+				if err != nil {
+					return err
+				}
+				bundle = auditBundle{Anchor: auditGenesisHash, Head: auditGenesisHash, Records: records, Count: len(records)}
+				if len(records) > 0 {
+					bundle.Head = records[len(records)-1].Hash
+				}
+			} else if bundle.Format != auditBundleFormat {
+				return fmt.Errorf("unsupported bundle format %q", bundle.Format)
+			}
+			if err := verifyAuditChain(bundle.Anchor, bundle.Records); err != nil {
+				return err
+			}
+			if bundle.Count != len(bundle.Records) || len(bundle.Records) > 0 && bundle.Head != bundle.Records[len(bundle.Records)-1].Hash {
+				return errors.New("bundle count or head does not match its records")
+			}
+			out := cmd.OutOrStdout()
+			if key == "" {
+				key = os.Getenv("AUDIT_SIGNING_KEY")
+			}
+			switch {
+			case bundle.Signature != "" && key != "":
+				if !hmac.Equal([]byte(bundle.Signature), []byte(auditSignature(key, &bundle))) {
+					return errors.New("bundle signature does not match")
+				}
+				fmt.Fprintln(out, "signature: valid")
+			case bundle.Signature != "":
+				fmt.Fprintln(out, "signature: not checked, pass --key")
+			case key != "" && bundle.Format != "":
+				return errors.New("bundle is not signed")
+			}
+			fmt.Fprintf(out, "chain: valid, %d record(s)\nanchor: %s\nhead:   %s\n", bundle.Count, bundle.Anchor, bundle.Head)
+			if bundle.Anchor != auditGenesisHash {
+				fmt.Fprintln(out, "The bundle starts mid-log; compare its anchor with the previous export's head.")
+			}
+			return nil
+		},
+	}
+	verify.Flags().StringVar(&key, "key", "", "signing key to check the bundle signature with (default AUDIT_SIGNING_KEY)")
+	cmd.AddCommand(verify)
+	return cmd
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockAuditFile takes an exclusive lock on the audit log, held by one process
+// at a time: during an upgrade the old and the new backend both append
+func lockAuditFile(f *os.File) (unlock func(), err error) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	return func() { syscall.Flock(int(f.Fd()), syscall.LOCK_UN) }, nil
+}
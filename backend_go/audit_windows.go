@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Upgrades are a restart on Windows, so one process appends at a time
+
+func lockAuditFile(f *os.File) (unlock func(), err error) { return func() {}, nil }
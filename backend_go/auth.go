@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Authentication of API and UI clients. Without OIDC_ISSUER the backend is
+// open, as behind an authenticating proxy. With it, every request outside
+// the public paths needs a login session cookie or a bearer token from the
+// identity provider (see oidc.go). The identity is forwarded to the Python
+// service in the X-Auth-* headers, which clients can never set themselves.
+
+// Identity is the authenticated user or machine client of a request
+type Identity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	// Method is "session" for a login cookie or "bearer" for a token
+	Method string `json:"method"`
+
+	session string // ID of the login session, for CSRF tokens
+}
+
+// User is how the identity appears in logs, run tags and upstream headers
+func (id *Identity) User() string {
+	if id.Email != "" {
+		return id.Email
+	}
+	return id.Subject
+}
+
+// Headers that carry the identity to the Python service
+const (
+	authUserHeader    = "X-Auth-User"
+	authSubjectHeader = "X-Auth-Subject"
+	authGroupsHeader  = "X-Auth-Groups"
+)
+
+// setHeaders describes the identity to the Python service
+func (id *Identity) setHeaders(h http.Header) {
+	h.Set(authUserHeader, id.User())
+	h.Set(authSubjectHeader, id.Subject)
+	if len(id.Groups) > 0 {
+		h.Set(authGroupsHeader, strings.Join(id.Groups, ","))
+	}
+}
+
+type identityKey struct{}
+
+// identityFrom returns the identity withAuth attached to the request, nil
+// when authentication is off
+func identityFrom(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// identityListed reports whether id is one of the comma-separated users or
+// "group:name" entries of list
+func identityListed(id *Identity, list string) bool {
+	if id == nil {
+		return false
+	}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if group, ok := strings.CutPrefix(entry, "group:"); ok {
+			if slices.Contains(id.Groups, group) {
+				return true
+			}
+		} else if entry != "" && (entry == id.User() || entry == id.Subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// authPublicPaths are served without a login: the login flow itself, probes,
+// version checks, and the admin and debug endpoints, which have ADMIN_TOKEN
+var authPublicPaths = []string{
+	"/auth/", "/healthz", "/readyz", "/startupz", "/health", "/favicon.ico",
+	"/api/version", "/admin/", "/debug/",
+}
+
+func isPublicPath(path string) bool {
+	for _, p := range authPublicPaths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAuth authenticates requests when OIDC is configured, and always drops
+// client-supplied identity headers so only this backend can set them
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{authUserHeader, authSubjectHeader, authGroupsHeader} {
+			r.Header.Del(h)
+		}
+		if oidc == nil || isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The secrets API takes ADMIN_TOKEN as well as logged-in admins
+		if strings.HasPrefix(r.URL.Path, "/api/secrets") && isAdminToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authenticate := oidc.authenticate
+		if tokenSocketPath(r.URL.Path) {
+			authenticate = authenticateExecution
+		}
+		id, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !oidc.checkCSRF(w, r, id) {
+			return
+		}
+		// Set on the request too, so the reverse proxy forwards it
+		id.setHeaders(r.Header)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
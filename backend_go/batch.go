@@ -0,0 +1,343 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Batch operations for housekeeping, so scripts need not make one call per
+// object. Runs and models are named by id or picked by a label selector,
+// and each one gets its own result; one failing does not stop the others.
+//
+//	POST /api/batch/runs/delete    {"run_ids": [...], "selector": "..."}
+//	POST /api/batch/models/labels  {"models": [...], "selector": "...", "labels": {"k": "v", "old": null}}
+//	POST /api/batch/download       {"format": "zip", "models": [...], "artifacts": [{"run_id": "...", "path": "..."}]}
+//
+// Downloads stream a zip or tar.gz with models/<file> and
+// runs/<run id>/<artifact path> entries.
+
+// batchResult is the outcome for one object of a batch
+type batchResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+var errBatchEmpty = errors.New("name objects by id or give a selector")
+
+// batchTargets returns the ids named and those whose labels match selector,
+// without duplicates
+func batchTargets(kind string, ids []string, selector string) ([]string, error) {
+	if len(ids) == 0 && selector == "" {
+		return nil, errBatchEmpty
+	}
+	out := slices.Clone(ids)
+	if selector != "" {
+		sel, err := parseLabelSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		all := labels.All(kind)
+		for _, id := range labelIDs(kind) {
+			set := all[id]
+			if set == nil {
+				set = map[string]string{}
+			}
+			if sel.Matches(set) {
+				out = append(out, id)
+			}
+		}
+	}
+	slices.Sort(out)
+	out = slices.Compact(out)
+	if limit := envInt("BATCH_MAX_ITEMS", 1000); len(out) > limit {
+		return nil, fmt.Errorf("a batch can hold at most %d objects, this one has %d", limit, len(out))
+	}
+	return out, nil
+}
+
+// handleBatch serves /api/batch/{operation}
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/api/batch/") {
+	case "runs/delete":
+		batchDeleteRuns(w, r)
+	case "models/labels":
+		batchLabelModels(w, r)
+	case "download":
+		batchDownload(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "batch operations are runs/delete, models/labels and download"})
+	}
+}
+
+func batchDeleteRuns(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RunIDs   []string `json:"run_ids"`
+		Selector string   `json:"selector"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"run_ids": [...]} or {"selector": "..."}`})
+		return
+	}
+	ids, err := batchTargets(labelKindRun, body.RunIDs, body.Selector)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	results := make([]batchResult, 0, len(ids))
+	deleted := 0
+	for _, id := range ids {
+		res := batchResult{ID: id, Status: "deleted"}
+		run, ok := store.Get(id)
+		switch {
+		case !ok:
+			res.Status, res.Error = "error", ErrRunNotFound.Error()
+		case !run.Finished():
+			res.Status, res.Error = "error", "run is "+run.Status
+		default:
+			if err := store.Delete(id); err != nil {
+				res.Status, res.Error = "error", err.Error()
+			} else {
+				deleted++
+			}
+		}
+		results = append(results, res)
+	}
+	log.Printf("Batch: %d of %d runs deleted by %s (request %s)", deleted, len(ids), secretActor(r), requestID(r))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": deleted, "results": results})
+}
+
+func batchLabelModels(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Models   []string           `json:"models"`
+		Selector string             `json:"selector"`
+		Labels   map[string]*string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Labels) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"models": [...], "labels": {"key": "value", "removed": null}}`})
+		return
+	}
+	for key, value := range body.Labels {
+		if err := validateLabelChange(labelKindModel, key); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if value == nil {
+			continue
+		}
+		if err := validateLabel(key, *value); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	for i, id := range body.Models {
+		body.Models[i] = strings.TrimSuffix(id, ".pt")
+	}
+	ids, err := batchTargets(labelKindModel, body.Models, body.Selector)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	results := make([]batchResult, 0, len(ids))
+	updated := 0
+	for _, id := range ids {
+		res := batchResult{ID: id, Status: "updated"}
+		if !labelTargetExists(labelKindModel, id) {
+			res.Status, res.Error = "error", ErrModelNotFound.Error()
+		} else if _, err := labels.Update(labelKindModel, id, body.Labels); err != nil {
+			res.Status, res.Error = "error", err.Error()
+		} else {
+			updated++
+		}
+		results = append(results, res)
+	}
+	if updated > 0 {
+		responses.Invalidate("/api/models")
+	}
+	log.Printf("Batch: labels of %d of %d models changed by %s (request %s)", updated, len(ids), secretActor(r), requestID(r))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"updated": updated, "results": results})
+}
+
+// archiveFile is a file going into a batch download
+type archiveFile struct {
+	name  string // path in the archive
+	local string
+}
+
+// archiveWriter is the part of zip and tar writers a batch download needs
+type archiveWriter interface {
+	add(name string, info fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (z zipArchive) add(name string, info fs.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name, header.Method = name, zip.Deflate
+	// Weights barely compress, so do not spend time on it
+	if strings.HasSuffix(name, ".pt") {
+		header.Method = zip.Store
+	}
+	w, err := z.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (t tarArchive) add(name string, info fs.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := t.WriteHeader(header); err != nil {
+		return err
+	}
+	// A log still being written may have grown since it was stat'ed
+	_, err = io.CopyN(t.Writer, r, header.Size)
+	return err
+}
+
+func (t tarArchive) Close() error {
+	if err := t.Writer.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// batchArtifact names a run artifact, or with an empty path all of them
+type batchArtifact struct {
+	RunID string `json:"run_id"`
+	Path  string `json:"path"`
+}
+
+// batchDownloadFiles resolves the models and run artifacts of a download
+func batchDownloadFiles(models []string, artifacts []batchArtifact) ([]archiveFile, error) {
+	var files []archiveFile
+	for _, id := range models {
+		model, err := loadModel(id)
+		if err != nil {
+			return nil, fmt.Errorf("model %s: %w", id, err)
+		}
+		for _, file := range modelFiles(model) {
+			files = append(files, archiveFile{name: "models/" + filepath.Base(file), local: file})
+		}
+	}
+	for _, a := range artifacts {
+		if _, ok := store.Get(a.RunID); !ok {
+			return nil, fmt.Errorf("run %s: %w", a.RunID, ErrRunNotFound)
+		}
+		root := store.ArtifactDir(a.RunID)
+		target, err := artifactPath(root, a.Path)
+		if err != nil {
+			return nil, fmt.Errorf("run %s: invalid artifact path %q", a.RunID, a.Path)
+		}
+		before := len(files)
+		filepath.WalkDir(target, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				rel, _ := filepath.Rel(root, p)
+				files = append(files, archiveFile{name: path.Join("runs", a.RunID, filepath.ToSlash(rel)), local: p})
+			}
+			return nil
+		})
+		if len(files) == before {
+			return nil, fmt.Errorf("run %s: no artifacts at %q", a.RunID, a.Path)
+		}
+	}
+	return files, nil
+}
+
+func batchDownload(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Format    string          `json:"format"`
+		Models    []string        `json:"models"`
+		Artifacts []batchArtifact `json:"artifacts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Models)+len(body.Artifacts) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"models": [...], "artifacts": [{"run_id": "...", "path": "..."}]}`})
+		return
+	}
+	if body.Format == "" {
+		body.Format = "zip"
+	}
+	if body.Format != "zip" && body.Format != "tar.gz" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format is zip or tar.gz"})
+		return
+	}
+	if limit := envInt("BATCH_MAX_ITEMS", 1000); len(body.Models)+len(body.Artifacts) > limit {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("a batch can hold at most %d objects", limit)})
+		return
+	}
+	files, err := batchDownloadFiles(body.Models, body.Artifacts)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrModelNotFound) || errors.Is(err, ErrRunNotFound) {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	name := "batch-" + time.Now().UTC().Format("20060102-150405") + "." + body.Format
+	var archive archiveWriter
+	if body.Format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = zipArchive{zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		archive = tarArchive{Writer: tar.NewWriter(gz), gz: gz}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	log.Printf("Batch: download of %d files requested by %s (request %s)", len(files), secretActor(r), requestID(r))
+
+	// The status line is gone once streaming starts, so errors can only be
+	// logged; the client sees a truncated archive
+	for _, f := range files {
+		if err := addArchiveFile(archive, f); err != nil {
+			log.Printf("Batch download stopped at %s: %v", f.name, err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Batch download: %v", err)
+	}
+}
+
+func addArchiveFile(archive archiveWriter, f archiveFile) error {
+	file, err := os.Open(f.local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return archive.add(f.name, info, file)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Request body limits on the proxy and the model endpoints, so a runaway
+// client cannot exhaust memory or disk here or in the Python service.
+// Uploads (multipart bodies, anything under /api/dataset/ and model uploads)
+// may be up to MAX_UPLOAD_SIZE (default 1GB), other API calls up to
+// MAX_REQUEST_SIZE (default 10MB). Sizes are bytes or take a KB, MB or GB
+// suffix; 0 means unlimited.
+
+type bodyLimits struct {
+	api    int64
+	upload int64
+}
+
+// newBodyLimits reads MAX_REQUEST_SIZE and MAX_UPLOAD_SIZE
+func newBodyLimits() (*bodyLimits, error) {
+	api, err := envByteSize("MAX_REQUEST_SIZE", 10<<20)
+	if err != nil {
+		return nil, err
+	}
+	upload, err := envByteSize("MAX_UPLOAD_SIZE", 1<<30)
+	if err != nil {
+		return nil, err
+	}
+	return &bodyLimits{api: api, upload: upload}, nil
+}
+
+// limitFor returns the upload limit for uploads and the API limit otherwise
+func (l *bodyLimits) limitFor(r *http.Request) int64 {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" || strings.HasPrefix(r.URL.Path, "/api/dataset/") || strings.HasPrefix(r.URL.Path, notebooksPrefix) || (strings.HasPrefix(r.URL.Path, "/api/model/") && strings.HasSuffix(r.URL.Path, "/upload")) {
+		return l.upload
+	}
+	return l.api
+}
+
+// Wrap answers 413 to bodies over the limit: at once when Content-Length says
+// so, or as soon as a streamed body crosses it
+func (l *bodyLimits) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := l.limitFor(r)
+		if limit <= 0 || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			writeTooLarge(w, r, limit)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tooLarge reports whether err came from reading past a body limit
+func tooLarge(err error) (int64, bool) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return maxErr.Limit, true
+	}
+	return 0, false
+}
+
+// writeTooLarge answers 413 with the limit that applied
+func writeTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	log.Printf("Rejected %s %s: body over %d bytes (request %s)", r.Method, r.URL.Path, limit, requestID(r))
+	w.Header().Set("Connection", "close")
+	writeJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+		"detail":      fmt.Sprintf("Request body exceeds the limit of %s", formatByteSize(limit)),
+		"error":       "request_too_large",
+		"limit_bytes": limit,
+	})
+}
+
+// envByteSize reads a size such as "512KB", "10MB" or "1GB"
+func envByteSize(key string, fallback int64) (int64, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback, nil
+	}
+	multiplier := int64(1)
+	upper := strings.ToUpper(raw)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(upper, suffix) {
+			upper, multiplier = strings.TrimSpace(strings.TrimSuffix(upper, suffix)), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(upper, "B"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid size %q", key, raw)
+	}
+	return n * multiplier, nil
+}
+
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dGB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
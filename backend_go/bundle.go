@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Run bundles for archiving and sharing. GET /api/runs/{id}/bundle streams
+// a tar.gz assembled on the fly:
+//
+//	run.json       the run with its params, tags and metrics
+//	metrics.json   the metric history by key
+//	pipeline.json  the pipeline config the run started with
+//	logs/          the run's log files
+//	model/         the weights, training summary and report of its model
+//
+// The pipeline config is snapshotted under DATA_DIR/pipelines/<sha256>.json
+// when a run starts and named by its pipeline_snapshot tag, so runs on the
+// same config share one file.
+
+// PipelineSnapshot returns the file of the pipeline config snapshot with the given hash
+func (s *RunStore) PipelineSnapshot(sum string) string {
+	return filepath.Join(s.dir, "pipelines", sum+".json")
+}
+
+// snapshotPipeline saves the current pipeline config unless it already is
+// and returns its hash, empty when it cannot be read
+func snapshotPipeline() string {
+	data, err := readPipelineConfig()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	file := store.PipelineSnapshot(hash)
+	if _, err := os.Stat(file); err == nil {
+		return hash
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		log.Printf("Error saving pipeline snapshot: %v", err)
+		return ""
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Error saving pipeline snapshot: %v", err)
+		return ""
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		log.Printf("Error saving pipeline snapshot: %v", err)
+		return ""
+	}
+	return hash
+}
+
+// addBytes adds an in-memory file to a tar archive
+func (t tarArchive) addBytes(name string, data []byte, modTime time.Time) error {
+	if err := t.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := t.Write(data)
+	return err
+}
+
+// handleRunBundle streams the bundle of a run
+func handleRunBundle(w http.ResponseWriter, runID string) {
+	run, ok := store.Get(runID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	runJSON, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	metrics := run.Metrics
+	if metrics == nil {
+		metrics = map[string][]MetricPoint{}
+	}
+	metricsJSON, _ := json.MarshalIndent(metrics, "", "  ")
+
+	var files []archiveFile
+	if hash := run.Tags["pipeline_snapshot"]; hash != "" {
+		if file := store.PipelineSnapshot(hash); fileExists(file) {
+			files = append(files, archiveFile{name: "pipeline.json", local: file})
+		}
+	}
+	if runLogs != nil {
+		for _, file := range runLogs.files(run.ID) {
+			files = append(files, archiveFile{name: "logs/" + filepath.Base(file), local: file})
+		}
+	}
+	if id := run.Tags["model_id"]; id != "" {
+		if model, err := loadModel(id); err == nil {
+			for _, file := range modelFiles(model) {
+				files = append(files, archiveFile{name: "model/" + filepath.Base(file), local: file})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "run-"+run.ID+".tar.gz"))
+	gz := gzip.NewWriter(w)
+	archive := tarArchive{Writer: tar.NewWriter(gz), gz: gz}
+	modTime := run.StartTime
+	if run.EndTime != nil {
+		modTime = *run.EndTime
+	}
+	// Errors past this point can only be logged; the client gets a
+	// truncated archive
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{"run.json", runJSON}, {"metrics.json", metricsJSON}} {
+		if err := archive.addBytes(entry.name, append(entry.data, '\n'), modTime); err != nil {
+			log.Printf("Bundle of run %s: %v", run.ID, err)
+			return
+		}
+	}
+	for _, f := range files {
+		if err := addArchiveFile(archive, f); err != nil {
+			log.Printf("Bundle of run %s stopped at %s: %v", run.ID, f.name, err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Bundle of run %s: %v", run.ID, err)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
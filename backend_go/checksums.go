@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checksum manifest of artifacts, kept in DATA_DIR/checksums.json. The
+// SHA-256 of a model's weights, training summary and report is recorded
+// when the run that trained it ends, or when the backend first sees the
+// model; that of an MLflow artifact as it is uploaded. Model info shows the
+// weights' checksum and POST /api/model/{id}/verify re-hashes the files
+// against the manifest. With ARTIFACT_DIGESTS=true, downloads are checked
+// before they are served and carry Digest and Repr-Digest headers.
+//
+// Keys are "models/<file>" and "runs/<run id>/<artifact path>".
+
+func init() {
+	modelActions["verify"] = modelAction{[]string{http.MethodPost}, handleModelVerify}
+}
+
+// modelFileExts are the files the Python service writes for a model
+var modelFileExts = []string{".pt", ".txt", ".html"}
+
+var errChecksumMismatch = errors.New("checksum does not match the manifest")
+
+type checksumEntry struct {
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// checksumCheck is the result of re-hashing one file
+type checksumCheck struct {
+	Key      string `json:"key"`
+	Status   string `json:"status"` // "ok", "mismatch", "missing" or "unrecorded"
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// hashedFile remembers a download's hash while the file is unchanged
+type hashedFile struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// ChecksumManifest holds the recorded checksum of each artifact by key
+type ChecksumManifest struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]checksumEntry
+	digests bool
+	hashed  map[string]hashedFile
+}
+
+// checksums is opened in serve next to the run store
+var checksums *ChecksumManifest
+
+// NewChecksumManifest opens (or creates) the manifest in dir
+func NewChecksumManifest(dir string) (*ChecksumManifest, error) {
+	m := &ChecksumManifest{
+		path:    filepath.Join(dir, "checksums.json"),
+		entries: map[string]checksumEntry{},
+		digests: getEnv("ARTIFACT_DIGESTS", "false") == "true",
+		hashed:  map[string]hashedFile{},
+	}
+	data, err := os.ReadFile(m.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &m.entries); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.path, err)
+		}
+	}
+	return m, nil
+}
+
+// save writes the manifest to disk; callers must hold m.mu
+func (m *ChecksumManifest) save() error {
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// Get returns the recorded checksum of an artifact
+func (m *ChecksumManifest) Get(key string) (checksumEntry, bool) {
+	if m == nil {
+		return checksumEntry{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	return e, ok
+}
+
+// Put records the checksum of an artifact, replacing any earlier one
+func (m *ChecksumManifest) Put(key, sum string, size int64) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = checksumEntry{SHA256: sum, Size: size, RecordedAt: time.Now().UTC()}
+	delete(m.hashed, key)
+	return m.save()
+}
+
+// Ensure records a file's checksum unless the manifest has one already
+func (m *ChecksumManifest) Ensure(key, file string) error {
+	if m == nil {
+		return nil
+	}
+	if _, ok := m.Get(key); ok {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return err
+	}
+	return m.Put(key, sum, info.Size())
+}
+
+// RemovePrefix forgets the artifacts under a key prefix, e.g. a deleted run's
+func (m *ChecksumManifest) RemovePrefix(prefix string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := false
+	for key := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.entries, key)
+			delete(m.hashed, key)
+			removed = true
+		}
+	}
+	if removed {
+		if err := m.save(); err != nil {
+			log.Printf("Error saving checksum manifest: %v", err)
+		}
+	}
+}
+
+// Check re-hashes a file and compares it with the manifest
+func (m *ChecksumManifest) Check(key, file string) checksumCheck {
+	c := checksumCheck{Key: key}
+	entry, recorded := m.Get(key)
+	c.Expected = entry.SHA256
+	info, err := os.Stat(file)
+	if err != nil {
+		c.Status = "missing"
+		return c
+	}
+	c.Size = info.Size()
+	if c.Actual, err = fileSHA256(file); err != nil {
+		c.Status = "missing"
+		return c
+	}
+	switch {
+	case !recorded:
+		c.Status = "unrecorded"
+	case c.Actual != entry.SHA256:
+		c.Status = "mismatch"
+	default:
+		c.Status = "ok"
+	}
+	return c
+}
+
+// digest returns a file's checksum for a download, hashing it again only
+// when its size or modification time changed, and errChecksumMismatch when
+// it differs from the manifest. Files without an entry are recorded.
+func (m *ChecksumManifest) digest(key, file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	h, ok := m.hashed[key]
+	m.mu.Unlock()
+	if !ok || h.size != info.Size() || !h.modTime.Equal(info.ModTime()) {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return "", err
+		}
+		h = hashedFile{size: info.Size(), modTime: info.ModTime(), sum: sum}
+		m.mu.Lock()
+		m.hashed[key] = h
+		m.mu.Unlock()
+	}
+	entry, recorded := m.Get(key)
+	if !recorded {
+		return h.sum, m.Put(key, h.sum, h.size)
+	}
+	if entry.SHA256 != h.sum {
+		return "", errChecksumMismatch
+	}
+	return h.sum, nil
+}
+
+// setDigestHeaders checks a file about to be downloaded against the
+// manifest and sets Digest and Repr-Digest from it; without
+// ARTIFACT_DIGESTS it does nothing
+func setDigestHeaders(w http.ResponseWriter, key, file string) error {
+	if checksums == nil || !checksums.digests {
+		return nil
+	}
+	sum, err := checksums.digest(key, file)
+	if err != nil {
+		if errors.Is(err, errChecksumMismatch) {
+			log.Printf("Refusing download of %s: %v", key, err)
+		}
+		return err
+	}
+	raw, _ := hex.DecodeString(sum)
+	b64 := base64.StdEncoding.EncodeToString(raw)
+	w.Header().Set("Digest", "sha-256="+b64)
+	w.Header().Set("Repr-Digest", "sha-256=:"+b64+":")
+	return nil
+}
+
+// modelKey is the manifest key of a model file
+func modelKey(file string) string {
+	return "models/" + filepath.Base(file)
+}
+
+// runArtifactKey is the manifest key of a run artifact
+func runArtifactKey(runID, rel string) string {
+	return "runs/" + runID + "/" + strings.TrimPrefix(path.Clean("/"+rel), "/")
+}
+
+// modelFiles returns the files of a model that exist
+func modelFiles(model *Model) []string {
+	base := strings.TrimSuffix(model.File, ".pt")
+	var files []string
+	for _, ext := range modelFileExts {
+		if _, err := os.Stat(base + ext); err == nil {
+			files = append(files, base+ext)
+		}
+	}
+	return files
+}
+
+// recordModels adds the models not yet in the manifest after a training
+// run, and records anew the files written since the run started
+func recordModels(since time.Time) {
+	if checksums == nil {
+		return
+	}
+	models, err := listModels()
+	if err != nil {
+		return
+	}
+	for _, model := range models {
+		for _, file := range modelFiles(model) {
+			var err error
+			if info, statErr := os.Stat(file); statErr == nil && !info.ModTime().Before(since) {
+				var sum string
+				if sum, err = fileSHA256(file); err == nil {
+					err = checksums.Put(modelKey(file), sum, info.Size())
+				}
+			} else {
+				err = checksums.Ensure(modelKey(file), file)
+			}
+			if err != nil {
+				log.Printf("Error recording checksum of %s: %v", file, err)
+			}
+		}
+	}
+}
+
+// handleModelVerify re-hashes a model's files against the manifest
+func handleModelVerify(w http.ResponseWriter, r *http.Request, modelID string) {
+	model, err := loadModel(modelID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	keys := map[string]string{}
+	for _, file := range modelFiles(model) {
+		keys[modelKey(file)] = file
+	}
+	// Files in the manifest that are gone count too
+	checksums.mu.Lock()
+	for key := range checksums.entries {
+		if strings.HasPrefix(key, "models/"+model.ID+".") && keys[key] == "" {
+			keys[key] = filepath.Join(modelsDir(), strings.TrimPrefix(key, "models/"))
+		}
+	}
+	checksums.mu.Unlock()
+
+	files := []checksumCheck{}
+	ok := true
+	for _, key := range sortedKeys(keys) {
+		c := checksums.Check(key, keys[key])
+		// Files the manifest has no entry for yet are reported, not failed
+		ok = ok && (c.Status == "ok" || c.Status == "unrecorded")
+		files = append(files, c)
+	}
+	if !ok {
+		log.Printf("Model %s failed verification", model.ID)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"model": model.ID, "ok": ok, "files": files})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Command line: serve (also what runs without a subcommand), run, models,
+// datasets, healthcheck, version and validate-config
+
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// serveOptions are the flags of serve; each defaults to its environment variable
+type serveOptions struct {
+	simulate  bool
+	recordDir string
+	replayDir string
+	// sessionDir is where execution sessions are recorded, see wstape.go
+	sessionDir string
+}
+
+func (o *serveOptions) addFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&o.simulate, "simulate", os.Getenv("SIMULATE") == "true", "serve synthetic training runs without a Python service")
+	flags.StringVar(&o.recordDir, "record", os.Getenv("RECORD_DIR"), "record proxied HTTP and execution streams to this directory")
+	flags.StringVar(&o.replayDir, "replay", os.Getenv("REPLAY_DIR"), "serve recordings from this directory instead of the Python service")
+	flags.StringVar(&o.sessionDir, "record-sessions", os.Getenv("SESSION_RECORD_DIR"), "record execution WebSocket sessions as clients see them to this directory")
+}
+
+func newRootCommand() *cobra.Command {
+	var opts serveOptions
+	root := &cobra.Command{
+		Use:   "training-backend",
+		Short: "Backend of the model training module",
+		Long: `Serves the model training module: the frontend, the API proxy to the
+Python training service and script execution streams. Settings come from
+environment variables and CONFIG_FILE, see the README.
+
+Without a subcommand it serves, like "training-backend serve".`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			serve(opts)
+		},
+	}
+	opts.addFlags(root.Flags())
+	root.AddCommand(newServeCommand(), newRunCommand(), newHealthcheckCommand(), newVersionCommand(), newValidateConfigCommand(), newModelsCommand(), newDatasetsCommand(), newAuditCommand(), newSessionsCommand())
+	return root
+}
+
+func newServeCommand() *cobra.Command {
+	var opts serveOptions
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the module on LISTEN_ADDR (default :3000)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			serve(opts)
+		},
+	}
+	opts.addFlags(cmd.Flags())
+	return cmd
+}
+
+func newHealthcheckCommand() *cobra.Command {
+	var ready bool
+	var timeout time.Duration
+	var target string
+	cmd := &cobra.Command{
+		Use:   "healthcheck",
+		Short: "Check the running server, exiting 0 when healthy and 1 otherwise",
+		Long: `Checks /healthz of the server listening on LISTEN_ADDR, or /readyz with
+--ready, and exits 0 when it answers 200 and 1 otherwise. Meant for Docker:
+
+  HEALTHCHECK CMD ["/training-backend", "healthcheck"]`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := "/healthz"
+			if ready {
+				path = "/readyz"
+			}
+			client, base := localClient(timeout)
+			if target != "" {
+				client, base = &http.Client{Timeout: timeout}, strings.TrimRight(target, "/")
+			}
+			resp, err := client.Get(base + path)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+				return fmt.Errorf("%s: %s %s", path, resp.Status, strings.TrimSpace(string(body)))
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: ok\n", path)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&ready, "ready", false, "check readiness (/readyz) instead of liveness (/healthz)")
+	cmd.Flags().DurationVar(&timeout, "timeout", 5*time.Second, "give up after this long")
+	cmd.Flags().StringVar(&target, "url", "", "server to check instead of the local one, e.g. http://backend:3000")
+	return cmd
+}
+
+// localServer returns the base URL of the server on LISTEN_ADDR, and its
+// socket path when it listens on a Unix socket
+func localServer() (base, socket string) {
+	addr := getEnv("LISTEN_ADDR", ":3000")
+	if path, ok := unixSocketPath(addr); ok {
+		return "http://localhost", path
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "3000"
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	scheme := "http"
+	if _, _, ok := serverTLS(); ok {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), ""
+}
+
+// localClient returns a client and base URL for the server on LISTEN_ADDR.
+// A TLS certificate is issued for the public name, so it is not verified here.
+func localClient(timeout time.Duration) (*http.Client, string) {
+	base, socket := localServer()
+	if socket != "" {
+		return &http.Client{Timeout: timeout, Transport: unixTransport(socket, HTTP2Auto)}, base
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &http.Client{Timeout: timeout, Transport: transport}, base
+}
+
+func newVersionCommand() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version, git commit and build information",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info := buildInfo()
+			out := cmd.OutOrStdout()
+			if asJSON {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(info)
+			}
+			fmt.Fprintf(out, "training-backend %s (API version %d)\n", info.Version, info.APIVersion)
+			if info.Commit != "" {
+				commit := info.Commit
+				if info.Modified {
+					commit += " (modified)"
+				}
+				fmt.Fprintf(out, "commit:  %s\n", commit)
+			}
+			if info.CommitTime != "" {
+				fmt.Fprintf(out, "date:    %s\n", info.CommitTime)
+			}
+			if info.BuildDate != "" {
+				fmt.Fprintf(out, "built:   %s\n", info.BuildDate)
+			}
+			fmt.Fprintf(out, "go:      %s %s\n", info.GoVersion, info.Platform)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print as JSON")
+	return cmd
+}
+
+func newValidateConfigCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate-config [file]",
+		Short: "Check CONFIG_FILE (or the given file) and the environment without serving",
+		Long: `Loads and validates the config file the way serve would, along with the
+settings read from the environment (PYTHON_SERVICE_URL, TRUSTED_PROXIES,
+MAX_REQUEST_SIZE, MAX_UPLOAD_SIZE, FAULTS, FEATURES, READY_UPSTREAMS and
+PYTHON_COMMAND).
+Exits 1 on the first problem, so deploys can check a config before rolling it out.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := os.Getenv("CONFIG_FILE")
+			if len(args) == 1 {
+				path = args[0]
+			}
+			cfg, err := loadConfig(path)
+			if err != nil {
+				return err
+			}
+			cfg.withDefaultUpstream(getEnv("PYTHON_SERVICE_URL", "http://localhost:3001"))
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+			if _, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+				return err
+			}
+			if _, err := newBodyLimits(); err != nil {
+				return err
+			}
+			if _, err := parseFaults(os.Getenv("FAULTS")); err != nil {
+				return err
+			}
+			if _, err := parseFeatures(os.Getenv("FEATURES")); err != nil {
+				return err
+			}
+			if _, err := newOIDCProviderFromEnv(); err != nil {
+				return err
+			}
+			if _, err := readyUpstreamsMode(); err != nil {
+				return err
+			}
+			if _, err := newPythonSupervisorFromEnv(); err != nil {
+				return err
+			}
+			source := path
+			if source == "" {
+				source = "environment (no CONFIG_FILE)"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: ok, %d upstream(s), %d route(s)\n", source, len(cfg.Upstreams), len(cfg.Routes))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON configuration file named by CONFIG_FILE. Simple
+// settings stay in environment variables; the file holds structured settings
+// that do not fit in a single variable.
+type Config struct {
+	// Upstreams are the Python training services by name. The service from
+	// PYTHON_SERVICE_URL is always available as "default".
+	Upstreams map[string]UpstreamConfig `json:"upstreams"`
+	// Routes map workspaces and pipelines to upstreams; first match wins
+	Routes []RouteRule `json:"routes"`
+	// DefaultUpstream receives traffic no route matches (default "default")
+	DefaultUpstream string `json:"default_upstream"`
+	// Cache lists cached read-only endpoints; omitted uses the built-in rules,
+	// an empty list disables response caching
+	Cache []CacheRule `json:"cache"`
+
+	// The settings below are re-applied on reload (SIGHUP, file change or
+	// POST /admin/reload) without restarting
+
+	// AllowedOrigins limits which pages may open the execution WebSocket,
+	// e.g. "https://app.example.com"; empty allows every origin
+	AllowedOrigins []string `json:"allowed_origins"`
+	// RateLimit caps proxied API calls per client IP; omitted means no limit
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+	// LogLevel is "info" (default) or "debug", which also logs every proxied request
+	LogLevel string `json:"log_level"`
+	// Timeouts give long-running routes their own read and write deadlines;
+	// omitted uses the built-in rules
+	Timeouts []TimeoutRule `json:"timeouts"`
+	// SecurityHeaders changes the security response headers; omitted uses the defaults
+	SecurityHeaders *SecurityHeadersConfig `json:"security_headers"`
+	// Features turn feature flags on or off, overriding FEATURES
+	Features map[string]bool `json:"features"`
+	// IPAccess limits which client addresses reach the admin API, script
+	// execution or everything; omitted admits every address
+	IPAccess *IPAccessConfig `json:"ip_access"`
+	// Concurrency caps running scripts per pipeline and workspace, within
+	// MAX_CONCURRENT_RUNS
+	Concurrency *ConcurrencyConfig `json:"concurrency"`
+	// UI brands the served training UI: title, logo, theme colors and which
+	// actions are shown
+	UI *UIConfig `json:"ui"`
+	// Notebooks are JupyterLab servers by workspace, proxied under
+	// /notebooks/{workspace}/ (see notebooks.go)
+	Notebooks map[string]NotebookConfig `json:"notebooks"`
+	// SecretGrants say which scripts may receive each secret and as which
+	// variables; a secret without a grant is never given to a script
+	SecretGrants map[string]SecretGrant `json:"secret_grants"`
+}
+
+// SecretGrant limits the runs that get a secret, see secrets.go
+type SecretGrant struct {
+	// Env lists the variables the secret may be set as; empty allows any
+	Env []string `json:"env"`
+	// Scripts are path.Match patterns such as "models/s3-*/train.py" for the
+	// scripts that may receive the secret; empty allows any script
+	Scripts []string `json:"scripts"`
+}
+
+// UIConfig matches the served UI to an embedding product, see ui.go
+type UIConfig struct {
+	// Title replaces the "Model Training Pipeline" heading
+	Title string `json:"title,omitempty"`
+	// LogoURL is shown above the heading; an http(s) URL or a path
+	LogoURL string `json:"logo_url,omitempty"`
+	// Theme sets colors and the font by name: primary, secondary,
+	// background, text and font_family
+	Theme map[string]string `json:"theme,omitempty"`
+	// Features hide actions when false: train, configure_pipeline,
+	// manage_dataset and test_model
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+// ConcurrencyConfig limits running scripts by pipeline (the pipeline
+// config's "name", else the stage, else the script) and by workspace (the
+// stage's or pipeline's "workspace", else "default"). "*" applies to each
+// one not listed; 0 means no limit.
+type ConcurrencyConfig struct {
+	Pipelines  map[string]int `json:"pipelines,omitempty"`
+	Workspaces map[string]int `json:"workspaces,omitempty"`
+}
+
+// TimeoutRule overrides the server's read and write timeouts for a path
+// (exact, or prefix when it ends in /). Durations such as "30m"; "0" means
+// no deadline and empty keeps the server's.
+type TimeoutRule struct {
+	Path  string `json:"path"`
+	Read  string `json:"read"`
+	Write string `json:"write"`
+}
+
+// SecurityHeadersConfig adjusts the security headers set on every response
+type SecurityHeadersConfig struct {
+	// Disabled sends none of the headers
+	Disabled bool `json:"disabled"`
+	// Headers add to or replace the defaults; an empty value removes a header
+	Headers map[string]string `json:"headers"`
+	// Routes override headers for a path (exact, or prefix when it ends in /);
+	// the longest matching path wins
+	Routes []SecurityHeaderRule `json:"routes"`
+}
+
+// SecurityHeaderRule overrides security headers for matching paths
+type SecurityHeaderRule struct {
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+}
+
+// RateLimitConfig is a token bucket per client IP
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// Burst is how many requests may arrive at once (default: one second's worth)
+	Burst int `json:"burst"`
+}
+
+// UpstreamConfig describes one Python training service
+type UpstreamConfig struct {
+	URL string `json:"url"`
+	// URLs lists replicas serving the same capability, in addition to URL
+	URLs []string `json:"urls"`
+	// Balance is round_robin (default) or least_connections for API calls
+	Balance string `json:"balance"`
+	// HealthPath is polled to track availability (default /api/process/active)
+	HealthPath string `json:"health_path"`
+	// HTTP2 is auto (default), h2c for HTTP/2 over plain http:// URLs, or off
+	HTTP2 string `json:"http2"`
+	// TLS sets a CA bundle and client certificate for https:// replicas
+	TLS *UpstreamTLS `json:"tls"`
+}
+
+// targetURLs returns every replica URL of the upstream
+func (u UpstreamConfig) targetURLs() []string {
+	var out []string
+	if u.URL != "" {
+		out = append(out, u.URL)
+	}
+	return append(out, u.URLs...)
+}
+
+// RouteRule sends matching traffic to an upstream. Empty fields match anything.
+type RouteRule struct {
+	Workspace string `json:"workspace"`
+	Pipeline  string `json:"pipeline"`
+	Upstream  string `json:"upstream"`
+}
+
+// CacheRule caches GET responses for a path (exact, or prefix when it ends in /)
+type CacheRule struct {
+	Path string `json:"path"`
+	TTL  string `json:"ttl"`
+	// InvalidatedBy lists paths whose POST/PUT/DELETE requests purge the entries
+	InvalidatedBy []string `json:"invalidated_by"`
+}
+
+// loadConfig reads the config file, returning an empty config when path is empty
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	if cfg.Upstreams == nil {
+		cfg.Upstreams = map[string]UpstreamConfig{}
+	}
+	if cfg.DefaultUpstream == "" {
+		cfg.DefaultUpstream = "default"
+	}
+	return cfg, nil
+}
+
+// withDefaultUpstream adds the PYTHON_SERVICE_URL service unless the file overrides it
+func (c *Config) withDefaultUpstream(pythonServiceURL string) *Config {
+	if _, ok := c.Upstreams["default"]; !ok {
+		c.Upstreams["default"] = UpstreamConfig{URL: pythonServiceURL}
+	}
+	return c
+}
+
+// Validate checks that every referenced upstream exists and URLs parse
+func (c *Config) Validate() error {
+	for name, up := range c.Upstreams {
+		if len(up.targetURLs()) == 0 {
+			return fmt.Errorf("upstream %q: no url configured", name)
+		}
+		for _, raw := range up.targetURLs() {
+			u, err := url.Parse(raw)
+			if err == nil && u.Scheme == "unix" {
+				if u.Host != "" || u.Path == "" {
+					return fmt.Errorf("upstream %q: invalid socket url %q, expected unix:///path/to.sock", name, raw)
+				}
+				continue
+			}
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("upstream %q: invalid url %q", name, raw)
+			}
+		}
+		switch up.Balance {
+		case "", BalanceRoundRobin, BalanceLeastConnections:
+		default:
+			return fmt.Errorf("upstream %q: unknown balance %q", name, up.Balance)
+		}
+		switch up.HTTP2 {
+		case "", HTTP2Auto, HTTP2Off:
+		case HTTP2H2C:
+			for _, raw := range up.targetURLs() {
+				if strings.HasPrefix(raw, "https://") {
+					return fmt.Errorf("upstream %q: h2c needs http:// urls, https negotiates HTTP/2 with auto", name)
+				}
+			}
+		default:
+			return fmt.Errorf("upstream %q: http2 %q: expected %q, %q or %q", name, up.HTTP2, HTTP2Auto, HTTP2H2C, HTTP2Off)
+		}
+		if up.TLS != nil {
+			if up.HTTP2 == HTTP2H2C {
+				return fmt.Errorf("upstream %q: tls needs https:// urls, h2c is plaintext", name)
+			}
+			if _, err := up.TLS.clientConfig(); err != nil {
+				return fmt.Errorf("upstream %q: tls: %w", name, err)
+			}
+		}
+	}
+	if _, ok := c.Upstreams[c.DefaultUpstream]; !ok {
+		return fmt.Errorf("default_upstream %q is not defined", c.DefaultUpstream)
+	}
+	for i, rule := range c.Cache {
+		if _, err := time.ParseDuration(rule.TTL); err != nil || rule.Path == "" {
+			return fmt.Errorf("cache rule %d: needs a path and a ttl such as \"30s\"", i)
+		}
+	}
+	for i, rule := range c.Routes {
+		if _, ok := c.Upstreams[rule.Upstream]; !ok {
+			return fmt.Errorf("route %d: upstream %q is not defined", i, rule.Upstream)
+		}
+	}
+	if rl := c.RateLimit; rl != nil && (rl.RequestsPerSecond <= 0 || rl.Burst < 0) {
+		return fmt.Errorf("rate_limit: requests_per_second must be positive")
+	}
+	if err := validateFeatures(c.Features); err != nil {
+		return fmt.Errorf("features: %w", err)
+	}
+	if _, err := parseIPAccess(c.IPAccess); err != nil {
+		return fmt.Errorf("ip_access: %w", err)
+	}
+	if err := validateUIConfig(c.UI); err != nil {
+		return fmt.Errorf("ui: %w", err)
+	}
+	if err := validateNotebooks(c.Notebooks); err != nil {
+		return err
+	}
+	if err := validateSecretGrants(c.SecretGrants); err != nil {
+		return fmt.Errorf("secret_grants: %w", err)
+	}
+	if cc := c.Concurrency; cc != nil {
+		for kind, limits := range map[string]map[string]int{"pipelines": cc.Pipelines, "workspaces": cc.Workspaces} {
+			for name, n := range limits {
+				if n < 0 {
+					return fmt.Errorf("concurrency: %s: %q must not be negative", kind, name)
+				}
+			}
+		}
+	}
+	switch c.LogLevel {
+	case "", LogInfo, LogDebug:
+	default:
+		return fmt.Errorf("log_level %q: expected %q or %q", c.LogLevel, LogInfo, LogDebug)
+	}
+	for i, rule := range c.Timeouts {
+		if rule.Path == "" {
+			return fmt.Errorf("timeout rule %d: needs a path", i)
+		}
+		for _, d := range []string{rule.Read, rule.Write} {
+			if _, err := time.ParseDuration(d); d != "" && err != nil {
+				return fmt.Errorf("timeout rule %d: invalid duration %q", i, d)
+			}
+		}
+	}
+	if sh := c.SecurityHeaders; sh != nil {
+		for i, rule := range sh.Routes {
+			if !strings.HasPrefix(rule.Path, "/") {
+				return fmt.Errorf("security_headers route %d: path must start with /", i)
+			}
+		}
+	}
+	return nil
+}
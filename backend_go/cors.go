@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Cross-origin access for browser apps on other origins that call the API
+// directly. CORS_ORIGINS lists the origins allowed (e.g.
+// https://app.example.com, or "*" for any); their requests get
+// Access-Control-Allow-Origin, with credentials unless the list is "*".
+// Preflight requests are answered here, before authentication, since
+// browsers send them without credentials; they never reach the Python
+// service, and origins not listed get an answer without the allow headers.
+
+// corsMethods are the methods preflights are told the API takes
+const corsMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// isPreflight reports whether a request is a CORS preflight rather than a
+// plain OPTIONS request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// withCORS answers preflights and adds the CORS headers for allowed origins
+func withCORS(origins []string, next http.Handler) http.Handler {
+	wildcard := slices.Contains(origins, "*")
+	maxAge := strconv.Itoa(int(envDuration("CORS_MAX_AGE", 10*time.Minute).Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && (wildcard || slices.Contains(origins, origin))
+		h := w.Header()
+		if len(origins) > 0 && !wildcard {
+			h.Add("Vary", "Origin")
+		}
+		if allowed {
+			if wildcard {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if isPreflight(r) {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if allowed {
+				h.Set("Access-Control-Allow-Methods", corsMethods)
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					h.Set("Access-Control-Allow-Headers", headers)
+				}
+				h.Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed {
+			h.Set("Access-Control-Expose-Headers", requestIDHeader+", ETag, Content-Disposition")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
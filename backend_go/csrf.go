@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CSRF protection for login sessions. Browsers send the session cookie with
+// any request, including one forged by another site, so a state-changing API
+// call from a session must also carry the session's CSRF token in the
+// X-CSRF-Token header. The token is issued in the training_csrf cookie, which
+// the frontend reads, and by GET /auth/csrf. Bearer token clients are exempt:
+// browsers never attach those on their own. CSRF_EXEMPT_PATHS lists further
+// paths (a trailing / matches a prefix) for clients that cannot send the header.
+
+const (
+	csrfCookie = "training_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken derives the token of a session, so it needs no storage
+func (p *oidcProvider) csrfToken(sessionID string) string {
+	mac := hmac.New(sha256.New, p.csrfKey)
+	mac.Write([]byte(sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueCSRFToken sets the token cookie unless the browser already has it
+func (p *oidcProvider) issueCSRFToken(w http.ResponseWriter, r *http.Request, s *oidcSession) {
+	token := p.csrfToken(s.ID)
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value == token {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:    csrfCookie,
+		Value:   token,
+		Path:    "/",
+		Expires: s.Expires,
+		// Readable by the frontend, which echoes it in the header
+		HttpOnly: false,
+		Secure:   requestProto(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkCSRF answers 403 when a state-changing API call from a login session
+// lacks the session's token
+func (p *oidcProvider) checkCSRF(w http.ResponseWriter, r *http.Request, id *Identity) bool {
+	if id.Method != "session" || !strings.HasPrefix(r.URL.Path, "/api/") || csrfExempt(r.URL.Path) {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	given := r.Header.Get(csrfHeader)
+	if given != "" && hmac.Equal([]byte(given), []byte(p.csrfToken(id.session))) {
+		return true
+	}
+	debugf("CSRF check failed for %s %s (request %s)", r.Method, r.URL.Path, requestID(r))
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": "missing or invalid CSRF token, send the training_csrf cookie value in " + csrfHeader})
+	return false
+}
+
+// csrfExempt reports whether CSRF_EXEMPT_PATHS lists the path
+func csrfExempt(path string) bool {
+	for _, p := range strings.Split(os.Getenv("CSRF_EXEMPT_PATHS"), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" && (path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCSRF returns the CSRF token of the session, for clients that cannot
+// read cookies
+func (p *oidcProvider) handleCSRF(w http.ResponseWriter, r *http.Request) {
+	session := p.readSession(r)
+	if session == nil || session.ID == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "not logged in", "login_url": "/auth/login"})
+		return
+	}
+	p.issueCSRFToken(w, r, session)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"csrf_token": p.csrfToken(session.ID), "header": csrfHeader})
+}
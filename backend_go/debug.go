@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	_ "net/http/pprof" // registers /debug/pprof/ on the default mux
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Profiling and runtime introspection under /debug/, behind the admin token
+
+var startedAt = time.Now()
+
+// protectDebug puts every /debug/ path behind adminAuth. net/http/pprof
+// registers its handlers on the default mux itself, so they are guarded here
+// rather than where they are registered.
+func protectDebug(next http.Handler) http.Handler {
+	guarded := adminAuth(next.ServeHTTP)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			guarded(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// secretEnvMarkers mark environment variables whose values are redacted
+var secretEnvMarkers = []string{"TOKEN", "SECRET", "PASSWORD", "KEY"}
+
+// registerDebugRoutes adds /debug/runtime next to the pprof handlers
+func registerDebugRoutes() {
+	http.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"version":        Version,
+			"go_version":     runtime.Version(),
+			"uptime_seconds": time.Since(startedAt).Seconds(),
+			"goroutines":     runtime.NumGoroutine(),
+			"gomaxprocs":     runtime.GOMAXPROCS(0),
+			"num_cpu":        runtime.NumCPU(),
+			"sessions":       liveSessions.count(),
+			"ws_queue": map[string]interface{}{
+				"policy":           wsQueue.policy,
+				"size":             wsQueue.size,
+				"frames_dropped":   wsFramesDropped.Load(),
+				"frames_coalesced": wsFramesCoalesced.Load(),
+			},
+			"memory": map[string]interface{}{
+				"heap_alloc_bytes":   mem.HeapAlloc,
+				"heap_inuse_bytes":   mem.HeapInuse,
+				"heap_objects":       mem.HeapObjects,
+				"stack_inuse_bytes":  mem.StackInuse,
+				"sys_bytes":          mem.Sys,
+				"total_alloc_bytes":  mem.TotalAlloc,
+				"num_gc":             mem.NumGC,
+				"gc_pause_total_ms":  float64(mem.PauseTotalNs) / 1e6,
+				"last_gc":            time.Unix(0, int64(mem.LastGC)),
+				"next_gc_heap_bytes": mem.NextGC,
+			},
+			"env": redactedEnv(),
+		})
+	})
+}
+
+// redactedEnv returns the environment with secret values hidden
+func redactedEnv() map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		upper := strings.ToUpper(key)
+		for _, marker := range secretEnvMarkers {
+			if strings.Contains(upper, marker) && value != "" {
+				value = "[redacted]"
+				break
+			}
+		}
+		env[key] = value
+	}
+	return env
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service discovery: upstream URLs of the form srv://<name> or
+// consul://<service> are re-resolved periodically instead of pointing at a
+// single static address. Replicas that disappear are drained, not cut off.
+
+// resolver returns the base URLs of the instances currently serving an upstream
+type resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+	String() string
+}
+
+// parseDiscoveryURL recognises discovery URLs; ok is false for plain http(s) URLs
+func parseDiscoveryURL(raw string) (resolver, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, false
+	}
+	scheme := u.Query().Get("scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	switch u.Scheme {
+	case "srv", "dns+srv":
+		return &srvResolver{name: u.Host, scheme: scheme}, true
+	case "consul":
+		addr := getEnv("CONSUL_HTTP_ADDR", "http://127.0.0.1:8500")
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		return &consulResolver{
+			addr:    strings.TrimRight(addr, "/"),
+			token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+			service: u.Host,
+			tag:     u.Query().Get("tag"),
+			scheme:  scheme,
+			client:  &http.Client{Timeout: 5 * time.Second},
+		}, true
+	}
+	return nil, false
+}
+
+// srvResolver looks up DNS SRV records, e.g. srv://_trainer._tcp.example.internal
+type srvResolver struct {
+	name   string
+	scheme string
+}
+
+func (r *srvResolver) String() string { return "srv://" + r.name }
+
+func (r *srvResolver) Resolve(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", r.name)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, rec := range records {
+		host := strings.TrimSuffix(rec.Target, ".")
+		out = append(out, r.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(rec.Port))))
+	}
+	return out, nil
+}
+
+// consulResolver asks the Consul catalog for passing instances of a service
+type consulResolver struct {
+	addr    string
+	token   string
+	service string
+	tag     string
+	scheme  string
+	client  *http.Client
+}
+
+func (r *consulResolver) String() string { return "consul://" + r.service }
+
+func (r *consulResolver) Resolve(ctx context.Context) ([]string, error) {
+	query := url.Values{"passing": {"true"}}
+	if r.tag != "" {
+		query.Set("tag", r.tag)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.addr+"/v1/health/service/"+url.PathEscape(r.service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("X-Consul-Token", r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decoding consul response: %w", err)
+	}
+	var out []string
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		out = append(out, r.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return out, nil
+}
+
+// resolve refreshes every upstream that uses discovery
+func (rt *Router) resolve(ctx context.Context) {
+	resolveUpstreams(ctx, rt.Upstreams())
+}
+
+// resolveUpstreams refreshes the upstreams that use discovery. On a lookup
+// error an upstream keeps its current replicas.
+func resolveUpstreams(ctx context.Context, upstreams []*Upstream) {
+	for _, up := range upstreams {
+		if len(up.resolvers) == 0 {
+			continue
+		}
+		urls := append([]string(nil), up.static...)
+		failed := false
+		for _, res := range up.resolvers {
+			found, err := res.Resolve(ctx)
+			if err != nil {
+				log.Printf("Upstream %s: resolving %s failed: %v", up.Name, res, err)
+				failed = true
+				continue
+			}
+			urls = append(urls, found...)
+		}
+		if failed {
+			// Still drop fully drained replicas without changing the set
+			up.setTargets(currentURLs(up))
+			continue
+		}
+		up.setTargets(urls)
+	}
+}
+
+func currentURLs(up *Upstream) []string {
+	var out []string
+	for _, t := range up.serving() {
+		out = append(out, t.URL.String())
+	}
+	return out
+}
+
+// RunDiscovery re-resolves discovered upstreams every DISCOVERY_INTERVAL
+func (rt *Router) RunDiscovery(ctx context.Context) {
+	interval := envDuration("DISCOVERY_INTERVAL", 30*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rt.resolve(ctx)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Iframe embed mode, for host apps that cannot inject the modal HTML into
+// their own DOM. GET /embed serves the training UI as a page of its own, and
+// /embed/frame.js, loaded by that page, posts the UI's events to the window
+// framing it:
+//
+//	{"source": "training-module", "type": "runStarted", "detail": {...}}
+//
+// Types are ready, runStarted, runCompleted and resize. Host pages load
+// /embed/bridge.js, which creates or attaches to the iframe and hands the
+// events to callbacks. Pages on other origins may only frame /embed when
+// they are listed in EMBED_ORIGINS, and only those get messages.
+
+// embedOrigins are the origins allowed to frame /embed besides the backend's own
+var embedOrigins []string
+
+var frameAncestors = regexp.MustCompile(`frame-ancestors[^;]*`)
+
+// parseOrigins reads the comma-separated list of origins such as
+// https://app.example.com, or "*" for any, of the named setting
+func parseOrigins(name, spec string) ([]string, error) {
+	var out []string
+	for _, part := range strings.Split(spec, ",") {
+		origin := strings.TrimSpace(part)
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+				return nil, fmt.Errorf("%s: %q is not an origin like https://app.example.com", name, origin)
+			}
+			origin = u.Scheme + "://" + u.Host
+		}
+		out = append(out, origin)
+	}
+	return out, nil
+}
+
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Model Training Module</title>
+    <link rel="stylesheet" href="css/training-module.css">
+    <style>
+        body.mt-embed { padding: 0; background: transparent; }
+        body.mt-embed #mt-model-info-modal { position: static; background: none; }
+        body.mt-embed #mt-model-info-modal > .mt-modal-content { width: auto; max-width: none; max-height: none; border-radius: 0; }
+        body.mt-embed #mt-model-info-modal .mt-close-button { display: none; }
+    </style>
+</head>
+
+<body class="mt-embed" data-embed-origins="{{.Origins}}">
+{{.Markup}}
+    <script type="module" src="embed/frame.js"></script>
+</body>
+
+</html>
+`))
+
+// handleEmbed serves the standalone page of the training UI
+func handleEmbed(w http.ResponseWriter, r *http.Request) {
+	asset, err := loadAsset(frontendAssets, "module.html", "module.html")
+	if err != nil {
+		log.Printf("Error reading module.html: %v", err)
+		http.Error(w, "Failed to read module HTML", http.StatusInternalServerError)
+		return
+	}
+	// The security headers are already set; open framing to the embedders
+	if len(embedOrigins) > 0 {
+		ancestors := "frame-ancestors 'self' " + strings.Join(embedOrigins, " ")
+		if csp := w.Header().Get("Content-Security-Policy"); csp != "" {
+			if frameAncestors.MatchString(csp) {
+				csp = frameAncestors.ReplaceAllString(csp, ancestors)
+			} else {
+				csp += "; " + ancestors
+			}
+			w.Header().Set("Content-Security-Policy", csp)
+		}
+		w.Header().Del("X-Frame-Options")
+	}
+	origins, _ := json.Marshal(embedOrigins)
+	locale := negotiateLocale(r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", locale)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := embedPage.Execute(w, map[string]interface{}{
+		"Locale":  locale,
+		"Origins": string(origins),
+		"Markup":  template.HTML(translateModal(brandModal(modalMarkup(string(asset.body))), locale)),
+	}); err != nil {
+		log.Printf("Error rendering embed page: %v", err)
+	}
+}
+
+// embedScripts are the frame and host sides of the bridge
+var embedScripts = map[string]*cachedAsset{
+	"frame.js":  newCachedAsset([]byte(embedFrameJS), time.Now()),
+	"bridge.js": newCachedAsset([]byte(embedBridgeJS), time.Now()),
+}
+
+func handleEmbedScript(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("script")
+	asset := embedScripts[name]
+	if asset == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	serveAsset(w, r, name, asset, assetMaxAge("js"))
+}
+
+// embedFrameJS runs in the embedded page. It opens the UI and relays the
+// mt:run-* events pipeline-config.js fires to the parent, when the parent's
+// origin is the backend's own or listed in EMBED_ORIGINS.
+const embedFrameJS = `// Frame side of the training module embed bridge
+import { openModal } from '../js/model.js';
+
+const origins = JSON.parse(document.body.dataset.embedOrigins || '[]');
+
+// The page framing this one; ancestorOrigins is not in every browser, the
+// referrer carries at least the origin
+function parentOrigin() {
+    if (location.ancestorOrigins && location.ancestorOrigins.length > 0) {
+        return location.ancestorOrigins[0];
+    }
+    try {
+        return new URL(document.referrer).origin;
+    } catch (error) {
+        return '';
+    }
+}
+
+const target = parentOrigin();
+const allowed = target !== '' && (target === location.origin || origins.includes('*') || origins.includes(target));
+
+function post(type, detail = {}) {
+    if (window.parent === window || !allowed) {
+        return;
+    }
+    window.parent.postMessage({ source: 'training-module', type, detail }, target);
+}
+
+window.addEventListener('mt:run-started', (event) => post('runStarted', event.detail));
+window.addEventListener('mt:run-completed', (event) => post('runCompleted', event.detail));
+
+document.addEventListener('DOMContentLoaded', async () => {
+    await openModal();
+    post('ready');
+    new ResizeObserver(() => {
+        post('resize', { height: document.documentElement.scrollHeight });
+    }).observe(document.body);
+});
+`
+
+// embedBridgeJS is loaded by host pages
+const embedBridgeJS = `// Host side of the training module embed bridge:
+//
+//   const embed = TrainingModuleEmbed.create(document.getElementById('training'));
+//   embed.on('runCompleted', (detail) => console.log(detail.status));
+(function () {
+    'use strict';
+
+    const script = document.currentScript;
+    const embedURL = new URL('../embed', script.src).href;
+    const backendOrigin = new URL(script.src).origin;
+
+    class TrainingModuleEmbed {
+        // Listens to an iframe showing /embed; with autoResize false the
+        // iframe keeps its own height
+        constructor(iframe, options = {}) {
+            this.iframe = iframe;
+            this.autoResize = options.autoResize !== false;
+            this.listeners = {};
+            this.onMessage = (event) => {
+                const message = event.data;
+                if (event.source !== this.iframe.contentWindow || event.origin !== backendOrigin ||
+                    !message || message.source !== 'training-module') {
+                    return;
+                }
+                if (message.type === 'resize' && this.autoResize) {
+                    this.iframe.style.height = message.detail.height + 'px';
+                }
+                (this.listeners[message.type] || []).forEach((callback) => callback(message.detail));
+            };
+            window.addEventListener('message', this.onMessage);
+        }
+
+        static attach(iframe, options) {
+            return new TrainingModuleEmbed(iframe, options);
+        }
+
+        // create adds an iframe showing /embed to container
+        static create(container, options) {
+            const iframe = document.createElement('iframe');
+            iframe.src = embedURL;
+            iframe.title = 'Model Training Module';
+            iframe.style.width = '100%';
+            iframe.style.border = '0';
+            container.appendChild(iframe);
+            return new TrainingModuleEmbed(iframe, options);
+        }
+
+        on(type, callback) {
+            (this.listeners[type] = this.listeners[type] || []).push(callback);
+            return this;
+        }
+
+        off(type, callback) {
+            this.listeners[type] = (this.listeners[type] || []).filter((c) => c !== callback);
+            return this;
+        }
+
+        destroy() {
+            window.removeEventListener('message', this.onMessage);
+            this.listeners = {};
+        }
+    }
+
+    window.TrainingModuleEmbed = TrainingModuleEmbed;
+})();
+`
+
+// registerEmbedRoutes adds the embed page and its bridge scripts
+func registerEmbedRoutes() error {
+	origins, err := parseOrigins("EMBED_ORIGINS", getEnv("EMBED_ORIGINS", ""))
+	if err != nil {
+		return err
+	}
+	embedOrigins = origins
+	http.HandleFunc("GET /embed", handleEmbed)
+	http.HandleFunc("GET /embed/{script}", handleEmbedScript)
+	return nil
+}
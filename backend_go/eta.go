@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Completion estimates for queued and running runs. A run is expected to
+// take as long as finished runs of the same stage (or script, outside a
+// pipeline): the median time per dataset image times its dataset_size when
+// it and at least etaMinSamples of them have one, else their median
+// duration, else the median of all finished runs. A queued run's start is
+// found by playing the queue forward on the scheduler's slots, and its
+// finish is that plus its own expected duration. Estimates are served on
+// GET /api/runs/{id} and sent to the client as "EXECUTION_ETA: ...".
+
+const (
+	// etaHistory is how many of the latest finished runs of a stage count
+	etaHistory = 50
+	// etaMinSamples is how many of them must have a dataset size to scale by it
+	etaMinSamples = 2
+)
+
+// Estimate bases
+const (
+	etaByDatasetSize = "dataset_size"
+	etaByStage       = "stage"
+	etaByAllRuns     = "all_runs"
+)
+
+// runETA is the estimate for a run that has not ended
+type runETA struct {
+	ExpectedSeconds  float64    `json:"expected_duration_seconds"`
+	EstimatedStart   *time.Time `json:"estimated_start,omitempty"`
+	WaitSeconds      float64    `json:"wait_seconds,omitempty"`
+	EstimatedFinish  time.Time  `json:"estimated_finish"`
+	RemainingSeconds float64    `json:"remaining_seconds"`
+	// Overdue is set when the run has already taken longer than expected
+	Overdue bool   `json:"overdue,omitempty"`
+	Basis   string `json:"basis"`
+	Samples int    `json:"samples"`
+}
+
+// durationModel holds the durations of finished runs by stage
+type durationModel struct {
+	byKey map[string][]*Run
+	all   []time.Duration
+}
+
+// etaKey groups runs that take about as long as each other
+func etaKey(run *Run) string {
+	if stage := run.Params["stage"]; stage != "" {
+		return "stage:" + stage
+	}
+	return "script:" + run.Script
+}
+
+func runDatasetSize(run *Run) int {
+	n, _ := strconv.Atoi(run.Params["dataset_size"])
+	return n
+}
+
+func newDurationModel(runs []*Run) *durationModel {
+	m := &durationModel{byKey: map[string][]*Run{}}
+	for _, run := range runs {
+		if run.Status != RunFinished || run.EndTime == nil || runDuration(run) <= 0 {
+			continue
+		}
+		key := etaKey(run)
+		m.byKey[key] = append(m.byKey[key], run)
+	}
+	for key, runs := range m.byKey {
+		// Latest first, so the history follows hardware and code changes
+		sort.Slice(runs, func(i, j int) bool { return runs[i].EndTime.After(*runs[j].EndTime) })
+		if len(runs) > etaHistory {
+			runs = runs[:etaHistory]
+		}
+		m.byKey[key] = runs
+		for _, run := range runs {
+			m.all = append(m.all, runDuration(run))
+		}
+	}
+	return m
+}
+
+// runDuration is how long a finished run ran, leaving out its time queued
+func runDuration(run *Run) time.Duration {
+	return run.EndTime.Sub(run.StartTime) - runQueuedTime(run)
+}
+
+func medianDuration(ds []time.Duration) time.Duration {
+	slices.Sort(ds)
+	n := len(ds)
+	if n%2 == 1 {
+		return ds[n/2]
+	}
+	return (ds[n/2-1] + ds[n/2]) / 2
+}
+
+// expected returns how long run should take in all, and the basis and
+// number of runs of the estimate; false without any history
+func (m *durationModel) expected(run *Run) (time.Duration, string, int, bool) {
+	history := m.byKey[etaKey(run)]
+	if size := runDatasetSize(run); size > 0 {
+		var perImage []time.Duration
+		for _, h := range history {
+			if n := runDatasetSize(h); n > 0 {
+				perImage = append(perImage, runDuration(h)/time.Duration(n))
+			}
+		}
+		if len(perImage) >= etaMinSamples {
+			return medianDuration(perImage) * time.Duration(size), etaByDatasetSize, len(perImage), true
+		}
+	}
+	if len(history) > 0 {
+		ds := make([]time.Duration, len(history))
+		for i, h := range history {
+			ds[i] = runDuration(h)
+		}
+		return medianDuration(ds), etaByStage, len(ds), true
+	}
+	if len(m.all) > 0 {
+		return medianDuration(slices.Clone(m.all)), etaByAllRuns, len(m.all), true
+	}
+	return 0, "", 0, false
+}
+
+// estimateRun returns the estimate for a run that has not ended, or nil
+// when it has or there is no history to go by
+func estimateRun(runID string, now time.Time) *runETA {
+	run, ok := store.Get(runID)
+	if !ok || run.Finished() {
+		return nil
+	}
+	model := newDurationModel(store.List())
+	expected, basis, samples, ok := model.expected(run)
+	if !ok {
+		return nil
+	}
+	eta := &runETA{ExpectedSeconds: expected.Seconds(), Basis: basis, Samples: samples}
+
+	snap := scheduler.snapshot()
+	started, running := run.StartTime, run.Status == RunRunning
+	for _, job := range snap.Running {
+		if job.RunID == runID {
+			started, running = *job.Started, true
+		}
+	}
+	if running {
+		eta.EstimatedFinish = started.Add(expected)
+		if eta.EstimatedFinish.Before(now) {
+			eta.EstimatedFinish, eta.Overdue = now, true
+		}
+		eta.RemainingSeconds = eta.EstimatedFinish.Sub(now).Seconds()
+		return eta
+	}
+
+	start := now
+	if position := slices.IndexFunc(snap.Waiting, func(j *schedJob) bool { return j.RunID == runID }); position >= 0 && snap.Slots > 0 {
+		start, ok = model.queueStart(snap, position, now)
+		if !ok {
+			return nil
+		}
+	}
+	eta.EstimatedStart = &start
+	eta.WaitSeconds = start.Sub(now).Seconds()
+	eta.EstimatedFinish = start.Add(expected)
+	eta.RemainingSeconds = eta.EstimatedFinish.Sub(now).Seconds()
+	return eta
+}
+
+// queueStart plays the queue forward: each slot frees up when its run is
+// expected to end, and the runs ahead take the earliest free slot in turn
+func (m *durationModel) queueStart(snap queueSnapshot, position int, now time.Time) (time.Time, bool) {
+	jobExpected := func(job *schedJob) (time.Duration, bool) {
+		run, ok := store.Get(job.RunID)
+		if !ok {
+			run = &Run{Script: job.Script}
+		}
+		d, _, _, ok := m.expected(run)
+		return d, ok
+	}
+	free := make([]time.Time, 0, snap.Slots)
+	for _, job := range snap.Running {
+		d, ok := jobExpected(job)
+		if !ok {
+			return time.Time{}, false
+		}
+		free = append(free, later(job.Started.Add(d), now))
+	}
+	for len(free) < snap.Slots {
+		free = append(free, now)
+	}
+	for _, job := range snap.Waiting[:position] {
+		slices.SortFunc(free, func(a, b time.Time) int { return a.Compare(b) })
+		d, ok := jobExpected(job)
+		if !ok {
+			return time.Time{}, false
+		}
+		free[0] = free[0].Add(d)
+	}
+	return slices.MinFunc(free, func(a, b time.Time) int { return a.Compare(b) }), true
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// message is the EXECUTION_ETA line for the client
+func (eta *runETA) message() string {
+	var b strings.Builder
+	b.WriteString("EXECUTION_ETA: ")
+	if eta.EstimatedStart != nil {
+		fmt.Fprintf(&b, "start in %s, ", formatETA(time.Duration(eta.WaitSeconds*float64(time.Second))))
+	}
+	if eta.Overdue {
+		b.WriteString("running longer than expected")
+	} else {
+		fmt.Fprintf(&b, "finish in %s (%s)", formatETA(time.Duration(eta.RemainingSeconds*float64(time.Second))), eta.EstimatedFinish.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	if eta.Samples == 1 {
+		b.WriteString(", from 1 finished run")
+	} else {
+		fmt.Fprintf(&b, ", from %d finished runs", eta.Samples)
+	}
+	return b.String()
+}
+
+// formatETA prints a duration to the minute, or the second below one
+func formatETA(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ExecRequest is the first message a client sends on the execution WebSocket
+type ExecRequest struct {
+	ScriptPath string   `json:"script_path"`
+	Args       []string `json:"args"`
+	Executor   string   `json:"executor,omitempty"`
+	// Workspace and Pipeline select the Python service through the routing table
+	Workspace string `json:"workspace,omitempty"`
+	Pipeline  string `json:"pipeline,omitempty"`
+	// Priority is the scheduling class: low, normal or high
+	Priority string `json:"priority,omitempty"`
+	// MaxDuration is how long the script may run, e.g. "6h"
+	MaxDuration string `json:"max_duration,omitempty"`
+	// DatasetSize is the number of images trained on, for completion estimates
+	DatasetSize int `json:"dataset_size,omitempty"`
+	// Dataset, DatasetVersion and CodeVersion (e.g. a git commit) are
+	// recorded for model lineage
+	Dataset        string `json:"dataset,omitempty"`
+	DatasetVersion string `json:"dataset_version,omitempty"`
+	CodeVersion    string `json:"code_version,omitempty"`
+}
+
+// wsMessage is a single WebSocket frame relayed between the legs of a session
+type wsMessage struct {
+	Type int
+	Data []byte
+}
+
+// ExecTarget is where a script runs, resolved from the request and pipeline config
+type ExecTarget struct {
+	Executor string
+	Stage    string
+	// Settings is the executor-specific block (e.g. "kubernetes") from the pipeline config
+	Settings json.RawMessage
+	// Secrets maps environment variables of the script to secret names
+	Secrets map[string]string
+	// Priority is the scheduling class of the stage or pipeline, and
+	// ResumeArgs are added to the script's arguments after a preemption
+	Priority   string
+	ResumeArgs []string
+	// MaxDuration is the stage's or pipeline's limit on running time
+	MaxDuration string
+	// Retry is the stage's or pipeline's retry policy
+	Retry json.RawMessage
+	// PipelineVersion is the pipeline's "version", else a hash of its config
+	PipelineVersion string
+	// Pipeline is what concurrency limits count the run against: the
+	// pipeline's "name", else the stage that owns the script, else the
+	// script. It comes from the config, never from the request.
+	Pipeline string
+	// Workspace is what workspace limits count the run against: the
+	// "workspace" of the stage, else of the pipeline, else "default"
+	Workspace string
+}
+
+// ExecSession connects an executor to the client-facing WebSocket. Executors
+// report progress with the same text protocol the Python service uses:
+// plain log lines, then EXECUTION_FINISHED or "EXECUTION_ERROR: <reason>".
+type ExecSession struct {
+	RunID string
+	// RequestID is the X-Request-ID of the WebSocket handshake
+	RequestID string
+	// Header goes on connections to the Python service: the request ID and
+	// how the client reached us (X-Forwarded-*, Forwarded)
+	Header  http.Header
+	Request ExecRequest
+	Target  ExecTarget
+	// Raw is the original request message, relayed verbatim by the Python executor
+	Raw []byte
+	// Input carries further client messages (e.g. CANCEL); closed when the client leaves
+	Input <-chan wsMessage
+	// Env holds the run's secrets by variable name, for the executor to set in
+	// the script's environment. Never log or record it.
+	Env map[string]string
+
+	mu     sync.Mutex
+	output func(messageType int, data []byte) error
+	// stream writes a frame read from r, for frames too large to buffer
+	stream func(messageType int, r io.Reader) error
+	// redactor masks the values of Env in output
+	redactor *strings.Replacer
+	// status is reported to the client as STATUS: lines; nil when it is not
+	status *sessionStatus
+}
+
+// Send writes a message to the client; safe for concurrent use
+func (s *ExecSession) Send(messageType int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if messageType == websocket.BinaryMessage {
+		return s.output(messageType, data)
+	}
+	return s.output(messageType, s.redact(data))
+}
+
+// SendStream writes a frame read from r to the client without holding it
+// in memory; safe for concurrent use
+func (s *ExecSession) SendStream(messageType int, r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream == nil {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return s.output(messageType, s.redact(data))
+	}
+	return s.stream(messageType, r)
+}
+
+// redact masks secret values in script output
+func (s *ExecSession) redact(data []byte) []byte {
+	if s.redactor == nil {
+		return data
+	}
+	return []byte(s.redactor.Replace(string(data)))
+}
+
+// SendText writes a text line to the client
+func (s *ExecSession) SendText(text string) error {
+	return s.Send(websocket.TextMessage, []byte(text))
+}
+
+// SetUpstream reports the state of the executor's connection to where the
+// script runs (upstreamConnecting, upstreamConnected, upstreamReconnecting)
+func (s *ExecSession) SetUpstream(state string) {
+	if s.status != nil {
+		s.status.setUpstream(state)
+	}
+}
+
+// Executor runs a training script and streams its output into the session
+type Executor interface {
+	Name() string
+	Execute(ctx context.Context, s *ExecSession) error
+}
+
+// executors holds the configured execution backends by name
+var executors = map[string]Executor{}
+
+func registerExecutor(e Executor) {
+	executors[e.Name()] = e
+}
+
+// readPipelineConfig loads the pipeline definition shared with the frontend,
+// from PIPELINE_CONFIG_PATH or else the frontend assets
+func readPipelineConfig() ([]byte, error) {
+	if path := os.Getenv("PIPELINE_CONFIG_PATH"); path != "" {
+		return os.ReadFile(path)
+	}
+	return fs.ReadFile(frontendAssets, "config/training-pipeline.json")
+}
+
+// resolveExecTarget picks the executor for a request: an explicit executor in
+// the request wins, then the stage that owns the script, then the pipeline
+// default, then DEFAULT_EXECUTOR.
+func resolveExecTarget(req ExecRequest) ExecTarget {
+	target := ExecTarget{Executor: getEnv("DEFAULT_EXECUTOR", "python")}
+
+	var file struct {
+		Pipeline map[string]json.RawMessage `json:"pipeline"`
+	}
+	if data, err := readPipelineConfig(); err == nil {
+		json.Unmarshal(data, &file)
+	}
+	pipeline := file.Pipeline
+	if name := rawString(pipeline["executor"]); name != "" {
+		target.Executor = name
+	}
+
+	var stages []map[string]json.RawMessage
+	json.Unmarshal(pipeline["stages"], &stages)
+	var stage map[string]json.RawMessage
+	for _, st := range stages {
+		var scripts []struct {
+			Script string `json:"script"`
+		}
+		json.Unmarshal(st["scripts"], &scripts)
+		for _, sc := range scripts {
+			if sc.Script == req.ScriptPath {
+				stage = st
+			}
+		}
+		if stage != nil {
+			break
+		}
+	}
+	if stage != nil {
+		target.Stage = rawString(stage["id"])
+		if name := rawString(stage["executor"]); name != "" {
+			target.Executor = name
+		}
+	}
+	switch {
+	case rawString(pipeline["name"]) != "":
+		target.Pipeline = rawString(pipeline["name"])
+	case target.Stage != "":
+		target.Pipeline = target.Stage
+	default:
+		target.Pipeline = req.ScriptPath
+	}
+	target.Workspace = rawString(pipeline["workspace"])
+	if ws := rawString(stage["workspace"]); ws != "" {
+		target.Workspace = ws
+	}
+	if req.Executor != "" {
+		target.Executor = req.Executor
+	}
+
+	// Stage secrets add to and override pipeline secrets
+	target.Secrets = pipelineSecrets(pipeline["secrets"])
+	for variable, name := range pipelineSecrets(stage["secrets"]) {
+		if target.Secrets == nil {
+			target.Secrets = map[string]string{}
+		}
+		target.Secrets[variable] = name
+	}
+
+	target.Priority = rawString(pipeline["priority"])
+	if p := rawString(stage["priority"]); p != "" {
+		target.Priority = p
+	}
+	json.Unmarshal(pipeline["resume_args"], &target.ResumeArgs)
+	if raw, ok := stage["resume_args"]; ok {
+		target.ResumeArgs = nil
+		json.Unmarshal(raw, &target.ResumeArgs)
+	}
+	if req.Priority != "" {
+		target.Priority = req.Priority
+	}
+	target.MaxDuration = rawString(pipeline["max_duration"])
+	if d := rawString(stage["max_duration"]); d != "" {
+		target.MaxDuration = d
+	}
+	if req.MaxDuration != "" {
+		target.MaxDuration = req.MaxDuration
+	}
+	target.Retry = pipeline["retry"]
+	if raw, ok := stage["retry"]; ok {
+		target.Retry = raw
+	}
+
+	if pipeline != nil {
+		target.PipelineVersion = rawString(pipeline["version"])
+		if target.PipelineVersion == "" {
+			data, _ := json.Marshal(pipeline)
+			sum := sha256.Sum256(data)
+			target.PipelineVersion = "sha256:" + hex.EncodeToString(sum[:6])
+		}
+	}
+
+	// Stage settings override pipeline settings for the chosen executor
+	if settings, ok := stage[target.Executor]; ok {
+		target.Settings = settings
+	} else if settings, ok := pipeline[target.Executor]; ok {
+		target.Settings = settings
+	}
+	return target
+}
+
+func rawString(raw json.RawMessage) string {
+	var s string
+	if len(raw) > 0 {
+		json.Unmarshal(raw, &s)
+	}
+	return s
+}
+
+// pythonExecutor relays the session to the execution WebSocket of the Python
+// service selected by the routing table
+type pythonExecutor struct {
+	router *Router
+}
+
+func (p *pythonExecutor) Name() string { return "python" }
+
+func (p *pythonExecutor) Execute(ctx context.Context, s *ExecSession) error {
+	pipeline := s.Request.Pipeline
+	if pipeline == "" {
+		pipeline = s.Target.Stage
+	}
+	upstream := p.router.Match(s.Request.Workspace, pipeline)
+	if upstream == nil {
+		return fmt.Errorf("no Python service routed for workspace %q pipeline %q", s.Request.Workspace, pipeline)
+	}
+
+	// Runs stick to one replica; fail over to the next when it cannot be reached
+	s.SetUpstream(upstreamConnecting)
+	var pythonConn *websocket.Conn
+	var target *Target
+	err := fmt.Errorf("no instance available")
+	for _, target = range upstream.Sticky(s.RunID) {
+		pythonConn, _, err = target.WebSocketDialer().DialContext(ctx, target.WebSocketURL("/api/script/ws/execute"), s.Header)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		target.markFailed(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to Python service %s: %w", upstream.Name, err)
+	}
+	s.SetUpstream(upstreamConnected)
+	target.active.Add(1)
+	defer target.active.Add(-1)
+	if store != nil && s.RunID != "" {
+		store.Update(s.RunID, func(r *Run) {
+			setMapValue(&r.Tags, "upstream", upstream.Name)
+			setMapValue(&r.Tags, "upstream_target", target.Addr())
+		})
+	}
+	upstreamConn := &pythonUpstream{conn: pythonConn}
+	defer func() { upstreamConn.current().Close() }()
+	// A cancelled run, e.g. one past its maximum duration, drops the upstream
+	defer context.AfterFunc(ctx, upstreamConn.leave)()
+	recording := traffic.session(s.Raw)
+	defer recording.save()
+
+	resumable := pythonResumeTimeout > 0 && s.RunID != ""
+	request, err := pythonRequest(s, resumable)
+	if err != nil {
+		return err
+	}
+	if err := upstreamConn.write(wsMessage{Type: websocket.TextMessage, Data: request}, false); err != nil {
+		return fmt.Errorf("sending request to Python service: %w", err)
+	}
+
+	// Forward client messages; closing the upstream when the client leaves lets
+	// the Python service terminate the script as before
+	go func() {
+		defer upstreamConn.leave()
+		for msg := range s.Input {
+			recording.message("client", msg.Type, msg.Data)
+			if err := upstreamConn.write(msg, resumable); err != nil {
+				return
+			}
+		}
+	}()
+
+	// received counts the service's messages, to re-attach after the last one
+	var received int64
+	ended := false
+	for {
+		messageType, buf, rest, err := readFrame(upstreamConn.current(), wsInspectLimit)
+		if err != nil {
+			// The Python service closes the socket once the script ends
+			if !resumable || ended || upstreamConn.hasLeft() || ctx.Err() != nil ||
+				websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			var ok bool
+			if received, ok, err = resumePython(ctx, s, upstreamConn, target, received, err); !ok {
+				return err
+			}
+			continue
+		}
+		received++
+		if messageType == websocket.TextMessage && (bytes.HasPrefix(buf.Bytes(), []byte("EXECUTION_FINISHED")) || bytes.HasPrefix(buf.Bytes(), []byte("EXECUTION_ERROR:"))) {
+			ended = true
+		}
+		if messageType == websocket.BinaryMessage {
+			// Binary frames, such as sample images, are sent whole up to
+			// WS_MAX_BINARY_SIZE and dropped beyond it
+			if rest != nil {
+				_, err = buf.ReadFrom(io.LimitReader(rest, wsQueue.maxBinary+1-int64(buf.Len())))
+				rest = nil
+			}
+			if err == nil && int64(buf.Len()) > wsQueue.maxBinary {
+				putWSBuffer(buf)
+				if s.SendText(fmt.Sprintf("BINARY_DROPPED: a binary frame over %s was skipped (WS_MAX_BINARY_SIZE)", formatByteSize(wsQueue.maxBinary))) != nil {
+					return nil
+				}
+				continue
+			}
+		}
+		if rest != nil && (s.redactor != nil || recording != nil) {
+			// Masking and recording need the whole message
+			_, err = buf.ReadFrom(rest)
+			rest = nil
+		}
+		if err == nil && rest != nil {
+			err = s.SendStream(messageType, io.MultiReader(buf, rest))
+		} else if err == nil {
+			if recording != nil {
+				recording.message("service", messageType, s.redact(buf.Bytes()))
+			}
+			err = s.Send(messageType, buf.Bytes())
+		}
+		putWSBuffer(buf)
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// pythonRequest is the request message for the Python service: the client's
+// message, plus the run's secrets as "env" when it has any, its "run_id",
+// which names the run's output directory, and "resumable" when it may be
+// re-attached. Those fields are the backend's to set; the client's are
+// dropped, so it cannot pick another run's directory or secrets.
+func pythonRequest(s *ExecSession, resumable bool) ([]byte, error) {
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(s.Raw, &msg); err != nil {
+		return nil, fmt.Errorf("invalid execution request: %w", err)
+	}
+	delete(msg, "env")
+	delete(msg, "run_id")
+	delete(msg, "resumable")
+	if len(s.Env) > 0 {
+		env, err := json.Marshal(s.Env)
+		if err != nil {
+			return nil, err
+		}
+		msg["env"] = env
+	}
+	if s.RunID != "" {
+		msg["run_id"], _ = json.Marshal(s.RunID)
+	}
+	if resumable {
+		msg["resumable"] = json.RawMessage("true")
+	}
+	return json.Marshal(msg)
+}
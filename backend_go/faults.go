@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Fault injection for resilience testing, enabled with FAULTS, e.g.
+//
+//	FAULTS=latency=300ms,jitter=200ms,error_rate=0.1,ws_drop_rate=0.05,ws_disconnect_rate=0.01
+//
+// Faults apply to the proxy path only: API calls forwarded to the Python
+// service and execution streams. Never set FAULTS in production.
+
+// faultInjector decides which requests and frames misbehave
+type faultInjector struct {
+	latency          time.Duration
+	jitter           time.Duration
+	errorRate        float64
+	wsDropRate       float64
+	wsDisconnectRate float64
+	// paths limits HTTP faults to these path prefixes; empty means all
+	paths []string
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// faults is the process-wide injector; nil unless FAULTS is set
+var faults *faultInjector
+
+// errInjectedDisconnect is returned by a session whose client was cut off
+var errInjectedDisconnect = errors.New("fault injection: disconnected")
+
+// parseFaults reads a FAULTS spec; an empty spec disables injection
+func parseFaults(spec string) (*faultInjector, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	f := &faultInjector{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, part := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("FAULTS: %q is not key=value", part)
+		}
+		var err error
+		switch key {
+		case "latency":
+			f.latency, err = time.ParseDuration(value)
+		case "jitter":
+			f.jitter, err = time.ParseDuration(value)
+		case "error_rate":
+			f.errorRate, err = parseRate(value)
+		case "ws_drop_rate":
+			f.wsDropRate, err = parseRate(value)
+		case "ws_disconnect_rate":
+			f.wsDisconnectRate, err = parseRate(value)
+		case "paths":
+			f.paths = strings.Split(value, "|")
+		case "seed":
+			var seed int64
+			seed, err = strconv.ParseInt(value, 10, 64)
+			f.rnd = rand.New(rand.NewSource(seed))
+		default:
+			err = errors.New("unknown fault")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("FAULTS: %s: %w", key, err)
+		}
+	}
+	return f, nil
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, errors.New("must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+func (f *faultInjector) String() string {
+	return fmt.Sprintf("latency=%s jitter=%s error_rate=%g ws_drop_rate=%g ws_disconnect_rate=%g paths=%v",
+		f.latency, f.jitter, f.errorRate, f.wsDropRate, f.wsDisconnectRate, f.paths)
+}
+
+// chance reports true with the given probability
+func (f *faultInjector) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rnd.Float64() < rate
+}
+
+// delay sleeps for the configured latency plus up to jitter
+func (f *faultInjector) delay() {
+	d := f.latency
+	if f.jitter > 0 {
+		f.mu.Lock()
+		d += time.Duration(f.rnd.Int63n(int64(f.jitter)))
+		f.mu.Unlock()
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (f *faultInjector) appliesTo(path string) bool {
+	if len(f.paths) == 0 {
+		return true
+	}
+	for _, p := range f.paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap delays proxied requests and fails some with a random 502/503/504
+func (f *faultInjector) Wrap(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+	statuses := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || !f.appliesTo(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f.delay()
+		if f.chance(f.errorRate) {
+			f.mu.Lock()
+			status := statuses[f.rnd.Intn(len(statuses))]
+			f.mu.Unlock()
+			log.Printf("Fault injection: %s %s -> %d", r.Method, r.URL.Path, status)
+			w.Header().Set("X-Fault-Injected", "error")
+			writeJSON(w, status, map[string]string{"detail": "Injected fault: " + http.StatusText(status)})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionStart delays the start of an execution stream
+func (f *faultInjector) sessionStart() {
+	if f != nil {
+		f.delay()
+	}
+}
+
+// frame decides the fate of a frame sent to the client: dropped, or the
+// connection cut before it is delivered
+func (f *faultInjector) frame() (drop, disconnect bool) {
+	if f == nil {
+		return false, false
+	}
+	if f.chance(f.wsDisconnectRate) {
+		return false, true
+	}
+	return f.chance(f.wsDropRate), false
+}
+
+// injectFrameFault applies frame faults to a frame for the client on conn;
+// skip is true when the frame must not be sent, with the error to return
+func injectFrameFault(conn *websocket.Conn, script string) (skip bool, err error) {
+	if drop, disconnect := faults.frame(); disconnect {
+		log.Printf("Fault injection: disconnecting %s mid-stream", script)
+		conn.Close()
+		return true, errInjectedDisconnect
+	} else if drop {
+		return true, nil
+	}
+	return false, nil
+}
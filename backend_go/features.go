@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Feature flags let a deployment turn experimental features on or off. Each
+// flag has a built-in default, FEATURES overrides it ("name" turns a flag on,
+// "-name" off) and "features" in CONFIG_FILE overrides both on reload.
+
+type featureFlag struct {
+	Description string
+	Default     bool
+}
+
+// envFeatures are the overrides from FEATURES, read at startup
+var envFeatures map[string]bool
+
+// featureFlags are the known flags by name
+var featureFlags = map[string]featureFlag{
+	"mlflow_api": {
+		Description: "MLflow-compatible tracking API under /api/2.0/mlflow/",
+		Default:     true,
+	},
+	"huggingface_publish": {
+		Description: "Publishing models to the Hugging Face Hub",
+		Default:     true,
+	},
+	"search": {
+		Description: "Search across runs, models and run logs under /api/search",
+		Default:     true,
+	},
+}
+
+// validateFeatures rejects unknown flag names, so a typo does not silently
+// leave a feature in its default state
+func validateFeatures(flags map[string]bool) error {
+	for name := range flags {
+		if _, ok := featureFlags[name]; !ok {
+			return fmt.Errorf("unknown feature flag %q", name)
+		}
+	}
+	return nil
+}
+
+// parseFeatures reads FEATURES, e.g. "huggingface_publish,-mlflow_api"
+func parseFeatures(value string) (map[string]bool, error) {
+	flags := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, on := strings.CutPrefix(item, "-")
+		flags[name] = !on
+	}
+	if err := validateFeatures(flags); err != nil {
+		return nil, fmt.Errorf("FEATURES: %w", err)
+	}
+	return flags, nil
+}
+
+// resolveFeatures returns the state of every flag: the defaults, then
+// FEATURES, then the config file
+func resolveFeatures(env, file map[string]bool) map[string]bool {
+	flags := map[string]bool{}
+	for name, f := range featureFlags {
+		flags[name] = f.Default
+	}
+	for name, on := range env {
+		flags[name] = on
+	}
+	for name, on := range file {
+		flags[name] = on
+	}
+	return flags
+}
+
+// featureEnabled reports whether a flag is on in the current settings
+func featureEnabled(name string) bool {
+	if on, ok := currentSettings().features[name]; ok {
+		return on
+	}
+	return featureFlags[name].Default
+}
+
+// enabledFeatures returns the names of the flags that are on, sorted
+func enabledFeatures() []string {
+	names := []string{}
+	for name := range featureFlags {
+		if featureEnabled(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requireFeature answers 404 while a flag is off, as if the endpoint did not exist
+func requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(name) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "feature " + name + " is disabled"})
+			return
+		}
+		next(w, r)
+	}
+}
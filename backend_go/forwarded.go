@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Client address, scheme and host behind reverse proxies. X-Forwarded-For,
+// X-Forwarded-Proto, X-Forwarded-Host and RFC 7239 Forwarded are only
+// believed from TRUSTED_PROXIES (comma separated IPs or CIDRs, e.g. the
+// ingress or the app embedding the trainingmodule). From anyone else they are
+// dropped before the request is handled, so clients cannot spoof their
+// address past the rate limiter or into the Python service.
+
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// trustedProxies is set from TRUSTED_PROXIES at startup
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads a comma separated list of IPs and CIDRs
+func parseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, err := parsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		out = append(out, prefix)
+	}
+	return out, nil
+}
+
+// parsePrefix reads a CIDR, or a single IP as a prefix of its full length
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// isTrustedProxy reports whether addr (an IP, optionally with port) is a trusted proxy
+func isTrustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(stripPort(addr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withForwarded drops forwarding headers that did not come from a trusted proxy
+func withForwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isTrustedProxy(r.RemoteAddr) {
+			for _, h := range forwardingHeaders {
+				r.Header.Del(h)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the address of the client: the connection's peer, or behind
+// trusted proxies the nearest address in the forwarding chain that is not one
+func clientIP(r *http.Request) string {
+	peer := stripPort(r.RemoteAddr)
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+	chain := forwardedFor(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !isTrustedProxy(chain[i]) {
+			return chain[i]
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0]
+	}
+	return peer
+}
+
+// forwardedFor lists the client addresses of X-Forwarded-For, or else of
+// Forwarded, first hop first
+func forwardedFor(r *http.Request) []string {
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, stripPort(ip))
+			}
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+	for _, elem := range parseForwarded(r.Header.Values("Forwarded")) {
+		if f := elem["for"]; f != "" {
+			chain = append(chain, stripPort(f))
+		}
+	}
+	return chain
+}
+
+// requestProto is the scheme the client used: from a trusted proxy's headers,
+// else whether this connection is TLS
+func requestProto(r *http.Request) string {
+	if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+		return strings.ToLower(proto)
+	}
+	if elems := parseForwarded(r.Header.Values("Forwarded")); len(elems) > 0 && elems[0]["proto"] != "" {
+		return strings.ToLower(elems[0]["proto"])
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost is the host the client asked for, as requestProto
+func requestHost(r *http.Request) string {
+	if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+		return host
+	}
+	if elems := parseForwarded(r.Header.Values("Forwarded")); len(elems) > 0 && elems[0]["host"] != "" {
+		return elems[0]["host"]
+	}
+	return r.Host
+}
+
+// setForwardedHeaders describes r to the Python service: X-Forwarded-Proto
+// and -Host of the original client request, and this hop appended to
+// Forwarded. X-Forwarded-For is left to the caller, because the reverse
+// proxy appends the peer itself.
+func setForwardedHeaders(h http.Header, r *http.Request) {
+	proto, host := requestProto(r), requestHost(r)
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", host)
+	elem := fmt.Sprintf("for=%s;host=%q;proto=%s", forwardedNode(stripPort(r.RemoteAddr)), host, proto)
+	if prior := strings.Join(r.Header.Values("Forwarded"), ", "); prior != "" {
+		elem = prior + ", " + elem
+	}
+	h.Set("Forwarded", elem)
+}
+
+// upstreamHeaders are the forwarding headers for a connection this backend
+// opens itself, such as the execution WebSocket to the Python service
+func upstreamHeaders(r *http.Request) http.Header {
+	h := http.Header{}
+	setForwardedHeaders(h, r)
+	chain := strings.Join(r.Header.Values("X-Forwarded-For"), ", ")
+	if chain != "" {
+		chain += ", "
+	}
+	h.Set("X-Forwarded-For", chain+stripPort(r.RemoteAddr))
+	return h
+}
+
+// parseForwarded splits RFC 7239 Forwarded values into one map per hop
+func parseForwarded(values []string) []map[string]string {
+	var elems []map[string]string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			pairs := map[string]string{}
+			for _, pair := range strings.Split(elem, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				pairs[strings.ToLower(key)] = strings.Trim(value, `"`)
+			}
+			if len(pairs) > 0 {
+				elems = append(elems, pairs)
+			}
+		}
+	}
+	return elems
+}
+
+// forwardedNode formats an address for Forwarded; IPv6 must be quoted and bracketed
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// stripPort removes the port from host:port, [v6]:port or [v6]
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// firstValue is the first entry of a comma separated header
+func firstValue(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.TrimSpace(first)
+}
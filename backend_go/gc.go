@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Garbage collection of run artifacts and logs, every GC_INTERVAL:
+//   - artifacts of failed and cancelled runs are deleted
+//     GC_FAILED_ARTIFACT_DAYS after the run ended
+//   - a workspace's artifacts are kept under GC_WORKSPACE_ARTIFACT_QUOTA by
+//     deleting those of its oldest ended runs, failed ones first
+//   - logs of runs that ended GC_ARCHIVE_LOG_DAYS ago are moved to S3 under
+//     GC_LOG_ARCHIVE_PREFIX
+//
+// GET /admin/gc reports what a pass would do, POST /admin/gc runs one now.
+// Running runs are never touched.
+
+// GC actions
+const (
+	gcDeleteArtifacts = "delete_artifacts"
+	gcArchiveLog      = "archive_log"
+)
+
+// gcAction is one thing a pass does, or would do
+type gcAction struct {
+	Action    string `json:"action"`
+	RunID     string `json:"run_id"`
+	Workspace string `json:"workspace"`
+	Reason    string `json:"reason"`
+	Bytes     int64  `json:"bytes"`
+	Error     string `json:"error,omitempty"`
+}
+
+// gcWorkspace is a workspace's artifact storage before and after a pass
+type gcWorkspace struct {
+	Bytes      int64 `json:"bytes"`
+	BytesAfter int64 `json:"bytes_after"`
+	Quota      int64 `json:"quota,omitempty"`
+	Runs       int   `json:"runs"`
+	// OverQuota is set when running runs alone exceed the quota
+	OverQuota bool `json:"over_quota,omitempty"`
+}
+
+// gcReport describes a pass
+type gcReport struct {
+	DryRun     bool                    `json:"dry_run"`
+	StartedAt  time.Time               `json:"started_at"`
+	FinishedAt time.Time               `json:"finished_at"`
+	Actions    []gcAction              `json:"actions"`
+	FreedBytes int64                   `json:"freed_bytes"`
+	Workspaces map[string]*gcWorkspace `json:"workspaces"`
+}
+
+type garbageCollector struct {
+	store         *RunStore
+	mirror        *ArtifactMirror
+	interval      time.Duration
+	failedAfter   time.Duration
+	quota         int64
+	archiveAfter  time.Duration
+	archive       *s3Client
+	archivePrefix string
+
+	// mu keeps passes from overlapping
+	mu   sync.Mutex
+	last *gcReport
+}
+
+func newGarbageCollectorFromEnv(store *RunStore, mirror *ArtifactMirror) (*garbageCollector, error) {
+	quota, err := envByteSize("GC_WORKSPACE_ARTIFACT_QUOTA", 0)
+	if err != nil {
+		return nil, err
+	}
+	gc := &garbageCollector{
+		store:         store,
+		mirror:        mirror,
+		interval:      envDuration("GC_INTERVAL", time.Hour),
+		failedAfter:   envDays("GC_FAILED_ARTIFACT_DAYS"),
+		quota:         quota,
+		archiveAfter:  envDays("GC_ARCHIVE_LOG_DAYS"),
+		archivePrefix: strings.Trim(getEnv("GC_LOG_ARCHIVE_PREFIX", "run-logs"), "/"),
+	}
+	if gc.archiveAfter > 0 {
+		if gc.archive = newS3ClientFromEnv(); gc.archive == nil {
+			return nil, errors.New("GC_ARCHIVE_LOG_DAYS needs S3_BUCKET to archive to")
+		}
+		if runLogs == nil {
+			return nil, errors.New("GC_ARCHIVE_LOG_DAYS is set but RUN_LOG_DIR is off")
+		}
+	}
+	return gc, nil
+}
+
+// enabled reports whether any rule is configured
+func (gc *garbageCollector) enabled() bool {
+	return gc.failedAfter > 0 || gc.quota > 0 || gc.archiveAfter > 0
+}
+
+// Run collects on every interval until ctx is cancelled
+func (gc *garbageCollector) Run(ctx context.Context) {
+	if !gc.enabled() {
+		return
+	}
+	log.Printf("Garbage collection every %s", gc.interval)
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+	for {
+		gc.Collect(ctx, false)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runWorkspace is where a run's artifacts count against a quota
+func runWorkspace(run *Run) string {
+	if ws := run.Params["workspace"]; ws != "" {
+		return ws
+	}
+	return "default"
+}
+
+// dirSize adds up the files under dir, 0 when it does not exist
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// plan works out the actions of a pass from the current runs and files
+func (gc *garbageCollector) plan(now time.Time) *gcReport {
+	report := &gcReport{Actions: []gcAction{}, Workspaces: map[string]*gcWorkspace{}}
+	type candidate struct {
+		run   *Run
+		bytes int64
+	}
+	byWorkspace := map[string][]candidate{}
+	for _, run := range gc.store.ListAll() {
+		ws := runWorkspace(run)
+		usage := report.Workspaces[ws]
+		if usage == nil {
+			usage = &gcWorkspace{Quota: gc.quota}
+			report.Workspaces[ws] = usage
+		}
+		size := dirSize(gc.store.ArtifactDir(run.ID))
+		usage.Bytes += size
+		usage.Runs++
+
+		if !run.Finished() || run.EndTime == nil {
+			continue
+		}
+		age := now.Sub(*run.EndTime)
+		if gc.archiveAfter > 0 && age > gc.archiveAfter {
+			var logBytes int64
+			for _, name := range runLogs.files(run.ID) {
+				if info, err := os.Stat(name); err == nil {
+					logBytes += info.Size()
+				}
+			}
+			if logBytes > 0 {
+				report.Actions = append(report.Actions, gcAction{
+					Action: gcArchiveLog, RunID: run.ID, Workspace: ws,
+					Reason: fmt.Sprintf("ended more than %s ago", formatDays(gc.archiveAfter)), Bytes: logBytes,
+				})
+			}
+		}
+		if size == 0 {
+			continue
+		}
+		failed := run.Status == RunFailed || run.Status == RunCancelled || run.Status == RunTimedOut
+		if gc.failedAfter > 0 && failed && age > gc.failedAfter {
+			report.Actions = append(report.Actions, gcAction{
+				Action: gcDeleteArtifacts, RunID: run.ID, Workspace: ws,
+				Reason: fmt.Sprintf("%s more than %s ago", run.Status, formatDays(gc.failedAfter)), Bytes: size,
+			})
+			usage.BytesAfter -= size
+			continue
+		}
+		byWorkspace[ws] = append(byWorkspace[ws], candidate{run, size})
+	}
+
+	for ws, usage := range report.Workspaces {
+		usage.BytesAfter += usage.Bytes
+		if gc.quota <= 0 || usage.BytesAfter <= gc.quota {
+			continue
+		}
+		// Failed runs go first, then the longest ended
+		candidates := byWorkspace[ws]
+		sort.Slice(candidates, func(i, j int) bool {
+			fi := candidates[i].run.Status != RunFinished
+			fj := candidates[j].run.Status != RunFinished
+			if fi != fj {
+				return fi
+			}
+			return candidates[i].run.EndTime.Before(*candidates[j].run.EndTime)
+		})
+		for _, c := range candidates {
+			if usage.BytesAfter <= gc.quota {
+				break
+			}
+			report.Actions = append(report.Actions, gcAction{
+				Action: gcDeleteArtifacts, RunID: c.run.ID, Workspace: ws,
+				Reason: "workspace over its " + formatByteSize(gc.quota) + " quota", Bytes: c.bytes,
+			})
+			usage.BytesAfter -= c.bytes
+		}
+		usage.OverQuota = usage.BytesAfter > gc.quota
+	}
+	return report
+}
+
+// formatDays prints a whole number of days
+func formatDays(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	if days == 1 {
+		return "1 day"
+	}
+	return strconv.Itoa(days) + " days"
+}
+
+// Collect runs a pass, or with dryRun only reports what it would do
+func (gc *garbageCollector) Collect(ctx context.Context, dryRun bool) *gcReport {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	start := time.Now()
+	report := gc.plan(start)
+	report.DryRun, report.StartedAt = dryRun, start
+	if !dryRun {
+		for i := range report.Actions {
+			a := &report.Actions[i]
+			if ctx.Err() != nil {
+				a.Error = ctx.Err().Error()
+				continue
+			}
+			var err error
+			switch a.Action {
+			case gcDeleteArtifacts:
+				err = gc.deleteArtifacts(ctx, a.RunID)
+			case gcArchiveLog:
+				err = gc.archiveLog(ctx, a.RunID)
+			}
+			if err != nil {
+				a.Error = err.Error()
+				log.Printf("GC: %s of run %s failed: %v", a.Action, a.RunID, err)
+				continue
+			}
+			report.FreedBytes += a.Bytes
+			log.Printf("GC: %s of run %s (%s, %s)", a.Action, a.RunID, a.Reason, formatByteSize(a.Bytes))
+		}
+		gc.last = report
+	} else {
+		for _, a := range report.Actions {
+			report.FreedBytes += a.Bytes
+		}
+	}
+	report.FinishedAt = time.Now()
+	return report
+}
+
+// deleteArtifacts removes a run's artifacts locally and from the mirror
+func (gc *garbageCollector) deleteArtifacts(ctx context.Context, runID string) error {
+	if gc.mirror != nil {
+		if err := gc.mirror.forgetRun(ctx, runID); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(gc.store.ArtifactDir(runID)); err != nil {
+		return err
+	}
+	checksums.RemovePrefix("runs/" + runID + "/")
+	return nil
+}
+
+// archiveLog uploads a run's log files to the archive prefix, then deletes them
+func (gc *garbageCollector) archiveLog(ctx context.Context, runID string) error {
+	files := runLogs.files(runID)
+	for _, name := range files {
+		sum, err := fileSHA256(name)
+		if err != nil {
+			return err
+		}
+		key := path.Join(gc.archivePrefix, runID, filepath.Base(name))
+		if _, err := gc.archive.PutFile(ctx, key, name, sum); err != nil {
+			return err
+		}
+	}
+	for _, name := range files {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerGCRoutes mounts the report and the manual trigger on the admin API
+func registerGCRoutes(gc *garbageCollector) {
+	http.HandleFunc("/admin/gc", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			gc.mu.Lock()
+			last := gc.last
+			gc.mu.Unlock()
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"enabled": gc.enabled(),
+				"plan":    gc.Collect(r.Context(), true),
+				"last":    last,
+			})
+		case http.MethodPost:
+			dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+			log.Printf("Admin: garbage collection requested (dry run %v)", dryRun)
+			writeJSON(w, http.StatusOK, gc.Collect(r.Context(), dryRun))
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+}
@@ -1,7 +1,15 @@
 module yolo-backend
 
-go 1.21
+go 1.22
 
-require github.com/gorilla/websocket v1.5.1
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/spf13/cobra v1.8.1
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/net v0.17.0
+)
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Aggregated /health: the overall status plus one entry per dependency, for
+// dashboards and the trainingmodule health proxy. Probes that gate traffic
+// are /healthz, /readyz and /startupz.
+
+// Dependency states in /health
+const (
+	DependencyOK       = "ok"
+	DependencyDegraded = "degraded"
+	DependencyDown     = "down"
+	DependencyDisabled = "disabled"
+)
+
+// dependencyHealth is the state of one dependency at its last check
+type dependencyHealth struct {
+	Status    string      `json:"status"`
+	LatencyMS int64       `json:"latency_ms"`
+	CheckedAt time.Time   `json:"checked_at,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Detail    interface{} `json:"detail,omitempty"`
+}
+
+// pythonServiceHealth summarizes the upstream health checks: down when no
+// upstream has a healthy replica, degraded when some replica is failing or
+// the supervised process is not running
+func pythonServiceHealth(router *Router, supervisor *pythonSupervisor) dependencyHealth {
+	h := dependencyHealth{Status: DependencyOK}
+	statuses := router.Statuses()
+	healthyUpstreams := 0
+	for _, up := range statuses {
+		if up.Healthy {
+			healthyUpstreams++
+		}
+		for _, t := range up.Targets {
+			if !t.Healthy {
+				h.Status = DependencyDegraded
+				if h.Error == "" {
+					h.Error = t.URL + ": " + t.Error
+				}
+			}
+			if t.CheckedAt.After(h.CheckedAt) {
+				h.CheckedAt = t.CheckedAt
+			}
+			h.LatencyMS = max(h.LatencyMS, t.LatencyMS)
+		}
+	}
+	if healthyUpstreams == 0 {
+		h.Status = DependencyDown
+	}
+	detail := map[string]interface{}{"upstreams": statuses}
+	if supervisor != nil {
+		status := supervisor.Status()
+		detail["process"] = status
+		if status.State != ProcessRunning && h.Status == DependencyOK {
+			h.Status = DependencyDegraded
+			h.Error = "python process is " + status.State
+		}
+	}
+	h.Detail = detail
+	return h
+}
+
+// storageHealth checks the run store directory
+func storageHealth() dependencyHealth {
+	start := time.Now()
+	h := dependencyHealth{Status: DependencyOK, Detail: map[string]string{"dir": store.dir}}
+	if err := store.Check(); err != nil {
+		h.Status, h.Error = DependencyDown, err.Error()
+	}
+	h.LatencyMS = time.Since(start).Milliseconds()
+	h.CheckedAt = time.Now()
+	return h
+}
+
+// queueHealth reports the executions in progress; draining counts as degraded
+func queueHealth() dependencyHealth {
+	h := dependencyHealth{
+		Status:    DependencyOK,
+		CheckedAt: time.Now(),
+		Detail:    map[string]interface{}{"running": liveSessions.count(), "draining": draining.Load()},
+	}
+	if draining.Load() {
+		h.Status = DependencyDegraded
+		h.Error = "draining, new executions are refused"
+	}
+	return h
+}
+
+// objectStoreCheckInterval bounds how often /health reaches out to the bucket
+const objectStoreCheckInterval = 30 * time.Second
+
+// objectStoreHealth caches the last bucket check of the artifact mirror
+type objectStoreHealth struct {
+	mirror *ArtifactMirror
+
+	mu   sync.Mutex
+	last dependencyHealth
+}
+
+// Health checks the bucket at most every objectStoreCheckInterval
+func (o *objectStoreHealth) Health(ctx context.Context) dependencyHealth {
+	if o.mirror == nil {
+		return dependencyHealth{Status: DependencyDisabled}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.last.CheckedAt) < objectStoreCheckInterval {
+		return o.last
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	h := dependencyHealth{Status: DependencyOK}
+	if err := o.mirror.s3.Ping(ctx, o.mirror.prefix); err != nil {
+		h.Status, h.Error = DependencyDown, err.Error()
+	}
+	h.LatencyMS = time.Since(start).Milliseconds()
+	h.CheckedAt = time.Now()
+
+	o.mirror.mu.Lock()
+	detail := map[string]interface{}{"bucket": o.mirror.s3.bucket, "prefix": o.mirror.prefix}
+	if !o.mirror.lastSync.IsZero() {
+		detail["last_sync"] = o.mirror.lastSync
+	}
+	if o.mirror.lastError != "" {
+		detail["last_sync_error"] = o.mirror.lastError
+		if h.Status == DependencyOK {
+			h.Status = DependencyDegraded
+		}
+	}
+	o.mirror.mu.Unlock()
+	h.Detail = detail
+	o.last = h
+	return h
+}
+
+// handleHealth serves /health. The status is ok, degraded when any
+// dependency is not ok, or draining.
+func handleHealth(router *Router, supervisor *pythonSupervisor, mirror *ArtifactMirror, pythonServiceURL string) http.HandlerFunc {
+	objectStore := &objectStoreHealth{mirror: mirror}
+	return func(w http.ResponseWriter, r *http.Request) {
+		deps := map[string]dependencyHealth{
+			"python_service": pythonServiceHealth(router, supervisor),
+			"storage":        storageHealth(),
+			"object_store":   objectStore.Health(r.Context()),
+			"queue":          queueHealth(),
+		}
+		status := "ok"
+		for _, d := range deps {
+			if d.Status == DependencyDegraded || d.Status == DependencyDown {
+				status = "degraded"
+			}
+		}
+		if draining.Load() {
+			status = "draining"
+		}
+		health := map[string]interface{}{
+			"status":       status,
+			"service":      "training-backend",
+			"version":      Version,
+			"checked_at":   time.Now(),
+			"dependencies": deps,
+			"python_proxy": pythonServiceURL,
+			"upstreams":    router.Statuses(),
+		}
+		if supervisor != nil {
+			health["python_process"] = supervisor.Status()
+		}
+		writeJSON(w, http.StatusOK, health)
+	}
+}
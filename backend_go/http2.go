@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP/2. With TLS_CERT_FILE and TLS_KEY_FILE the server listens on HTTPS and
+// negotiates HTTP/2 with clients that offer it (HTTP2=off keeps every client
+// on HTTP/1.1). Towards the Python service each upstream chooses its protocol
+// with "http2" in CONFIG_FILE.
+
+// Upstream HTTP/2 modes
+const (
+	// HTTP2Auto negotiates HTTP/2 with https:// upstreams and uses HTTP/1.1 on http://
+	HTTP2Auto = "auto"
+	// HTTP2H2C speaks HTTP/2 without TLS to http:// upstreams (prior knowledge)
+	HTTP2H2C = "h2c"
+	// HTTP2Off always uses HTTP/1.1, for services that misbehave with HTTP/2
+	HTTP2Off = "off"
+)
+
+var (
+	h2cTransport   = newH2CTransport((&net.Dialer{}).DialContext)
+	http1Transport = newHTTP1Transport()
+)
+
+// newH2CTransport multiplexes requests to an upstream over one plain connection
+func newH2CTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+		// Ping idle connections so a restarted service is noticed
+		ReadIdleTimeout: 30 * time.Second,
+	}
+}
+
+func newHTTP1Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ForceAttemptHTTP2 = false
+	// A non-nil empty map turns off HTTP/2 negotiation
+	t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	return t
+}
+
+// upstreamTransport returns the transport for an upstream's http2 mode
+func upstreamTransport(mode string) http.RoundTripper {
+	switch mode {
+	case HTTP2H2C:
+		return h2cTransport
+	case HTTP2Off:
+		return http1Transport
+	}
+	return http.DefaultTransport
+}
+
+// serverTLS returns the certificate and key to serve HTTPS with, if configured
+func serverTLS() (certFile, keyFile string, ok bool) {
+	certFile, keyFile = os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	return certFile, keyFile, certFile != "" && keyFile != ""
+}
+
+// configureHTTP2 turns off HTTP/2 on the listener when HTTP2=off. Otherwise
+// net/http negotiates it on TLS connections by itself.
+func configureHTTP2(srv *http.Server) {
+	if strings.EqualFold(os.Getenv("HTTP2"), "off") {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Push trained models to the Hugging Face Hub. Weights go through the Git LFS
+// batch API, the generated model card is committed inline.
+
+func init() {
+	modelActions["publish/huggingface"] = modelAction{[]string{http.MethodPost}, handlePublishHuggingFace}
+}
+
+// hfNamePattern is the Hub's character set for the owner and name of a repo
+var hfNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// hfRevisionPattern is a branch, tag or commit, e.g. "main" or "refs/pr/1"
+var hfRevisionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// validHFRepoID reports whether id is exactly <owner>/<name>
+func validHFRepoID(id string) bool {
+	owner, name, ok := strings.Cut(id, "/")
+	return ok && hfNamePattern.MatchString(owner) && hfNamePattern.MatchString(name) &&
+		!strings.Contains(owner, "..") && !strings.Contains(name, "..")
+}
+
+// validHFRevision reports whether rev can name a revision of a repo
+func validHFRevision(rev string) bool {
+	return hfRevisionPattern.MatchString(rev) && !strings.Contains(rev, "..") && !strings.HasSuffix(rev, "/")
+}
+
+type hfClient struct {
+	endpoint string
+	token    string
+	http     *http.Client
+}
+
+type hfUpload struct {
+	path    string // path inside the repo
+	local   string // file on disk, for LFS uploads
+	content []byte // inline content, for regular uploads
+	size    int64
+	sha256  string
+	mode    string // "lfs" or "regular", decided by preupload
+}
+
+func newHFClient() *hfClient {
+	return &hfClient{
+		endpoint: strings.TrimRight(getEnv("HF_ENDPOINT", "https://huggingface.co"), "/"),
+		token:    os.Getenv("HF_TOKEN"),
+		http:     &http.Client{Timeout: 30 * time.Minute},
+	}
+}
+
+// handlePublishHuggingFace uploads a model and its card to a Hub repository
+func handlePublishHuggingFace(w http.ResponseWriter, r *http.Request, modelID string) {
+	if !featureEnabled("huggingface_publish") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "feature huggingface_publish is disabled"})
+		return
+	}
+	var req struct {
+		RepoID   string `json:"repo_id"`
+		Revision string `json:"revision"`
+		Private  bool   `json:"private"`
+		RunID    string `json:"run_id"`
+		Message  string `json:"commit_message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if !validHFRepoID(req.RepoID) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "repo_id must be <owner>/<name>, each letters, digits, '.', '_' or '-'"})
+		return
+	}
+	if req.Revision == "" {
+		req.Revision = "main"
+	}
+	if !validHFRevision(req.Revision) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid revision"})
+		return
+	}
+
+	client := newHFClient()
+	if client.token == "" {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "HF_TOKEN is not configured"})
+		return
+	}
+
+	model, err := loadModel(modelID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	var run *Run
+	if req.RunID != "" {
+		var ok bool
+		if run, ok = store.Get(req.RunID); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+			return
+		}
+	}
+	if req.Message == "" {
+		req.Message = "Upload " + model.ID
+	}
+
+	weights := filepath.Base(model.File)
+	card := []byte(buildModelCard(model, run).markdown())
+	uploads := []*hfUpload{
+		{path: "README.md", content: card, size: int64(len(card))},
+		{path: weights, local: model.File, size: model.Size},
+	}
+
+	log.Printf("Publishing model %s to Hugging Face repo %s", model.ID, req.RepoID)
+	commitURL, err := client.publish(r.Context(), req.RepoID, req.Revision, req.Private, req.Message, uploads)
+	if err != nil {
+		log.Printf("Hugging Face publish of %s failed: %v", model.ID, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	if run != nil {
+		store.Update(run.ID, func(r *Run) {
+			setMapValue(&r.Tags, "huggingface.repo_id", req.RepoID)
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"model":      model.ID,
+		"repo_id":    req.RepoID,
+		"revision":   req.Revision,
+		"commit_url": commitURL,
+		"files":      []string{"README.md", weights},
+	})
+}
+
+// publish creates the repo if needed, uploads LFS objects and commits all files
+func (c *hfClient) publish(ctx context.Context, repoID, revision string, private bool, message string, uploads []*hfUpload) (string, error) {
+	if err := c.createRepo(ctx, repoID, private); err != nil {
+		return "", err
+	}
+	for _, u := range uploads {
+		if err := u.hash(); err != nil {
+			return "", err
+		}
+	}
+	if err := c.preupload(ctx, repoID, revision, uploads); err != nil {
+		return "", err
+	}
+	for _, u := range uploads {
+		if u.mode == "lfs" {
+			if err := c.uploadLFS(ctx, repoID, u); err != nil {
+				return "", fmt.Errorf("uploading %s: %w", u.path, err)
+			}
+		}
+	}
+	return c.commit(ctx, repoID, revision, message, uploads)
+}
+
+func (c *hfClient) createRepo(ctx context.Context, repoID string, private bool) error {
+	owner, name, _ := strings.Cut(repoID, "/")
+	body := map[string]interface{}{"type": "model", "name": name, "organization": owner, "private": private}
+	resp, err := c.doJSON(ctx, http.MethodPost, c.endpoint+"/api/repos/create", body, nil)
+	if err != nil {
+		return err
+	}
+	// 409 means the repo already exists, which is fine; a user namespace may
+	// also reject the organization field, so retry without it
+	if resp == http.StatusBadRequest || resp == http.StatusForbidden {
+		delete(body, "organization")
+		resp, err = c.doJSON(ctx, http.MethodPost, c.endpoint+"/api/repos/create", body, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if resp >= 300 && resp != http.StatusConflict {
+		return fmt.Errorf("creating repo %s: status %d", repoID, resp)
+	}
+	return nil
+}
+
+func (c *hfClient) preupload(ctx context.Context, repoID, revision string, uploads []*hfUpload) error {
+	type file struct {
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		Sample string `json:"sample"`
+	}
+	req := struct {
+		Files []file `json:"files"`
+	}{}
+	for _, u := range uploads {
+		sample, err := u.sample()
+		if err != nil {
+			return err
+		}
+		req.Files = append(req.Files, file{Path: u.path, Size: u.size, Sample: sample})
+	}
+
+	var resp struct {
+		Files []struct {
+			Path       string `json:"path"`
+			UploadMode string `json:"uploadMode"`
+		} `json:"files"`
+	}
+	url := fmt.Sprintf("%s/api/models/%s/preupload/%s", c.endpoint, repoID, url.PathEscape(revision))
+	status, err := c.doJSON(ctx, http.MethodPost, url, req, &resp)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return fmt.Errorf("preupload check: status %d", status)
+	}
+	modes := map[string]string{}
+	for _, f := range resp.Files {
+		modes[f.Path] = f.UploadMode
+	}
+	for _, u := range uploads {
+		u.mode = modes[u.path]
+		if u.mode == "lfs" && u.local == "" {
+			return fmt.Errorf("%s must be uploaded through LFS", u.path)
+		}
+	}
+	return nil
+}
+
+func (c *hfClient) uploadLFS(ctx context.Context, repoID string, u *hfUpload) error {
+	batch := map[string]interface{}{
+		"operation": "upload",
+		"transfers": []string{"basic"},
+		"hash_algo": "sha256",
+		"objects":   []map[string]interface{}{{"oid": u.sha256, "size": u.size}},
+	}
+	var resp struct {
+		Objects []struct {
+			Actions map[string]struct {
+				Href   string            `json:"href"`
+				Header map[string]string `json:"header"`
+			} `json:"actions"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"objects"`
+	}
+	status, err := c.doJSON(ctx, http.MethodPost, fmt.Sprintf("%s/%s.git/info/lfs/objects/batch", c.endpoint, repoID), batch, &resp)
+	if err != nil {
+		return err
+	}
+	if status >= 300 || len(resp.Objects) == 0 {
+		return fmt.Errorf("LFS batch: status %d", status)
+	}
+	obj := resp.Objects[0]
+	if obj.Error != nil {
+		return fmt.Errorf("LFS batch: %s", obj.Error.Message)
+	}
+
+	// No upload action means the object is already stored on the Hub
+	upload, ok := obj.Actions["upload"]
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(u.local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, upload.Href, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = u.size
+	for k, v := range upload.Header {
+		req.Header.Set(k, v)
+	}
+	putResp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	putResp.Body.Close()
+	if putResp.StatusCode >= 300 {
+		return fmt.Errorf("LFS upload: status %d", putResp.StatusCode)
+	}
+
+	if verify, ok := obj.Actions["verify"]; ok {
+		status, err := c.doJSON(ctx, http.MethodPost, verify.Href, map[string]interface{}{"oid": u.sha256, "size": u.size}, nil)
+		if err != nil {
+			return err
+		}
+		if status >= 300 {
+			return fmt.Errorf("LFS verify: status %d", status)
+		}
+	}
+	return nil
+}
+
+// commit sends the NDJSON commit payload referencing inline and LFS files
+func (c *hfClient) commit(ctx context.Context, repoID, revision, message string, uploads []*hfUpload) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(map[string]interface{}{"key": "header", "value": map[string]string{"summary": message}})
+	for _, u := range uploads {
+		if u.mode == "lfs" {
+			enc.Encode(map[string]interface{}{"key": "lfsFile", "value": map[string]interface{}{
+				"path": u.path, "algo": "sha256", "oid": u.sha256, "size": u.size,
+			}})
+			continue
+		}
+		content := u.content
+		if content == nil {
+			data, err := os.ReadFile(u.local)
+			if err != nil {
+				return "", err
+			}
+			content = data
+		}
+		enc.Encode(map[string]interface{}{"key": "file", "value": map[string]string{
+			"path": u.path, "encoding": "base64", "content": base64.StdEncoding.EncodeToString(content),
+		}})
+	}
+
+	url := fmt.Sprintf("%s/api/models/%s/commit/%s", c.endpoint, repoID, url.PathEscape(revision))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("commit: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var out struct {
+		CommitURL string `json:"commitUrl"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return out.CommitURL, nil
+}
+
+// doJSON sends an authenticated JSON request and decodes a JSON response into out
+func (c *hfClient) doJSON(ctx context.Context, method, url string, body, out interface{}) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.git-lfs+json, application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// hash computes the SHA-256 and size of the upload contents
+func (u *hfUpload) hash() error {
+	h := sha256.New()
+	if u.content != nil {
+		h.Write(u.content)
+	} else {
+		f, err := os.Open(u.local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if u.size, err = io.Copy(h, f); err != nil {
+			return err
+		}
+	}
+	u.sha256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// sample returns the base64 of the first 512 bytes, used by the Hub to detect binary files
+func (u *hfUpload) sample() (string, error) {
+	head := u.content
+	if head == nil {
+		f, err := os.Open(u.local)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		head = make([]byte, 512)
+		n, err := io.ReadFull(f, head)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		head = head[:n]
+	}
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return base64.StdEncoding.EncodeToString(head), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
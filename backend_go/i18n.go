@@ -0,0 +1,172 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Translated UI strings. The bundles under locales/ are compiled in, one
+// JSON object of key to text per language; keys missing from a bundle fall
+// back to English. GET /api/ui/strings returns the strings for the locale
+// negotiated from ?locale= or Accept-Language, and the modal HTML served by
+// /api/model/modal-html and /embed comes translated: elements carrying a
+// data-i18n attribute get the text of their key. UI_LOCALE is the locale
+// used when nothing the client accepts is available.
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// fallbackLocale is the bundle every key is in
+const fallbackLocale = "en"
+
+// locales are the bundles by language tag
+var locales = map[string]map[string]string{}
+
+// defaultLocale is UI_LOCALE, or English
+var defaultLocale = fallbackLocale
+
+// i18nElement matches an element with a data-i18n attribute and only text
+// inside, up to its closing tag
+var i18nElement = regexp.MustCompile(`(<[a-z][a-z0-9]*\b[^>]*\sdata-i18n="([a-z0-9_.]+)"[^>]*>)([^<]*)(</)`)
+
+func loadLocales() error {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			return err
+		}
+		var strs map[string]string
+		if err := json.Unmarshal(data, &strs); err != nil {
+			return fmt.Errorf("locales/%s: %w", f.Name(), err)
+		}
+		locales[strings.ToLower(strings.TrimSuffix(f.Name(), path.Ext(f.Name())))] = strs
+	}
+	if locales[fallbackLocale] == nil {
+		return fmt.Errorf("locales/%s.json is missing", fallbackLocale)
+	}
+	return nil
+}
+
+// matchLocale returns the bundle for a language tag such as de-AT, by the
+// whole tag and then by its language; empty when there is none
+func matchLocale(tag string) string {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	if locales[tag] != nil {
+		return tag
+	}
+	if lang, _, ok := strings.Cut(tag, "-"); ok && locales[lang] != nil {
+		return lang
+	}
+	return ""
+}
+
+// negotiateLocale picks the locale of a request: ?locale= when available,
+// otherwise the most preferred available language of Accept-Language
+func negotiateLocale(r *http.Request) string {
+	if locale := matchLocale(r.URL.Query().Get("locale")); locale != "" {
+		return locale
+	}
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && q > 0 {
+			accepted = append(accepted, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+	for _, a := range accepted {
+		if a.tag == "*" {
+			break
+		}
+		if locale := matchLocale(a.tag); locale != "" {
+			return locale
+		}
+	}
+	return defaultLocale
+}
+
+// uiStrings returns every string of a locale, English where it has none
+func uiStrings(locale string) map[string]string {
+	out := make(map[string]string, len(locales[fallbackLocale]))
+	for key, text := range locales[fallbackLocale] {
+		out[key] = text
+	}
+	for key, text := range locales[locale] {
+		out[key] = text
+	}
+	return out
+}
+
+// uiString returns the text of one key in a locale
+func uiString(locale, key string) string {
+	if text, ok := locales[locale][key]; ok {
+		return text
+	}
+	return locales[fallbackLocale][key]
+}
+
+// translateModal puts the strings of a locale into the modal HTML
+func translateModal(markup, locale string) string {
+	if locale == fallbackLocale || locales[locale] == nil {
+		return markup
+	}
+	return i18nElement.ReplaceAllStringFunc(markup, func(m string) string {
+		parts := i18nElement.FindStringSubmatch(m)
+		text, ok := locales[locale][parts[2]]
+		if !ok {
+			return m
+		}
+		return parts[1] + html.EscapeString(text) + parts[4]
+	})
+}
+
+// handleUIStrings serves /api/ui/strings
+func handleUIStrings(w http.ResponseWriter, r *http.Request) {
+	locale := negotiateLocale(r)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locale)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"locale":    locale,
+		"available": sortedKeys(locales),
+		"strings":   uiStrings(locale),
+	})
+}
+
+// registerI18nRoutes loads the bundles and adds the strings endpoint
+func registerI18nRoutes() error {
+	if err := loadLocales(); err != nil {
+		return err
+	}
+	if raw := getEnv("UI_LOCALE", ""); raw != "" {
+		locale := matchLocale(raw)
+		if locale == "" {
+			return fmt.Errorf("UI_LOCALE: no translations for %q, available: %s", raw, strings.Join(sortedKeys(locales), ", "))
+		}
+		defaultLocale = locale
+	}
+	http.HandleFunc("GET /api/ui/strings", handleUIStrings)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IP allow and deny lists, for deployments on shared lab networks. The
+// "ip_access" block of CONFIG_FILE limits who may reach the admin and debug
+// endpoints, who may run scripts, and optionally who may reach anything.
+// Rules follow reloads. The client address is the one clientIP reports, so
+// behind a proxy TRUSTED_PROXIES must name it.
+
+// IPAccessConfig holds the rules of each scope; a request must pass every
+// scope that covers its path
+type IPAccessConfig struct {
+	// All applies to every request, probes included
+	All *IPRules `json:"all"`
+	// Admin applies to /admin/ and /debug/
+	Admin *IPRules `json:"admin"`
+	// Execution applies to /api/script/, the execution WebSocket and its
+	// tokens, and the notebook servers, which run code too
+	Execution *IPRules `json:"execution"`
+}
+
+// IPRules lists IPs and CIDRs. Deny wins; a non-empty allow list admits
+// only the addresses on it.
+type IPRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ipRules is IPRules parsed
+type ipRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// ipAccessScope is a set of rules and the paths they cover
+type ipAccessScope struct {
+	name     string
+	prefixes []string
+	rules    ipRules
+}
+
+// ipAccessScopes are the paths of each scope in IPAccessConfig
+var ipAccessScopes = map[string][]string{
+	"all":       {"/"},
+	"admin":     {"/admin/", "/debug/"},
+	"execution": {"/api/script/", notebooksPrefix},
+}
+
+// parseIPAccess turns the config into scopes; nil when there are no rules
+func parseIPAccess(c *IPAccessConfig) ([]ipAccessScope, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var scopes []ipAccessScope
+	for _, s := range []struct {
+		name  string
+		rules *IPRules
+	}{{"all", c.All}, {"admin", c.Admin}, {"execution", c.Execution}} {
+		if s.rules == nil {
+			continue
+		}
+		allow, err := parsePrefixes(s.rules.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("%s.allow: %w", s.name, err)
+		}
+		deny, err := parsePrefixes(s.rules.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("%s.deny: %w", s.name, err)
+		}
+		scopes = append(scopes, ipAccessScope{name: s.name, prefixes: ipAccessScopes[s.name], rules: ipRules{allow: allow, deny: deny}})
+	}
+	return scopes, nil
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		prefix, err := parsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix)
+	}
+	return out, nil
+}
+
+// admits reports whether the rules let ip through
+func (r ipRules) admits(ip netip.Addr) bool {
+	for _, p := range r.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, p := range r.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s ipAccessScope) covers(path string) bool {
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// withIPAccess answers 403 to clients the current rules keep out
+func withIPAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes := currentSettings().ipAccess
+		if len(scopes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := clientIP(r)
+		// An address that does not parse matches no rule, so only allow lists stop it
+		ip, _ := netip.ParseAddr(client)
+		ip = ip.Unmap()
+		for _, s := range scopes {
+			if s.covers(r.URL.Path) && !s.rules.admits(ip) {
+				log.Printf("Rejected %s %s from %s by ip_access %s rules (request %s)", r.Method, r.URL.Path, client, s.name, requestID(r))
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "access from your address is not allowed"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
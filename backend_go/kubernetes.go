@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Kubernetes executor: each script runs as a batch/v1 Job whose pod logs are
+// streamed back through the API server. Talks to the API directly using the
+// in-cluster service account, or K8S_API_URL/K8S_TOKEN from outside a cluster.
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sJobSettings is the "kubernetes" block of a pipeline or stage config
+type k8sJobSettings struct {
+	Image          string            `json:"image"`
+	Namespace      string            `json:"namespace"`
+	WorkingDir     string            `json:"working_dir"`
+	GPUs           int               `json:"gpus"`
+	CPU            string            `json:"cpu"`
+	Memory         string            `json:"memory"`
+	NodeSelector   map[string]string `json:"node_selector"`
+	ServiceAccount string            `json:"service_account"`
+	PVCClaim       string            `json:"pvc_claim"`
+	PVCMountPath   string            `json:"pvc_mount_path"`
+	Env            map[string]string `json:"env"`
+	// ScheduleTimeout overrides K8S_SCHEDULE_TIMEOUT, e.g. "30m"
+	ScheduleTimeout string `json:"schedule_timeout"`
+}
+
+type kubernetesExecutor struct {
+	apiURL    string
+	token     string
+	namespace string
+	image     string
+	http      *http.Client
+	// scheduleTimeout is how long a pod may stay Pending, 0 for no limit
+	scheduleTimeout time.Duration
+}
+
+// newKubernetesExecutorFromEnv returns nil unless running in a cluster or K8S_API_URL is set
+func newKubernetesExecutorFromEnv() *kubernetesExecutor {
+	apiURL := os.Getenv("K8S_API_URL")
+	token := os.Getenv("K8S_TOKEN")
+	tlsConfig := &tls.Config{}
+
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); apiURL == "" && host != "" {
+		apiURL = "https://" + host + ":" + getEnv("KUBERNETES_SERVICE_PORT", "443")
+		if data, err := os.ReadFile(serviceAccountDir + "/token"); err == nil {
+			token = strings.TrimSpace(string(data))
+		}
+		if ca, err := os.ReadFile(serviceAccountDir + "/ca.crt"); err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(ca)
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if apiURL == "" {
+		return nil
+	}
+	if os.Getenv("K8S_INSECURE_SKIP_VERIFY") == "true" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	namespace := os.Getenv("K8S_NAMESPACE")
+	if namespace == "" {
+		if data, err := os.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	scheduleTimeout := envDuration("K8S_SCHEDULE_TIMEOUT", 10*time.Minute)
+	if strings.EqualFold(os.Getenv("K8S_SCHEDULE_TIMEOUT"), "off") {
+		scheduleTimeout = 0
+	}
+
+	log.Printf("Kubernetes executor enabled (%s, namespace %s)", apiURL, namespace)
+	return &kubernetesExecutor{
+		apiURL:          strings.TrimRight(apiURL, "/"),
+		token:           token,
+		namespace:       namespace,
+		image:           getEnv("K8S_JOB_IMAGE", "aikeymouse/training-module-python:latest"),
+		http:            &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		scheduleTimeout: scheduleTimeout,
+	}
+}
+
+func (k *kubernetesExecutor) Name() string { return "kubernetes" }
+
+func (k *kubernetesExecutor) Execute(ctx context.Context, s *ExecSession) error {
+	settings := k8sJobSettings{Image: k.image, Namespace: k.namespace, WorkingDir: "/app"}
+	if len(s.Target.Settings) > 0 {
+		if err := json.Unmarshal(s.Target.Settings, &settings); err != nil {
+			return fmt.Errorf("invalid kubernetes settings: %w", err)
+		}
+	}
+	scheduleTimeout := k.scheduleTimeout
+	if settings.ScheduleTimeout != "" {
+		d, err := time.ParseDuration(settings.ScheduleTimeout)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid kubernetes schedule_timeout %q", settings.ScheduleTimeout)
+		}
+		scheduleTimeout = d
+	}
+
+	runID := s.RunID
+	if runID == "" {
+		runID = newID()
+	}
+	jobName := "training-" + runID[:12]
+	job := k.jobManifest(jobName, runID, s.Request, settings, s.Env)
+
+	jobsPath := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", settings.Namespace)
+	var created struct {
+		Metadata struct {
+			UID string `json:"uid"`
+		} `json:"metadata"`
+	}
+	if err := k.doJSON(ctx, http.MethodPost, jobsPath, job, &created); err != nil {
+		return fmt.Errorf("creating job: %w", err)
+	}
+	finished := false
+	defer func() {
+		if !finished {
+			k.deleteJob(settings.Namespace, jobName)
+		}
+	}()
+
+	// Secrets reach the pod through a Secret object rather than the Job spec,
+	// and are removed once the run ends. The Job owns the Secret, so it goes
+	// with the Job should the backend not get to delete it; the pod waits
+	// for it to exist.
+	if len(s.Env) > 0 {
+		if err := k.createSecret(ctx, settings.Namespace, jobName, runID, created.Metadata.UID, s.Env); err != nil {
+			return fmt.Errorf("creating secret: %w", err)
+		}
+		defer k.deleteSecret(settings.Namespace, jobName)
+	}
+	s.SendText(fmt.Sprintf("Executing: python -u %s %s (Kubernetes Job %s/%s)", s.Request.ScriptPath, strings.Join(s.Request.Args, " "), settings.Namespace, jobName))
+
+	// Delete the job (and its pod) when the user cancels or disconnects
+	jobCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	cancelled := make(chan struct{})
+	go func() {
+		for msg := range s.Input {
+			if string(msg.Data) == "CANCEL" {
+				close(cancelled)
+				stop()
+				return
+			}
+		}
+		stop()
+	}()
+
+	// Until the pod is up, the run is connecting
+	s.SetUpstream(upstreamConnecting)
+	pod, err := k.waitForPod(jobCtx, settings.Namespace, jobName, scheduleTimeout)
+	if err != nil {
+		return k.interrupted(jobCtx, cancelled, err)
+	}
+	s.SetUpstream(upstreamConnected)
+	if err := k.streamLogs(jobCtx, settings.Namespace, pod, s); err != nil {
+		return k.interrupted(jobCtx, cancelled, err)
+	}
+
+	succeeded, err := k.waitForCompletion(jobCtx, settings.Namespace, jobName)
+	if err != nil {
+		return k.interrupted(jobCtx, cancelled, err)
+	}
+	finished = true
+	if !succeeded {
+		return s.SendText("EXECUTION_ERROR: Kubernetes Job " + jobName + " failed")
+	}
+	return s.SendText("EXECUTION_FINISHED")
+}
+
+// interrupted maps a context error caused by cancellation to a clean return
+func (k *kubernetesExecutor) interrupted(ctx context.Context, cancelled chan struct{}, err error) error {
+	select {
+	case <-cancelled:
+		return nil
+	default:
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (k *kubernetesExecutor) jobManifest(name, runID string, req ExecRequest, st k8sJobSettings, secretEnv map[string]string) map[string]interface{} {
+	resources := map[string]map[string]string{"limits": {}, "requests": {}}
+	if st.GPUs > 0 {
+		resources["limits"]["nvidia.com/gpu"] = fmt.Sprint(st.GPUs)
+	}
+	if st.CPU != "" {
+		resources["requests"]["cpu"] = st.CPU
+	}
+	if st.Memory != "" {
+		resources["requests"]["memory"] = st.Memory
+		resources["limits"]["memory"] = st.Memory
+	}
+
+	env := []map[string]interface{}{{"name": "PYTHONUNBUFFERED", "value": "1"}}
+	for k, v := range st.Env {
+		env = append(env, map[string]interface{}{"name": k, "value": v})
+	}
+	for k := range secretEnv {
+		env = append(env, map[string]interface{}{
+			"name":      k,
+			"valueFrom": map[string]interface{}{"secretKeyRef": map[string]string{"name": name, "key": k}},
+		})
+	}
+
+	container := map[string]interface{}{
+		"name":       "training",
+		"image":      st.Image,
+		"command":    append([]string{"python", "-u", req.ScriptPath}, req.Args...),
+		"workingDir": st.WorkingDir,
+		"env":        env,
+		"resources":  resources,
+	}
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers":    []interface{}{container},
+	}
+	if len(st.NodeSelector) > 0 {
+		podSpec["nodeSelector"] = st.NodeSelector
+	}
+	if st.ServiceAccount != "" {
+		podSpec["serviceAccountName"] = st.ServiceAccount
+	}
+	if st.PVCClaim != "" {
+		mountPath := st.PVCMountPath
+		if mountPath == "" {
+			mountPath = st.WorkingDir
+		}
+		podSpec["volumes"] = []interface{}{map[string]interface{}{
+			"name":                  "workspace",
+			"persistentVolumeClaim": map[string]string{"claimName": st.PVCClaim},
+		}}
+		container["volumeMounts"] = []interface{}{map[string]string{"name": "workspace", "mountPath": mountPath}}
+	}
+
+	labels := k8sRunLabels(runID)
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]interface{}{"name": name, "labels": labels},
+		"spec": map[string]interface{}{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 3600,
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec":     podSpec,
+			},
+		},
+	}
+}
+
+// k8sRunLabels marks the objects of a run
+func k8sRunLabels(runID string) map[string]string {
+	return map[string]string{"app.kubernetes.io/managed-by": "training-backend", "training/run-id": runID}
+}
+
+// waitForPod polls until the job's pod has started (or already finished).
+// A pod still Pending after timeout, e.g. unschedulable or unable to pull its
+// image, fails the run with the reason Kubernetes gives.
+func (k *kubernetesExecutor) waitForPod(ctx context.Context, namespace, jobName string, timeout time.Duration) (string, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", namespace, url.QueryEscape("job-name="+jobName))
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	reason := "no pod created"
+	for {
+		var pods struct {
+			Items []struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+				Status struct {
+					Phase      string `json:"phase"`
+					Conditions []struct {
+						Type    string `json:"type"`
+						Status  string `json:"status"`
+						Message string `json:"message"`
+					} `json:"conditions"`
+					ContainerStatuses []struct {
+						State struct {
+							Waiting *struct {
+								Reason  string `json:"reason"`
+								Message string `json:"message"`
+							} `json:"waiting"`
+						} `json:"state"`
+					} `json:"containerStatuses"`
+				} `json:"status"`
+			} `json:"items"`
+		}
+		if err := k.doJSON(ctx, http.MethodGet, path, nil, &pods); err != nil {
+			return "", err
+		}
+		for _, p := range pods.Items {
+			if p.Status.Phase != "Pending" && p.Status.Phase != "" {
+				return p.Metadata.Name, nil
+			}
+			reason = "pod " + p.Metadata.Name + " pending"
+			for _, c := range p.Status.Conditions {
+				if c.Type == "PodScheduled" && c.Status == "False" && c.Message != "" {
+					reason = "pod " + p.Metadata.Name + " not scheduled: " + c.Message
+				}
+			}
+			for _, c := range p.Status.ContainerStatuses {
+				if w := c.State.Waiting; w != nil && w.Reason != "" {
+					reason = "pod " + p.Metadata.Name + " waiting: " + strings.TrimSpace(w.Reason+" "+w.Message)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-deadline:
+			return "", fmt.Errorf("job %s did not start within %s (%s)", jobName, timeout, reason)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// streamLogs follows the pod log and forwards each line to the client
+func (k *kubernetesExecutor) streamLogs(ctx context.Context, namespace, pod string, s *ExecSession) error {
+	req, err := k.request(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?follow=true", namespace, pod), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("streaming logs: status %d", resp.StatusCode)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			if err := s.SendText(line); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// waitForCompletion polls the job status until it succeeded or failed
+func (k *kubernetesExecutor) waitForCompletion(ctx context.Context, namespace, jobName string) (bool, error) {
+	path := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", namespace, jobName)
+	for {
+		var job struct {
+			Status struct {
+				Succeeded int `json:"succeeded"`
+				Failed    int `json:"failed"`
+			} `json:"status"`
+		}
+		if err := k.doJSON(ctx, http.MethodGet, path, nil, &job); err != nil {
+			return false, err
+		}
+		if job.Status.Succeeded > 0 {
+			return true, nil
+		}
+		if job.Status.Failed > 0 {
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// deleteJob removes the job and its pods; uses a fresh context since the session may be gone
+func (k *kubernetesExecutor) deleteJob(namespace, jobName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	path := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", namespace, jobName)
+	body := map[string]string{"kind": "DeleteOptions", "apiVersion": "v1", "propagationPolicy": "Background"}
+	if err := k.doJSON(ctx, http.MethodDelete, path, body, nil); err != nil {
+		log.Printf("Error deleting Kubernetes Job %s: %v", jobName, err)
+		return
+	}
+	log.Printf("Deleted Kubernetes Job %s/%s", namespace, jobName)
+}
+
+// createSecret stores a run's secrets for the pod of its Job, named name
+// with UID jobUID, which owns the Secret
+func (k *kubernetesExecutor) createSecret(ctx context.Context, namespace, name, runID, jobUID string, env map[string]string) error {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets", namespace)
+	secret := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": k8sRunLabels(runID),
+			"ownerReferences": []interface{}{map[string]string{
+				"apiVersion": "batch/v1",
+				"kind":       "Job",
+				"name":       name,
+				"uid":        jobUID,
+			}},
+		},
+		"type":       "Opaque",
+		"stringData": env,
+	}
+	return k.doJSON(ctx, http.MethodPost, path, secret, nil)
+}
+
+// deleteSecret removes a run's Secret; uses a fresh context since the session may be gone
+func (k *kubernetesExecutor) deleteSecret(namespace, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, name)
+	if err := k.doJSON(ctx, http.MethodDelete, path, nil, nil); err != nil {
+		log.Printf("Error deleting Kubernetes Secret %s: %v", name, err)
+	}
+}
+
+func (k *kubernetesExecutor) request(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.apiURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	return req, nil
+}
+
+func (k *kubernetesExecutor) doJSON(ctx context.Context, method, path string, body, out interface{}) error {
+	req, err := k.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
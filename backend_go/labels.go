@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Key/value labels on runs, models and datasets, kept in DATA_DIR/labels.json
+// and managed under /api/labels/{kind}/{id}. Keys and values follow the
+// Kubernetes label syntax, and so do the selectors that filter lists:
+// GET /api/labels/{kind}?selector=, /api/models?label_selector=,
+// /api/search?label_selector= and MLflow runs/search with "label_selector".
+//
+//	team=vision,env!=dev,stage in (staging,prod),!archived
+
+// Objects that can carry labels
+const (
+	labelKindRun     = "run"
+	labelKindModel   = "model"
+	labelKindDataset = "dataset"
+)
+
+var (
+	labelNamePattern   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?$`)
+)
+
+var errInvalidLabel = errors.New("invalid label")
+
+// validateLabel checks a key ("name" or "prefix/name") and value like Kubernetes does
+func validateLabel(key, value string) error {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if !labelPrefixPattern.MatchString(prefix) {
+			return fmt.Errorf("%w: key %q: the prefix must be a DNS subdomain", errInvalidLabel, key)
+		}
+		name = rest
+	}
+	if !labelNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: key %q: names are 1-63 letters, digits, '-', '_' or '.', starting and ending with a letter or digit", errInvalidLabel, key)
+	}
+	if value != "" && !labelNamePattern.MatchString(value) {
+		return fmt.Errorf("%w: value %q: values are empty or 1-63 letters, digits, '-', '_' or '.', starting and ending with a letter or digit", errInvalidLabel, value)
+	}
+	return nil
+}
+
+// validateLabelChange rejects setting or removing a label that only the
+// backend writes: a model's stage changes through approved promotions alone
+func validateLabelChange(kind, key string) error {
+	if kind == labelKindModel && key == stageLabel {
+		return fmt.Errorf("%w: key %q is reserved, request a promotion to change it", errInvalidLabel, key)
+	}
+	return nil
+}
+
+// LabelStore holds the labels of every object by kind and id
+type LabelStore struct {
+	mu     sync.RWMutex
+	path   string
+	labels map[string]map[string]map[string]string
+}
+
+// labels is opened in serve next to the run store
+var labels *LabelStore
+
+// NewLabelStore opens (or creates) the label store in dir
+func NewLabelStore(dir string) (*LabelStore, error) {
+	s := &LabelStore{path: filepath.Join(dir, "labels.json"), labels: map[string]map[string]map[string]string{}}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.labels); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+	}
+	return s, nil
+}
+
+// save writes the store to disk; callers must hold s.mu
+func (s *LabelStore) save() error {
+	data, err := json.MarshalIndent(s.labels, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Get returns a copy of an object's labels, empty when it has none
+func (s *LabelStore) Get(kind, id string) map[string]string {
+	if s == nil {
+		return map[string]string{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := cloneStringMap(s.labels[kind][id])
+	if out == nil {
+		out = map[string]string{}
+	}
+	return out
+}
+
+// All returns the labels of every labelled object of a kind
+func (s *LabelStore) All(kind string) map[string]map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]map[string]string, len(s.labels[kind]))
+	for id, set := range s.labels[kind] {
+		out[id] = cloneStringMap(set)
+	}
+	return out
+}
+
+// Update sets the labels with a value and removes those set to nil, then
+// returns the object's labels; reserved labels are refused
+func (s *LabelStore) Update(kind, id string, changes map[string]*string) (map[string]string, error) {
+	for key := range changes {
+		if err := validateLabelChange(kind, key); err != nil {
+			return nil, err
+		}
+	}
+	return s.apply(kind, id, changes)
+}
+
+// apply is Update without the reserved label check, for promotions
+func (s *LabelStore) apply(kind, id string, changes map[string]*string) (map[string]string, error) {
+	for key, value := range changes {
+		if value == nil {
+			continue
+		}
+		if err := validateLabel(key, *value); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set := s.labels[kind][id]
+	if set == nil {
+		set = map[string]string{}
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(set, key)
+		} else {
+			set[key] = *value
+		}
+	}
+	s.put(kind, id, set)
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return cloneStringMap(set), nil
+}
+
+// Remove drops all labels of an object, e.g. a deleted run; a nil store has none
+func (s *LabelStore) Remove(kind, id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.labels[kind][id]; !ok {
+		return
+	}
+	s.put(kind, id, nil)
+	if err := s.save(); err != nil {
+		log.Printf("Error saving labels: %v", err)
+	}
+}
+
+// put stores or, when empty, deletes a label set; callers must hold s.mu
+func (s *LabelStore) put(kind, id string, set map[string]string) {
+	if len(set) == 0 {
+		delete(s.labels[kind], id)
+		if len(s.labels[kind]) == 0 {
+			delete(s.labels, kind)
+		}
+		return
+	}
+	if s.labels[kind] == nil {
+		s.labels[kind] = map[string]map[string]string{}
+	}
+	s.labels[kind][id] = set
+}
+
+// labelRequirement is one comma separated term of a selector
+type labelRequirement struct {
+	key    string
+	op     string // "=", "!=", "in", "notin", "exists" or "!"
+	values []string
+}
+
+// labelSelector matches a label set when all its requirements do; the empty
+// selector matches everything
+type labelSelector []labelRequirement
+
+// parseLabelSelector reads the Kubernetes selector syntax: key=value,
+// key==value, key!=value, key in (a,b), key notin (a,b), key and !key
+func parseLabelSelector(raw string) (labelSelector, error) {
+	var sel labelSelector
+	for _, term := range splitSelector(raw) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		req, err := parseLabelRequirement(term)
+		if err != nil {
+			return nil, fmt.Errorf("label selector %q: %w", term, err)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// splitSelector splits on the commas outside of parentheses
+func splitSelector(raw string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range raw {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, raw[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, raw[start:])
+}
+
+func parseLabelRequirement(term string) (labelRequirement, error) {
+	if key, ok := strings.CutPrefix(term, "!"); ok {
+		key = strings.TrimSpace(key)
+		return labelRequirement{key: key, op: "!"}, validateLabel(key, "")
+	}
+	for _, op := range []string{"!=", "==", "="} {
+		if key, value, ok := strings.Cut(term, op); ok {
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if op == "==" {
+				op = "="
+			}
+			return labelRequirement{key: key, op: op, values: []string{value}}, validateLabel(key, value)
+		}
+	}
+	if open := strings.Index(term, "("); open >= 0 {
+		if !strings.HasSuffix(term, ")") {
+			return labelRequirement{}, errors.New("missing )")
+		}
+		fields := strings.Fields(term[:open])
+		if len(fields) != 2 || (fields[1] != "in" && fields[1] != "notin") {
+			return labelRequirement{}, errors.New(`expected "key in (...)" or "key notin (...)"`)
+		}
+		req := labelRequirement{key: fields[0], op: fields[1]}
+		for _, value := range strings.Split(term[open+1:len(term)-1], ",") {
+			value = strings.TrimSpace(value)
+			if err := validateLabel(req.key, value); err != nil {
+				return req, err
+			}
+			req.values = append(req.values, value)
+		}
+		return req, nil
+	}
+	return labelRequirement{key: term, op: "exists"}, validateLabel(term, "")
+}
+
+// Matches reports whether a label set satisfies the selector. As in
+// Kubernetes, != and notin also match objects without the key.
+func (sel labelSelector) Matches(set map[string]string) bool {
+	for _, req := range sel {
+		value, ok := set[req.key]
+		var match bool
+		switch req.op {
+		case "=":
+			match = ok && value == req.values[0]
+		case "!=":
+			match = !ok || value != req.values[0]
+		case "in":
+			match = ok && slices.Contains(req.values, value)
+		case "notin":
+			match = !ok || !slices.Contains(req.values, value)
+		case "exists":
+			match = ok
+		case "!":
+			match = !ok
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// labelTargetExists reports whether an object of kind can be labelled
+func labelTargetExists(kind, id string) bool {
+	switch kind {
+	case labelKindRun:
+		_, ok := store.Get(id)
+		return ok
+	case labelKindModel:
+		_, err := loadModel(id)
+		return err == nil
+	case labelKindDataset:
+		return slices.Contains(datasetNames, id)
+	}
+	return false
+}
+
+// labelIDs lists the objects of a kind that exist, labelled or not
+func labelIDs(kind string) []string {
+	var ids []string
+	switch kind {
+	case labelKindRun:
+		for _, run := range store.List() {
+			ids = append(ids, run.ID)
+		}
+	case labelKindModel:
+		models, _ := listModels()
+		for _, m := range models {
+			ids = append(ids, m.ID)
+		}
+	case labelKindDataset:
+		ids = append(ids, datasetNames...)
+	}
+	return ids
+}
+
+// labelledObject is an entry of GET /api/labels/{kind}
+type labelledObject struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+}
+
+// handleLabels serves /api/labels/{kind}[/{id}]
+func handleLabels(w http.ResponseWriter, r *http.Request) {
+	kind, id, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/labels"), "/"), "/")
+	if kind != labelKindRun && kind != labelKindModel && kind != labelKindDataset {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "labels exist for run, model and dataset"})
+		return
+	}
+	if id == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sel, err := parseLabelSelector(r.URL.Query().Get("selector"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		all := labels.All(kind)
+		objects := []labelledObject{}
+		for _, id := range labelIDs(kind) {
+			set := all[id]
+			if set == nil {
+				set = map[string]string{}
+			}
+			if sel.Matches(set) {
+				objects = append(objects, labelledObject{ID: id, Labels: set})
+			}
+		}
+		sort.Slice(objects, func(i, j int) bool { return objects[i].ID < objects[j].ID })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": kind, "items": objects})
+		return
+	}
+	id, key, _ := strings.Cut(id, "/")
+	if !labelTargetExists(kind, id) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": kind + " not found"})
+		return
+	}
+
+	var changes map[string]*string
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		writeJSON(w, http.StatusOK, labelledObject{ID: id, Labels: labels.Get(kind, id)})
+		return
+	case r.Method == http.MethodPatch && key == "":
+		var body struct {
+			Labels map[string]*string `json:"labels"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Labels == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"labels": {"key": "value", "removed": null}}`})
+			return
+		}
+		changes = body.Labels
+	case r.Method == http.MethodDelete && key != "":
+		changes = map[string]*string{key: nil}
+	default:
+		if key == "" {
+			w.Header().Set("Allow", "GET, PATCH")
+		} else {
+			w.Header().Set("Allow", "DELETE")
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	set, err := labels.Update(kind, id, changes)
+	if err != nil {
+		if errors.Is(err, errInvalidLabel) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("Error saving labels: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "could not save labels"})
+		return
+	}
+	if kind == labelKindModel {
+		responses.Invalidate("/api/models")
+	}
+	log.Printf("Labels of %s %s changed by %s (request %s)", kind, id, secretActor(r), requestID(r))
+	writeJSON(w, http.StatusOK, labelledObject{ID: id, Labels: set})
+}
+
+// handleModelList filters the Python service's model list by label_selector
+func handleModelList(proxy http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("label_selector")
+		if raw == "" || r.Method != http.MethodGet {
+			proxy(w, r)
+			return
+		}
+		sel, err := parseLabelSelector(raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		upstream := r.Clone(r.Context())
+		query := upstream.URL.Query()
+		query.Del("label_selector")
+		upstream.URL.RawQuery = query.Encode()
+		upstream.RequestURI = upstream.URL.RequestURI()
+		// The list is small JSON; identity encoding keeps it readable here
+		upstream.Header.Del("Accept-Encoding")
+		rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+		proxy(rec, upstream)
+
+		var models []map[string]interface{}
+		if rec.status != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &models) != nil {
+			for k, v := range rec.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+		all := labels.All(labelKindModel)
+		filtered := []map[string]interface{}{}
+		for _, m := range models {
+			name, _ := m["path"].(string)
+			if sel.Matches(all[strings.TrimSuffix(name, ".pt")]) {
+				filtered = append(filtered, m)
+			}
+		}
+		writeJSON(w, http.StatusOK, filtered)
+	}
+}
+
+// bufferedResponse holds a proxied response so it can be rewritten
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
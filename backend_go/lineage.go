@@ -0,0 +1,247 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Model lineage: what produced each model. A finished run is linked to the
+// model it wrote through its model_id tag, set when it ends to the newest
+// model written while it ran that no other run claims. Scripts can set the
+// tag themselves over the MLflow API to link exactly. The run's dataset,
+// pipeline and code versions and the checkpoint it started from, itself a
+// model with a lineage of its own when it is in the models directory, make
+// up the graph at GET /api/model/{id}/lineage.
+
+// lineageMaxDepth bounds how many parent checkpoints are followed
+const lineageMaxDepth = 10
+
+// Lineage node types
+const (
+	lineageModel      = "model"
+	lineageRun        = "run"
+	lineageDataset    = "dataset"
+	lineagePipeline   = "pipeline"
+	lineageCode       = "code"
+	lineageCheckpoint = "checkpoint"
+)
+
+type lineageNode struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Label      string            `json:"label"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// lineageEdge points from an input to what was made from it
+type lineageEdge struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Relation string `json:"relation"`
+}
+
+type lineageGraph struct {
+	Model string        `json:"model"`
+	Nodes []lineageNode `json:"nodes"`
+	Edges []lineageEdge `json:"edges"`
+
+	seen map[string]bool
+	runs []*Run
+}
+
+func init() {
+	modelActions["lineage"] = modelAction{[]string{http.MethodGet}, handleModelLineage}
+}
+
+// linkRunModel tags a finished run with the model it wrote, if any
+func linkRunModel(runID string) {
+	run, ok := store.Get(runID)
+	if !ok || run.Tags["model_id"] != "" || run.EndTime == nil {
+		return
+	}
+	models, err := listModels()
+	if err != nil {
+		return
+	}
+	claimed := map[string]bool{}
+	for _, other := range store.List() {
+		if id := other.Tags["model_id"]; id != "" {
+			claimed[id] = true
+		}
+	}
+	var newest *Model
+	for _, m := range models {
+		if claimed[m.ID] || m.ModifiedAt.Before(run.StartTime) || m.ModifiedAt.After(*run.EndTime) {
+			continue
+		}
+		if newest == nil || m.ModifiedAt.After(newest.ModifiedAt) {
+			newest = m
+		}
+	}
+	if newest == nil {
+		return
+	}
+	store.Update(runID, func(r *Run) {
+		setMapValue(&r.Tags, "model_id", newest.ID)
+	})
+	log.Printf("Run %s produced model %s", runID, newest.ID)
+}
+
+// producingRun returns the latest of runs that produced a model
+func producingRun(runs []*Run, modelID string) *Run {
+	var found *Run
+	for _, run := range runs {
+		if run.Tags["model_id"] == modelID && (found == nil || run.StartTime.After(found.StartTime)) {
+			found = run
+		}
+	}
+	return found
+}
+
+// runCheckpoint is the --model argument a training run started from
+func runCheckpoint(run *Run) string {
+	for i, arg := range run.Args {
+		if value, ok := strings.CutPrefix(arg, "--model="); ok {
+			return value
+		}
+		if arg == "--model" && i+1 < len(run.Args) {
+			return run.Args[i+1]
+		}
+	}
+	return ""
+}
+
+func (g *lineageGraph) node(n lineageNode) string {
+	if !g.seen[n.ID] {
+		g.seen[n.ID] = true
+		g.Nodes = append(g.Nodes, n)
+	}
+	return n.ID
+}
+
+func (g *lineageGraph) edge(source, target, relation string) {
+	g.Edges = append(g.Edges, lineageEdge{Source: source, Target: target, Relation: relation})
+}
+
+// versioned names a node by name and, when known, version
+func versioned(kind, name, version string) string {
+	if version == "" {
+		return kind + ":" + name
+	}
+	return kind + ":" + name + "@" + version
+}
+
+// addModel adds a model, the run that produced it and that run's inputs,
+// then follows its parent checkpoint
+func (g *lineageGraph) addModel(model *Model, depth int) string {
+	id := "model:" + model.ID
+	if g.seen[id] {
+		return id
+	}
+	attrs := map[string]string{"modified_at": model.ModifiedAt.UTC().Format(time.RFC3339)}
+	if stage := labels.Get(labelKindModel, model.ID)[stageLabel]; stage != "" {
+		attrs["stage"] = stage
+	}
+	for name, v := range model.Metrics {
+		attrs[name] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	g.node(lineageNode{ID: id, Type: lineageModel, Label: model.ID, Attributes: attrs})
+
+	checkpoint := model.Config["Base Model"]
+	consumer := id
+	if run := producingRun(g.runs, model.ID); run != nil {
+		consumer = g.addRun(run)
+		g.edge(consumer, id, "produced")
+		if c := runCheckpoint(run); c != "" {
+			checkpoint = c
+		}
+	}
+	if checkpoint == "" {
+		return id
+	}
+	parentID := strings.TrimSuffix(filepath.Base(checkpoint), ".pt")
+	if parent, err := loadModel(parentID); err == nil && parent.ID != model.ID && depth < lineageMaxDepth {
+		g.edge(g.addModel(parent, depth+1), consumer, "parent_checkpoint")
+	} else {
+		g.edge(g.node(lineageNode{ID: "checkpoint:" + checkpoint, Type: lineageCheckpoint, Label: checkpoint}), consumer, "parent_checkpoint")
+	}
+	return id
+}
+
+// addRun adds a run and its dataset, pipeline and code
+func (g *lineageGraph) addRun(run *Run) string {
+	attrs := map[string]string{"status": run.Status, "started_at": run.StartTime.UTC().Format(time.RFC3339)}
+	if run.EndTime != nil {
+		attrs["ended_at"] = run.EndTime.UTC().Format(time.RFC3339)
+	}
+	for _, key := range []string{"stage", "workspace", "dataset_size"} {
+		if v := run.Params[key]; v != "" {
+			attrs[key] = v
+		}
+	}
+	if user := run.Tags["mlflow.user"]; user != "" {
+		attrs["user"] = user
+	}
+	id := g.node(lineageNode{ID: "run:" + run.ID, Type: lineageRun, Label: run.Name, Attributes: attrs})
+
+	p := run.Params
+	if name := p["dataset"]; name != "" {
+		g.edge(g.node(lineageNode{
+			ID: versioned(lineageDataset, name, p["dataset_version"]), Type: lineageDataset, Label: name,
+			Attributes: optionalAttrs("version", p["dataset_version"], "images", p["dataset_size"]),
+		}), id, "trained_on")
+	}
+	pipeline := p["pipeline"]
+	if pipeline == "" {
+		pipeline = p["stage"]
+	}
+	if pipeline != "" || p["pipeline_version"] != "" {
+		if pipeline == "" {
+			pipeline = "pipeline"
+		}
+		g.edge(g.node(lineageNode{
+			ID: versioned(lineagePipeline, pipeline, p["pipeline_version"]), Type: lineagePipeline, Label: pipeline,
+			Attributes: optionalAttrs("version", p["pipeline_version"], "stage", p["stage"]),
+		}), id, "configured_by")
+	}
+	if run.Script != "" {
+		g.edge(g.node(lineageNode{
+			ID: versioned(lineageCode, run.Script, p["code_version"]), Type: lineageCode, Label: run.Script,
+			Attributes: optionalAttrs("version", p["code_version"], "args", p["args"]),
+		}), id, "executed")
+	}
+	return id
+}
+
+// optionalAttrs builds attributes from key, value pairs, leaving out empty values
+func optionalAttrs(pairs ...string) map[string]string {
+	attrs := map[string]string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			attrs[pairs[i]] = pairs[i+1]
+		}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	return attrs
+}
+
+// handleModelLineage returns the lineage graph of a model
+func handleModelLineage(w http.ResponseWriter, r *http.Request, modelID string) {
+	model, err := loadModel(modelID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	g := &lineageGraph{Model: model.ID, Nodes: []lineageNode{}, Edges: []lineageEdge{}, seen: map[string]bool{}}
+	if store != nil {
+		g.runs = store.List()
+	}
+	g.addModel(model, 0)
+	writeJSON(w, http.StatusOK, g)
+}
@@ -1,193 +1,910 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins
-	},
+	// All origins unless the config sets allowed_origins
+	CheckOrigin:       checkOrigin,
+	WriteBufferPool:   wsWriteBufferPool,
+	EnableCompression: wsCompression,
 }
 
-// Forward requests to the Python training service
-func newProxy(targetHost string) (*httputil.ReverseProxy, error) {
-	url, err := url.Parse(targetHost)
-	if err != nil {
-		return nil, err
+// Run store shared by the execution proxy and the tracking APIs
+var store *RunStore
+
+// getEnv returns the environment variable or fallback when unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envInt reads an integer environment variable
+func envInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return n
 	}
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	return proxy, nil
+	return fallback
 }
 
-func handleProxy(proxy *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Proxying request: %s", r.URL.Path)
-		proxy.ServeHTTP(w, r)
+// writeJSON encodes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
 	}
 }
 
-// WebSocket handler to proxy script execution to Python service
+// WebSocket handler that runs a script on the selected executor (the Python
+// service by default) and streams its output back to the client. Clients
+// speaking envelopes may run several scripts over one connection.
 func handleScriptExecution(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	x := &execClient{r: r, reqID: requestID(r), forward: upstreamHeaders(r)}
+	x.forward.Set(requestIDHeader, x.reqID)
+	if id := identityFrom(r); id != nil {
+		id.setHeaders(x.forward)
+		x.user = id.User()
+	}
+	useEnvelope, err := wsEnvelopeFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	header := http.Header{requestIDHeader: {x.reqID}}
+	if proto := wsTokenProtocol(r); proto != "" {
+		// Browsers drop the connection unless the offered protocol is selected
+		header.Set("Sec-WebSocket-Protocol", proto)
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Println("Upgrade error:", err)
 		return
 	}
 	defer conn.Close()
-
-	pythonServiceURL := os.Getenv("PYTHON_SERVICE_URL")
-	if pythonServiceURL == "" {
-		pythonServiceURL = "http://localhost:3001"
+	conn.SetReadLimit(wsQueue.maxBinary)
+	tapes.open(conn, wsTapeHeader{RequestID: x.reqID, User: x.user, RemoteAddr: clientIP(r), Envelope: useEnvelope, StartedAt: time.Now().UTC()})
+	defer tapes.close(conn)
+	x.conn = conn
+	if useEnvelope {
+		x.serveEnvelopes()
+		return
 	}
 
-	// Convert HTTP URL to WebSocket URL
-	wsURL := strings.Replace(pythonServiceURL, "http://", "ws://", 1) + "/api/script/ws/execute"
-
-	// Connect to Python service WebSocket
-	pythonConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	// The first message describes the script to run
+	messageType, first, err := conn.ReadMessage()
 	if err != nil {
-		log.Println("Error connecting to Python WebSocket:", err)
-		conn.WriteMessage(websocket.TextMessage, []byte("Error connecting to Python service"))
+		log.Println("Error reading execution request:", err)
+		tapeOf(conn).end(err)
 		return
 	}
-	defer pythonConn.Close()
+	tapeOf(conn).message("in", messageType, first)
 
-	// Proxy messages between client and Python service
+	// Further client messages (e.g. CANCEL) go to the session; leaving ends it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	input := make(chan wsMessage, 16)
 	go func() {
+		defer cancel()
 		for {
 			messageType, message, err := conn.ReadMessage()
 			if err != nil {
 				log.Println("Error reading from client:", err)
-				break
+				tapeOf(conn).end(err)
+				return
 			}
-			if err := pythonConn.WriteMessage(messageType, message); err != nil {
-				log.Println("Error writing to Python service:", err)
-				break
+			tapeOf(conn).message("in", messageType, message)
+			select {
+			case input <- wsMessage{Type: messageType, Data: message}:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
+	x.runExecution(ctx, nil, first, input, func() { conn.Close() })
+}
+
+// execClient is the client end of an execution WebSocket
+type execClient struct {
+	r     *http.Request
+	conn  *websocket.Conn
+	reqID string
+	// forward goes on connections to the Python service
+	forward http.Header
+	user    string
+}
+
+// runExecution runs the script of an execution request and streams its
+// output to the client through envelope, nil for free-form clients, until it
+// ends or ctx is done. input carries the client's further messages;
+// disconnect drops the client when the session is killed.
+func (x *execClient) runExecution(ctx context.Context, envelope *wsEnveloper, first []byte, input <-chan wsMessage, disconnect func()) {
+	r, conn, reqID, forward, user := x.r, x.conn, x.reqID, x.forward, x.user
+	var req ExecRequest
+	if err := json.Unmarshal(first, &req); err != nil || req.ScriptPath == "" {
+		envelope.writeText(conn, "EXECUTION_ERROR: No script path provided")
+		return
+	}
+	// Clients show this with any error so a failed run can be traced in the logs
+	envelope.writeText(conn, "REQUEST_ID: "+reqID)
+
+	if draining.Load() {
+		envelope.writeText(conn, "EXECUTION_ERROR: Server is draining and not accepting new runs")
+		return
+	}
+
+	target := resolveExecTarget(req)
+	executor, ok := executors[target.Executor]
+	if !ok {
+		envelope.writeText(conn, "EXECUTION_ERROR: Unknown executor "+target.Executor)
+		return
+	}
+	priority, err := parsePriority(target.Priority)
+	if err != nil {
+		envelope.writeText(conn, "EXECUTION_ERROR: "+err.Error())
+		return
+	}
+	limit, err := scheduler.maxRunDuration(target.MaxDuration)
+	if err != nil {
+		envelope.writeText(conn, "EXECUTION_ERROR: "+err.Error())
+		return
+	}
+	retry, err := parseRetryPolicy(target.Retry)
+	if err != nil {
+		envelope.writeText(conn, "EXECUTION_ERROR: "+err.Error())
+		return
+	}
+
+	env, err := resolveSecretEnv(ctx, target.Secrets, req.ScriptPath)
+	if err != nil {
+		log.Printf("Cannot run %s (request %s): %v", req.ScriptPath, reqID, err)
+		envelope.writeText(conn, "EXECUTION_ERROR: "+err.Error())
+		return
+	}
+
+	tracker := &runTracker{}
+	tracker.start(req, target, reqID, user)
+	defer tracker.close()
+	envelope.setRun(tracker.runID)
+	runLog := runLogs.open(tracker.runID)
+	defer runLog.Close()
+
+	// The client leaving ends the run, unless it is being retried: retries
+	// go on without a client, streaming to the run log and followers only
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	var retrying, detached atomic.Bool
+	go func() {
+		select {
+		case <-ctx.Done():
+			if retrying.Load() {
+				detached.Store(true)
+				log.Printf("Client of run %s left, its retries go on (request %s)", tracker.runID, reqID)
+				return
+			}
+			cancelRun()
+		case <-runCtx.Done():
+		}
+	}()
+
+	// Further client messages (e.g. CANCEL), relayed to the executor until
+	// the run ends
+	relayed := make(chan wsMessage, 16)
+	go func() {
+		defer close(relayed)
+		for {
+			select {
+			case msg := <-input:
+				tracker.clientMessage(msg.Data)
+				select {
+				case relayed <- msg:
+				case <-runCtx.Done():
+					return
+				}
+			case <-runCtx.Done():
+				return
+			}
+		}
+	}()
+
+	// Output goes through a bounded queue so a slow client neither stalls the
+	// executor nor piles up frames
+	outbox := newWSOutbox(conn, wsQueue, envelope)
+	defer func() {
+		outbox.close()
+		if st := outbox.stats(); st.Dropped > 0 || st.Coalesced > 0 {
+			log.Printf("Client of %s fell behind: %d log lines dropped, %d coalesced (request %s)", req.ScriptPath, st.Dropped, st.Coalesced, reqID)
+		}
+	}()
+
+	// Status reports tell the client the run is alive while the script is quiet
+	status := newSessionStatus()
+	statusDone := make(chan struct{})
+	defer close(statusDone)
+	go reportStatus(status, outbox, statusDone)
+
+	// Once the client of a retrying run has left, sending to it fails; the
+	// executor carries on regardless
+	sent := func(err error) error {
+		if err != nil && detached.Load() {
+			return nil
+		}
+		return err
+	}
 
+	// While a failing script would be retried, its EXECUTION_ERROR is held
+	// back from the client, which would take it as the end
+	var holdError bool
+	var heldError []byte
+	output := func(messageType int, data []byte) error {
+		if skip, err := injectFrameFault(conn, req.ScriptPath); skip {
+			return err
+		}
+		status.seen(messageType, data)
+		if messageType == websocket.BinaryMessage {
+			// Binary frames, such as sample images, are not log lines
+			return sent(outbox.push(messageType, data))
+		}
+		tracker.serviceMessage(data)
+		runLog.WriteFrame(data)
+		if holdError && bytes.HasPrefix(data, []byte("EXECUTION_ERROR:")) {
+			heldError = bytes.Clone(data)
+			return nil
+		}
+		if bytes.HasPrefix(data, []byte("EXECUTION_FINISHED")) || bytes.HasPrefix(data, []byte("EXECUTION_ERROR:")) {
+			status.end()
+		}
+		return sent(outbox.push(messageType, data))
+	}
+	stream := func(messageType int, r io.Reader) error {
+		if skip, err := injectFrameFault(conn, req.ScriptPath); skip {
+			return err
+		}
+		status.seen(messageType, nil)
+		err := outbox.stream(messageType, io.TeeReader(r, runLog))
+		if err != nil && detached.Load() {
+			_, err = io.Copy(runLog, r)
+		}
+		runLog.EndFrame()
+		return err
+	}
+	faults.sessionStart()
+
+	// Listed in the admin API, which can kill it
+	live := &liveSession{
+		ID:        tracker.runID,
+		RunID:     tracker.runID,
+		RequestID: reqID,
+		Script:    req.ScriptPath,
+		Executor:  executor.Name(),
+		Workspace: target.Workspace,
+		Priority:  priorityNames[priority],
+		User:      user,
+		Remote:    clientIP(r),
+		StartedAt: time.Now(),
+		outbox:    outbox,
+		status:    status,
+		kill: func(reason string) {
+			message := "EXECUTION_ERROR: " + reason
+			tracker.serviceMessage([]byte(message))
+			runLog.WriteFrame([]byte(message))
+			outbox.abort(message)
+			cancelRun()
+			disconnect()
+		},
+	}
+	if limit > 0 {
+		live.MaxDuration = limit.String()
+	}
+	liveSessions.add(live)
+	defer liveSessions.remove(live)
+
+	audit.RecordRequest(r, AuditExecute, req.ScriptPath, 0, map[string]string{
+		"run_id":   tracker.runID,
+		"executor": executor.Name(),
+	})
+	if user != "" {
+		log.Printf("Executing %s on %s executor for %s (request %s)", req.ScriptPath, executor.Name(), user, reqID)
+	} else {
+		log.Printf("Executing %s on %s executor (request %s)", req.ScriptPath, executor.Name(), reqID)
+	}
+
+	// Runs count against the limits of their pipeline and workspace
+	pipeline, workspace := target.Pipeline, target.Workspace
+
+	// Each attempt waits for a slot; a preempted run goes back to the queue
+	// and a failed one may be retried as a new run after backoff. ran is the
+	// running time of the current run so far, for the maximum duration.
+	raw, args := first, req.Args
+	var ran, backoff time.Duration
+	preemptions, retried := 0, 0
 	for {
-		messageType, message, err := pythonConn.ReadMessage()
+		job := scheduler.newJob(tracker.runID, req.ScriptPath, pipeline, workspace, priority)
+		if backoff > 0 {
+			status.setState(sessionRetrying)
+			if !waitForRetry(runCtx, relayed, job, backoff) {
+				log.Printf("Retry of %s cancelled during its backoff (request %s)", req.ScriptPath, reqID)
+				return
+			}
+			backoff = 0
+		}
+		status.setState(sessionQueued)
+		queued := false
+		err := scheduler.acquire(runCtx, job, func(position, total int, reason string) {
+			if !queued {
+				queued = true
+				tracker.setStatus(RunQueued)
+			}
+			output(websocket.TextMessage, []byte(fmt.Sprintf("EXECUTION_QUEUED: position %d of %d (priority %s), %s", position, total, job.Priority, reason)))
+			if eta := estimateRun(tracker.runID, time.Now()); eta != nil {
+				output(websocket.TextMessage, []byte(eta.message()))
+			}
+		})
 		if err != nil {
-			log.Println("Error reading from Python service:", err)
-			break
+			log.Printf("%s left the queue before it started (request %s)", req.ScriptPath, reqID)
+			return
+		}
+		if queued || preemptions+retried > 0 {
+			tracker.setStatus(RunRunning)
 		}
-		if err := conn.WriteMessage(messageType, message); err != nil {
-			log.Println("Error writing to client:", err)
-			break
+		status.setState(sessionRunning)
+		if eta := estimateRun(tracker.runID, time.Now()); eta != nil {
+			output(websocket.TextMessage, []byte(eta.message()))
+		}
+
+		attemptCtx, cancelAttempt := context.WithCancel(runCtx)
+		expired := make(chan struct{})
+		stopDeadline := func() {}
+		if limit > 0 {
+			stopDeadline = scheduler.watchDeadline(limit-ran, func() bool {
+				if !tracker.timedOut(limit) {
+					return false
+				}
+				log.Printf("Run %s of %s exceeded its maximum duration of %s, cancelling (request %s)", tracker.runID, req.ScriptPath, limit, reqID)
+				audit.RecordRequest(r, AuditTimeout, req.ScriptPath, 0, map[string]string{
+					"run_id":       tracker.runID,
+					"max_duration": limit.String(),
+				})
+				close(expired)
+				return true
+			}, cancelAttempt)
+		}
+
+		started := time.Now()
+		done := make(chan struct{})
+		session := &ExecSession{
+			RunID:     tracker.runID,
+			RequestID: reqID,
+			Header:    forward,
+			Request:   req,
+			Target:    target,
+			Raw:       raw,
+			Input:     attemptInput(relayed, job.preempt, expired, done),
+			Env:       env,
+			redactor:  secretRedactor(env),
+			output:    output,
+			stream:    stream,
+			status:    status,
+		}
+		holdError, heldError = retry.any && retried < retry.max, nil
+		err = executor.Execute(attemptCtx, session)
+		close(done)
+		stopDeadline()
+		cancelAttempt()
+		scheduler.release(job)
+		ran += time.Since(started)
+
+		select {
+		case <-expired:
+			session.SendText(fmt.Sprintf("EXECUTION_ERROR: Run exceeded its maximum duration of %s and was cancelled", limit))
+			return
+		default:
+		}
+
+		select {
+		case <-job.preempt:
+			if runCtx.Err() == nil && !tracker.terminal() {
+				log.Printf("Run %s of %s preempted, requeued (request %s)", tracker.runID, req.ScriptPath, reqID)
+				session.SendText("EXECUTION_PREEMPTED: stopped for a higher priority run, it will resume when a slot is free")
+				preemptions++
+				tracker.preempted(preemptions)
+				if preemptions == 1 && len(target.ResumeArgs) > 0 {
+					req.Args = append(slices.Clip(req.Args), target.ResumeArgs...)
+					if raw, err = resumeRequest(first, req.Args); err != nil {
+						session.SendText("EXECUTION_ERROR: " + err.Error())
+						return
+					}
+				}
+				continue
+			}
+		default:
+		}
+
+		// Script errors count only when held back; otherwise a failure is the
+		// executor giving up on the script or losing it
+		failure := ""
+		switch {
+		case heldError != nil:
+			failure = strings.TrimSpace(strings.TrimPrefix(string(heldError), "EXECUTION_ERROR:"))
+		case tracker.terminal():
+		case err != nil:
+			failure = err.Error()
+		case runCtx.Err() == nil:
+			failure = "connection closed before the script finished"
+		}
+		if failure != "" && retried < retry.max && runCtx.Err() == nil && !tracker.cancelRequested() {
+			retrying.Store(true)
+			retried++
+			backoff = retry.delay(retried)
+			log.Printf("Run %s of %s failed, retry %d of %d in %s (request %s): %s", tracker.runID, req.ScriptPath, retried, retry.max, backoff, reqID, failure)
+			session.SendText(fmt.Sprintf("EXECUTION_RETRY: retry %d of %d in %s after: %s", retried, retry.max, backoff, failure))
+			tracker.retry(failure, retried, args)
+			envelope.setRun(tracker.runID)
+			runLog.moveTo(tracker.runID)
+			req.Args, raw, ran, preemptions = args, first, 0, 0
+			continue
+		}
+		if heldError != nil {
+			outbox.push(websocket.TextMessage, heldError)
+		}
+		if err != nil {
+			log.Printf("Execution of %s failed (request %s): %v", req.ScriptPath, reqID, err)
+			if !tracker.terminal() {
+				session.SendText("EXECUTION_ERROR: " + err.Error())
+			}
+		}
+		return
+	}
+}
+
+// waitForRetry waits out the backoff before job retries a run, on the
+// scheduler's retrying list; false when the run was cancelled meanwhile
+func waitForRetry(ctx context.Context, client <-chan wsMessage, job *schedJob, delay time.Duration) bool {
+	ready, stop := scheduler.retryAfter(job, delay)
+	defer stop()
+	for {
+		select {
+		case <-ready:
+			return true
+		case msg, ok := <-client:
+			if !ok || string(msg.Data) == "CANCEL" {
+				return false
+			}
+		case <-ctx.Done():
+			return false
 		}
 	}
 }
 
-func main() {
+// attemptInput relays client messages to one execution attempt until done,
+// and sends CANCEL when the attempt is preempted or runs out of time. The
+// channel is closed when the client leaves or the attempt is over.
+func attemptInput(client <-chan wsMessage, preempt, expired, done <-chan struct{}) <-chan wsMessage {
+	out := make(chan wsMessage, 16)
+	go func() {
+		defer close(out)
+		cancel := wsMessage{Type: websocket.TextMessage, Data: []byte("CANCEL")}
+		for {
+			var msg wsMessage
+			select {
+			case m, ok := <-client:
+				if !ok {
+					return
+				}
+				msg = m
+			case <-preempt:
+				preempt, msg = nil, cancel
+			case <-expired:
+				expired, msg = nil, cancel
+			case <-done:
+				return
+			}
+			select {
+			case out <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// serve runs the server until it is stopped or upgraded
+func serve(opts serveOptions) {
 	pythonServiceURL := os.Getenv("PYTHON_SERVICE_URL")
 	if pythonServiceURL == "" {
 		pythonServiceURL = "http://localhost:3001" // Default for local dev
 	}
+	dataDir := getEnv("DATA_DIR", "./data")
+
+	var err error
+	switch {
+	case opts.replayDir != "":
+		// Everything is answered from the recordings instead
+		pythonServiceURL, err = startReplay(opts.replayDir)
+		if err != nil {
+			log.Fatal("Could not load recordings:", err)
+		}
+	case opts.simulate:
+		// Everything goes to the built-in simulator instead
+		pythonServiceURL, err = startSimulator(filepath.Join(dataDir, "simulator"))
+		if err != nil {
+			log.Fatal("Could not start simulator:", err)
+		}
+	}
+	offline := opts.replayDir != "" || opts.simulate
 
-	proxy, err := newProxy(pythonServiceURL)
+	// readConfig loads the Python training services and the routing table
+	// between them; it runs again on reload
+	readConfig := func() (*Config, error) {
+		cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		if offline {
+			cfg.Upstreams, cfg.Routes, cfg.DefaultUpstream = map[string]UpstreamConfig{}, nil, "default"
+		}
+		cfg.withDefaultUpstream(pythonServiceURL)
+		return cfg, cfg.Validate()
+	}
+	config, err := readConfig()
+	if err != nil {
+		log.Fatal("Invalid config:", err)
+	}
+	if envFeatures, err = parseFeatures(os.Getenv("FEATURES")); err != nil {
+		log.Fatal(err)
+	}
+	applySettings(config)
+	if oidc, err = newOIDCProviderFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if trustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Fatal(err)
+	}
+	bodyLimit, err := newBodyLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+	modelUploadLimit = bodyLimit.upload
+	if wsQueue, err = wsQueueConfigFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	pythonResumeTimeout = pythonResumeTimeoutFromEnv()
+	wsStatusInterval = wsStatusIntervalFromEnv()
+	if runFileMaxSize, err = envByteSize("RUN_FILE_MAX_SIZE", 100<<20); err != nil {
+		log.Fatal(err)
+	}
+	if faults, err = parseFaults(os.Getenv("FAULTS")); err != nil {
+		log.Fatal(err)
+	}
+	if faults != nil {
+		log.Printf("WARNING: fault injection enabled (%s), not for production", faults)
+	}
+	if opts.recordDir != "" {
+		if traffic, err = newTrafficRecorder(opts.recordDir); err != nil {
+			log.Fatal("Could not start recording:", err)
+		}
+	}
+	if opts.sessionDir != "" {
+		if tapes, err = newWSTapeRecorder(opts.sessionDir); err != nil {
+			log.Fatal("Could not start session recording:", err)
+		}
+	}
+	router, err := newRouter(config)
 	if err != nil {
 		log.Fatal("Could not create proxy:", err)
 	}
 
-	// API endpoint to serve modal HTML for integration
-	http.HandleFunc("/api/model/modal-html", func(w http.ResponseWriter, r *http.Request) {
-		// Read the frontend module.html file
-		content, err := os.ReadFile("./frontend/module.html")
+	store, err = NewRunStore(dataDir)
+	if err != nil {
+		log.Fatal("Could not open run store:", err)
+	}
+	log.Printf("Run store opened at %s", filepath.Clean(dataDir))
+
+	if labels, err = NewLabelStore(dataDir); err != nil {
+		log.Fatal("Could not open label store:", err)
+	}
+	if promotions, err = NewPromotionStore(dataDir); err != nil {
+		log.Fatal("Could not open promotion store:", err)
+	}
+	if checksums, err = NewChecksumManifest(dataDir); err != nil {
+		log.Fatal("Could not open checksum manifest:", err)
+	}
+	if modelCards, err = NewModelCardStore(dataDir); err != nil {
+		log.Fatal("Could not open model card store:", err)
+	}
+	webhooks = newWebhookSenderFromEnv()
+
+	if audit, err = openAuditLogFromEnv(dataDir); err != nil {
+		log.Fatal("Could not open audit log:", err)
+	}
+
+	if runLogs, err = openRunLogsFromEnv(dataDir); err != nil {
+		log.Fatal("Could not open run logs:", err)
+	}
+
+	searcher = newSearchIndexFromEnv()
+
+	if secrets, err = newSecretStoreFromEnv(dataDir); err != nil {
+		log.Fatal("Could not open secret store:", err)
+	}
+	if secrets != nil {
+		log.Printf("Secret store: %s", secrets.Backend())
+	}
+
+	// Execution backends; the Python service is always available
+	registerExecutor(&pythonExecutor{router: router})
+	if k8s := newKubernetesExecutorFromEnv(); k8s != nil {
+		registerExecutor(k8s)
+	}
+	if ssh := newSSHExecutorFromEnv(); ssh != nil {
+		registerExecutor(ssh)
+	}
+
+	// Optionally launch and supervise the Python service ourselves
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	supervisor, err := newPythonSupervisorFromEnv()
+	if err != nil {
+		log.Fatal("Invalid supervisor config:", err)
+	}
+	if supervisor != nil {
+		go supervisor.Run(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down")
+		if err := store.Flush(); err != nil {
+			log.Printf("Error saving run store: %v", err)
+		}
+		if supervisor != nil {
+			supervisor.Wait()
+		}
+		os.Exit(0)
+	}()
+
+	// Run logs past RUN_LOG_RETENTION_DAYS are deleted in the background,
+	// and so are session recordings past SESSION_RECORD_RETENTION_DAYS
+	go runLogs.runSweeper(ctx)
+	go tapes.runSweeper(ctx)
+
+	responses, err = newResponseCache(config.Cache, envInt("RESPONSE_CACHE_SIZE", 512))
+	if err != nil {
+		log.Fatal("Invalid cache config:", err)
+	}
+
+	// Execution slots, and the concurrency limits that follow reloads
+	if scheduler, err = newRunSchedulerFromEnv(); err != nil {
+		log.Fatal("Invalid scheduler config:", err)
+	}
+	scheduler.setLimits(config.Concurrency)
+
+	// Routing and runtime settings follow CONFIG_FILE edits and SIGHUP; the
+	// response cache rules are only read at startup
+	reloadConfig := func() error {
+		cfg, err := readConfig()
 		if err != nil {
-			http.Error(w, "Failed to read modal HTML", http.StatusInternalServerError)
-			log.Printf("Error reading module.html: %v", err)
-			return
+			return err
 		}
+		router.Reload(cfg)
+		applySettings(cfg)
+		scheduler.setLimits(cfg.Concurrency)
+		// The modal HTML carries the UI branding
+		responses.Invalidate("/api/model/modal-html")
+		return nil
+	}
+	go watchConfig(ctx, os.Getenv("CONFIG_FILE"), reloadConfig)
 
-		html := string(content)
+	go router.RunHealthChecks(ctx)
+	go router.RunDiscovery(ctx)
 
-		// Extract modal sections - everything between modal comments
-		startMarker := `<!-- Model Info Modal -->`
-		endMarker := `<script type="module"`
+	// Optional S3 mirroring of run artifacts
+	mirror := newArtifactMirror(store)
+	if mirror != nil {
+		go mirror.Run(ctx)
+	}
 
-		startIdx := strings.Index(html, startMarker)
-		endIdx := strings.Index(html, endMarker)
+	// Retention rules for artifacts and run logs
+	gc, err := newGarbageCollectorFromEnv(store, mirror)
+	if err != nil {
+		log.Fatal("Invalid garbage collection config:", err)
+	}
+	go gc.Run(ctx)
+
+	// Frontend assets, embedded or from FRONTEND_DIR
+	frontendAssets = frontendFS()
 
-		var modalHTML string
-		if startIdx != -1 && endIdx != -1 && endIdx > startIdx {
-			modalHTML = html[startIdx:endIdx]
-		} else {
-			modalHTML = "" // Return empty if modal section not found
+	// API endpoint to serve modal HTML for integration
+	http.Handle("GET /api/model/modal-html", responses.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the frontend module.html file
+		content, err := fs.ReadFile(frontendAssets, "module.html")
+		if err != nil {
+			http.Error(w, "Failed to read modal HTML", http.StatusInternalServerError)
+			log.Printf("Error reading module.html: %v", err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(modalHTML))
-	})
+		locale := negotiateLocale(r)
+		w.Header().Set("Content-Language", locale)
+		w.Header().Add("Vary", "Accept-Language")
+		w.Write([]byte(translateModal(brandModal(modalMarkup(string(content))), locale)))
+	})))
 
 	// API-only backend - no HTML pages served
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(`{"message": "Training Module Backend API", "status": "running", "frontend_url": "http://localhost:3000/container"}`))
-		} else {
-			http.NotFound(w, r)
-		}
+	http.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"message": "Training Module Backend API", "status": "running", "frontend_url": "http://localhost:3000/container"}`))
 	})
 
 	// Serve the full training module interface at /container
-	http.HandleFunc("/container", func(w http.ResponseWriter, r *http.Request) {
-		content, err := os.ReadFile("./frontend/module.html")
+	http.HandleFunc("GET /container", func(w http.ResponseWriter, r *http.Request) {
+		asset, err := loadAsset(frontendAssets, "module.html", "module.html")
 		if err != nil {
 			http.Error(w, "Failed to read module HTML", http.StatusInternalServerError)
 			log.Printf("Error reading module.html: %v", err)
 			return
 		}
-		w.Header().Set("Content-Type", "text/html")
-		w.Write(content)
+		serveAsset(w, r, "module.html", asset, 0)
 	})
 
 	// Serve frontend assets (CSS, JS) but not HTML pages
-	http.HandleFunc("/css/", func(w http.ResponseWriter, r *http.Request) {
-		filePath := "./frontend" + r.URL.Path
-		http.ServeFile(w, r, filePath)
-	})
+	http.Handle("GET /css/", staticHandler("css"))
+	http.Handle("GET /js/", staticHandler("js"))
 
-	http.HandleFunc("/js/", func(w http.ResponseWriter, r *http.Request) {
-		filePath := "./frontend" + r.URL.Path
-		http.ServeFile(w, r, filePath)
-	})
+	// Title, logo, theme and visible actions of the UI
+	http.HandleFunc("GET /api/ui/config", handleUIConfig)
+
+	// UI strings in the client's language
+	if err := registerI18nRoutes(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The training UI as a <training-module> web component for non-Go frontends
+	registerWidgetRoutes()
+
+	// The training UI in an iframe, with a postMessage bridge to the host page
+	if err := registerEmbedRoutes(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Serve config files specifically
-	http.HandleFunc("/config/", func(w http.ResponseWriter, r *http.Request) {
-		// Remove /config/ prefix and serve from frontend/config/
-		configPath := "./frontend" + r.URL.Path
-		http.ServeFile(w, r, configPath)
-	})
+	http.Handle("GET /config/", staticHandler("config"))
+
+	// Proxy the Python service's API, answering hot reads from the cache
+	proxy := apiLimiter.Wrap(bodyLimit.Wrap(faults.Wrap(traffic.Wrap(router))))
+	registerProxyRoutes(proxy)
 
-	// Proxy API requests to the Python service
-	http.HandleFunc("/api/", handleProxy(proxy))
+	// Backend-native model endpoints: info, download, card, lineage, publishing
+	modelAction := responses.Wrap(bodyLimit.Wrap(http.HandlerFunc(handleModelAction)))
+	http.Handle("/api/model/{id}/{action}", modelAction)
+	http.Handle("/api/model/{id}/{action}/{target}", modelAction)
+
+	// Runs with their stored execution logs, retries and bundles
+	registerRunRoutes()
+
+	// Labels on runs, models and datasets; the model list filters by them
+	http.HandleFunc("/api/labels", handleLabels)
+	http.HandleFunc("/api/labels/", handleLabels)
+	http.Handle("GET /api/models", responses.Wrap(handleModelList(proxy.ServeHTTP)))
+
+	// Batch deletion of runs, labelling of models and downloads
+	http.HandleFunc("POST /api/batch/", handleBatch)
+
+	// Promotion of models between registry stages, with approvals
+	http.HandleFunc("/api/promotions", handlePromotions)
+	http.HandleFunc("/api/promotions/", handlePromotions)
+
+	// HTML fragments of run status for HTMX and server-rendered host apps
+	registerPartialRoutes()
+
+	// Search across runs, models and run logs
+	http.HandleFunc("GET /api/search", requireFeature("search", handleSearch))
+
+	// Backend, frontend and Python service versions for compatibility checks
+	http.HandleFunc("GET /api/version", handleVersion(router))
+
+	// OIDC login, logout and the current user
+	registerAuthRoutes()
+
+	// Build information, feature flags and capabilities
+	http.HandleFunc("GET /api/meta", handleMeta(mirror))
+
+	// MLflow-compatible tracking API backed by the run store
+	registerMLflowRoutes(store)
+
+	// Pipeline secrets, write-only
+	http.HandleFunc("/api/secrets", handleSecrets)
+	http.HandleFunc("/api/secrets/", handleSecrets)
+
+	// Artifact mirror status and reconcile
+	registerMirrorRoutes(mirror)
+
+	// JupyterLab servers by workspace
+	registerNotebookRoutes()
+
+	// Sessions, drain and config reload for operators
+	registerAdminRoutes(reloadConfig)
+	registerAuditRoutes()
+	registerRecordingRoutes()
+	registerGCRoutes(gc)
+	registerQueueRoutes()
+
+	// pprof and runtime info, admin token required
+	registerDebugRoutes()
 
 	// Handle WebSocket connections for script execution
-	http.HandleFunc("/api/script/ws/execute", handleScriptExecution)
+	http.HandleFunc("GET "+executionPath, handleScriptExecution)
+	http.HandleFunc("/api/script/ws/token", handleWSToken)
 
 	// Favicon handler to prevent 404 errors
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("GET /favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 	})
 
-	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status": "ok", "service": "training-backend", "python_proxy": "` + pythonServiceURL + `"}`))
-	})
+	// Health check endpoint with per-dependency detail
+	http.HandleFunc("GET /health", handleHealth(router, supervisor, mirror, pythonServiceURL))
+
+	// Kubernetes liveness, readiness and startup probes
+	if err := registerProbeRoutes(router, supervisor); err != nil {
+		log.Fatal(err)
+	}
+
+	// Browser apps on other origins calling the API
+	corsOrigins, err := parseOrigins("CORS_ORIGINS", getEnv("CORS_ORIGINS", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Println("Go backend server starting on :3000")
-	if err := http.ListenAndServe(":3000", nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	handler := withForwarded(withRequestID(withIPAccess(withTimeouts(withSecurityHeaders(withCORS(corsOrigins, withAuth(withAudit(protectDebug(http.DefaultServeMux)))))))))
+	addr := getEnv("LISTEN_ADDR", ":3000")
+	ln, err := inheritedListener()
+	if ln == nil && err == nil {
+		ln, err = listen(addr)
+	}
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	server := newServer(addr, handler)
+	configureHTTP2(server)
+	upgraded := watchUpgrades(server, ln, supervisor != nil)
+	upgradeReady()
+	if certFile, keyFile, ok := serverTLS(); ok {
+		log.Printf("Go backend server starting on %s (HTTPS)", addr)
+		err = server.ServeTLS(ln, certFile, keyFile)
+	} else {
+		log.Printf("Go backend server starting on %s", addr)
+		err = server.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		// A new process took over; exit once the running executions are done
+		<-upgraded
+		if err := store.Flush(); err != nil {
+			log.Printf("Error saving run store: %v", err)
+		}
+		return
 	}
+	log.Fatal("Serve: ", err)
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+)
+
+// /api/meta tells clients what this deployment is and can do: the build,
+// the feature flags that are on and the configured capabilities, so a
+// frontend can hide what is not available instead of probing endpoints.
+
+// Auth modes reported by /api/meta
+const (
+	// AuthNone leaves the API open, as behind an authenticating proxy
+	AuthNone = "none"
+	// AuthOIDC requires an OIDC login session or bearer token
+	AuthOIDC = "oidc"
+)
+
+// authMode returns how API clients are authenticated
+func authMode() string {
+	if oidc != nil {
+		return AuthOIDC
+	}
+	return AuthNone
+}
+
+// handleMeta reports build information, feature flags and capabilities
+func handleMeta(mirror *ArtifactMirror) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := buildInfo()
+		executorNames := make([]string, 0, len(executors))
+		for name := range executors {
+			executorNames = append(executorNames, name)
+		}
+		sort.Strings(executorNames)
+		// Runs, models and artifacts always live on local disk; S3 mirrors artifacts
+		storage := []string{"local"}
+		if mirror != nil {
+			storage = append(storage, "s3")
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"build": map[string]interface{}{
+				"version":     info.Version,
+				"api_version": info.APIVersion,
+				"commit":      info.Commit,
+				"commit_time": info.CommitTime,
+				"build_date":  info.BuildDate,
+				"go_version":  info.GoVersion,
+			},
+			"features": enabledFeatures(),
+			"capabilities": map[string]interface{}{
+				"executors":        executorNames,
+				"default_executor": getEnv("DEFAULT_EXECUTOR", "python"),
+				"storage_backends": storage,
+				"secret_store":     secretBackend(),
+				"ws_compression":   wsCompression,
+				"search_logs":      searcher.logs && runLogs != nil,
+				"auth": map[string]interface{}{
+					"mode":      authMode(),
+					"admin_api": os.Getenv("ADMIN_TOKEN") != "",
+				},
+			},
+		})
+	}
+}
+
+// secretBackend names the secret store, empty when secrets are off
+func secretBackend() string {
+	if secrets == nil {
+		return ""
+	}
+	return secrets.Backend()
+}
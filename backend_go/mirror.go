@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background mirroring of run artifacts to S3 with lifecycle rules:
+// artifacts older than ARTIFACT_ARCHIVE_DAYS move to an archive storage class
+// and are dropped locally, artifacts of failed runs are deleted everywhere
+// after FAILED_ARTIFACT_RETENTION_DAYS.
+
+// Artifact mirror states
+const (
+	MirrorPending  = "pending"
+	MirrorMirrored = "mirrored"
+	MirrorArchived = "archived"
+	MirrorDeleted  = "deleted"
+	MirrorError    = "error"
+)
+
+// MirroredArtifact is the mirror status of a single artifact file
+type MirroredArtifact struct {
+	RunID      string     `json:"run_id"`
+	Path       string     `json:"path"`
+	Key        string     `json:"key"`
+	Size       int64      `json:"size"`
+	SHA256     string     `json:"sha256,omitempty"`
+	ModTime    time.Time  `json:"mod_time"`
+	Status     string     `json:"status"`
+	ETag       string     `json:"etag,omitempty"`
+	MirroredAt *time.Time `json:"mirrored_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// ArtifactMirror syncs the run store's artifact directory to a bucket
+type ArtifactMirror struct {
+	store        *RunStore
+	s3           *s3Client
+	prefix       string
+	interval     time.Duration
+	archiveAfter time.Duration
+	failedAfter  time.Duration
+	archiveClass string
+
+	mu        sync.Mutex
+	artifacts map[string]*MirroredArtifact
+	lastSync  time.Time
+	lastError string
+	trigger   chan struct{}
+}
+
+// divergence is one finding of a reconcile pass
+type divergence struct {
+	Key    string `json:"key"`
+	Issue  string `json:"issue"`
+	Local  int64  `json:"local_size,omitempty"`
+	Remote int64  `json:"remote_size,omitempty"`
+}
+
+// newArtifactMirror returns nil when S3 is not configured
+func newArtifactMirror(store *RunStore) *ArtifactMirror {
+	client := newS3ClientFromEnv()
+	if client == nil {
+		return nil
+	}
+	m := &ArtifactMirror{
+		store:        store,
+		s3:           client,
+		prefix:       strings.Trim(getEnv("S3_PREFIX", "artifacts"), "/"),
+		interval:     envDuration("S3_MIRROR_INTERVAL", 5*time.Minute),
+		archiveAfter: envDays("ARTIFACT_ARCHIVE_DAYS"),
+		failedAfter:  envDays("FAILED_ARTIFACT_RETENTION_DAYS"),
+		archiveClass: getEnv("S3_ARCHIVE_STORAGE_CLASS", "GLACIER"),
+		artifacts:    map[string]*MirroredArtifact{},
+		trigger:      make(chan struct{}, 1),
+	}
+	if data, err := os.ReadFile(m.stateFile()); err == nil {
+		var saved []*MirroredArtifact
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Printf("Ignoring unreadable mirror state: %v", err)
+		}
+		for _, a := range saved {
+			m.artifacts[a.RunID+"/"+a.Path] = a
+		}
+	}
+	return m
+}
+
+func (m *ArtifactMirror) stateFile() string {
+	return filepath.Join(m.store.dir, "mirror.json")
+}
+
+// Run mirrors on every interval until ctx is cancelled
+func (m *ArtifactMirror) Run(ctx context.Context) {
+	log.Printf("Mirroring artifacts to s3://%s/%s every %s", m.s3.bucket, m.prefix, m.interval)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.Sync(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.trigger:
+		}
+	}
+}
+
+// Trigger requests a sync pass without waiting for the next tick
+func (m *ArtifactMirror) Trigger() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Sync uploads new or changed artifacts and applies lifecycle rules
+func (m *ArtifactMirror) Sync(ctx context.Context) {
+	root := filepath.Join(m.store.dir, "artifacts")
+	seen := map[string]bool{}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		runID, artifactPath, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		id := runID + "/" + artifactPath
+		seen[id] = true
+		m.syncFile(ctx, id, runID, artifactPath, p, info)
+		return ctx.Err()
+	})
+
+	m.mu.Lock()
+	if err != nil {
+		m.lastError = err.Error()
+		log.Printf("Artifact mirror walk failed: %v", err)
+	} else {
+		m.lastError = ""
+	}
+	m.lastSync = time.Now()
+	m.mu.Unlock()
+
+	m.applyLifecycle(ctx, seen)
+	m.save()
+}
+
+func (m *ArtifactMirror) syncFile(ctx context.Context, id, runID, artifactPath, local string, info fs.FileInfo) {
+	m.mu.Lock()
+	a, ok := m.artifacts[id]
+	if ok && a.Status == MirrorMirrored && a.Size == info.Size() && a.ModTime.Equal(info.ModTime()) {
+		m.mu.Unlock()
+		return
+	}
+	if !ok {
+		a = &MirroredArtifact{RunID: runID, Path: artifactPath, Key: path.Join(m.prefix, runID, artifactPath)}
+		m.artifacts[id] = a
+	}
+	a.Size, a.ModTime, a.Status = info.Size(), info.ModTime(), MirrorPending
+	m.mu.Unlock()
+
+	sum, err := fileSHA256(local)
+	var etag string
+	if err == nil {
+		etag, err = m.s3.PutFile(ctx, a.Key, local, sum)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		a.Status, a.Error = MirrorError, err.Error()
+		log.Printf("Mirroring %s failed: %v", id, err)
+		return
+	}
+	now := time.Now()
+	a.SHA256, a.ETag, a.Status, a.Error, a.MirroredAt = sum, etag, MirrorMirrored, "", &now
+}
+
+// applyLifecycle archives old artifacts and deletes expired failed-run
+// artifacts. It decides on copies taken under m.mu, as syncs and reconcile
+// passes update the artifacts meanwhile.
+func (m *ArtifactMirror) applyLifecycle(ctx context.Context, seen map[string]bool) {
+	type candidate struct {
+		artifact *MirroredArtifact
+		snapshot MirroredArtifact
+	}
+	m.mu.Lock()
+	candidates := make([]candidate, 0, len(m.artifacts))
+	for _, a := range m.artifacts {
+		if a.Status != MirrorDeleted {
+			candidates = append(candidates, candidate{a, *a})
+		}
+	}
+	m.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			return
+		}
+		a := c.snapshot
+		local := filepath.Join(m.store.ArtifactDir(a.RunID), filepath.FromSlash(a.Path))
+		run, ok := m.store.Get(a.RunID)
+
+		if m.failedAfter > 0 && ok && run.Status == RunFailed && run.EndTime != nil && now.Sub(*run.EndTime) > m.failedAfter {
+			err := m.s3.Delete(ctx, a.Key)
+			if err == nil {
+				err = os.Remove(local)
+				if os.IsNotExist(err) {
+					err = nil
+				}
+			}
+			m.setStatus(c.artifact, MirrorDeleted, err)
+			continue
+		}
+
+		if m.archiveAfter > 0 && a.Status == MirrorMirrored && seen[a.RunID+"/"+a.Path] && now.Sub(a.ModTime) > m.archiveAfter {
+			err := m.s3.SetStorageClass(ctx, a.Key, m.archiveClass)
+			if err == nil {
+				err = os.Remove(local)
+			}
+			m.setStatus(c.artifact, MirrorArchived, err)
+		}
+	}
+}
+
+// forgetRun deletes the mirrored copies of a run's artifacts, whose local
+// files are about to be removed
+func (m *ArtifactMirror) forgetRun(ctx context.Context, runID string) error {
+	m.mu.Lock()
+	var mirrored []*MirroredArtifact
+	for _, a := range m.artifacts {
+		if a.RunID == runID && a.Status != MirrorDeleted {
+			mirrored = append(mirrored, a)
+		}
+	}
+	m.mu.Unlock()
+	for _, a := range mirrored {
+		err := m.s3.Delete(ctx, a.Key)
+		m.setStatus(a, MirrorDeleted, err)
+		if err != nil {
+			return err
+		}
+	}
+	if len(mirrored) > 0 {
+		m.save()
+	}
+	return nil
+}
+
+func (m *ArtifactMirror) setStatus(a *MirroredArtifact, status string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		a.Error = err.Error()
+		log.Printf("Lifecycle action %s on %s failed: %v", status, a.Key, err)
+		return
+	}
+	a.Status, a.Error = status, ""
+	log.Printf("Artifact %s %s", a.Key, status)
+}
+
+// Reconcile compares local files, mirror state and the bucket listing
+func (m *ArtifactMirror) Reconcile(ctx context.Context, repair bool) ([]divergence, error) {
+	remote, err := m.s3.List(ctx, m.prefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	remoteByKey := map[string]s3Object{}
+	for _, o := range remote {
+		remoteByKey[o.Key] = o
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	findings := []divergence{}
+	known := map[string]bool{}
+	for _, a := range m.artifacts {
+		known[a.Key] = true
+		local := filepath.Join(m.store.ArtifactDir(a.RunID), filepath.FromSlash(a.Path))
+		info, statErr := os.Stat(local)
+		obj, inRemote := remoteByKey[a.Key]
+
+		switch a.Status {
+		case MirrorDeleted:
+			if inRemote {
+				findings = append(findings, divergence{Key: a.Key, Issue: "deleted_but_remote_exists", Remote: obj.Size})
+			}
+		case MirrorArchived:
+			if !inRemote {
+				findings = append(findings, divergence{Key: a.Key, Issue: "archived_but_remote_missing"})
+			}
+		default:
+			if statErr != nil {
+				findings = append(findings, divergence{Key: a.Key, Issue: "missing_local", Remote: obj.Size})
+				continue
+			}
+			if !inRemote {
+				findings = append(findings, divergence{Key: a.Key, Issue: "missing_remote", Local: info.Size()})
+			} else if obj.Size != info.Size() {
+				findings = append(findings, divergence{Key: a.Key, Issue: "size_mismatch", Local: info.Size(), Remote: obj.Size})
+			} else {
+				continue
+			}
+			if repair {
+				a.Status = MirrorPending
+			}
+		}
+	}
+	for _, o := range remote {
+		if !known[o.Key] {
+			findings = append(findings, divergence{Key: o.Key, Issue: "orphan_remote", Remote: o.Size})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Key < findings[j].Key })
+	if repair {
+		m.Trigger()
+	}
+	return findings, nil
+}
+
+// Artifacts returns the mirror state, optionally filtered to one run
+func (m *ArtifactMirror) Artifacts(runID string) []MirroredArtifact {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []MirroredArtifact{}
+	for _, a := range m.artifacts {
+		if runID == "" || a.RunID == runID {
+			out = append(out, *a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func (m *ArtifactMirror) save() {
+	m.mu.Lock()
+	list := make([]*MirroredArtifact, 0, len(m.artifacts))
+	for _, a := range m.artifacts {
+		list = append(list, a)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	m.mu.Unlock()
+	if err == nil {
+		err = os.WriteFile(m.stateFile(), data, 0o644)
+	}
+	if err != nil {
+		log.Printf("Error saving mirror state: %v", err)
+	}
+}
+
+// registerMirrorRoutes exposes mirror status and the reconcile command
+func registerMirrorRoutes(m *ArtifactMirror) {
+	http.HandleFunc("/api/artifacts/mirror", func(w http.ResponseWriter, r *http.Request) {
+		if m == nil {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+			return
+		}
+		if r.Method == http.MethodPost {
+			m.Trigger()
+		}
+		counts := map[string]int{}
+		artifacts := m.Artifacts(r.URL.Query().Get("run_id"))
+		for _, a := range artifacts {
+			counts[a.Status]++
+		}
+		m.mu.Lock()
+		lastSync, lastError := m.lastSync, m.lastError
+		m.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"enabled":    true,
+			"bucket":     m.s3.bucket,
+			"prefix":     m.prefix,
+			"last_sync":  lastSync,
+			"last_error": lastError,
+			"counts":     counts,
+			"artifacts":  artifacts,
+		})
+	})
+
+	http.HandleFunc("/api/artifacts/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if m == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "S3 mirroring is not configured"})
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		repair, _ := strconv.ParseBool(r.URL.Query().Get("repair"))
+		findings, err := m.Reconcile(r.Context(), repair)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"in_sync":    len(findings) == 0,
+			"divergence": findings,
+			"repaired":   repair && len(findings) > 0,
+		})
+	})
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// envDuration parses a Go duration from the environment
+func envDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// envDays parses a whole number of days from the environment; 0 disables the rule
+func envDays(key string) time.Duration {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return time.Duration(n) * 24 * time.Hour
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MLflow-compatible tracking API backed by the run store. Only the subset used
+// by mlflow.start_run / log_param / log_metric / log_artifact is implemented.
+
+const (
+	mlflowPrefix          = "/api/2.0/mlflow/"
+	mlflowArtifactsPrefix = "/api/2.0/mlflow-artifacts/artifacts"
+)
+
+type mlflowKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type mlflowMetric struct {
+	Key       string  `json:"key"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+	Step      int64   `json:"step"`
+}
+
+type mlflowRunInfo struct {
+	RunID          string `json:"run_id"`
+	RunUUID        string `json:"run_uuid"`
+	RunName        string `json:"run_name"`
+	ExperimentID   string `json:"experiment_id"`
+	Status         string `json:"status"`
+	StartTime      int64  `json:"start_time"`
+	EndTime        int64  `json:"end_time,omitempty"`
+	ArtifactURI    string `json:"artifact_uri"`
+	LifecycleStage string `json:"lifecycle_stage"`
+}
+
+type mlflowRunData struct {
+	Metrics []mlflowMetric `json:"metrics"`
+	Params  []mlflowKV     `json:"params"`
+	Tags    []mlflowKV     `json:"tags"`
+}
+
+type mlflowRun struct {
+	Info mlflowRunInfo `json:"info"`
+	Data mlflowRunData `json:"data"`
+}
+
+type mlflowExperiment struct {
+	ExperimentID     string `json:"experiment_id"`
+	Name             string `json:"name"`
+	ArtifactLocation string `json:"artifact_location"`
+	LifecycleStage   string `json:"lifecycle_stage"`
+	CreationTime     int64  `json:"creation_time"`
+}
+
+// registerMLflowRoutes mounts the tracking and artifact APIs on the default mux
+func registerMLflowRoutes(store *RunStore) {
+	http.HandleFunc(mlflowPrefix, requireFeature("mlflow_api", func(w http.ResponseWriter, r *http.Request) {
+		handleMLflow(store, w, r)
+	}))
+	http.HandleFunc(mlflowArtifactsPrefix, requireFeature("mlflow_api", func(w http.ResponseWriter, r *http.Request) {
+		handleMLflowArtifacts(store, w, r)
+	}))
+	http.HandleFunc(mlflowArtifactsPrefix+"/", requireFeature("mlflow_api", func(w http.ResponseWriter, r *http.Request) {
+		handleMLflowArtifacts(store, w, r)
+	}))
+}
+
+func handleMLflow(store *RunStore, w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimPrefix(r.URL.Path, mlflowPrefix)
+
+	switch endpoint {
+	case "experiments/create":
+		var req struct {
+			Name string `json:"name"`
+		}
+		if !decodeMLflow(w, r, &req) {
+			return
+		}
+		if req.Name == "" {
+			mlflowError(w, http.StatusBadRequest, "INVALID_PARAMETER_VALUE", "name is required")
+			return
+		}
+		exp, err := store.CreateExperiment(req.Name)
+		if err != nil {
+			mlflowError(w, http.StatusBadRequest, "RESOURCE_ALREADY_EXISTS", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"experiment_id": exp.ID})
+
+	case "experiments/get":
+		exp, ok := store.GetExperiment(r.URL.Query().Get("experiment_id"))
+		if !ok {
+			mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", "experiment not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"experiment": toMLflowExperiment(exp)})
+
+	case "experiments/get-by-name":
+		exp, ok := store.ExperimentByName(r.URL.Query().Get("experiment_name"))
+		if !ok {
+			mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", "experiment not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"experiment": toMLflowExperiment(exp)})
+
+	case "experiments/search", "experiments/list":
+		exps := []mlflowExperiment{}
+		for _, e := range store.Experiments() {
+			exps = append(exps, toMLflowExperiment(e))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"experiments": exps})
+
+	case "runs/create":
+		var req struct {
+			ExperimentID string     `json:"experiment_id"`
+			RunName      string     `json:"run_name"`
+			StartTime    int64      `json:"start_time"`
+			Tags         []mlflowKV `json:"tags"`
+		}
+		if !decodeMLflow(w, r, &req) {
+			return
+		}
+		run := &Run{
+			ExperimentID: req.ExperimentID,
+			Name:         req.RunName,
+			Tags:         map[string]string{},
+		}
+		if req.StartTime > 0 {
+			run.StartTime = time.UnixMilli(req.StartTime)
+		}
+		for _, t := range req.Tags {
+			run.Tags[t.Key] = t.Value
+		}
+		if run.Name == "" {
+			run.Name = run.Tags["mlflow.runName"]
+		}
+		created, err := store.Create(run)
+		if err != nil {
+			mlflowStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"run": toMLflowRun(created)})
+
+	case "runs/get":
+		run, ok := store.Get(mlflowRunID(r.URL.Query().Get("run_id"), r.URL.Query().Get("run_uuid")))
+		if !ok {
+			mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", "run not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"run": toMLflowRun(run)})
+
+	case "runs/update":
+		var req struct {
+			RunID   string `json:"run_id"`
+			RunUUID string `json:"run_uuid"`
+			Status  string `json:"status"`
+			EndTime int64  `json:"end_time"`
+			RunName string `json:"run_name"`
+		}
+		if !decodeMLflow(w, r, &req) {
+			return
+		}
+		run, err := store.Update(mlflowRunID(req.RunID, req.RunUUID), func(run *Run) {
+			if req.RunName != "" {
+				run.Name = req.RunName
+			}
+			if req.Status != "" {
+				run.Status = fromMLflowStatus(req.Status)
+			}
+			if req.EndTime > 0 {
+				end := time.UnixMilli(req.EndTime)
+				run.EndTime = &end
+			} else if run.Finished() && run.EndTime == nil {
+				run.Finish(run.Status)
+			}
+		})
+		if err != nil {
+			mlflowStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"run_info": toMLflowRun(run).Info})
+
+	case "runs/delete", "runs/restore":
+		// Like MLflow, deleting only sets the lifecycle stage
+		var req struct {
+			RunID string `json:"run_id"`
+		}
+		if !decodeMLflow(w, r, &req) {
+			return
+		}
+		if err := store.SetDeleted(req.RunID, endpoint == "runs/delete"); err != nil {
+			mlflowStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+
+	case "runs/log-parameter", "runs/set-tag":
+		var req struct {
+			RunID   string `json:"run_id"`
+			RunUUID string `json:"run_uuid"`
+			mlflowKV
+		}
+		if !decodeMLflow(w, r, &req) {
+			return
+		}
+		isTag := endpoint == "runs/set-tag"
+		_, err := store.Log(mlflowRunID(req.RunID, req.RunUUID), func(run *Run) {
+			if isTag {
+				setMapValue(&run.Tags, req.Key, req.Value)
+			} else {
+				setMapValue(&run.Params, req.Key, req.Value)
+			}
+		})
+		if err != nil {
+			mlflowStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+
+	case "runs/log-metric":
+		var req struct {
+			RunID   string `json:"run_id"`
+			RunUUID string `json:"run_uuid"`
+			mlflowMetric
+		}
+		if !decodeMLflow(w, r, &req) {
+			return
+		}
+		_, err := store.Log(mlflowRunID(req.RunID, req.RunUUID), func(run *Run) {
+			appendMetric(run, req.mlflowMetric)
+		})
+		if err != nil {
+			mlflowStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+
+	case "runs/log-batch":
+		var req struct {
+			RunID   string         `json:"run_id"`
+			RunUUID string         `json:"run_uuid"`
+			Metrics []mlflowMetric `json:"metrics"`
+			Params  []mlflowKV     `json:"params"`
+			Tags    []mlflowKV     `json:"tags"`
+		}
+		if !decodeMLflow(w, r, &req) {
+			return
+		}
+		_, err := store.Log(mlflowRunID(req.RunID, req.RunUUID), func(run *Run) {
+			for _, m := range req.Metrics {
+				appendMetric(run, m)
+			}
+			for _, p := range req.Params {
+				setMapValue(&run.Params, p.Key, p.Value)
+			}
+			for _, t := range req.Tags {
+				setMapValue(&run.Tags, t.Key, t.Value)
+			}
+		})
+		if err != nil {
+			mlflowStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+
+	case "runs/search":
+		var req struct {
+			ExperimentIDs []string `json:"experiment_ids"`
+			MaxResults    int      `json:"max_results"`
+			// RunViewType is ACTIVE_ONLY (the default), DELETED_ONLY or ALL
+			RunViewType string `json:"run_view_type"`
+			// LabelSelector is not part of MLflow; it filters by the backend's run labels
+			LabelSelector string `json:"label_selector"`
+		}
+		if r.Method == http.MethodPost && !decodeMLflow(w, r, &req) {
+			return
+		}
+		if raw := r.URL.Query().Get("label_selector"); raw != "" {
+			req.LabelSelector = raw
+		}
+		if raw := r.URL.Query().Get("run_view_type"); raw != "" {
+			req.RunViewType = raw
+		}
+		sel, err := parseLabelSelector(req.LabelSelector)
+		if err != nil {
+			mlflowError(w, http.StatusBadRequest, "INVALID_PARAMETER_VALUE", err.Error())
+			return
+		}
+		runLabels := labels.All(labelKindRun)
+		wanted := map[string]bool{}
+		for _, id := range req.ExperimentIDs {
+			wanted[id] = true
+		}
+		runs := []mlflowRun{}
+		for _, run := range store.ListAll() {
+			if len(wanted) > 0 && !wanted[run.ExperimentID] {
+				continue
+			}
+			if !mlflowViewIncludes(req.RunViewType, run) {
+				continue
+			}
+			if !sel.Matches(runLabels[run.ID]) {
+				continue
+			}
+			if req.MaxResults > 0 && len(runs) >= req.MaxResults {
+				break
+			}
+			runs = append(runs, toMLflowRun(run))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs})
+
+	case "metrics/get-history":
+		q := r.URL.Query()
+		run, ok := store.Get(mlflowRunID(q.Get("run_id"), q.Get("run_uuid")))
+		if !ok {
+			mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", "run not found")
+			return
+		}
+		key := q.Get("metric_key")
+		metrics := []mlflowMetric{}
+		for _, p := range run.Metrics[key] {
+			metrics = append(metrics, mlflowMetric{Key: key, Value: p.Value, Timestamp: p.Timestamp, Step: p.Step})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"metrics": metrics})
+
+	case "artifacts/list":
+		q := r.URL.Query()
+		run, ok := store.Get(mlflowRunID(q.Get("run_id"), q.Get("run_uuid")))
+		if !ok {
+			mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", "run not found")
+			return
+		}
+		files, err := listArtifacts(store.ArtifactDir(run.ID), q.Get("path"))
+		if err != nil {
+			mlflowError(w, http.StatusBadRequest, "INVALID_PARAMETER_VALUE", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"root_uri": toMLflowRun(run).Info.ArtifactURI, "files": files})
+
+	default:
+		mlflowError(w, http.StatusNotFound, "ENDPOINT_NOT_FOUND", "unsupported MLflow endpoint: "+endpoint)
+	}
+}
+
+// handleMLflowArtifacts implements the mlflow-artifacts proxy used by log_artifact.
+// Paths have the form <experiment_id>/<run_id>/artifacts/<relative path>.
+func handleMLflowArtifacts(store *RunStore, w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, mlflowArtifactsPrefix), "/")
+	if rest == "" {
+		rest = r.URL.Query().Get("path")
+	}
+	parts := strings.SplitN(rest, "/", 4)
+	if len(parts) < 3 || parts[2] != "artifacts" {
+		mlflowError(w, http.StatusBadRequest, "INVALID_PARAMETER_VALUE", "artifact path must be <experiment_id>/<run_id>/artifacts/<path>")
+		return
+	}
+	runID := parts[1]
+	if _, ok := store.Get(runID); !ok {
+		mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", "run not found")
+		return
+	}
+	rel := ""
+	if len(parts) == 4 {
+		rel = parts[3]
+	}
+	root := store.ArtifactDir(runID)
+
+	switch r.Method {
+	case http.MethodPut:
+		target, err := artifactPath(root, rel)
+		if err != nil || rel == "" {
+			mlflowError(w, http.StatusBadRequest, "INVALID_PARAMETER_VALUE", "invalid artifact path")
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			mlflowError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+			return
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			mlflowError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+			return
+		}
+		defer f.Close()
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), r.Body)
+		if err != nil {
+			mlflowError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+			return
+		}
+		if err := checksums.Put(runArtifactKey(runID, rel), hex.EncodeToString(h.Sum(nil)), n); err != nil {
+			log.Printf("Error recording checksum of artifact %s of run %s: %v", rel, runID, err)
+		}
+		log.Printf("Stored MLflow artifact %s for run %s", rel, runID)
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+
+	case http.MethodGet, http.MethodHead:
+		target, err := artifactPath(root, rel)
+		if err != nil {
+			mlflowError(w, http.StatusBadRequest, "INVALID_PARAMETER_VALUE", "invalid artifact path")
+			return
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", "artifact not found")
+			return
+		}
+		if info.IsDir() {
+			files, err := listArtifacts(root, rel)
+			if err != nil {
+				mlflowError(w, http.StatusBadRequest, "INVALID_PARAMETER_VALUE", err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"files": files})
+			return
+		}
+		if err := setDigestHeaders(w, runArtifactKey(runID, rel), target); err != nil {
+			mlflowError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+			return
+		}
+		http.ServeFile(w, r, target)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		mlflowError(w, http.StatusMethodNotAllowed, "INVALID_PARAMETER_VALUE", "method not allowed")
+	}
+}
+
+type mlflowFileInfo struct {
+	Path     string `json:"path"`
+	IsDir    bool   `json:"is_dir"`
+	FileSize int64  `json:"file_size,omitempty"`
+}
+
+// listArtifacts lists the direct children of rel inside an artifact root
+func listArtifacts(root, rel string) ([]mlflowFileInfo, error) {
+	dir, err := artifactPath(root, rel)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []mlflowFileInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]mlflowFileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi := mlflowFileInfo{Path: path.Join(rel, e.Name()), IsDir: e.IsDir()}
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			fi.FileSize = info.Size()
+		}
+		files = append(files, fi)
+	}
+	return files, nil
+}
+
+// artifactPath resolves rel inside root, refusing paths that escape it
+func artifactPath(root, rel string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(rel))
+	target := filepath.Join(root, clean)
+	if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return "", os.ErrPermission
+	}
+	return target, nil
+}
+
+func toMLflowRun(run *Run) mlflowRun {
+	info := mlflowRunInfo{
+		RunID:          run.ID,
+		RunUUID:        run.ID,
+		RunName:        run.Name,
+		ExperimentID:   run.ExperimentID,
+		Status:         toMLflowStatus(run.Status),
+		StartTime:      run.StartTime.UnixMilli(),
+		ArtifactURI:    "mlflow-artifacts:/" + run.ExperimentID + "/" + run.ID + "/artifacts",
+		LifecycleStage: "active",
+	}
+	if run.EndTime != nil {
+		info.EndTime = run.EndTime.UnixMilli()
+	}
+	if run.DeletedAt != nil {
+		info.LifecycleStage = "deleted"
+	}
+
+	data := mlflowRunData{Metrics: []mlflowMetric{}, Params: []mlflowKV{}, Tags: []mlflowKV{}}
+	for key, points := range run.Metrics {
+		if len(points) == 0 {
+			continue
+		}
+		last := points[len(points)-1]
+		data.Metrics = append(data.Metrics, mlflowMetric{Key: key, Value: last.Value, Timestamp: last.Timestamp, Step: last.Step})
+	}
+	for k, v := range run.Params {
+		data.Params = append(data.Params, mlflowKV{Key: k, Value: v})
+	}
+	for k, v := range run.Tags {
+		data.Tags = append(data.Tags, mlflowKV{Key: k, Value: v})
+	}
+	sort.Slice(data.Metrics, func(i, j int) bool { return data.Metrics[i].Key < data.Metrics[j].Key })
+	sort.Slice(data.Params, func(i, j int) bool { return data.Params[i].Key < data.Params[j].Key })
+	sort.Slice(data.Tags, func(i, j int) bool { return data.Tags[i].Key < data.Tags[j].Key })
+
+	return mlflowRun{Info: info, Data: data}
+}
+
+func toMLflowExperiment(e *Experiment) mlflowExperiment {
+	return mlflowExperiment{
+		ExperimentID:     e.ID,
+		Name:             e.Name,
+		ArtifactLocation: "mlflow-artifacts:/" + e.ID,
+		LifecycleStage:   "active",
+		CreationTime:     e.CreatedAt.UnixMilli(),
+	}
+}
+
+func toMLflowStatus(status string) string {
+	switch status {
+	case RunQueued:
+		return "SCHEDULED"
+	case RunFinished:
+		return "FINISHED"
+	case RunFailed, RunTimedOut:
+		return "FAILED"
+	case RunCancelled:
+		return "KILLED"
+	default:
+		return "RUNNING"
+	}
+}
+
+func fromMLflowStatus(status string) string {
+	switch strings.ToUpper(status) {
+	case "SCHEDULED":
+		return RunQueued
+	case "FINISHED":
+		return RunFinished
+	case "FAILED":
+		return RunFailed
+	case "KILLED":
+		return RunCancelled
+	default:
+		return RunRunning
+	}
+}
+
+func appendMetric(run *Run, m mlflowMetric) {
+	if run.Metrics == nil {
+		run.Metrics = map[string][]MetricPoint{}
+	}
+	if m.Timestamp == 0 {
+		m.Timestamp = time.Now().UnixMilli()
+	}
+	run.Metrics[m.Key] = append(run.Metrics[m.Key], MetricPoint{Value: m.Value, Step: m.Step, Timestamp: m.Timestamp})
+}
+
+func setMapValue(m *map[string]string, key, value string) {
+	if *m == nil {
+		*m = map[string]string{}
+	}
+	(*m)[key] = value
+}
+
+// mlflowViewIncludes reports whether a runs/search run_view_type covers run
+func mlflowViewIncludes(viewType string, run *Run) bool {
+	switch strings.ToUpper(viewType) {
+	case "ALL":
+		return true
+	case "DELETED_ONLY":
+		return run.DeletedAt != nil
+	default:
+		return run.DeletedAt == nil
+	}
+}
+
+// mlflowRunID returns run_id, falling back to the deprecated run_uuid field
+func mlflowRunID(runID, runUUID string) string {
+	if runID != "" {
+		return runID
+	}
+	return runUUID
+}
+
+func decodeMLflow(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		mlflowError(w, http.StatusBadRequest, "MALFORMED_REQUEST", "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func mlflowStoreError(w http.ResponseWriter, err error) {
+	if err == ErrRunNotFound {
+		mlflowError(w, http.StatusNotFound, "RESOURCE_DOES_NOT_EXIST", err.Error())
+		return
+	}
+	mlflowError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+}
+
+func mlflowError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"error_code": code, "message": message})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Model cards, generated from a model's training summary, the run that
+// produced it (see lineage.go) and its dataset, plus the description,
+// intended use and limitations users write for it. GET /api/model/{id}/card
+// returns markdown, or JSON with ?format=json; PUT sets the written parts,
+// kept in DATA_DIR/model_cards.json. Publishing to the Hugging Face Hub
+// commits the card as README.md, and `training-backend models download
+// --card` saves it next to the weights.
+
+func init() {
+	modelActions["card"] = modelAction{[]string{http.MethodGet, http.MethodPut}, handleModelCard}
+}
+
+// modelCardText is what users write about a model
+type modelCardText struct {
+	Description string    `json:"description,omitempty"`
+	IntendedUse string    `json:"intended_use,omitempty"`
+	Limitations string    `json:"limitations,omitempty"`
+	UpdatedBy   string    `json:"updated_by,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ModelCardStore holds the written parts of model cards by model id
+type ModelCardStore struct {
+	mu    sync.RWMutex
+	path  string
+	cards map[string]modelCardText
+}
+
+// modelCards is opened in serve next to the label store
+var modelCards *ModelCardStore
+
+// NewModelCardStore opens (or creates) the model card store in dir
+func NewModelCardStore(dir string) (*ModelCardStore, error) {
+	s := &ModelCardStore{path: filepath.Join(dir, "model_cards.json"), cards: map[string]modelCardText{}}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.cards); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+	}
+	return s, nil
+}
+
+// Get returns what was written about a model; a nil store has nothing
+func (s *ModelCardStore) Get(modelID string) modelCardText {
+	if s == nil {
+		return modelCardText{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cards[modelID]
+}
+
+// Put replaces what was written about a model
+func (s *ModelCardStore) Put(modelID string, text modelCardText) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cards[modelID] = text
+	data, err := json.MarshalIndent(s.cards, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+type cardDataset struct {
+	Name             string `json:"name,omitempty"`
+	Version          string `json:"version,omitempty"`
+	Images           int    `json:"images,omitempty"`
+	TrainingImages   int    `json:"training_images,omitempty"`
+	ValidationImages int    `json:"validation_images,omitempty"`
+}
+
+type cardRun struct {
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	Status          string            `json:"status"`
+	User            string            `json:"user,omitempty"`
+	StartedAt       time.Time         `json:"started_at"`
+	EndedAt         *time.Time        `json:"ended_at,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds,omitempty"`
+	Params          map[string]string `json:"params,omitempty"`
+}
+
+// modelCard is the JSON form of a card
+type modelCard struct {
+	Model          string             `json:"model"`
+	Stage          string             `json:"stage,omitempty"`
+	BaseModel      string             `json:"base_model,omitempty"`
+	Description    string             `json:"description,omitempty"`
+	IntendedUse    string             `json:"intended_use,omitempty"`
+	Limitations    string             `json:"limitations,omitempty"`
+	Metrics        map[string]float64 `json:"metrics,omitempty"`
+	TrainingConfig map[string]string  `json:"training_config,omitempty"`
+	Dataset        *cardDataset       `json:"dataset,omitempty"`
+	Run            *cardRun           `json:"run,omitempty"`
+	GeneratedAt    time.Time          `json:"generated_at"`
+}
+
+// buildModelCard puts a card together; without a run it uses the one that
+// produced the model, if known
+func buildModelCard(model *Model, run *Run) *modelCard {
+	if run == nil && store != nil {
+		run = producingRun(store.List(), model.ID)
+	}
+	text := modelCards.Get(model.ID)
+	card := &modelCard{
+		Model:          model.ID,
+		Stage:          labels.Get(labelKindModel, model.ID)[stageLabel],
+		BaseModel:      model.Config["Base Model"],
+		Description:    text.Description,
+		IntendedUse:    text.IntendedUse,
+		Limitations:    text.Limitations,
+		Metrics:        model.Metrics,
+		TrainingConfig: model.Config,
+		GeneratedAt:    time.Now().UTC(),
+	}
+
+	dataset := &cardDataset{}
+	dataset.TrainingImages, _ = strconv.Atoi(model.Config["Training Images"])
+	dataset.ValidationImages, _ = strconv.Atoi(model.Config["Validation Images"])
+	if run != nil {
+		card.Run = &cardRun{
+			ID:        run.ID,
+			Name:      run.Name,
+			Status:    run.Status,
+			User:      run.Tags["mlflow.user"],
+			StartedAt: run.StartTime,
+			EndedAt:   run.EndTime,
+			Params:    run.Params,
+		}
+		if run.EndTime != nil {
+			card.Run.DurationSeconds = runDuration(run).Seconds()
+		}
+		if c := runCheckpoint(run); c != "" {
+			card.BaseModel = c
+		}
+		dataset.Name, dataset.Version = run.Params["dataset"], run.Params["dataset_version"]
+		dataset.Images = runDatasetSize(run)
+	}
+	if *dataset != (cardDataset{}) {
+		card.Dataset = dataset
+	}
+	return card
+}
+
+// markdown renders the card as a Hugging Face Hub README, with metadata front matter
+func (c *modelCard) markdown() string {
+	var b strings.Builder
+	b.WriteString("---\nlibrary_name: ultralytics\ntags:\n- yolov8\n- object-detection\n- model-training-module\n")
+	if len(c.Metrics) > 0 {
+		b.WriteString("model-index:\n- name: " + c.Model + "\n  results:\n  - task:\n      type: object-detection\n    metrics:\n")
+		for _, key := range sortedKeys(c.Metrics) {
+			fmt.Fprintf(&b, "    - type: %s\n      value: %g\n", key, c.Metrics[key])
+		}
+	}
+	b.WriteString("---\n\n")
+
+	fmt.Fprintf(&b, "# %s\n\n", c.Model)
+	if c.Description != "" {
+		b.WriteString(c.Description + "\n\n")
+	} else {
+		b.WriteString("YOLOv8 object detection model trained with the Model Training Module.\n\n")
+	}
+	if c.BaseModel != "" {
+		fmt.Fprintf(&b, "Trained from `%s`.\n\n", c.BaseModel)
+	}
+	if c.Stage != "" {
+		fmt.Fprintf(&b, "Registry stage: **%s**\n\n", c.Stage)
+	}
+	if c.IntendedUse != "" {
+		b.WriteString("## Intended Use\n\n" + c.IntendedUse + "\n\n")
+	}
+	if c.Limitations != "" {
+		b.WriteString("## Limitations\n\n" + c.Limitations + "\n\n")
+	}
+
+	if len(c.Metrics) > 0 {
+		b.WriteString("## Metrics\n\n| Metric | Value |\n|---|---|\n")
+		for _, key := range sortedKeys(c.Metrics) {
+			fmt.Fprintf(&b, "| %s | %.3f |\n", key, c.Metrics[key])
+		}
+		b.WriteString("\n")
+	}
+	if d := c.Dataset; d != nil {
+		b.WriteString("## Dataset\n\n")
+		for _, item := range [][2]string{
+			{"Name", d.Name}, {"Version", d.Version}, {"Images", cardCount(d.Images)},
+			{"Training images", cardCount(d.TrainingImages)}, {"Validation images", cardCount(d.ValidationImages)},
+		} {
+			if item[1] != "" {
+				fmt.Fprintf(&b, "- **%s**: %s\n", item[0], item[1])
+			}
+		}
+		b.WriteString("\n")
+	}
+	if len(c.TrainingConfig) > 0 {
+		b.WriteString("## Training Configuration\n\n")
+		for _, key := range sortedKeys(c.TrainingConfig) {
+			fmt.Fprintf(&b, "- **%s**: %s\n", key, c.TrainingConfig[key])
+		}
+		b.WriteString("\n")
+	}
+	if run := c.Run; run != nil {
+		fmt.Fprintf(&b, "## Training Run\n\n- **Run ID**: %s\n- **Name**: %s\n- **Status**: %s\n- **Started**: %s\n",
+			run.ID, run.Name, run.Status, run.StartedAt.UTC().Format(time.RFC3339))
+		if run.DurationSeconds > 0 {
+			fmt.Fprintf(&b, "- **Duration**: %s\n", time.Duration(run.DurationSeconds*float64(time.Second)).Round(time.Second))
+		}
+		if run.User != "" {
+			fmt.Fprintf(&b, "- **User**: %s\n", run.User)
+		}
+		for _, key := range sortedKeys(run.Params) {
+			fmt.Fprintf(&b, "- **%s**: %s\n", key, run.Params[key])
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func cardCount(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// handleModelCard serves a model's card, and sets its written parts on PUT
+func handleModelCard(w http.ResponseWriter, r *http.Request, modelID string) {
+	model, err := loadModel(modelID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if r.Method == http.MethodPut {
+		var text modelCardText
+		if err := json.NewDecoder(r.Body).Decode(&text); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"description": "...", "intended_use": "...", "limitations": "..."}`})
+			return
+		}
+		text.UpdatedBy, text.UpdatedAt = secretActor(r), time.Now().UTC()
+		if err := modelCards.Put(model.ID, text); err != nil {
+			log.Printf("Error saving model card: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "could not save model card"})
+			return
+		}
+		log.Printf("Model card of %s changed by %s (request %s)", model.ID, text.UpdatedBy, requestID(r))
+	}
+
+	card := buildModelCard(model, nil)
+	if r.Method == http.MethodPut || r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, card)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Write([]byte(card.markdown()))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrModelNotFound is returned when no weights file exists for a model id
+var ErrModelNotFound = errors.New("model not found")
+
+// Model describes a trained weights file in the shared models directory
+type Model struct {
+	ID         string             `json:"id"`
+	File       string             `json:"file"`
+	Size       int64              `json:"size"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Config     map[string]string  `json:"config,omitempty"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+	// SHA256 is the weights' checksum in the manifest, set by the info endpoint
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func init() {
+	modelActions["info"] = modelAction{[]string{http.MethodGet}, handleModelInfo}
+	modelActions["download"] = modelAction{[]string{http.MethodGet}, handleModelDownload}
+}
+
+// modelsDir is the directory the Python service writes trained models to
+func modelsDir() string {
+	return getEnv("MODELS_DIR", "./models")
+}
+
+// modelActionFunc handles a backend-native endpoint under /api/model/{id}/
+type modelActionFunc func(w http.ResponseWriter, r *http.Request, modelID string)
+
+// modelAction is a backend-native endpoint and the methods it answers; GET
+// includes HEAD
+type modelAction struct {
+	methods []string
+	handle  modelActionFunc
+}
+
+// modelActions maps the path after /api/model/{id}/ to its action. The
+// Python service's model endpoints are registered apart, in apiroutes.go.
+var modelActions = map[string]modelAction{}
+
+// handleModelAction serves /api/model/{id}/{action} and
+// /api/model/{id}/{action}/{target}. The actions share these patterns, since
+// per-action patterns would conflict with the Python service's
+// /api/model/report/{name}.
+func handleModelAction(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("action")
+	if target := r.PathValue("target"); target != "" {
+		name += "/" + target
+	}
+	action, ok := modelActions[name]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown model endpoint"})
+		return
+	}
+	allowed := slices.Contains(action.methods, r.Method) || (r.Method == http.MethodHead && slices.Contains(action.methods, http.MethodGet))
+	if !allowed {
+		allow := action.methods
+		if slices.Contains(allow, http.MethodGet) {
+			allow = append(slices.Clone(allow), http.MethodHead)
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action.handle(w, r, r.PathValue("id"))
+}
+
+// handleModelInfo returns the size, training config and metrics of a model
+func handleModelInfo(w http.ResponseWriter, r *http.Request, modelID string) {
+	model, err := loadModel(modelID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, file := range modelFiles(model) {
+		if err := checksums.Ensure(modelKey(file), file); err != nil {
+			log.Printf("Error recording checksum of %s: %v", file, err)
+		}
+	}
+	if entry, ok := checksums.Get(modelKey(model.File)); ok {
+		model.SHA256 = entry.SHA256
+	}
+	writeJSON(w, http.StatusOK, model)
+}
+
+// handleModelDownload serves the weights file of a model
+func handleModelDownload(w http.ResponseWriter, r *http.Request, modelID string) {
+	model, err := loadModel(modelID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := setDigestHeaders(w, modelKey(model.File), model.File); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "model " + model.ID + ": " + err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(model.File)))
+	http.ServeFile(w, r, model.File)
+}
+
+// loadModel reads metadata for the model with the given id (file name without .pt)
+func loadModel(id string) (*Model, error) {
+	id = strings.TrimSuffix(id, ".pt")
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return nil, ErrModelNotFound
+	}
+	path := filepath.Join(modelsDir(), id+".pt")
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil, ErrModelNotFound
+	}
+	m := &Model{
+		ID:         id,
+		File:       path,
+		Size:       info.Size(),
+		ModifiedAt: info.ModTime(),
+	}
+	m.Config, m.Metrics = parseModelInfo(filepath.Join(modelsDir(), id+".txt"))
+	return m, nil
+}
+
+// listModels returns every .pt file in the models directory
+func listModels() ([]*Model, error) {
+	entries, err := os.ReadDir(modelsDir())
+	if err != nil {
+		return nil, err
+	}
+	models := []*Model{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pt") {
+			continue
+		}
+		if m, err := loadModel(e.Name()); err == nil {
+			models = append(models, m)
+		}
+	}
+	return models, nil
+}
+
+// parseModelInfo reads the training summary written next to each model by
+// train_yolov8.py, using the same labels as parse_model_metrics in the Python service
+func parseModelInfo(path string) (map[string]string, map[string]float64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	config := map[string]string{}
+	metrics := map[string]float64{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "Training Configuration:":
+			section = "config"
+			continue
+		case line == "Final Training Metrics:":
+			section = "metrics"
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch section {
+		case "config":
+			config[key] = value
+		case "metrics":
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "Precision (P)":
+				metrics["p"] = v
+			case "Recall (R)":
+				metrics["r"] = v
+			case "mAP50":
+				metrics["map50"] = v
+			case "mAP50-95":
+				metrics["map50_95"] = v
+			}
+		}
+	}
+	return config, metrics
+}
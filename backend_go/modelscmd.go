@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// models and datasets: scriptable management of a running backend through
+// apiClient
+
+// apiOptions are the flags shared by the models and datasets commands
+type apiOptions struct {
+	target  string
+	timeout time.Duration
+	asJSON  bool
+}
+
+func (o *apiOptions) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&o.target, "url", "", "backend to manage instead of the local one, e.g. http://backend:3000")
+	cmd.PersistentFlags().DurationVar(&o.timeout, "timeout", 30*time.Second, "give up on a request after this long")
+	cmd.PersistentFlags().BoolVar(&o.asJSON, "json", false, "print as JSON")
+}
+
+func (o *apiOptions) client() *apiClient {
+	return newAPIClient(o.target, o.timeout)
+}
+
+// print writes v as indented JSON with --json, and calls text otherwise
+func (o *apiOptions) print(out io.Writer, v interface{}, text func(w io.Writer)) error {
+	if o.asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	text(tw)
+	return tw.Flush()
+}
+
+func newModelsCommand() *cobra.Command {
+	var opts apiOptions
+	cmd := &cobra.Command{
+		Use:   "models",
+		Short: "List, inspect, download and delete trained models",
+		Long: `Manages the trained models of the backend at LISTEN_ADDR or --url. Models
+are named as listed (best_model.pt) or without the .pt extension.`,
+		Args: cobra.NoArgs,
+	}
+	opts.addFlags(cmd)
+
+	var modelSelector string
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List trained models with their final metrics",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			models, err := opts.client().ListModels(cmd.Context(), modelSelector)
+			if err != nil {
+				return err
+			}
+			return opts.print(cmd.OutOrStdout(), models, func(w io.Writer) {
+				fmt.Fprintln(w, "NAME\tMODIFIED\tP\tR\tMAP50\tMAP50-95")
+				for _, m := range models {
+					modified := time.Unix(int64(m.LastModified), 0).Format("2006-01-02 15:04")
+					fmt.Fprintf(w, "%s\t%s\t%.3f\t%.3f\t%.3f\t%.3f\n", m.Name, modified, m.P, m.R, m.MAP50, m.MAP50_95)
+				}
+			})
+		},
+	}
+
+	get := &cobra.Command{
+		Use:   "get <model>",
+		Short: "Show the size, training config and metrics of a model",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			model, err := opts.client().Model(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			return opts.print(cmd.OutOrStdout(), model, func(w io.Writer) {
+				fmt.Fprintf(w, "Model:\t%s\n", model.ID)
+				fmt.Fprintf(w, "File:\t%s\n", model.File)
+				fmt.Fprintf(w, "Size:\t%d bytes\n", model.Size)
+				fmt.Fprintf(w, "Modified:\t%s\n", model.ModifiedAt.Format(time.RFC3339))
+				for _, k := range sortedKeys(model.Metrics) {
+					fmt.Fprintf(w, "%s:\t%.4f\n", k, model.Metrics[k])
+				}
+				for _, k := range sortedKeys(model.Config) {
+					fmt.Fprintf(w, "%s:\t%s\n", k, model.Config[k])
+				}
+			})
+		},
+	}
+
+	var (
+		output   string
+		withCard bool
+	)
+	download := &cobra.Command{
+		Use:   "download <model>",
+		Short: "Download the weights of a model",
+		Long: `Downloads the weights of a model to --output, by default its file name in
+the current directory. "-o -" writes them to standard output. With --card the
+model card is saved next to them as <name>.md.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := modelFileName(args[0])
+			if output == "" {
+				output = filepath.Base(name)
+			}
+			client := opts.client()
+			ctx, cancel := context.WithTimeout(cmd.Context(), downloadTimeout(opts.timeout))
+			defer cancel()
+			if output == "-" {
+				_, err := client.DownloadModel(ctx, name, cmd.OutOrStdout())
+				return err
+			}
+			// Write next to the destination first so a failed download
+			// leaves no partial weights behind
+			tmp, err := os.CreateTemp(filepath.Dir(output), ".download-*")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(tmp.Name())
+			n, err := client.DownloadModel(ctx, name, tmp)
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			if err := os.Rename(tmp.Name(), output); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Downloaded %s to %s (%d bytes)\n", name, output, n)
+			if withCard {
+				card, err := client.ModelCard(ctx, name)
+				if err != nil {
+					return fmt.Errorf("model card: %w", err)
+				}
+				cardFile := strings.TrimSuffix(output, filepath.Ext(output)) + ".md"
+				if err := os.WriteFile(cardFile, []byte(card), 0o644); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "Saved the model card to %s\n", cardFile)
+			}
+			return nil
+		},
+	}
+	download.Flags().StringVarP(&output, "output", "o", "", "file to write, or - for standard output")
+	download.Flags().BoolVar(&withCard, "card", false, "also save the model card next to the weights")
+
+	del := &cobra.Command{
+		Use:   "delete <model>...",
+		Short: "Delete models along with their reports",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := opts.client()
+			for _, name := range args {
+				if err := client.DeleteModel(cmd.Context(), name); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Deleted %s\n", modelFileName(name))
+			}
+			return nil
+		},
+	}
+
+	list.Flags().StringVarP(&modelSelector, "selector", "l", "", "only models with matching labels, e.g. team=vision,stage in (prod)")
+	cmd.AddCommand(list, get, download, del)
+	return cmd
+}
+
+// downloadTimeout scales the request timeout up for weights files, which
+// are far larger than any API answer
+func downloadTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return 0
+	}
+	return 20 * timeout
+}
+
+func newDatasetsCommand() *cobra.Command {
+	var opts apiOptions
+	cmd := &cobra.Command{
+		Use:   "datasets",
+		Short: "Inspect datasets and upload images for the custom dataset",
+		Long: `Manages the datasets of the backend at LISTEN_ADDR or --url: the synthetic
+dataset and the custom dataset generated from uploaded target and
+background images.`,
+		Args: cobra.NoArgs,
+	}
+	opts.addFlags(cmd)
+
+	var datasetSelector string
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the datasets with their image counts",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			datasets, err := opts.client().ListDatasets(cmd.Context(), datasetSelector)
+			if err != nil {
+				return err
+			}
+			return opts.print(cmd.OutOrStdout(), datasets, func(w io.Writer) {
+				fmt.Fprintln(w, "NAME\tEXISTS\tIMAGES\tPATH")
+				for _, d := range datasets {
+					fmt.Fprintf(w, "%s\t%t\t%d\t%s\n", d.Name, d.Exists, d.TotalImages, d.Path)
+				}
+			})
+		},
+	}
+
+	stats := &cobra.Command{
+		Use:       "stats <dataset>",
+		Short:     "Show the image count of a dataset, and the uploaded images of the custom one",
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: datasetNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := opts.client()
+			info, err := client.DatasetStats(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			stats := struct {
+				*DatasetInfo
+				Targets     []DatasetFile `json:"targets,omitempty"`
+				Backgrounds []DatasetFile `json:"backgrounds,omitempty"`
+			}{DatasetInfo: info}
+			if info.Name == "custom" {
+				if stats.Targets, err = client.DatasetFiles(cmd.Context(), "target"); err != nil {
+					return err
+				}
+				if stats.Backgrounds, err = client.DatasetFiles(cmd.Context(), "background"); err != nil {
+					return err
+				}
+			}
+			return opts.print(cmd.OutOrStdout(), stats, func(w io.Writer) {
+				fmt.Fprintf(w, "Dataset:\t%s\n", info.Name)
+				fmt.Fprintf(w, "Exists:\t%t\n", info.Exists)
+				fmt.Fprintf(w, "Images:\t%d\n", info.TotalImages)
+				if info.Path != "" {
+					fmt.Fprintf(w, "Path:\t%s\n", info.Path)
+				}
+				if info.Name == "custom" {
+					fmt.Fprintf(w, "Targets:\t%d (%d bytes)\n", len(stats.Targets), totalSize(stats.Targets))
+					fmt.Fprintf(w, "Backgrounds:\t%d (%d bytes)\n", len(stats.Backgrounds), totalSize(stats.Backgrounds))
+				}
+			})
+		},
+	}
+
+	var kind string
+	upload := &cobra.Command{
+		Use:   "upload --kind target|background <image>...",
+		Short: "Upload target or background images for the custom dataset",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := opts.client()
+			for _, path := range args {
+				name, err := client.UploadDatasetFile(cmd.Context(), kind, path)
+				if err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Uploaded %s as %s\n", path, name)
+			}
+			return nil
+		},
+	}
+	upload.Flags().StringVar(&kind, "kind", "", "what the images are: target or background")
+	upload.MarkFlagRequired("kind")
+
+	list.Flags().StringVarP(&datasetSelector, "selector", "l", "", "only datasets with matching labels, e.g. source=synthetic")
+	cmd.AddCommand(list, stats, upload)
+	return cmd
+}
+
+func totalSize(files []DatasetFile) int64 {
+	var n int64
+	for _, f := range files {
+		n += f.Size
+	}
+	return n
+}
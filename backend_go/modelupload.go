@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Resumable model uploads. PUT /api/model/{id}/upload takes the weights
+// either whole or in chunks carrying Content-Range: bytes start-end/total.
+// Chunks go to a hidden .part file in the models directory; one that starts
+// before the end of it replaces what follows, so a chunk whose answer got
+// lost can be sent again. A PUT without Content-Range is the whole file, and
+// may be sent chunked. GET tells how many bytes have arrived, for a client
+// resuming an interrupted upload. With the last byte the file becomes
+// <id>.pt and is recorded in the checksum manifest. An existing model is only
+// replaced with ?overwrite=true; the total may be up to MAX_UPLOAD_SIZE.
+// Uploads of different models run side by side; those of one model take
+// turns.
+
+// modelUploadLimit is MAX_UPLOAD_SIZE
+var modelUploadLimit int64
+
+// modelUploads holds a lock per model being uploaded, so chunks of one model
+// are written in turn while other models upload in parallel
+var modelUploads = struct {
+	sync.Mutex
+	locks map[string]*modelUploadLock
+}{locks: map[string]*modelUploadLock{}}
+
+type modelUploadLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockModelUpload waits for the upload lock of id and returns its unlock
+func lockModelUpload(id string) (unlock func()) {
+	modelUploads.Lock()
+	l := modelUploads.locks[id]
+	if l == nil {
+		l = &modelUploadLock{}
+		modelUploads.locks[id] = l
+	}
+	l.users++
+	modelUploads.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		modelUploads.Lock()
+		if l.users--; l.users == 0 {
+			delete(modelUploads.locks, id)
+		}
+		modelUploads.Unlock()
+	}
+}
+
+func init() {
+	modelActions["upload"] = modelAction{[]string{http.MethodGet, http.MethodPut}, handleModelUpload}
+}
+
+// modelUploadPath is where the chunks of a model's upload collect
+func modelUploadPath(id string) string {
+	return filepath.Join(modelsDir(), "."+id+".pt.part")
+}
+
+// parseContentRange reads "bytes start-end/total"
+func parseContentRange(header string, length int64) (start, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, errors.New("want bytes start-end/total")
+	}
+	span, size, _ := strings.Cut(spec, "/")
+	first, last, _ := strings.Cut(span, "-")
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	total, err3 := strconv.ParseInt(size, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || start < 0 || end < start || end >= total {
+		return 0, 0, errors.New("want bytes start-end/total")
+	}
+	if length >= 0 && end-start+1 != length {
+		return 0, 0, fmt.Errorf("range is %d bytes, body %d", end-start+1, length)
+	}
+	return start, total, nil
+}
+
+// handleModelUpload reports an upload's progress (GET) or takes a chunk (PUT)
+func handleModelUpload(w http.ResponseWriter, r *http.Request, modelID string) {
+	id := strings.TrimSuffix(modelID, ".pt")
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid model id"})
+		return
+	}
+	part := modelUploadPath(id)
+	var received int64
+	if r.Method != http.MethodPut {
+		if info, err := os.Stat(part); err == nil {
+			received = info.Size()
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "offset": received})
+		return
+	}
+	defer lockModelUpload(id)()
+	if info, err := os.Stat(part); err == nil {
+		received = info.Size()
+	}
+
+	if _, err := loadModel(id); err == nil && r.URL.Query().Get("overwrite") != "true" {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "model " + id + " exists, add overwrite=true to replace it"})
+		return
+	}
+	start, total := int64(0), r.ContentLength
+	header := r.Header.Get("Content-Range")
+	if header != "" {
+		var err error
+		if start, total, err = parseContentRange(header, r.ContentLength); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Content-Range: " + err.Error()})
+			return
+		}
+	}
+	if modelUploadLimit > 0 && total > modelUploadLimit {
+		writeTooLarge(w, r, modelUploadLimit)
+		return
+	}
+	if start > received {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": fmt.Sprintf("chunk starts at %d, %d bytes received", start, received), "offset": received})
+		return
+	}
+
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	// A chunk sent again replaces what followed its start
+	err = f.Truncate(start)
+	if err == nil {
+		_, err = f.Seek(start, io.SeekStart)
+	}
+	var written int64
+	if err == nil {
+		written, err = io.Copy(f, r.Body)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if limit, ok := tooLarge(err); ok {
+			writeTooLarge(w, r, limit)
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "writing upload: " + err.Error()})
+		return
+	}
+	received = start + written
+	if header == "" {
+		// The whole file, complete when the body ends
+		total = received
+	}
+	if received < total {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "offset": received})
+		return
+	}
+	if received > total {
+		os.Remove(part)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("received %d bytes, more than the %d announced", received, total)})
+		return
+	}
+
+	file := filepath.Join(modelsDir(), id+".pt")
+	if err := os.Rename(part, file); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if checksums != nil {
+		if sum, err := fileSHA256(file); err != nil {
+			log.Printf("Error recording checksum of %s: %v", file, err)
+		} else if err := checksums.Put(modelKey(file), sum, total); err != nil {
+			log.Printf("Error recording checksum of %s: %v", file, err)
+		}
+	}
+	responses.Invalidate("/api/models")
+	log.Printf("Model %s uploaded by %s, %d bytes (request %s)", id, secretActor(r), total, requestID(r))
+	model, err := loadModel(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, model)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Notebook servers by workspace. The "notebooks" block of CONFIG_FILE names
+// a JupyterLab server for a workspace, which the backend proxies under
+// /notebooks/{workspace}/, kernel and terminal WebSockets included, so data
+// scientists can explore datasets next to the training UI. Each server runs
+// with that path as its base_url and the workspace's data directory as its
+// root_dir; the backend sends its token on every request, so users never
+// handle it. Access needs a login (OIDC_ISSUER), optionally in given groups.
+// GET /api/notebooks lists the workspaces whose notebooks the user may open.
+
+// notebooksPrefix is where the notebook servers are mounted
+const notebooksPrefix = "/notebooks/"
+
+// NotebookConfig is a workspace's JupyterLab server
+type NotebookConfig struct {
+	// URL is the server, started with --ServerApp.base_url=/notebooks/{workspace}/
+	URL string `json:"url"`
+	// TokenEnv names the environment variable holding the server's token
+	TokenEnv string `json:"token_env,omitempty"`
+	// Groups admits only identities in one of them; empty admits any login
+	Groups []string `json:"groups,omitempty"`
+	// AllowAnonymous serves the notebook without OIDC, for deployments behind
+	// an authenticating proxy
+	AllowAnonymous bool `json:"allow_anonymous,omitempty"`
+}
+
+// notebookServer is a configured notebook with its proxy
+type notebookServer struct {
+	workspace string
+	cfg       NotebookConfig
+	proxy     *httputil.ReverseProxy
+}
+
+// validateNotebooks checks the notebooks block of the config
+func validateNotebooks(notebooks map[string]NotebookConfig) error {
+	for ws, nb := range notebooks {
+		if ws == "" || strings.ContainsAny(ws, "/?#%") {
+			return fmt.Errorf("notebooks: invalid workspace name %q", ws)
+		}
+		u, err := url.Parse(nb.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notebooks: %s: invalid url %q", ws, nb.URL)
+		}
+	}
+	return nil
+}
+
+// newNotebookServers builds the proxies of a validated notebooks block
+func newNotebookServers(notebooks map[string]NotebookConfig) map[string]*notebookServer {
+	servers := map[string]*notebookServer{}
+	for ws, nb := range notebooks {
+		target, _ := url.Parse(nb.URL)
+		token := ""
+		if nb.TokenEnv != "" {
+			token = os.Getenv(nb.TokenEnv)
+			if token == "" {
+				log.Printf("Notebook server of workspace %s: %s is not set, requests go without a token", ws, nb.TokenEnv)
+			}
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				// The server's base_url is the proxied path, so it stays as is
+				pr.Out.URL.Scheme, pr.Out.URL.Host = target.Scheme, target.Host
+				pr.Out.Host = target.Host
+				pr.SetXForwarded()
+				if token != "" {
+					pr.Out.Header.Set("Authorization", "token "+token)
+				} else {
+					pr.Out.Header.Del("Authorization")
+				}
+				// Jupyter checks the Origin of WebSockets against its own host;
+				// the backend has checked it against its own already
+				if pr.Out.Header.Get("Origin") != "" {
+					pr.Out.Header.Set("Origin", target.Scheme+"://"+target.Host)
+				}
+				pr.Out.Header.Del(authUserHeader)
+				pr.Out.Header.Del(authSubjectHeader)
+				pr.Out.Header.Del(authGroupsHeader)
+				removeCookie(pr.Out, sessionCookie)
+				removeCookie(pr.Out, csrfCookie)
+			},
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("Notebook server of workspace %s unreachable: %v (request %s)", ws, err, requestID(r))
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": "notebook server unavailable"})
+			},
+		}
+		servers[ws] = &notebookServer{workspace: ws, cfg: nb, proxy: proxy}
+	}
+	return servers
+}
+
+// removeCookie drops one cookie from a request, keeping the others
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// allows reports whether the request's user may use the notebook, and why not
+func (nb *notebookServer) allows(r *http.Request) (bool, string) {
+	id := identityFrom(r)
+	if id == nil {
+		if nb.cfg.AllowAnonymous {
+			return true, ""
+		}
+		return false, "notebooks need a login, set OIDC_ISSUER"
+	}
+	if len(nb.cfg.Groups) == 0 {
+		return true, ""
+	}
+	for _, g := range id.Groups {
+		if slices.Contains(nb.cfg.Groups, g) {
+			return true, ""
+		}
+	}
+	return false, "not in a group allowed to use the notebooks of workspace " + nb.workspace
+}
+
+// sameOrigin reports whether a browser request comes from the backend's own
+// pages or an allowed origin. The token the backend adds exempts requests
+// from Jupyter's own XSRF check, and a cross-site page must not reach a
+// kernel with the user's cookies, so unlike checkOrigin an empty allowlist
+// admits no other origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && (strings.EqualFold(u.Host, r.Host) || strings.EqualFold(u.Host, requestHost(r))) {
+		return true
+	}
+	for _, o := range currentSettings().allowedOrigins {
+		if o != "*" && strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleNotebook proxies /notebooks/{workspace}/... to the workspace's server
+func handleNotebook(w http.ResponseWriter, r *http.Request) {
+	ws, rest, found := strings.Cut(strings.TrimPrefix(r.URL.Path, notebooksPrefix), "/")
+	nb := currentSettings().notebooks[ws]
+	if nb == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no notebook server for workspace " + ws})
+		return
+	}
+	if ok, reason := nb.allows(r); !ok {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": reason})
+		return
+	}
+	if !found {
+		http.Redirect(w, r, notebooksPrefix+ws+"/", http.StatusFound)
+		return
+	}
+	upgrade := r.Header.Get("Upgrade") != ""
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+	if (upgrade || !safe) && !sameOrigin(r) {
+		log.Printf("Rejected notebook request of workspace %s from origin %s", ws, r.Header.Get("Origin"))
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "origin not allowed"})
+		return
+	}
+	if upgrade {
+		// Kernels and terminals stay open as long as the tab
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		if path := "/" + rest; strings.Contains(path, "/kernels/") || strings.Contains(path, "/terminals/") {
+			audit.RecordRequest(r, AuditNotebook, ws, 0, map[string]string{"path": path})
+		}
+	}
+	// JupyterLab sends its own policy; the UI's would break it
+	w.Header().Del("Content-Security-Policy")
+	nb.proxy.ServeHTTP(w, r)
+}
+
+// notebookInfo is a notebook the user may open, as listed by /api/notebooks
+type notebookInfo struct {
+	Workspace string `json:"workspace"`
+	Path      string `json:"path"`
+}
+
+func handleNotebookList(w http.ResponseWriter, r *http.Request) {
+	servers := currentSettings().notebooks
+	out := []notebookInfo{}
+	for _, ws := range sortedKeys(servers) {
+		if ok, _ := servers[ws].allows(r); ok {
+			out = append(out, notebookInfo{Workspace: ws, Path: notebooksPrefix + ws + "/lab"})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"notebooks": out})
+}
+
+// registerNotebookRoutes mounts the notebook proxy and its listing
+func registerNotebookRoutes() {
+	http.HandleFunc(notebooksPrefix, handleNotebook)
+	http.HandleFunc("GET /api/notebooks", handleNotebookList)
+}
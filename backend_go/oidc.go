@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect login (authorization code flow with PKCE) against the
+// identity provider at OIDC_ISSUER. The session lives in an encrypted
+// cookie, so it survives restarts and upgrades and works across replicas
+// sharing SESSION_SECRET. Tokens are refreshed when they expire, which also
+// ends the session of a user the provider has disabled. Machine clients send
+// a provider-issued JWT as "Authorization: Bearer" instead.
+
+const (
+	sessionCookie   = "training_session"
+	loginCookie     = "training_login"
+	oidcClockSkew   = time.Minute
+	loginStateTTL   = 10 * time.Minute
+	jwksMinInterval = time.Minute
+)
+
+// oidc is the configured provider, nil when OIDC is off
+var oidc *oidcProvider
+
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string // empty derives it from the request
+	scopes       string
+	audience     string // accepted aud of bearer tokens
+	groupsClaim  string
+	allowed      map[string]bool // groups allowed to sign in, empty allows all
+	sessionTTL   time.Duration
+	aead         cipher.AEAD
+	csrfKey      []byte
+	http         *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+	refreshed map[string]*oidcRefresh // by refresh token, see refresh
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcSession is the content of the session cookie
+type oidcSession struct {
+	Identity
+	ID           string    `json:"id"`  // binds the CSRF token to the session
+	Expires      time.Time `json:"exp"` // end of the session, SESSION_TTL after login
+	RefreshAt    time.Time `json:"rat"` // when the tokens expire and are refreshed
+	RefreshToken string    `json:"rt,omitempty"`
+}
+
+// oidcLogin is the content of the login cookie between /auth/login and the callback
+type oidcLogin struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Redirect string    `json:"redirect"`
+	Expires  time.Time `json:"exp"`
+}
+
+type oidcTokens struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// oidcRefresh remembers a refresh for a minute, so parallel requests of a
+// browser share one instead of racing with a rotated refresh token
+type oidcRefresh struct {
+	done    chan struct{}
+	session *oidcSession
+	err     error
+	at      time.Time
+}
+
+// newOIDCProviderFromEnv configures OIDC from OIDC_ISSUER and friends; nil
+// when OIDC_ISSUER is unset
+func newOIDCProviderFromEnv() (*oidcProvider, error) {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	p := &oidcProvider{
+		issuer:       issuer,
+		clientID:     os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		scopes:       getEnv("OIDC_SCOPES", "openid profile email"),
+		groupsClaim:  getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		allowed:      map[string]bool{},
+		sessionTTL:   envDuration("SESSION_TTL", 12*time.Hour),
+		http:         &http.Client{Timeout: 10 * time.Second},
+		refreshed:    map[string]*oidcRefresh{},
+	}
+	if p.clientID == "" {
+		return nil, errors.New("OIDC_ISSUER is set but OIDC_CLIENT_ID is not")
+	}
+	p.audience = getEnv("OIDC_AUDIENCE", p.clientID)
+	for _, g := range strings.Split(os.Getenv("OIDC_ALLOWED_GROUPS"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			p.allowed[g] = true
+		}
+	}
+	secret := os.Getenv("SESSION_SECRET")
+	if secret == "" {
+		log.Printf("WARNING: SESSION_SECRET is not set, sessions end when the backend restarts")
+		secret = newID() + newID()
+	}
+	key := sha256.Sum256([]byte(secret))
+	csrfKey := sha256.Sum256([]byte("csrf:" + secret))
+	p.csrfKey = csrfKey[:]
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if p.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// registerAuthRoutes mounts the login flow when OIDC is configured
+func registerAuthRoutes() {
+	if oidc == nil {
+		return
+	}
+	http.HandleFunc("/auth/login", oidc.handleLogin)
+	http.HandleFunc("/auth/callback", oidc.handleCallback)
+	http.HandleFunc("/auth/logout", oidc.handleLogout)
+	http.HandleFunc("/auth/me", oidc.handleMe)
+	http.HandleFunc("/auth/csrf", oidc.handleCSRF)
+}
+
+// authenticate returns the identity of the request, answering it with a
+// login redirect or 401 when there is none
+func (p *oidcProvider) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		claims, err := p.verify(r.Context(), strings.TrimPrefix(auth, "Bearer "), p.audience)
+		if err != nil {
+			debugf("Bearer token rejected (request %s): %v", requestID(r), err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid bearer token"})
+			return nil, false
+		}
+		id := p.identity(claims)
+		if !p.allowedIdentity(id) {
+			debugf("Bearer token of %s refused: not in OIDC_ALLOWED_GROUPS (request %s)", id.User(), requestID(r))
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "not allowed to use this service"})
+			return nil, false
+		}
+		id.Method = "bearer"
+		return id, true
+	}
+
+	session := p.readSession(r)
+	if session != nil && time.Now().After(session.RefreshAt) {
+		var err error
+		if session, err = p.refresh(r.Context(), session); err != nil {
+			log.Printf("Session refresh failed (request %s): %v", requestID(r), err)
+			session = nil
+		} else {
+			p.writeSession(w, r, session)
+		}
+	}
+	if session == nil {
+		p.clearCookie(w, r, sessionCookie, "/")
+		// Browsers navigating to a page go to the login, API calls get 401
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/auth/login?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return nil, false
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="training"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required", "login_url": "/auth/login"})
+		return nil, false
+	}
+	if session.ID == "" {
+		// Sessions from before CSRF tokens get an ID now
+		session.ID = randomToken()
+		p.writeSession(w, r, session)
+	}
+	p.issueCSRFToken(w, r, session)
+	id := session.Identity
+	id.Method = "session"
+	id.session = session.ID
+	return &id, true
+}
+
+// handleLogin sends the browser to the provider's authorization endpoint
+func (p *oidcProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	d, err := p.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		Redirect: safeRedirect(r.URL.Query().Get("redirect")),
+		Expires:  time.Now().Add(loginStateTTL),
+	}
+	if err := p.setCookie(w, r, loginCookie, "/auth/", login, login.Expires); err != nil {
+		http.Error(w, "Could not start login", http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.callbackURL(r)},
+		"scope":                 {p.scopes},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+"?"+q.Encode(), http.StatusFound)
+}
+
+// handleCallback exchanges the authorization code and starts the session
+func (p *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	if !p.readCookie(r, loginCookie, &login) || time.Now().After(login.Expires) {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	p.clearCookie(w, r, loginCookie, "/auth/")
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("OIDC login refused by the provider: %s %s", e, q.Get("error_description"))
+		http.Error(w, "Login failed: "+e, http.StatusForbidden)
+		return
+	}
+	if q.Get("state") != login.State || q.Get("code") == "" {
+		http.Error(w, "Invalid login response", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := p.exchange(r.Context(), url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {p.callbackURL(r)},
+		"code_verifier": {login.Verifier},
+	})
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := p.verify(r.Context(), tokens.IDToken, p.clientID)
+	if err == nil && claims["nonce"] != login.Nonce {
+		err = errors.New("nonce mismatch")
+	}
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	id := p.identity(claims)
+	if !p.allowedIdentity(id) {
+		log.Printf("Login of %s refused: not in OIDC_ALLOWED_GROUPS", id.User())
+		http.Error(w, "You are not allowed to use this service", http.StatusForbidden)
+		return
+	}
+	session := &oidcSession{
+		Identity:     *id,
+		ID:           randomToken(),
+		Expires:      time.Now().Add(p.sessionTTL),
+		RefreshAt:    tokensExpiry(tokens, claims),
+		RefreshToken: tokens.RefreshToken,
+	}
+	p.writeSession(w, r, session)
+	log.Printf("User %s logged in", id.User())
+	http.Redirect(w, r, login.Redirect, http.StatusFound)
+}
+
+// handleLogout ends the session, and the provider's when it supports that
+func (p *oidcProvider) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if session := p.readSession(r); session != nil {
+		log.Printf("User %s logged out", session.User())
+	}
+	p.clearCookie(w, r, sessionCookie, "/")
+	p.clearCookie(w, r, csrfCookie, "/")
+	target := "/"
+	if d, err := p.discover(r.Context()); err == nil && d.EndSessionEndpoint != "" {
+		q := url.Values{"client_id": {p.clientID}}
+		if after := os.Getenv("OIDC_POST_LOGOUT_REDIRECT_URL"); after != "" {
+			q.Set("post_logout_redirect_uri", after)
+		}
+		target = d.EndSessionEndpoint + "?" + q.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleMe returns the identity of the session, for the UI to show
+func (p *oidcProvider) handleMe(w http.ResponseWriter, r *http.Request) {
+	session := p.readSession(r)
+	if session == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "not logged in", "login_url": "/auth/login"})
+		return
+	}
+	id := session.Identity
+	id.Method = "session"
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":       id.User(),
+		"identity":   id,
+		"expires_at": session.Expires,
+	})
+}
+
+// refresh renews the tokens of a session with its refresh token. Without
+// one the session simply lasts SESSION_TTL.
+func (p *oidcProvider) refresh(ctx context.Context, session *oidcSession) (*oidcSession, error) {
+	if session.RefreshToken == "" {
+		s := *session
+		s.RefreshAt = s.Expires
+		return &s, nil
+	}
+	p.mu.Lock()
+	for token, call := range p.refreshed {
+		if time.Since(call.at) > time.Minute {
+			delete(p.refreshed, token)
+		}
+	}
+	call, ok := p.refreshed[session.RefreshToken]
+	if !ok {
+		call = &oidcRefresh{done: make(chan struct{}), at: time.Now()}
+		p.refreshed[session.RefreshToken] = call
+		go func() {
+			defer close(call.done)
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			call.session, call.err = p.renew(ctx, session)
+		}()
+	}
+	p.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.session, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *oidcProvider) renew(ctx context.Context, session *oidcSession) (*oidcSession, error) {
+	tokens, err := p.exchange(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := *session
+	var claims map[string]interface{}
+	if tokens.IDToken != "" {
+		if claims, err = p.verify(ctx, tokens.IDToken, p.clientID); err != nil {
+			return nil, err
+		}
+		if claims["sub"] != session.Subject {
+			return nil, errors.New("refreshed ID token is for another subject")
+		}
+		s.Identity = *p.identity(claims)
+		if !p.allowedIdentity(&s.Identity) {
+			return nil, fmt.Errorf("%s is no longer in OIDC_ALLOWED_GROUPS", s.User())
+		}
+	}
+	if tokens.RefreshToken != "" {
+		s.RefreshToken = tokens.RefreshToken
+	}
+	s.RefreshAt = tokensExpiry(tokens, claims)
+	return &s, nil
+}
+
+// exchange calls the token endpoint
+func (p *oidcProvider) exchange(ctx context.Context, form url.Values) (*oidcTokens, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var tokens oidcTokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	return &tokens, nil
+}
+
+// discover fetches and caches the provider configuration
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = &oidcDiscovery{}
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("provider reports issuer %q, expected %q", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("provider configuration lacks endpoints")
+	}
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+	return d, nil
+}
+
+// key returns the signing key with the given id, refetching the key set
+// when it is unknown (the provider rotated keys) at most once a minute
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysAt) > jwksMinInterval
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	p.mu.Lock()
+	p.keys, p.keysAt = keys, time.Now()
+	p.mu.Unlock()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// verify checks a JWT's signature, issuer, audience and validity period and
+// returns its claims
+func (p *oidcProvider) verify(ctx context.Context, token, audience string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != p.issuer {
+		return nil, fmt.Errorf("issuer %q", iss)
+	}
+	if !hasAudience(claims["aud"], audience) {
+		return nil, fmt.Errorf("token is not for audience %q", audience)
+	}
+	now := time.Now()
+	exp, _ := claims["exp"].(float64)
+	if now.Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(iat), 0)) {
+		return nil, errors.New("token issued in the future")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// identity reads the user from ID or access token claims
+func (p *oidcProvider) identity(claims map[string]interface{}) *Identity {
+	id := &Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.Name, _ = claims["name"].(string)
+	if id.Name == "" {
+		id.Name, _ = claims["preferred_username"].(string)
+	}
+	switch groups := claims[p.groupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	case string:
+		id.Groups = strings.Fields(groups)
+	}
+	return id
+}
+
+func (p *oidcProvider) allowedIdentity(id *Identity) bool {
+	if len(p.allowed) == 0 {
+		return true
+	}
+	for _, g := range id.Groups {
+		if p.allowed[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// callbackURL is OIDC_REDIRECT_URL, or /auth/callback on the host the client used
+func (p *oidcProvider) callbackURL(r *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	return requestProto(r) + "://" + requestHost(r) + "/auth/callback"
+}
+
+func (p *oidcProvider) readSession(r *http.Request) *oidcSession {
+	var s oidcSession
+	if !p.readCookie(r, sessionCookie, &s) || time.Now().After(s.Expires) {
+		return nil
+	}
+	return &s
+}
+
+func (p *oidcProvider) writeSession(w http.ResponseWriter, r *http.Request, s *oidcSession) {
+	if err := p.setCookie(w, r, sessionCookie, "/", s, s.Expires); err != nil {
+		log.Printf("Error writing session cookie: %v", err)
+	}
+}
+
+// seal encrypts and authenticates v. The purpose is authenticated too, so a
+// value sealed for one use (a login cookie) cannot pose as another (a session).
+func (p *oidcProvider) seal(purpose string, v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(p.aead.Seal(nonce, nonce, plain, []byte(purpose))), nil
+}
+
+// open decrypts a value sealed for the purpose into v
+func (p *oidcProvider) open(purpose, value string, v interface{}) bool {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	n := p.aead.NonceSize()
+	if err != nil || len(sealed) < n {
+		return false
+	}
+	plain, err := p.aead.Open(nil, sealed[:n], sealed[n:], []byte(purpose))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(plain, v) == nil
+}
+
+// setCookie stores v sealed in a cookie
+func (p *oidcProvider) setCookie(w http.ResponseWriter, r *http.Request, name, path string, v interface{}, expires time.Time) error {
+	value, err := p.seal(name, v)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   requestProto(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (p *oidcProvider) readCookie(r *http.Request, name string, v interface{}) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	return p.open(name, c.Value, v)
+}
+
+func (p *oidcProvider) clearCookie(w http.ResponseWriter, r *http.Request, name, path string) {
+	if _, err := r.Cookie(name); err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, HttpOnly: true, Secure: requestProto(r) == "https"})
+}
+
+// tokensExpiry is when the access token (or else the ID token) expires
+func tokensExpiry(tokens *oidcTokens, claims map[string]interface{}) time.Time {
+	if tokens.ExpiresIn > 0 {
+		return time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0)
+	}
+	return time.Now().Add(time.Hour)
+}
+
+// safeRedirect keeps the post-login redirect on this site
+func safeRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/container"
+	}
+	return target
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, v := range a {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jsonWebKey is an RSA or EC public key of the provider's key set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("malformed key")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature checks a JWS signature for the RS, PS and ES algorithms
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return errors.New("invalid signature")
+			}
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %q does not match the key", alg)
+}
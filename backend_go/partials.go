@@ -0,0 +1,250 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server-rendered HTML fragments of training status, for host apps that use
+// HTMX or plain SSR and want to show runs without the module's frontend.
+//
+//	GET /partials/run-status/{id}  one run: status, progress, ETA and latest metrics
+//	GET /partials/run-list         recent runs, newest first
+//
+// Fragments that can still change carry hx-get, hx-trigger and hx-swap
+// attributes, so HTMX polls them every PARTIALS_REFRESH (default 5s); a run's
+// status stops polling once the run ends. Without HTMX the attributes are
+// inert. Elements have mtm-* classes and a data-status for styling, and
+// PARTIALS_BASE_URL is put in front of the polled URLs when the host app
+// serves them under another path.
+
+// partialsMaxRuns bounds the run list
+const partialsMaxRuns = 100
+
+var partialTemplates = template.Must(template.New("partials").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 UTC") },
+}).Parse(`
+{{- define "poll" -}}
+{{if .Poll}} hx-get="{{.Poll}}" hx-trigger="every {{.Every}}" hx-swap="outerHTML"{{end}}
+{{- end -}}
+
+{{- define "run-status" -}}
+<div class="mtm-run-status" id="mtm-run-{{.ID}}" data-run-id="{{.ID}}" data-status="{{.Status}}"{{template "poll" .}}>
+  <div class="mtm-run-header">
+    <span class="mtm-run-name">{{.Name}}</span>
+    <span class="mtm-status mtm-status-{{.Status}}">{{.Status}}</span>
+  </div>
+  {{- if ge .Percent 0}}
+  <progress class="mtm-progress" max="100" value="{{.Percent}}">{{.Percent}}%</progress>
+  {{- end}}
+  <dl class="mtm-run-details">
+    <dt>Started</dt><dd>{{time .Started}}</dd>
+    {{- if .Elapsed}}
+    <dt>{{if .Finished}}Duration{{else}}Elapsed{{end}}</dt><dd>{{.Elapsed}}</dd>
+    {{- end}}
+    {{- if .Remaining}}
+    <dt>Remaining</dt><dd>{{.Remaining}}{{if .Overdue}} (overdue){{end}}</dd>
+    {{- end}}
+    {{- if .ModelID}}
+    <dt>Model</dt><dd class="mtm-model">{{.ModelID}}</dd>
+    {{- end}}
+  </dl>
+  {{- if .Error}}
+  <p class="mtm-error">{{.Error}}</p>
+  {{- end}}
+  {{- if .Metrics}}
+  <table class="mtm-metrics">
+    <thead><tr><th>Metric</th><th>Value</th><th>Step</th></tr></thead>
+    <tbody>
+    {{- range .Metrics}}
+      <tr><td>{{.Key}}</td><td>{{.Value}}</td><td>{{.Step}}</td></tr>
+    {{- end}}
+    </tbody>
+  </table>
+  {{- end}}
+</div>
+{{end -}}
+
+{{- define "run-list" -}}
+<div class="mtm-run-list"{{template "poll" .}}>
+  {{- if .Runs}}
+  <table>
+    <thead><tr><th>Run</th><th>Status</th><th>Started</th><th>Duration</th></tr></thead>
+    <tbody>
+    {{- range .Runs}}
+      <tr class="mtm-run" data-run-id="{{.ID}}" data-status="{{.Status}}">
+        <td class="mtm-run-name">{{.Name}}</td>
+        <td><span class="mtm-status mtm-status-{{.Status}}">{{.Status}}</span>{{if ge .Percent 0}} {{.Percent}}%{{end}}</td>
+        <td>{{time .Started}}</td>
+        <td>{{.Elapsed}}</td>
+      </tr>
+    {{- end}}
+    </tbody>
+  </table>
+  {{- else}}
+  <p class="mtm-empty">No runs</p>
+  {{- end}}
+</div>
+{{end -}}
+`))
+
+type partialMetric struct {
+	Key   string
+	Value string
+	Step  int64
+}
+
+// partialRun is what the templates show of a run
+type partialRun struct {
+	ID, Name, Status, Error string
+	ModelID                 string
+	Started                 time.Time
+	Finished, Overdue       bool
+	Elapsed, Remaining      string
+	// Percent is the share of the expected duration gone by, -1 when unknown
+	Percent int
+	Metrics []partialMetric
+	Poll    string
+	Every   string
+}
+
+// newPartialRun works out what to show of a run; metrics only when asked,
+// since the list leaves them out
+func newPartialRun(run *Run, now time.Time, metrics bool) *partialRun {
+	p := &partialRun{
+		ID: run.ID, Name: run.Name, Status: run.Status, Error: run.Error,
+		ModelID: run.Tags["model_id"], Started: run.StartTime, Finished: run.Finished(), Percent: -1,
+	}
+	if p.Name == "" {
+		p.Name = run.ID
+	}
+	switch {
+	case run.EndTime != nil:
+		p.Elapsed = runDuration(run).Round(time.Second).String()
+	case run.Status == RunRunning:
+		p.Elapsed = (now.Sub(run.StartTime) - runQueuedTime(run)).Round(time.Second).String()
+	}
+	if run.Status == RunFinished {
+		p.Percent = 100
+	}
+	if eta := estimateRun(run.ID, now); eta != nil {
+		p.Remaining = time.Duration(eta.RemainingSeconds * float64(time.Second)).Round(time.Second).String()
+		p.Overdue = eta.Overdue
+		if run.Status == RunRunning && eta.ExpectedSeconds > 0 {
+			// Never 100 before the run actually ends
+			p.Percent = min(99, int(100*(1-eta.RemainingSeconds/eta.ExpectedSeconds)))
+		}
+	}
+	if metrics {
+		for _, key := range sortedKeys(run.Metrics) {
+			points := run.Metrics[key]
+			if len(points) == 0 {
+				continue
+			}
+			last := points[len(points)-1]
+			p.Metrics = append(p.Metrics, partialMetric{Key: key, Value: strconv.FormatFloat(last.Value, 'g', 6, 64), Step: last.Step})
+		}
+	}
+	return p
+}
+
+// partialPoll returns the URL a fragment polls, with the base URL host apps
+// serve partials under
+func partialPoll(r *http.Request) string {
+	return strings.TrimSuffix(getEnv("PARTIALS_BASE_URL", ""), "/") + r.URL.RequestURI()
+}
+
+func partialRefresh() string {
+	return envDuration("PARTIALS_REFRESH", 5*time.Second).String()
+}
+
+func renderPartial(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := partialTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Error rendering partial %s: %v", name, err)
+	}
+}
+
+// handleRunStatusPartial serves /partials/run-status/{id}
+func handleRunStatusPartial(w http.ResponseWriter, r *http.Request) {
+	run, ok := store.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	p := newPartialRun(run, time.Now(), true)
+	if !p.Finished {
+		p.Poll, p.Every = partialPoll(r), partialRefresh()
+	}
+	renderPartial(w, "run-status", p)
+}
+
+// handleRunListPartial serves /partials/run-list, filtered by ?status= and
+// ?label_selector= and cut to ?limit= runs (default 20)
+func handleRunListPartial(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 20
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, partialsMaxRuns)
+	}
+	var sel labelSelector
+	if raw := query.Get("label_selector"); raw != "" {
+		var err error
+		if sel, err = parseLabelSelector(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	statuses := map[string]bool{}
+	for _, s := range strings.Split(query.Get("status"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			statuses[s] = true
+		}
+	}
+
+	all := labels.All(labelKindRun)
+	runs := slices.DeleteFunc(store.List(), func(run *Run) bool {
+		if len(statuses) > 0 && !statuses[run.Status] {
+			return true
+		}
+		if sel != nil {
+			set := all[run.ID]
+			if set == nil {
+				set = map[string]string{}
+			}
+			return !sel.Matches(set)
+		}
+		return false
+	})
+	slices.SortFunc(runs, func(a, b *Run) int { return b.StartTime.Compare(a.StartTime) })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	now := time.Now()
+	data := struct {
+		Runs        []*partialRun
+		Poll, Every string
+	}{Poll: partialPoll(r), Every: partialRefresh()}
+	for _, run := range runs {
+		data.Runs = append(data.Runs, newPartialRun(run, now, false))
+	}
+	renderPartial(w, "run-list", data)
+}
+
+// registerPartialRoutes adds the HTML fragment endpoints
+func registerPartialRoutes() {
+	http.HandleFunc("GET /partials/run-status/{id}", handleRunStatusPartial)
+	http.HandleFunc("GET /partials/run-list", handleRunListPartial)
+}
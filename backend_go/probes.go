@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// Kubernetes probes. /healthz only says the process is serving, so a Python
+// service blip never restarts the pod; /readyz also checks the Python
+// service, the run store and the frontend assets, taking the pod out of load
+// balancing until they recover; /startupz passes once the first round of
+// upstream health checks is in.
+//
+// READY_UPSTREAMS picks which upstreams /readyz requires:
+//
+//	default  the default upstream has a healthy replica (the default)
+//	any      any upstream has a healthy replica
+//	all      every upstream has a healthy replica
+//	none     upstreams are not checked
+const (
+	ReadyUpstreamsDefault = "default"
+	ReadyUpstreamsAny     = "any"
+	ReadyUpstreamsAll     = "all"
+	ReadyUpstreamsNone    = "none"
+)
+
+// probeCheck is a named readiness check; nil means passing
+type probeCheck struct {
+	name string
+	run  func() error
+}
+
+// readyUpstreamsMode reads and checks READY_UPSTREAMS
+func readyUpstreamsMode() (string, error) {
+	mode := strings.ToLower(getEnv("READY_UPSTREAMS", ReadyUpstreamsDefault))
+	switch mode {
+	case ReadyUpstreamsDefault, ReadyUpstreamsAny, ReadyUpstreamsAll, ReadyUpstreamsNone:
+		return mode, nil
+	}
+	return "", fmt.Errorf("READY_UPSTREAMS must be default, any, all or none, got %q", mode)
+}
+
+// registerProbeRoutes mounts /healthz, /readyz and /startupz
+func registerProbeRoutes(router *Router, supervisor *pythonSupervisor) error {
+	mode, err := readyUpstreamsMode()
+	if err != nil {
+		return err
+	}
+
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, nil)
+	})
+
+	var startup []probeCheck
+	if mode != ReadyUpstreamsNone {
+		startup = append(startup, probeCheck{"upstream_checks", func() error {
+			if !router.checked.Load() {
+				return errors.New("first upstream health check not done")
+			}
+			return nil
+		}})
+	}
+	http.HandleFunc("/startupz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, startup)
+	})
+
+	ready := append(append([]probeCheck{}, startup...),
+		probeCheck{"draining", func() error {
+			if draining.Load() {
+				return errors.New("draining")
+			}
+			return nil
+		}},
+		probeCheck{"run_store", store.Check},
+		probeCheck{"assets", func() error {
+			_, err := fs.Stat(frontendAssets, "module.html")
+			return err
+		}},
+	)
+	if mode != ReadyUpstreamsNone {
+		ready = append(ready, probeCheck{"upstreams", func() error { return checkUpstreams(router, mode) }})
+	}
+	if supervisor != nil {
+		ready = append(ready, probeCheck{"python_process", func() error {
+			if state := supervisor.Status().State; state != ProcessRunning {
+				return fmt.Errorf("python process is %s", state)
+			}
+			return nil
+		}})
+	}
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, ready)
+	})
+	return nil
+}
+
+// checkUpstreams applies the READY_UPSTREAMS policy to the current upstreams
+func checkUpstreams(router *Router, mode string) error {
+	if mode == ReadyUpstreamsDefault {
+		up := router.Default()
+		if up == nil || !up.Healthy() {
+			return errors.New("default upstream has no healthy replica")
+		}
+		return nil
+	}
+	var down []string
+	ups := router.Upstreams()
+	for _, up := range ups {
+		if !up.Healthy() {
+			down = append(down, up.Name)
+		}
+	}
+	if mode == ReadyUpstreamsAll && len(down) > 0 {
+		return fmt.Errorf("no healthy replica for %s", strings.Join(down, ", "))
+	}
+	if mode == ReadyUpstreamsAny && len(down) == len(ups) {
+		return errors.New("no upstream has a healthy replica")
+	}
+	return nil
+}
+
+// writeProbe runs the checks and answers 200, or 503 with the failures
+func writeProbe(w http.ResponseWriter, checks []probeCheck) {
+	status, code := "ok", http.StatusOK
+	results := map[string]string{}
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			results[c.name] = err.Error()
+			status, code = "fail", http.StatusServiceUnavailable
+			continue
+		}
+		results[c.name] = "ok"
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": results})
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Model promotion with approvals, kept in DATA_DIR/promotions.json. A user
+// requests moving a model to a registry stage (the model's "stage" label),
+// and the approvers in PROMOTION_APPROVERS approve or reject it under
+// /api/promotions. Once PROMOTION_REQUIRED_APPROVALS of them approve, the
+// label is set and a model previously in production is archived; a single
+// rejection closes the request. Requests and decisions go to the audit log
+// and fire promotion.* webhooks.
+//
+//	POST /api/promotions                {"model": "best", "stage": "production", "comment": "..."}
+//	GET  /api/promotions?status=&model=
+//	GET  /api/promotions/{id}
+//	POST /api/promotions/{id}/approve   {"comment": "..."}
+//	POST /api/promotions/{id}/reject    {"comment": "..."}
+//	POST /api/promotions/{id}/cancel
+
+// Registry stages, set as the "stage" label of a model
+const (
+	stageLabel      = "stage"
+	stageStaging    = "staging"
+	stageProduction = "production"
+	stageArchived   = "archived"
+)
+
+// Promotion statuses
+const (
+	PromotionPending   = "pending"
+	PromotionApproved  = "approved"
+	PromotionRejected  = "rejected"
+	PromotionCancelled = "cancelled"
+)
+
+// Audit actions of the promotion workflow
+const (
+	AuditPromotionRequest  = "promotion_request"
+	AuditPromotionDecision = "promotion_decision"
+)
+
+// promotionAdmin is the approver name of a request made with ADMIN_TOKEN
+const promotionAdmin = "admin-token"
+
+// PromotionDecision is one approver's approval or rejection
+type PromotionDecision struct {
+	Approver string    `json:"approver"`
+	Decision string    `json:"decision"` // "approve" or "reject"
+	Comment  string    `json:"comment,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Promotion is a request to move a model to a registry stage
+type Promotion struct {
+	ID          string              `json:"id"`
+	Model       string              `json:"model"`
+	Stage       string              `json:"stage"`
+	FromStage   string              `json:"from_stage,omitempty"`
+	Status      string              `json:"status"`
+	RequestedBy string              `json:"requested_by"`
+	Comment     string              `json:"comment,omitempty"`
+	Required    int                 `json:"required_approvals"`
+	Decisions   []PromotionDecision `json:"decisions"`
+	CreatedAt   time.Time           `json:"created_at"`
+	DecidedAt   *time.Time          `json:"decided_at,omitempty"`
+	// Archived lists the models moved out of production by this promotion
+	Archived []string `json:"archived,omitempty"`
+}
+
+func (p *Promotion) clone() *Promotion {
+	c := *p
+	c.Decisions = slices.Clone(p.Decisions)
+	c.Archived = slices.Clone(p.Archived)
+	return &c
+}
+
+// approvals counts the approve decisions
+func (p *Promotion) approvals() int {
+	n := 0
+	for _, d := range p.Decisions {
+		if d.Decision == "approve" {
+			n++
+		}
+	}
+	return n
+}
+
+var (
+	errPromotionNotFound = errors.New("promotion not found")
+	errPromotionClosed   = errors.New("promotion is no longer pending")
+	errPromotionPending  = errors.New("a promotion of this model to this stage is already pending")
+	errPromotionDecided  = errors.New("you have already decided on this promotion")
+	errPromotionOwn      = errors.New("requesters cannot approve their own promotion")
+)
+
+// PromotionStore holds every promotion request by id
+type PromotionStore struct {
+	mu         sync.Mutex
+	path       string
+	promotions map[string]*Promotion
+}
+
+// promotions is opened in serve next to the label store
+var promotions *PromotionStore
+
+// NewPromotionStore opens (or creates) the promotion store in dir
+func NewPromotionStore(dir string) (*PromotionStore, error) {
+	s := &PromotionStore{path: filepath.Join(dir, "promotions.json"), promotions: map[string]*Promotion{}}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.promotions); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+	}
+	return s, nil
+}
+
+// save writes the store to disk; callers must hold s.mu
+func (s *PromotionStore) save() error {
+	data, err := json.MarshalIndent(s.promotions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Create stores a new pending promotion, unless one for the same model and
+// stage is already pending
+func (s *PromotionStore) Create(p *Promotion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.promotions {
+		if other.Status == PromotionPending && other.Model == p.Model && other.Stage == p.Stage {
+			return errPromotionPending
+		}
+	}
+	s.promotions[p.ID] = p.clone()
+	return s.save()
+}
+
+// Get returns a copy of a promotion
+func (s *PromotionStore) Get(id string) (*Promotion, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.promotions[id]
+	if !ok {
+		return nil, false
+	}
+	return p.clone(), true
+}
+
+// List returns copies of all promotions, newest first
+func (s *PromotionStore) List() []*Promotion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*Promotion, 0, len(s.promotions))
+	for _, p := range s.promotions {
+		out = append(out, p.clone())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Update applies fn to a pending promotion and saves it
+func (s *PromotionStore) Update(id string, fn func(p *Promotion) error) (*Promotion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.promotions[id]
+	if !ok {
+		return nil, errPromotionNotFound
+	}
+	if p.Status != PromotionPending {
+		return nil, errPromotionClosed
+	}
+	next := p.clone()
+	if err := fn(next); err != nil {
+		return nil, err
+	}
+	s.promotions[id] = next
+	if err := s.save(); err != nil {
+		s.promotions[id] = p
+		return nil, err
+	}
+	return next.clone(), nil
+}
+
+// promotionActor names who made a request: the logged in user, the admin
+// token holder, or failing both the client address
+func promotionActor(r *http.Request) string {
+	if id := identityFrom(r); id != nil {
+		return id.User()
+	}
+	if isAdminToken(r) {
+		return promotionAdmin
+	}
+	return clientIP(r)
+}
+
+// isAdminToken reports whether the request carries ADMIN_TOKEN as its bearer token
+func isAdminToken(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// canApprove reports whether the request comes from a designated approver:
+// a user or "group:name" in PROMOTION_APPROVERS, or the admin token
+func canApprove(r *http.Request) bool {
+	if isAdminToken(r) {
+		return true
+	}
+	return identityListed(identityFrom(r), os.Getenv("PROMOTION_APPROVERS"))
+}
+
+// applyPromotion sets the model's stage label; promoting to production
+// archives the models that were there
+func applyPromotion(p *Promotion) error {
+	stage := p.Stage
+	if _, err := labels.apply(labelKindModel, p.Model, map[string]*string{stageLabel: &stage}); err != nil {
+		return err
+	}
+	if p.Stage == stageProduction {
+		archived := stageArchived
+		for id, set := range labels.All(labelKindModel) {
+			if id == p.Model || set[stageLabel] != stageProduction {
+				continue
+			}
+			if _, err := labels.apply(labelKindModel, id, map[string]*string{stageLabel: &archived}); err != nil {
+				return err
+			}
+			p.Archived = append(p.Archived, id)
+		}
+		sort.Strings(p.Archived)
+	}
+	responses.Invalidate("/api/models")
+	return nil
+}
+
+// handlePromotions serves /api/promotions[/{id}[/{action}]]
+func handlePromotions(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/promotions"), "/"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		listPromotions(w, r)
+	case id == "" && r.Method == http.MethodPost:
+		requestPromotion(w, r)
+	case id == "":
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case action == "" && r.Method == http.MethodGet:
+		p, ok := promotions.Get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": errPromotionNotFound.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case action == "":
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case action != "approve" && action != "reject" && action != "cancel":
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "promotions can be approved, rejected or cancelled"})
+	case r.Method != http.MethodPost:
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		decidePromotion(w, r, id, action)
+	}
+}
+
+func listPromotions(w http.ResponseWriter, r *http.Request) {
+	status, model := r.URL.Query().Get("status"), r.URL.Query().Get("model")
+	items := []*Promotion{}
+	for _, p := range promotions.List() {
+		if (status == "" || p.Status == status) && (model == "" || p.Model == model) {
+			items = append(items, p)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"promotions": items})
+}
+
+func requestPromotion(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model   string `json:"model"`
+		Stage   string `json:"stage"`
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Model == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"model": "...", "stage": "production"}`})
+		return
+	}
+	if body.Stage == "" {
+		body.Stage = stageProduction
+	}
+	if body.Stage != stageStaging && body.Stage != stageProduction {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "models can be promoted to staging or production"})
+		return
+	}
+	if !labelTargetExists(labelKindModel, body.Model) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "model not found"})
+		return
+	}
+	from := labels.Get(labelKindModel, body.Model)[stageLabel]
+	if from == body.Stage {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "model is already in " + body.Stage})
+		return
+	}
+	p := &Promotion{
+		ID:          newID(),
+		Model:       body.Model,
+		Stage:       body.Stage,
+		FromStage:   from,
+		Status:      PromotionPending,
+		RequestedBy: promotionActor(r),
+		Comment:     body.Comment,
+		Required:    max(envInt("PROMOTION_REQUIRED_APPROVALS", 1), 1),
+		Decisions:   []PromotionDecision{},
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := promotions.Create(p); err != nil {
+		if errors.Is(err, errPromotionPending) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("Error saving promotion: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "could not save promotion"})
+		return
+	}
+	log.Printf("Promotion %s of model %s to %s requested by %s", p.ID, p.Model, p.Stage, p.RequestedBy)
+	audit.RecordRequest(r, AuditPromotionRequest, p.Model, http.StatusCreated, map[string]string{
+		"promotion": p.ID, "stage": p.Stage, "from_stage": p.FromStage, "requested_by": p.RequestedBy,
+	})
+	webhooks.Send("promotion.requested", p)
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// decidePromotion approves, rejects or cancels a pending promotion
+func decidePromotion(w http.ResponseWriter, r *http.Request, id, action string) {
+	var body struct {
+		Comment string `json:"comment"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"comment": "..."}`})
+			return
+		}
+	}
+	actor := promotionActor(r)
+	if action != "cancel" && !canApprove(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only approvers in PROMOTION_APPROVERS can " + action + " promotions"})
+		return
+	}
+
+	now := time.Now().UTC()
+	p, err := promotions.Update(id, func(p *Promotion) error {
+		switch action {
+		case "cancel":
+			if actor != p.RequestedBy && !isAdminToken(r) {
+				return errPromotionOwn
+			}
+			p.Status = PromotionCancelled
+			p.DecidedAt = &now
+			return nil
+		case "approve":
+			if actor == p.RequestedBy && actor != promotionAdmin {
+				return errPromotionOwn
+			}
+		}
+		if slices.ContainsFunc(p.Decisions, func(d PromotionDecision) bool { return d.Approver == actor }) {
+			return errPromotionDecided
+		}
+		p.Decisions = append(p.Decisions, PromotionDecision{Approver: actor, Decision: action, Comment: body.Comment, At: now})
+		switch {
+		case action == "reject":
+			p.Status = PromotionRejected
+		case p.approvals() >= p.Required:
+			// The stage changes under the store's lock, so two last approvals
+			// cannot both apply it
+			if err := applyPromotion(p); err != nil {
+				return err
+			}
+			p.Status = PromotionApproved
+		default:
+			return nil
+		}
+		p.DecidedAt = &now
+		return nil
+	})
+	switch {
+	case errors.Is(err, errPromotionNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, errPromotionClosed), errors.Is(err, errPromotionDecided):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, errPromotionOwn) && action == "cancel":
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the requester can cancel a promotion"})
+		return
+	case errors.Is(err, errPromotionOwn):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Error saving promotion %s: %v", id, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "could not save promotion"})
+		return
+	}
+
+	log.Printf("Promotion %s of model %s to %s: %s by %s (now %s)", p.ID, p.Model, p.Stage, action, actor, p.Status)
+	audit.RecordRequest(r, AuditPromotionDecision, p.Model, http.StatusOK, map[string]string{
+		"promotion": p.ID, "stage": p.Stage, "decision": action, "approver": actor, "status": p.Status,
+	})
+	if p.Status != PromotionPending {
+		webhooks.Send("promotion."+p.Status, p)
+	}
+	writeJSON(w, http.StatusOK, p)
+}
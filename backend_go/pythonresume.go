@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Re-attaching to runs of the Python service. A dropped connection to the
+// service, such as a proxy restart or a network blip, need not end the run:
+// the service keeps a resumable run's script going for its
+// RESUME_GRACE_SECONDS and numbers the messages it sends, and the backend
+// reconnects to /api/script/ws/attach/{run_id}?after=<n> for those it missed.
+// The client's stream waits meanwhile, told by EXECUTION_RECONNECTING and
+// EXECUTION_RESUMED. PYTHON_RESUME_TIMEOUT (default 60s, "off" disables it)
+// is how long the backend keeps trying; a service without the attach endpoint
+// refuses it, and the run ends as before.
+
+// pythonResumeTimeout is how long a run tries to re-attach, 0 when it does not
+var pythonResumeTimeout = 60 * time.Second
+
+func pythonResumeTimeoutFromEnv() time.Duration {
+	if strings.EqualFold(os.Getenv("PYTHON_RESUME_TIMEOUT"), "off") {
+		return 0
+	}
+	return envDuration("PYTHON_RESUME_TIMEOUT", 60*time.Second)
+}
+
+// pythonUpstream is a run's connection to the Python service, replaced when
+// the run is re-attached
+type pythonUpstream struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// detached is set from a dropped connection until the run is re-attached;
+	// client messages meanwhile, such as a CANCEL, are held in pending
+	detached bool
+	pending  []wsMessage
+	// left is set once the client left or the run was cancelled, which ends
+	// the run instead of re-attaching it
+	left bool
+}
+
+func (u *pythonUpstream) current() *websocket.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conn
+}
+
+// write sends a client message; while detached, or when it fails on a
+// resumable run, the message waits for the next connection
+func (u *pythonUpstream) write(msg wsMessage, resumable bool) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.detached {
+		u.pending = append(u.pending, msg)
+		return nil
+	}
+	err := u.conn.WriteMessage(msg.Type, msg.Data)
+	if err != nil && resumable && !u.left {
+		u.pending = append(u.pending, msg)
+		return nil
+	}
+	return err
+}
+
+// leave cancels the run and closes the connection for good. The service
+// keeps a resumable run going when its connection just drops, so it is sent
+// a CANCEL first; a detached run has no connection to send it on and ends
+// once RESUME_GRACE_SECONDS pass without a re-attach.
+func (u *pythonUpstream) leave() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.left {
+		return
+	}
+	u.left = true
+	if !u.detached {
+		deadline := time.Now().Add(time.Second)
+		u.conn.SetWriteDeadline(deadline)
+		if u.conn.WriteMessage(websocket.TextMessage, []byte("CANCEL")) == nil {
+			u.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "run ended"), deadline)
+		}
+	}
+	u.conn.Close()
+}
+
+func (u *pythonUpstream) hasLeft() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.left
+}
+
+// reattach dials the run's attach endpoint until it answers or
+// PYTHON_RESUME_TIMEOUT passes, and returns the number of the first message
+// the service replays
+func (u *pythonUpstream) reattach(ctx context.Context, s *ExecSession, target *Target, after int64) (int64, error) {
+	u.mu.Lock()
+	u.detached = true
+	u.mu.Unlock()
+	deadline := time.Now().Add(pythonResumeTimeout)
+	attachURL := target.WebSocketURL("/api/script/ws/attach/"+url.PathEscape(s.RunID)) + "?after=" + strconv.FormatInt(after, 10)
+	backoff := 250 * time.Millisecond
+	for {
+		dialCtx, cancel := context.WithDeadline(ctx, deadline)
+		conn, resp, err := target.WebSocketDialer().DialContext(dialCtx, attachURL, s.Header)
+		cancel()
+		if err == nil {
+			return u.attached(conn)
+		}
+		if resp != nil {
+			// The service answered: it does not know the run, or cannot re-attach
+			return 0, fmt.Errorf("re-attach refused with %s", resp.Status)
+		}
+		if u.hasLeft() || ctx.Err() != nil || !time.Now().Add(backoff).Before(deadline) {
+			return 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// attached reads the service's RESUMED: <n> from a new connection, switches
+// to it and sends the client messages held meanwhile
+func (u *pythonUpstream) attached(conn *websocket.Conn) (int64, error) {
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	rest, ok := strings.CutPrefix(string(data), "RESUMED:")
+	first, perr := strconv.ParseInt(strings.TrimSpace(rest), 10, 64)
+	if !ok || perr != nil {
+		conn.Close()
+		return 0, fmt.Errorf("unexpected re-attach response %q", data)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.left {
+		conn.Close()
+		return 0, context.Canceled
+	}
+	u.conn.Close()
+	u.conn, u.detached = conn, false
+	for _, msg := range u.pending {
+		if err := conn.WriteMessage(msg.Type, msg.Data); err != nil {
+			break
+		}
+	}
+	u.pending = nil
+	return first, nil
+}
+
+// resumePython re-attaches a run whose connection to the Python service dropped
+// after received messages, and returns the count to go on from. A nil error
+// with ok false means the run ended meanwhile.
+func resumePython(ctx context.Context, s *ExecSession, u *pythonUpstream, target *Target, received int64, cause error) (int64, bool, error) {
+	log.Printf("Run %s lost its connection to Python service %s (%v), re-attaching after message %d", s.RunID, target.Addr(), cause, received)
+	s.SetUpstream(upstreamReconnecting)
+	if s.SendText("EXECUTION_RECONNECTING: Lost the connection to the training service, re-attaching to the run") != nil {
+		return received, false, nil
+	}
+	started := time.Now()
+	first, err := u.reattach(ctx, s, target, received)
+	if u.hasLeft() || ctx.Err() != nil {
+		return received, false, nil
+	}
+	if err != nil {
+		log.Printf("Run %s could not re-attach to Python service %s: %v", s.RunID, target.Addr(), err)
+		return received, false, fmt.Errorf("lost the connection to the Python service and could not re-attach: %w", err)
+	}
+	log.Printf("Run %s re-attached to Python service %s after %s", s.RunID, target.Addr(), time.Since(started).Round(time.Millisecond))
+	s.SetUpstream(upstreamConnected)
+	if lost := first - received - 1; lost > 0 {
+		s.SendText(fmt.Sprintf("LOG_DROPPED: %d log lines lost while re-attaching", lost))
+	}
+	s.SendText(fmt.Sprintf("EXECUTION_RESUMED: Re-attached to the run after %s", time.Since(started).Round(100*time.Millisecond)))
+	return first - 1, true, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Record and replay of upstream traffic. With --record DIR every proxied HTTP
+// exchange is appended to DIR/http.jsonl and every execution stream is saved
+// as DIR/ws/<n>.json. With --replay DIR the backend serves those recordings
+// from an in-process stand-in for the Python service, so a customer's session
+// can be reproduced, or used as a regression fixture, without their setup.
+
+// httpRecording is one proxied request and the answer it got
+type httpRecording struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	BodySHA256 string      `json:"body_sha256,omitempty"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	RecordedAt time.Time   `json:"recorded_at"`
+}
+
+// wsRecording is one execution stream, both directions in order
+type wsRecording struct {
+	Request    json.RawMessage `json:"request"`
+	RecordedAt time.Time       `json:"recorded_at"`
+	Messages   []wsRecorded    `json:"messages"`
+}
+
+// wsRecorded is a message with its offset from the start of the stream
+type wsRecorded struct {
+	// From is "client" or "service"
+	From     string `json:"from"`
+	OffsetMS int64  `json:"offset_ms"`
+	Type     int    `json:"type"`
+	Data     string `json:"data"`
+}
+
+// trafficRecorder writes recordings; nil when recording is off
+type trafficRecorder struct {
+	dir string
+
+	mu       sync.Mutex
+	httpLog  *os.File
+	sessions int
+}
+
+// traffic is the process-wide recorder, set by --record
+var traffic *trafficRecorder
+
+func newTrafficRecorder(dir string) (*trafficRecorder, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "ws"), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "http.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	existing, _ := filepath.Glob(filepath.Join(dir, "ws", "*.json"))
+	log.Printf("Recording upstream traffic to %s", dir)
+	return &trafficRecorder{dir: dir, httpLog: f, sessions: len(existing)}, nil
+}
+
+// Wrap records the requests next proxies and the responses it writes
+func (t *trafficRecorder) Wrap(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if limit, ok := tooLarge(err); ok {
+			writeTooLarge(w, r, limit)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		rec := &cacheRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next.ServeHTTP(rec, r)
+		// Bodies over maxCachedResponse (downloads) are left out
+		if rec.overflow {
+			log.Printf("Recording: %s %s not recorded, response too large", r.Method, r.URL.Path)
+			return
+		}
+		header := w.Header().Clone()
+		header.Del("X-Cache")
+		t.writeHTTP(httpRecording{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      recordedQuery(r.URL.RawQuery),
+			BodySHA256: bodyHash(body),
+			Status:     rec.status,
+			Header:     header,
+			Body:       rec.body.Bytes(),
+			RecordedAt: time.Now().UTC(),
+		})
+	})
+}
+
+// recordedQuery drops one-time WebSocket tokens from a query, so they are
+// neither written to disk nor needed to match a recording
+func recordedQuery(raw string) string {
+	if !strings.Contains(raw, "token=") {
+		return raw
+	}
+	var kept []string
+	for _, param := range strings.Split(raw, "&") {
+		if !strings.HasPrefix(param, "token=") {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+func bodyHash(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *trafficRecorder) writeHTTP(rec httpRecording) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Recording: %v", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.httpLog.Write(append(line, '\n')); err != nil {
+		log.Printf("Recording: writing %s: %v", t.httpLog.Name(), err)
+	}
+}
+
+// wsSessionRecorder collects one execution stream until save
+type wsSessionRecorder struct {
+	t     *trafficRecorder
+	start time.Time
+
+	mu  sync.Mutex
+	rec wsRecording
+}
+
+// session starts recording an execution stream; nil when recording is off
+func (t *trafficRecorder) session(request []byte) *wsSessionRecorder {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	return &wsSessionRecorder{t: t, start: now, rec: wsRecording{Request: json.RawMessage(request), RecordedAt: now.UTC()}}
+}
+
+func (s *wsSessionRecorder) message(from string, messageType int, data []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec.Messages = append(s.rec.Messages, wsRecorded{
+		From:     from,
+		OffsetMS: time.Since(s.start).Milliseconds(),
+		Type:     messageType,
+		Data:     string(data),
+	})
+}
+
+// save writes the stream to ws/<n>.json
+func (s *wsSessionRecorder) save() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.rec, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Recording: %v", err)
+		return
+	}
+	s.t.mu.Lock()
+	s.t.sessions++
+	name := filepath.Join(s.t.dir, "ws", fmt.Sprintf("%06d.json", s.t.sessions))
+	s.t.mu.Unlock()
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		log.Printf("Recording: writing %s: %v", name, err)
+	}
+}
+
+// replayer serves recordings in place of the Python service
+type replayer struct {
+	// speed scales recorded message delays; 0 plays streams back without delays
+	speed float64
+
+	mu       sync.Mutex
+	http     map[string][]*httpRecording
+	served   map[string]int
+	sessions []*wsRecording
+}
+
+// startReplay loads the recordings in dir, serves them on a loopback port
+// and returns its URL
+func startReplay(dir string) (string, error) {
+	rp := &replayer{
+		speed:  envFloat("REPLAY_SPEED", 0),
+		http:   map[string][]*httpRecording{},
+		served: map[string]int{},
+	}
+	if err := rp.load(dir); err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/script/ws/execute", rp.handleExecute)
+	mux.HandleFunc("/", rp.handleHTTP)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Replay stopped: %v", err)
+		}
+	}()
+	url := "http://" + listener.Addr().String()
+	log.Printf("Replaying %d HTTP exchanges and %d execution streams from %s on %s", rp.countHTTP(), len(rp.sessions), dir, url)
+	return url, nil
+}
+
+func (rp *replayer) load(dir string) error {
+	f, err := os.Open(filepath.Join(dir, "http.jsonl"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if f != nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 4*maxCachedResponse)
+		for scanner.Scan() {
+			var rec httpRecording
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return fmt.Errorf("%s: %w", f.Name(), err)
+			}
+			for _, key := range replayKeys(rec.Method, rec.Path, rec.Query, rec.BodySHA256) {
+				rp.http[key] = append(rp.http[key], &rec)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %w", f.Name(), err)
+		}
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "ws", "*.json"))
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var rec wsRecording
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		rp.sessions = append(rp.sessions, &rec)
+	}
+	return nil
+}
+
+// replayKeys are the lookup keys for an exchange, most specific first: the
+// exact request, then method and path alone
+func replayKeys(method, path, query, bodySHA string) []string {
+	return []string{
+		strings.Join([]string{method, path, query, bodySHA}, " "),
+		method + " " + path,
+	}
+}
+
+func (rp *replayer) countHTTP() int {
+	n := 0
+	for key, recs := range rp.http {
+		if strings.Count(key, " ") == 1 {
+			n += len(recs)
+		}
+	}
+	return n
+}
+
+// handleHTTP answers with the recorded responses for the request in the order
+// they were recorded, repeating the last one
+func (rp *replayer) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rp.mu.Lock()
+	var rec *httpRecording
+	for _, key := range replayKeys(r.Method, r.URL.Path, recordedQuery(r.URL.RawQuery), bodyHash(body)) {
+		if recs := rp.http[key]; len(recs) > 0 {
+			i := rp.served[key]
+			if i >= len(recs) {
+				i = len(recs) - 1
+			}
+			rp.served[key] = i + 1
+			rec = recs[i]
+			break
+		}
+	}
+	rp.mu.Unlock()
+	if rec == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "No recording for " + r.Method + " " + r.URL.Path})
+		return
+	}
+	for k, v := range rec.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Length", "Date":
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// matchSession picks the recorded stream for an execution request: the same
+// request message if recorded, otherwise the same script
+func (rp *replayer) matchSession(raw []byte) *wsRecording {
+	var req ExecRequest
+	json.Unmarshal(raw, &req)
+	var sameScript *wsRecording
+	for _, rec := range rp.sessions {
+		if bytes.Equal(bytes.TrimSpace(rec.Request), bytes.TrimSpace(raw)) {
+			return rec
+		}
+		var recorded ExecRequest
+		if json.Unmarshal(rec.Request, &recorded) == nil && recorded.ScriptPath == req.ScriptPath && sameScript == nil {
+			sameScript = rec
+		}
+	}
+	return sameScript
+}
+
+// handleExecute plays back the service side of a recorded stream. Client
+// messages are read and dropped; a CANCEL ends the stream.
+func (rp *replayer) handleExecute(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, raw, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	rec := rp.matchSession(raw)
+	if rec == nil {
+		conn.WriteMessage(websocket.TextMessage, []byte("EXECUTION_ERROR: No recording for this script"))
+		return
+	}
+
+	cancelled := make(chan struct{})
+	go func() {
+		defer close(cancelled)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil || string(msg) == "CANCEL" {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for _, msg := range rec.Messages {
+		if msg.From != "service" {
+			continue
+		}
+		if rp.speed > 0 {
+			due := start.Add(time.Duration(float64(msg.OffsetMS)/rp.speed) * time.Millisecond)
+			select {
+			case <-cancelled:
+				return
+			case <-time.After(time.Until(due)):
+			}
+		}
+		if err := conn.WriteMessage(msg.Type, []byte(msg.Data)); err != nil {
+			return
+		}
+	}
+}
+
+// envFloat reads a float environment variable
+func envFloat(key string, fallback float64) float64 {
+	if f, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return f
+	}
+	return fallback
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchConfig re-applies the config on SIGHUP and whenever CONFIG_FILE
+// changes. The file is polled every CONFIG_WATCH_INTERVAL (default 2s), which
+// also catches the symlink swaps Kubernetes uses for mounted ConfigMaps.
+// A config that fails to load or validate is logged and the current one kept.
+func watchConfig(ctx context.Context, path string, reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	apply := func(reason string) {
+		if err := reload(); err != nil {
+			log.Printf("Config reload (%s) failed, keeping current config: %v", reason, err)
+			return
+		}
+		log.Printf("Config reloaded (%s)", reason)
+	}
+
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	var lastMod time.Time
+	var lastSize int64
+	if path != "" {
+		if info, err := os.Stat(path); err == nil {
+			lastMod, lastSize = info.ModTime(), info.Size()
+		}
+		ticker = time.NewTicker(envDuration("CONFIG_WATCH_INTERVAL", 2*time.Second))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			apply("SIGHUP")
+		case <-tick:
+			info, err := os.Stat(path)
+			if err != nil {
+				// Editors and ConfigMap updates replace the file; wait for it to return
+				continue
+			}
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+			apply(path + " changed")
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Request IDs correlate a request across the trainingmodule proxy, this
+// backend and the Python service. A caller's X-Request-ID is kept when it
+// looks sane, otherwise one is generated. It is echoed in the response,
+// forwarded to the Python service, added to log lines about the request, and
+// sent as the first "REQUEST_ID: <id>" line of an execution stream.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID assigns the request ID before any other handler runs
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newID()
+		}
+		// Set on the request too, so the reverse proxy forwards it
+		r.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID assigned by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID accepts up to 128 letters, digits and . _ : - so a caller
+// cannot inject anything into logs or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
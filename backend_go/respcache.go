@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory LRU cache for hot read-only endpoints, so dashboards polling
+// /api/models and the pipeline config do not hit the Python service each time.
+// Entries expire after their route's TTL and are purged as soon as a
+// mutating request (or a finished run) touches the data they hold.
+
+// maxCachedResponse is the largest body kept in the cache
+const maxCachedResponse = 1 << 20
+
+// defaultCacheRules apply when the config file has no "cache" section
+var defaultCacheRules = []CacheRule{
+	{Path: "/api/models", TTL: "30s", InvalidatedBy: []string{"/api/model/delete"}},
+	{Path: "/api/model/loaded", TTL: "10s", InvalidatedBy: []string{"/api/model/load", "/api/model/delete"}},
+	{Path: "/api/pipeline/load", TTL: "60s", InvalidatedBy: []string{"/api/pipeline/save"}},
+	{Path: "/api/model/modal-html", TTL: "5m"},
+}
+
+type cacheEntry struct {
+	key     string
+	rule    *cacheRule
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+type cacheRule struct {
+	CacheRule
+	ttl time.Duration
+}
+
+// responseCache is the LRU shared by every cached route
+type responseCache struct {
+	rules []*cacheRule
+	size  int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// responses is the process-wide cache; nil when caching is disabled
+var responses *responseCache
+
+// newResponseCache returns nil when no rules are configured
+func newResponseCache(rules []CacheRule, size int) (*responseCache, error) {
+	if rules == nil {
+		rules = defaultCacheRules
+	}
+	if len(rules) == 0 || size <= 0 {
+		return nil, nil
+	}
+	c := &responseCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+	for _, r := range rules {
+		ttl, err := time.ParseDuration(r.TTL)
+		if err != nil {
+			return nil, err
+		}
+		c.rules = append(c.rules, &cacheRule{CacheRule: r, ttl: ttl})
+	}
+	return c, nil
+}
+
+// matchPath reports whether a rule path (exact, or prefix when ending in /) covers p
+func matchPath(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(p, pattern)
+	}
+	return p == pattern
+}
+
+func (c *responseCache) ruleFor(p string) *cacheRule {
+	for _, r := range c.rules {
+		if matchPath(r.Path, p) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Wrap serves cached GET responses and purges entries on mutating requests
+func (c *responseCache) Wrap(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if rec.status < 400 {
+				c.Invalidate(r.URL.Path)
+			}
+			return
+		}
+
+		rule := c.ruleFor(r.URL.Path)
+		if rule == nil || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := cacheKey(r)
+		if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			if entry := c.get(key); entry != nil {
+				for k, v := range entry.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("X-Cache", "HIT")
+				if notModified(r, entry.header) {
+					for _, name := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
+						w.Header().Del(name)
+					}
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.WriteHeader(entry.status)
+				if r.Method == http.MethodGet {
+					w.Write(entry.body)
+				}
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next.ServeHTTP(rec, r)
+		// A response setting cookies, such as a refreshed login session or
+		// CSRF token, belongs to the one client it was written for
+		noStore := strings.Contains(w.Header().Get("Cache-Control"), "no-store") || len(w.Header().Values("Set-Cookie")) > 0
+		if r.Method == http.MethodGet && rec.status == http.StatusOK && !rec.overflow && !noStore {
+			header := w.Header().Clone()
+			header.Del("X-Cache")
+			// Each request keeps its own ID, and gets the security headers in force when served
+			header.Del(requestIDHeader)
+			for name := range currentSettings().securityHeaders().forPath(r.URL.Path) {
+				header.Del(name)
+			}
+			// and the CORS headers of its own origin
+			for name := range header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					header.Del(name)
+				}
+			}
+			c.put(&cacheEntry{
+				key:     key,
+				rule:    rule,
+				status:  rec.status,
+				header:  header,
+				body:    rec.body.Bytes(),
+				expires: time.Now().Add(rule.ttl),
+			})
+		}
+	})
+}
+
+// notModified reports whether a conditional request is satisfied by the
+// validators of a cached response: If-None-Match by weak comparison of
+// ETags, otherwise If-Modified-Since against Last-Modified
+func notModified(r *http.Request, header http.Header) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// cacheKey separates responses by query, routing keys, encoding, locale and
+// user, as the Python service gets the user's identity with each request
+func cacheKey(r *http.Request) string {
+	workspace, pipeline := routingKeys(r)
+	user := ""
+	if id := identityFrom(r); id != nil {
+		user = id.Subject + "\x01" + strings.Join(id.Groups, ",")
+	}
+	return strings.Join([]string{r.URL.Path, r.URL.RawQuery, workspace, pipeline, r.Header.Get("Accept-Encoding"), negotiateLocale(r), user}, "\x00")
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return entry
+}
+
+func (c *responseCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[entry.key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Invalidate drops cached responses whose rule is affected by a change at path:
+// the rule's own path or any of its invalidated_by paths
+func (c *responseCache) Invalidate(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	for key, el := range c.entries {
+		rule := el.Value.(*cacheEntry).rule
+		if !ruleAffectedBy(rule, path) {
+			continue
+		}
+		c.order.Remove(el)
+		delete(c.entries, key)
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("Response cache: %s invalidated %d entries", path, dropped)
+	}
+}
+
+func ruleAffectedBy(rule *cacheRule, path string) bool {
+	if matchPath(rule.Path, path) {
+		return true
+	}
+	for _, p := range rule.InvalidatedBy {
+		if matchPath(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing)
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// cacheRecorder also keeps a copy of the body, up to maxCachedResponse
+type cacheRecorder struct {
+	statusRecorder
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *cacheRecorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if r.body.Len()+len(p) > maxCachedResponse {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
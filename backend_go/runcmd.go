@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+)
+
+// Headless pipeline runs. training-backend run sends the enabled stages of a
+// pipeline config to a running backend over the execution WebSocket, one
+// script at a time like the frontend, and exits 0 only when every script
+// finished. Runs are tied to their connection, so the command always waits.
+
+// pipelineRun is the part of a pipeline config that says what to execute
+type pipelineRun struct {
+	Pipeline struct {
+		Executor string `json:"executor"`
+		// DatasetVariable names the variable --dataset sets, like
+		// selected_model_variable_reference does for the model
+		DatasetVariable string          `json:"dataset_variable_reference"`
+		Stages          []pipelineStage `json:"stages"`
+		Variables       map[string]struct {
+			Default json.RawMessage `json:"default"`
+		} `json:"variables"`
+	} `json:"pipeline"`
+}
+
+type pipelineStage struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Executor    string `json:"executor"`
+	Scripts     []struct {
+		Script string   `json:"script"`
+		Args   []string `json:"args"`
+	} `json:"scripts"`
+}
+
+// defaultDatasetVariable is set by --dataset when the pipeline names none
+const defaultDatasetVariable = "custom_dataset_path"
+
+var pipelineVariablePattern = regexp.MustCompile(`\{(\w+)\}`)
+
+func newRunCommand() *cobra.Command {
+	var (
+		pipelinePath string
+		dataset      string
+		vars         map[string]string
+		stages       []string
+		workspace    string
+		priority     string
+		maxDuration  string
+		codeVersion  string
+		target       string
+		follow       bool
+	)
+	cmd := &cobra.Command{
+		Use:   "run",
+		Short: "Run a training pipeline on a backend and report the result in the exit code",
+		Long: `Runs the enabled stages of a pipeline config (--pipeline, default
+PIPELINE_CONFIG_PATH or the built-in one) on the backend at LISTEN_ADDR or
+--url, through the same execution WebSocket the frontend uses. Placeholders
+such as {epochs} take the variable defaults, overridden with --set, and
+--dataset sets the pipeline's dataset variable. With --follow every log line
+is printed; otherwise only progress and errors are. Exits 0 when every script
+finished, 1 when one failed and 130 when interrupted (the run is cancelled).`,
+		Example: `  training-backend run --pipeline config.json --dataset /data/my-data --follow
+  training-backend run --url http://backend:3000 --stage train --set epochs=50`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var data []byte
+			var err error
+			if pipelinePath != "" {
+				data, err = os.ReadFile(pipelinePath)
+			} else {
+				data, err = readPipelineConfig()
+			}
+			if err != nil {
+				return fmt.Errorf("reading pipeline config: %w", err)
+			}
+			var pipeline pipelineRun
+			if err := json.Unmarshal(data, &pipeline); err != nil {
+				return fmt.Errorf("pipeline config: %w", err)
+			}
+			values := pipeline.variableValues()
+			if dataset != "" {
+				name := pipeline.Pipeline.DatasetVariable
+				if name == "" {
+					name = defaultDatasetVariable
+				}
+				values[name] = dataset
+			}
+			for k, v := range vars {
+				values[k] = v
+			}
+			selected, err := pipeline.selectStages(stages)
+			if err != nil {
+				return err
+			}
+			// The backend estimates completion times from the size and
+			// records the version in the lineage of the models
+			datasetSize, datasetVer := 0, ""
+			if dataset != "" {
+				datasetSize = countDatasetImages(dataset)
+				datasetVer = datasetVersion(dataset)
+			}
+
+			runner := &pipelineRunner{
+				out:       cmd.OutOrStdout(),
+				follow:    follow,
+				target:    target,
+				interrupt: make(chan os.Signal, 1),
+			}
+			signal.Notify(runner.interrupt, os.Interrupt)
+			defer signal.Stop(runner.interrupt)
+			start := time.Now()
+			for i, stage := range selected {
+				fmt.Fprintf(runner.out, "==> Stage %d/%d: %s\n", i+1, len(selected), stage.label())
+				for _, script := range stage.Scripts {
+					req := ExecRequest{
+						ScriptPath:     script.Script,
+						Args:           substituteVariables(script.Args, values),
+						Executor:       stage.Executor,
+						Workspace:      workspace,
+						Priority:       priority,
+						MaxDuration:    maxDuration,
+						DatasetSize:    datasetSize,
+						Dataset:        dataset,
+						DatasetVersion: datasetVer,
+						CodeVersion:    codeVersion,
+					}
+					if req.Executor == "" {
+						req.Executor = pipeline.Pipeline.Executor
+					}
+					if err := runner.execute(req); err != nil {
+						if errors.Is(err, errRunInterrupted) {
+							fmt.Fprintln(runner.out, "Interrupted, run cancelled")
+							os.Exit(130)
+						}
+						return fmt.Errorf("stage %s, %s: %w", stage.label(), script.Script, err)
+					}
+				}
+			}
+			fmt.Fprintf(runner.out, "Pipeline finished in %s\n", time.Since(start).Round(time.Second))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&pipelinePath, "pipeline", "", "pipeline config file (default PIPELINE_CONFIG_PATH or the built-in config)")
+	cmd.Flags().StringVar(&dataset, "dataset", "", "dataset for the pipeline's dataset variable (dataset_variable_reference, default custom_dataset_path)")
+	cmd.Flags().StringToStringVar(&vars, "set", nil, "override a pipeline variable, e.g. --set epochs=50 (repeatable)")
+	cmd.Flags().StringSliceVar(&stages, "stage", nil, "run only these stage ids, enabled or not (repeatable)")
+	cmd.Flags().StringVar(&workspace, "workspace", "", "workspace to route the run by")
+	cmd.Flags().StringVar(&priority, "priority", "", "priority class of the run: low, normal or high (default the stage's or pipeline's)")
+	cmd.Flags().StringVar(&maxDuration, "max-duration", "", "cancel each script that runs longer than this, e.g. 6h (default the stage's or pipeline's)")
+	cmd.Flags().StringVar(&codeVersion, "code-version", "", "version of the training code to record for model lineage, e.g. a git commit")
+	cmd.Flags().StringVar(&target, "url", "", "backend to run on instead of the local one, e.g. http://backend:3000")
+	cmd.Flags().BoolVar(&follow, "follow", false, "print every log line of the run")
+	return cmd
+}
+
+// countDatasetImages counts the images under a local dataset directory, 0
+// when it is not one (e.g. a path on the backend)
+func countDatasetImages(dir string) int {
+	n := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".jpg", ".jpeg", ".png", ".bmp", ".webp":
+				n++
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// datasetVersion hashes the paths and sizes of the files under a local
+// dataset directory, so runs on the same data share a version
+func datasetVersion(dir string) string {
+	h := sha256.New()
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				rel, _ := filepath.Rel(dir, path)
+				fmt.Fprintf(h, "%s\x00%d\n", filepath.ToSlash(rel), info.Size())
+			}
+		}
+		return nil
+	})
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)[:6])
+}
+
+// variableValues returns the defaults of the pipeline variables as text
+func (p *pipelineRun) variableValues() map[string]string {
+	values := map[string]string{}
+	for name, v := range p.Pipeline.Variables {
+		var s string
+		if json.Unmarshal(v.Default, &s) == nil {
+			values[name] = s
+		} else if len(v.Default) > 0 && string(v.Default) != "null" {
+			values[name] = string(v.Default)
+		}
+	}
+	return values
+}
+
+// selectStages returns the stages to run: the named ones in config order, or
+// the enabled ones
+func (p *pipelineRun) selectStages(ids []string) ([]pipelineStage, error) {
+	want := map[string]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+	var out []pipelineStage
+	for _, stage := range p.Pipeline.Stages {
+		if len(ids) > 0 && want[stage.ID] || len(ids) == 0 && stage.Enabled {
+			out = append(out, stage)
+			delete(want, stage.ID)
+		}
+	}
+	for id := range want {
+		return nil, fmt.Errorf("no stage %q in the pipeline config", id)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no stages to run")
+	}
+	return out, nil
+}
+
+func (s pipelineStage) label() string {
+	if s.Description != "" {
+		return s.Description
+	}
+	return s.ID
+}
+
+// substituteVariables fills {name} placeholders; unknown ones stay as they are
+func substituteVariables(args []string, values map[string]string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = pipelineVariablePattern.ReplaceAllStringFunc(arg, func(match string) string {
+			if v, ok := values[match[1:len(match)-1]]; ok && v != "" {
+				return v
+			}
+			return match
+		})
+	}
+	return out
+}
+
+var errRunInterrupted = errors.New("interrupted")
+
+// pipelineRunner executes scripts one at a time on a backend
+type pipelineRunner struct {
+	out       io.Writer
+	follow    bool
+	target    string
+	interrupt chan os.Signal
+}
+
+// execute runs one script and waits for its outcome
+func (r *pipelineRunner) execute(req ExecRequest) error {
+	url, dialer := r.executionEndpoint()
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", url, err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(req); err != nil {
+		return err
+	}
+	fmt.Fprintf(r.out, "--> %s %s\n", req.ScriptPath, strings.Join(req.Args, " "))
+
+	messages := make(chan string)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			// Log lines may arrive batched, one per line of the frame
+			for _, line := range strings.Split(string(data), "\n") {
+				select {
+				case messages <- line:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	reqID := ""
+	cancelled := false
+	for {
+		select {
+		case <-r.interrupt:
+			if cancelled {
+				return errRunInterrupted
+			}
+			// The backend cancels the run and answers with EXECUTION_ERROR
+			cancelled = true
+			conn.WriteMessage(websocket.TextMessage, []byte("CANCEL"))
+		case err := <-readErr:
+			if cancelled {
+				return errRunInterrupted
+			}
+			return fmt.Errorf("connection lost before the script finished: %w", err)
+		case msg := <-messages:
+			switch {
+			case strings.HasPrefix(msg, "REQUEST_ID:"):
+				reqID = strings.TrimSpace(strings.TrimPrefix(msg, "REQUEST_ID:"))
+			case msg == "EXECUTION_FINISHED":
+				fmt.Fprintf(r.out, "<-- finished %s\n", req.ScriptPath)
+				return nil
+			case strings.HasPrefix(msg, "EXECUTION_ERROR:"):
+				if cancelled {
+					return errRunInterrupted
+				}
+				reason := strings.TrimSpace(strings.TrimPrefix(msg, "EXECUTION_ERROR:"))
+				return fmt.Errorf("%s (request %s)", reason, reqID)
+			case strings.HasPrefix(msg, "EXECUTION_QUEUED:"), strings.HasPrefix(msg, "EXECUTION_PREEMPTED:"), strings.HasPrefix(msg, "EXECUTION_RETRY:"), strings.HasPrefix(msg, "EXECUTION_ETA:"),
+				strings.HasPrefix(msg, "EXECUTION_RECONNECTING:"), strings.HasPrefix(msg, "EXECUTION_RESUMED:"):
+				fmt.Fprintln(r.out, msg)
+			case strings.HasPrefix(msg, "HEARTBEAT:"), strings.HasPrefix(msg, "STATUS:"):
+			case r.follow:
+				fmt.Fprintln(r.out, lastLogLine(msg))
+			}
+		}
+	}
+}
+
+// executionEndpoint returns the execution WebSocket URL and a dialer for it
+func (r *pipelineRunner) executionEndpoint() (string, *websocket.Dialer) {
+	dialer := *websocket.DefaultDialer
+	// Only offered; the server compresses when WS_COMPRESSION is on
+	dialer.EnableCompression = true
+	base := strings.TrimRight(r.target, "/")
+	if base == "" {
+		var socket string
+		base, socket = localServer()
+		if socket != "" {
+			dialer.NetDialContext = dialUnix(socket)
+		}
+		// The certificate is issued for the public name
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	url := "ws" + strings.TrimPrefix(base, "http") + "/api/script/ws/execute"
+	return url, &dialer
+}
+
+// lastLogLine keeps what a terminal would show of a progress bar line
+// redrawn with carriage returns
+func lastLogLine(msg string) string {
+	msg = strings.TrimRight(msg, "\r\n")
+	if i := strings.LastIndex(msg, "\r"); i >= 0 {
+		msg = msg[i+1:]
+	}
+	return msg
+}
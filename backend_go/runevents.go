@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live events of a run for programs following it, over a WebSocket at
+// GET /api/runs/{id}/events. Every message is a JSON object with a type:
+// "log" for each line of the run's log, "metric" for each point logged
+// through the MLflow API and "state" when the run's status changes, once on
+// connecting too. ?offset=N skips the first N log lines, so a client that
+// reconnects goes on where it stopped; metrics are sent in full every time.
+// Once the run has ended and everything is sent, the connection is closed
+// normally. With authentication on, the upgrade needs a one-time token or a
+// bearer token like the execution WebSocket, and browsers may only connect
+// from the backend's own pages or an allowed origin.
+
+type runLogEvent struct {
+	Type string `json:"type"`
+	runLogLine
+}
+
+type runMetricEvent struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	MetricPoint
+}
+
+type runStateEvent struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleRunEvents streams a run's events until it has ended or the client
+// leaves
+func handleRunEvents(w http.ResponseWriter, r *http.Request) {
+	runID := r.PathValue("id")
+	if _, ok := store.Get(runID); !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	offset, err := queryInt(r.URL.Query().Get("offset"), 0, 0)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "offset: " + err.Error()})
+		return
+	}
+	if !sameOrigin(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "origin not allowed"})
+		return
+	}
+	header := http.Header{requestIDHeader: {requestID(r)}}
+	if proto := wsTokenProtocol(r); proto != "" {
+		header.Set("Sec-WebSocket-Protocol", proto)
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Nothing is expected from the client; reading notices it leaving
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = followRunEvents(ctx, runID, offset, func(event any) error {
+		return conn.WriteJSON(event)
+	})
+	switch {
+	case err == nil:
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "run ended"), time.Now().Add(time.Second))
+	case errors.Is(err, errRunGone):
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "run deleted"), time.Now().Add(time.Second))
+	}
+}
+
+// errRunGone is followRunEvents' error for a run that does not exist (anymore)
+var errRunGone = errors.New("run not found")
+
+// followRunEvents emits a run's events as they happen, skipping the first
+// offset log lines, until it has ended (nil), it is deleted (errRunGone), an
+// emit fails or ctx is done
+func followRunEvents(ctx context.Context, runID string, offset int, emit func(event any) error) error {
+	var reader *runLogReader
+	var path string
+	if runLogs != nil {
+		reader = &runLogReader{files: runLogs.files(runID)}
+		defer reader.close()
+		path = runLogs.path(runID)
+	}
+	status := ""
+	metrics := map[string]int{}
+	ticker := time.NewTicker(runLogPollInterval)
+	defer ticker.Stop()
+	for {
+		run, ok := store.Get(runID)
+		if !ok {
+			return errRunGone
+		}
+		for _, key := range sortedKeys(run.Metrics) {
+			points := run.Metrics[key]
+			for _, p := range points[min(metrics[key], len(points)):] {
+				if err := emit(runMetricEvent{"metric", key, p}); err != nil {
+					return err
+				}
+			}
+			metrics[key] = len(points)
+		}
+		if reader != nil {
+			err := reader.readNew(path, func(line runLogLine) error {
+				if line.N <= int64(offset) {
+					return nil
+				}
+				return emit(runLogEvent{"log", line})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// After the log, so the end of a run comes after its last lines
+		if run.Status != status {
+			status = run.Status
+			if err := emit(runStateEvent{"state", run.Status, run.Error}); err != nil {
+				return err
+			}
+		}
+		if run.Finished() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
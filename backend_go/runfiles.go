@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files a run wrote. The Python service gives each run an output directory,
+// RUNS_DIR/<run_id> on its side, and passes it to the script as
+// RUN_OUTPUT_DIR. The backend sees the same volume as RUN_FILES_DIR, like it
+// sees trained models as MODELS_DIR, and serves it read-only:
+//
+//	GET /api/runs/{id}/files         every file, with size and modification time
+//	GET /api/runs/{id}/files/{path}  one file
+//
+// so confusion matrices or sample outputs can be fetched without a shell in
+// the Python container. Files over RUN_FILE_MAX_SIZE (default 100MB) are
+// listed but not served, and symlinks are neither.
+
+// runFilesMaxList is the most files a listing returns
+const runFilesMaxList = 1000
+
+// runFileMaxSize is the largest file served, RUN_FILE_MAX_SIZE
+var runFileMaxSize int64 = 100 << 20
+
+// runFilesDir is the directory holding the output directories of runs
+func runFilesDir() string {
+	return getEnv("RUN_FILES_DIR", "./runs")
+}
+
+// runFile is an entry of a run's file listing
+type runFile struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModifiedAt  time.Time `json:"modified_at"`
+	ContentType string    `json:"content_type"`
+	// TooLarge is set for files over RUN_FILE_MAX_SIZE, which are not served
+	TooLarge bool `json:"too_large,omitempty"`
+}
+
+// runOutputDir returns a known run's output directory
+func runOutputDir(runID string) (string, bool) {
+	if runID == "" || runID != filepath.Base(runID) || strings.HasPrefix(runID, ".") {
+		return "", false
+	}
+	if _, ok := store.Get(runID); !ok {
+		return "", false
+	}
+	return filepath.Join(runFilesDir(), runID), true
+}
+
+// listRunFiles walks a run's output directory, sorted by path. Only regular
+// files count; symlinks are skipped rather than followed.
+func listRunFiles(root string) (files []runFile, total int64, truncated bool) {
+	files = []runFile{}
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if len(files) == runFilesMaxList {
+			truncated = true
+			return filepath.SkipAll
+		}
+		rel, _ := filepath.Rel(root, p)
+		files = append(files, runFile{
+			Path:        filepath.ToSlash(rel),
+			Size:        info.Size(),
+			ModifiedAt:  info.ModTime(),
+			ContentType: runFileContentType(p),
+			TooLarge:    info.Size() > runFileMaxSize,
+		})
+		total += info.Size()
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, total, truncated
+}
+
+// runFileContentType guesses a file's type from its extension
+func runFileContentType(name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// openRunFile opens rel inside root for reading. Paths that leave root, also
+// through a symlink, are refused, and so is anything but a regular file.
+func openRunFile(root, rel string) (*os.File, os.FileInfo, error) {
+	target, err := artifactPath(root, rel)
+	if err != nil || target == root {
+		return nil, nil, os.ErrNotExist
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, nil, os.ErrNotExist
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil || !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+		return nil, nil, os.ErrNotExist
+	}
+	if info, err := os.Lstat(target); err != nil || !info.Mode().IsRegular() {
+		return nil, nil, os.ErrNotExist
+	}
+	f, err := os.Open(real)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, os.ErrNotExist
+	}
+	return f, info, nil
+}
+
+// inlineRunFileTypes are shown by the browser; anything else is downloaded,
+// as a script's HTML or SVG output must not run in the UI's origin
+var inlineRunFileTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"text/plain": true,
+}
+
+func handleRunFiles(w http.ResponseWriter, r *http.Request) {
+	runID := r.PathValue("id")
+	root, ok := runOutputDir(runID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	files, total, truncated := listRunFiles(root)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"run_id":      runID,
+		"files":       files,
+		"total_bytes": total,
+		"truncated":   truncated,
+	})
+}
+
+func handleRunFile(w http.ResponseWriter, r *http.Request) {
+	root, ok := runOutputDir(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	rel := r.PathValue("path")
+	f, info, err := openRunFile(root, rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "file not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	if info.Size() > runFileMaxSize {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{
+			"error": fmt.Sprintf("file is %s, over the %s limit (RUN_FILE_MAX_SIZE)", formatByteSize(info.Size()), formatByteSize(runFileMaxSize)),
+		})
+		return
+	}
+	name := path.Base(filepath.ToSlash(rel))
+	contentType := runFileContentType(name)
+	disposition := "attachment"
+	if base, _, _ := strings.Cut(contentType, ";"); inlineRunFileTypes[base] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, name))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Execution output is teed to a log file per run under RUN_LOG_DIR (default
+// DATA_DIR/logs, "off" disables it), so it survives browser refreshes and
+// backend restarts, and served by GET /api/runs/{id}/logs. Each line is
+// stored as "<RFC 3339 time> <text>". A run's log rotates at
+// RUN_LOG_MAX_SIZE, keeping RUN_LOG_MAX_FILES files, and the logs of runs
+// that ended more than RUN_LOG_RETENTION_DAYS ago are deleted.
+
+const (
+	runLogPageSize    = 1000
+	runLogMaxPageSize = 10000
+	// runLogPollInterval is how often a followed log is checked for new lines
+	runLogPollInterval = 500 * time.Millisecond
+)
+
+type runLogStore struct {
+	dir       string
+	maxSize   int64
+	maxFiles  int
+	retention time.Duration
+}
+
+// runLogs is nil when RUN_LOG_DIR is "off"
+var runLogs *runLogStore
+
+func openRunLogsFromEnv(dataDir string) (*runLogStore, error) {
+	dir := getEnv("RUN_LOG_DIR", filepath.Join(dataDir, "logs"))
+	if dir == "off" {
+		return nil, nil
+	}
+	maxSize, err := envByteSize("RUN_LOG_MAX_SIZE", 50<<20)
+	if err != nil {
+		return nil, err
+	}
+	s := &runLogStore{
+		dir:       dir,
+		maxSize:   maxSize,
+		maxFiles:  envInt("RUN_LOG_MAX_FILES", 3),
+		retention: envDays("RUN_LOG_RETENTION_DAYS"),
+	}
+	if s.maxFiles < 1 {
+		return nil, errors.New("RUN_LOG_MAX_FILES must be at least 1")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// path is the current log file of a run; rotated ones add .1, .2, ...
+func (s *runLogStore) path(runID string) string {
+	return filepath.Join(s.dir, runID+".log")
+}
+
+// files lists a run's log files, oldest first
+func (s *runLogStore) files(runID string) []string {
+	var out []string
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		name := s.path(runID) + "." + strconv.Itoa(i)
+		if _, err := os.Stat(name); err == nil {
+			out = append(out, name)
+		}
+	}
+	if _, err := os.Stat(s.path(runID)); err == nil {
+		out = append(out, s.path(runID))
+	}
+	return out
+}
+
+// remove deletes a run's logs; a nil store has none
+func (s *runLogStore) remove(runID string) {
+	if s == nil {
+		return
+	}
+	for _, name := range s.files(runID) {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing run log %s: %v", name, err)
+		}
+	}
+}
+
+// open starts or continues a run's log; nil when logs are off or the file
+// cannot be opened, which does not stop the run
+func (s *runLogStore) open(runID string) *runLogWriter {
+	if s == nil || runID == "" {
+		return nil
+	}
+	w := &runLogWriter{path: s.path(runID), store: s}
+	if err := w.openFile(); err != nil {
+		log.Printf("Error opening log of run %s: %v", runID, err)
+		return nil
+	}
+	return w
+}
+
+// sweep deletes the logs of runs that ended before the retention period
+func (s *runLogStore) sweep() {
+	if s == nil || s.retention <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Error listing run logs: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-s.retention)
+	for _, entry := range entries {
+		runID, _, ok := strings.Cut(entry.Name(), ".log")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		// A quiet run may still be going
+		if run, ok := store.Get(runID); ok && !run.Finished() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, entry.Name())); err != nil {
+			log.Printf("Error removing run log %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// runSweeper applies the retention period hourly until ctx is done
+func (s *runLogStore) runSweeper(ctx context.Context) {
+	if s == nil || s.retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		s.sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runLogWriter appends the frames sent to a run's client as timestamped
+// lines. Frames may hold several lines and large ones arrive in pieces, so
+// it keeps track of whether it is in the middle of a line.
+type runLogWriter struct {
+	mu      sync.Mutex
+	path    string
+	store   *runLogStore
+	buf     *bufio.Writer
+	f       *os.File
+	size    int64
+	midLine bool
+	failed  bool
+}
+
+func (w *runLogWriter) openFile() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.buf, w.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+// rotate shifts the numbered files up, dropping the oldest, and starts a new one
+func (w *runLogWriter) rotate() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	w.f.Close()
+	os.Remove(w.path + "." + strconv.Itoa(w.store.maxFiles-1))
+	for i := w.store.maxFiles - 2; i >= 1; i-- {
+		os.Rename(w.path+"."+strconv.Itoa(i), w.path+"."+strconv.Itoa(i+1))
+	}
+	if w.store.maxFiles > 1 {
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+	return w.openFile()
+}
+
+// Write adds text to the log, starting a timestamped line after every newline
+func (w *runLogWriter) Write(p []byte) (int, error) {
+	if w == nil {
+		return len(p), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed {
+		return len(p), nil
+	}
+	if err := w.write(p); err != nil {
+		// The run goes on without its log rather than failing
+		log.Printf("Error writing run log %s, giving up on it: %v", w.path, err)
+		w.failed = true
+	}
+	return len(p), nil
+}
+
+func (w *runLogWriter) write(p []byte) error {
+	for len(p) > 0 {
+		if !w.midLine {
+			if w.size >= w.store.maxSize && w.store.maxSize > 0 {
+				if err := w.rotate(); err != nil {
+					return err
+				}
+			}
+			n, _ := w.buf.WriteString(time.Now().UTC().Format(time.RFC3339Nano) + " ")
+			w.size += int64(n)
+			w.midLine = true
+		}
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line, w.midLine = p[:i+1], false
+		}
+		n, err := w.buf.Write(line)
+		w.size += int64(n)
+		if err != nil {
+			return err
+		}
+		p = p[len(line):]
+	}
+	return nil
+}
+
+// EndFrame ends the line of the frame written so far and flushes the file,
+// so followers see it
+func (w *runLogWriter) EndFrame() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed {
+		return
+	}
+	var err error
+	if w.midLine {
+		err = w.write([]byte("\n"))
+	}
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if err != nil {
+		log.Printf("Error writing run log %s, giving up on it: %v", w.path, err)
+		w.failed = true
+	}
+}
+
+// WriteFrame logs one frame sent to the client
+func (w *runLogWriter) WriteFrame(data []byte) {
+	w.Write(data)
+	w.EndFrame()
+}
+
+// moveTo continues in another run's log, for a run retried in the same session
+func (w *runLogWriter) moveTo(runID string) {
+	if w == nil || runID == "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Flush()
+	w.f.Close()
+	w.path, w.midLine, w.failed = w.store.path(runID), false, false
+	if err := w.openFile(); err != nil {
+		log.Printf("Error opening log of run %s: %v", runID, err)
+		w.failed = true
+	}
+}
+
+func (w *runLogWriter) Close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Flush()
+	w.f.Close()
+}
+
+// runLogLine is one line as served by the logs API; n counts from the oldest
+// line still kept
+type runLogLine struct {
+	N    int64      `json:"n"`
+	Time *time.Time `json:"time,omitempty"`
+	Text string     `json:"text"`
+}
+
+func parseRunLogLine(n int64, raw string) runLogLine {
+	line := runLogLine{N: n, Text: raw}
+	if stamp, text, ok := strings.Cut(raw, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+			line.Time, line.Text = &t, text
+		}
+	}
+	return line
+}
+
+// runLogReader reads the complete lines of a run's log files in order,
+// remembering where it stopped in the last one so a follower can continue
+type runLogReader struct {
+	files []string
+	f     *os.File
+	r     *bufio.Reader
+	// partial holds the start of a line still being written
+	partial string
+	n       int64
+}
+
+// next returns the next complete line, or io.EOF once the files are read
+func (lr *runLogReader) next() (string, error) {
+	for {
+		if lr.r == nil {
+			if len(lr.files) == 0 {
+				return "", io.EOF
+			}
+			f, err := os.Open(lr.files[0])
+			if err != nil {
+				return "", err
+			}
+			lr.files = lr.files[1:]
+			lr.f, lr.r = f, bufio.NewReaderSize(f, 64<<10)
+		}
+		chunk, err := lr.r.ReadString('\n')
+		if err == nil {
+			line := lr.partial + strings.TrimSuffix(chunk, "\n")
+			lr.partial = ""
+			lr.n++
+			return line, nil
+		}
+		if err != io.EOF {
+			return "", err
+		}
+		lr.partial += chunk
+		if len(lr.files) == 0 {
+			// Stay on the live file
+			return "", io.EOF
+		}
+		lr.f.Close()
+		lr.f, lr.r, lr.partial = nil, nil, ""
+	}
+}
+
+// rotated reports whether the live file was renamed away since it was opened
+func (lr *runLogReader) rotated(path string) bool {
+	if lr.f == nil {
+		return false
+	}
+	opened, err1 := lr.f.Stat()
+	current, err2 := os.Stat(path)
+	return err1 == nil && err2 == nil && !os.SameFile(opened, current)
+}
+
+// readNew passes the lines written since the last call to emit, going on in
+// the new live file when the log rotated and picking the log up once the run
+// starts writing it. It stops at the first error of emit.
+func (lr *runLogReader) readNew(path string, emit func(runLogLine) error) error {
+	for {
+		rotated := lr.rotated(path)
+		for {
+			raw, err := lr.next()
+			if err != nil {
+				break
+			}
+			if err := emit(parseRunLogLine(lr.n, raw)); err != nil {
+				return err
+			}
+		}
+		switch {
+		case rotated:
+			// Read to the end of the renamed file above; go on with the new one
+			lr.close()
+			*lr = runLogReader{files: []string{path}, n: lr.n}
+		case lr.f == nil:
+			// No log yet; pick it up once the run starts writing
+			if _, err := os.Stat(path); err != nil {
+				return nil
+			}
+			lr.files = []string{path}
+		default:
+			return nil
+		}
+	}
+}
+
+func (lr *runLogReader) close() {
+	if lr.f != nil {
+		lr.f.Close()
+	}
+}
+
+// registerRunRoutes adds /api/runs/{id}, /api/runs/{id}/logs,
+// /api/runs/{id}/events, /api/runs/{id}/retries, /api/runs/{id}/bundle and
+// /api/runs/{id}/files
+func registerRunRoutes() {
+	http.HandleFunc("GET /api/runs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleRun(w, r.PathValue("id"))
+	})
+	http.HandleFunc("GET /api/runs/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		handleRunLogs(w, r, r.PathValue("id"))
+	})
+	http.HandleFunc("GET /api/runs/{id}/events", handleRunEvents)
+	http.HandleFunc("GET /api/runs/{id}/retries", func(w http.ResponseWriter, r *http.Request) {
+		handleRunRetries(w, r.PathValue("id"))
+	})
+	http.HandleFunc("GET /api/runs/{id}/bundle", func(w http.ResponseWriter, r *http.Request) {
+		handleRunBundle(w, r.PathValue("id"))
+	})
+	http.HandleFunc("GET /api/runs/{id}/files", handleRunFiles)
+	http.HandleFunc("GET /api/runs/{id}/files/{path...}", handleRunFile)
+}
+
+// handleRunLogs pages through a run's log. Query parameters: offset and
+// limit, or tail=N for the last N lines; q keeps lines containing the text
+// (case-insensitive); follow=true streams NDJSON lines until the run ends;
+// format=text answers plain text.
+func handleRunLogs(w http.ResponseWriter, r *http.Request, runID string) {
+	if runLogs == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run logs are disabled"})
+		return
+	}
+	if runID == "" || runID != filepath.Base(runID) || strings.HasPrefix(runID, ".") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	run, known := store.Get(runID)
+	files := runLogs.files(runID)
+	if !known && len(files) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	query := r.URL.Query()
+	offset, err := queryInt(query.Get("offset"), 0, 0)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "offset: " + err.Error()})
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), runLogPageSize, 1)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: " + err.Error()})
+		return
+	}
+	tail, err := queryInt(query.Get("tail"), 0, 1)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tail: " + err.Error()})
+		return
+	}
+	limit = min(limit, runLogMaxPageSize)
+	tail = min(tail, runLogMaxPageSize)
+	search := strings.ToLower(query.Get("q"))
+	match := func(text string) bool {
+		return search == "" || strings.Contains(strings.ToLower(text), search)
+	}
+
+	// One pass over the files: count the matches and keep the page, or the
+	// last tail of them
+	reader := &runLogReader{files: files}
+	defer reader.close()
+	var page []runLogLine
+	total := 0
+	for {
+		raw, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		line := parseRunLogLine(reader.n, raw)
+		if !match(line.Text) {
+			continue
+		}
+		total++
+		switch {
+		case tail > 0:
+			page = append(page, line)
+			if len(page) > tail {
+				page = page[1:]
+			}
+		case total > offset && len(page) < limit:
+			page = append(page, line)
+		}
+	}
+	if tail > 0 {
+		offset = total - len(page)
+	}
+
+	switch {
+	case query.Get("follow") == "true":
+		followRunLog(w, r, runID, reader, page, match)
+	case query.Get("format") == "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range page {
+			fmt.Fprintln(w, line.Text)
+		}
+	default:
+		status := ""
+		if known {
+			status = run.Status
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"run_id":     runID,
+			"run_status": status,
+			"lines":      append([]runLogLine{}, page...),
+			"offset":     offset,
+			"total":      total,
+			"more":       offset+len(page) < total,
+		})
+	}
+}
+
+// followRunLog sends the page as NDJSON, then new lines as they are written,
+// until the run has ended and its log is read or the client leaves
+func followRunLog(w http.ResponseWriter, r *http.Request, runID string, reader *runLogReader, page []runLogLine, match func(string) bool) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for _, line := range page {
+		enc.Encode(line)
+	}
+	rc.Flush()
+	path := runLogs.path(runID)
+	ticker := time.NewTicker(runLogPollInterval)
+	defer ticker.Stop()
+	for {
+		// Checked before reading, so the last lines of a run that just ended
+		// are still sent
+		run, ok := store.Get(runID)
+		ended := !ok || run.Finished()
+		sent := false
+		err := reader.readNew(path, func(line runLogLine) error {
+			if !match(line.Text) {
+				return nil
+			}
+			sent = true
+			return enc.Encode(line)
+		})
+		if err != nil || (sent && rc.Flush() != nil) {
+			return
+		}
+		if ended {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queryInt parses an integer query parameter of at least least
+func queryInt(raw string, fallback, least int) (int, error) {
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < least {
+		return 0, fmt.Errorf("must be an integer of at least %d", least)
+	}
+	return n, nil
+}
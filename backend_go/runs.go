@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Run lifecycle states
+const (
+	RunQueued    = "queued"
+	RunRunning   = "running"
+	RunFinished  = "finished"
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+	RunTimedOut  = "timed_out"
+)
+
+// ErrRunNotFound is returned when a run or experiment id is unknown
+var ErrRunNotFound = errors.New("run not found")
+
+// MetricPoint is a single logged value of a metric
+type MetricPoint struct {
+	Value     float64 `json:"value"`
+	Step      int64   `json:"step"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// Run records a single training script execution or an externally tracked run
+type Run struct {
+	ID           string                   `json:"id"`
+	ExperimentID string                   `json:"experiment_id"`
+	Name         string                   `json:"name"`
+	Script       string                   `json:"script,omitempty"`
+	Args         []string                 `json:"args,omitempty"`
+	Status       string                   `json:"status"`
+	Error        string                   `json:"error,omitempty"`
+	StartTime    time.Time                `json:"start_time"`
+	EndTime      *time.Time               `json:"end_time,omitempty"`
+	Params       map[string]string        `json:"params,omitempty"`
+	Metrics      map[string][]MetricPoint `json:"metrics,omitempty"`
+	Tags         map[string]string        `json:"tags,omitempty"`
+	// DeletedAt is set once the run was deleted through the MLflow API,
+	// which keeps it restorable like MLflow does
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Experiment groups runs, mirroring the MLflow concept
+type Experiment struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Finished reports whether the run reached a terminal state
+func (r *Run) Finished() bool {
+	return r.Status == RunFinished || r.Status == RunFailed || r.Status == RunCancelled || r.Status == RunTimedOut
+}
+
+// Finish moves the run to a terminal state and stamps the end time
+func (r *Run) Finish(status string) {
+	now := time.Now()
+	r.Status = status
+	r.EndTime = &now
+}
+
+func (r *Run) clone() *Run {
+	c := *r
+	c.Args = append([]string(nil), r.Args...)
+	c.Params = cloneStringMap(r.Params)
+	c.Tags = cloneStringMap(r.Tags)
+	if r.EndTime != nil {
+		t := *r.EndTime
+		c.EndTime = &t
+	}
+	if r.DeletedAt != nil {
+		t := *r.DeletedAt
+		c.DeletedAt = &t
+	}
+	if r.Metrics != nil {
+		c.Metrics = make(map[string][]MetricPoint, len(r.Metrics))
+		for k, v := range r.Metrics {
+			c.Metrics[k] = append([]MetricPoint(nil), v...)
+		}
+	}
+	return &c
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// RunStore keeps runs and experiments in memory and persists them as JSON under the data directory
+type RunStore struct {
+	mu          sync.RWMutex
+	dir         string
+	runs        map[string]*Run
+	experiments map[string]*Experiment
+	// touched runs were changed by this process; the file has the latest
+	// version of the others, which another process may be updating during
+	// an upgrade
+	touched map[string]bool
+	// dirty is set while logged values wait for saveTimer to write them
+	dirty     bool
+	saveTimer *time.Timer
+}
+
+// runStoreSaveDelay is how long logged values wait to be written, so a
+// training loop logging every step rewrites runs.json at most that often
+const runStoreSaveDelay = time.Second
+
+type runStoreFile struct {
+	Runs        []*Run        `json:"runs"`
+	Experiments []*Experiment `json:"experiments"`
+}
+
+// NewRunStore opens (or creates) the run store in dir
+func NewRunStore(dir string) (*RunStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &RunStore{
+		dir:         dir,
+		runs:        make(map[string]*Run),
+		experiments: make(map[string]*Experiment),
+		touched:     make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(s.file())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var f runStoreFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+		for _, r := range f.Runs {
+			s.runs[r.ID] = r
+		}
+		for _, e := range f.Experiments {
+			s.experiments[e.ID] = e
+		}
+	}
+
+	// MLflow clients expect experiment "0" to always exist
+	if _, ok := s.experiments["0"]; !ok {
+		s.experiments["0"] = &Experiment{ID: "0", Name: "Default", CreatedAt: time.Now()}
+	}
+	return s, nil
+}
+
+func (s *RunStore) file() string {
+	return filepath.Join(s.dir, "runs.json")
+}
+
+// Check reports whether the store directory is still there to save into
+func (s *RunStore) Check() error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(s.dir + " is not a directory")
+	}
+	return nil
+}
+
+// ArtifactDir returns the directory holding artifacts for a run
+func (s *RunStore) ArtifactDir(runID string) string {
+	return filepath.Join(s.dir, "artifacts", runID)
+}
+
+// merge picks up what another process wrote for runs this one has not
+// touched; callers must hold s.mu
+func (s *RunStore) merge() {
+	data, err := os.ReadFile(s.file())
+	if err != nil {
+		return
+	}
+	var f runStoreFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return
+	}
+	onDisk := map[string]bool{}
+	for _, r := range f.Runs {
+		onDisk[r.ID] = true
+		if !s.touched[r.ID] {
+			s.runs[r.ID] = r
+		}
+	}
+	for id := range s.runs {
+		if !onDisk[id] && !s.touched[id] {
+			delete(s.runs, id)
+		}
+	}
+	for _, e := range f.Experiments {
+		if _, ok := s.experiments[e.ID]; !ok {
+			s.experiments[e.ID] = e
+		}
+	}
+}
+
+// save writes the store to disk; callers must hold s.mu
+func (s *RunStore) save() error {
+	s.dirty = false
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+	s.merge()
+	f := runStoreFile{}
+	for _, r := range s.runs {
+		f.Runs = append(f.Runs, r)
+	}
+	for _, e := range s.experiments {
+		f.Experiments = append(f.Experiments, e)
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file())
+}
+
+// Create stores a new run, assigning an id and start time when missing
+func (s *RunStore) Create(run *Run) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if run.ID == "" {
+		run.ID = newID()
+	}
+	if run.ExperimentID == "" {
+		run.ExperimentID = "0"
+	}
+	if _, ok := s.experiments[run.ExperimentID]; !ok {
+		return nil, ErrRunNotFound
+	}
+	if run.StartTime.IsZero() {
+		run.StartTime = time.Now()
+	}
+	if run.Status == "" {
+		run.Status = RunRunning
+	}
+	s.runs[run.ID] = run
+	s.touched[run.ID] = true
+	return run.clone(), s.save()
+}
+
+// Get returns a copy of the run with the given id
+func (s *RunStore) Get(id string) (*Run, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.runs[id]
+	if !ok {
+		return nil, false
+	}
+	return r.clone(), true
+}
+
+// List returns copies of all runs not deleted, newest first
+func (s *RunStore) List() []*Run {
+	return s.list(false)
+}
+
+// ListAll returns copies of all runs, deleted ones included, newest first
+func (s *RunStore) ListAll() []*Run {
+	return s.list(true)
+}
+
+func (s *RunStore) list(deleted bool) []*Run {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*Run, 0, len(s.runs))
+	for _, r := range s.runs {
+		if r.DeletedAt == nil || deleted {
+			out = append(out, r.clone())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartTime.After(out[j].StartTime)
+	})
+	return out
+}
+
+// Update applies fn to the stored run and persists the result
+func (s *RunStore) Update(id string, fn func(*Run)) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.touched[id] {
+		s.merge()
+	}
+	r, ok := s.runs[id]
+	if !ok {
+		return nil, ErrRunNotFound
+	}
+	fn(r)
+	s.touched[id] = true
+	return r.clone(), s.save()
+}
+
+// Log applies fn to the stored run like Update, but the result is written
+// within runStoreSaveDelay, together with whatever else is logged meanwhile
+func (s *RunStore) Log(id string, fn func(*Run)) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.touched[id] {
+		s.merge()
+	}
+	r, ok := s.runs[id]
+	if !ok {
+		return nil, ErrRunNotFound
+	}
+	fn(r)
+	s.touched[id] = true
+	s.dirty = true
+	if s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(runStoreSaveDelay, func() {
+			if err := s.Flush(); err != nil {
+				log.Printf("Error saving run store: %v", err)
+			}
+		})
+	}
+	return r.clone(), nil
+}
+
+// Flush writes logged values that are still waiting to be saved
+func (s *RunStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// SetDeleted marks a run deleted or restores it. Deleted runs keep their
+// artifacts and log, but are left out of List.
+func (s *RunStore) SetDeleted(id string, deleted bool) error {
+	_, err := s.Update(id, func(run *Run) {
+		switch {
+		case !deleted:
+			run.DeletedAt = nil
+		case run.DeletedAt == nil:
+			now := time.Now()
+			run.DeletedAt = &now
+		}
+	})
+	return err
+}
+
+// Delete removes a run, its artifacts and its log
+func (s *RunStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.runs[id]; !ok {
+		return ErrRunNotFound
+	}
+	delete(s.runs, id)
+	s.touched[id] = true
+	if err := os.RemoveAll(s.ArtifactDir(id)); err != nil {
+		return err
+	}
+	runLogs.remove(id)
+	labels.Remove(labelKindRun, id)
+	checksums.RemovePrefix("runs/" + id + "/")
+	return s.save()
+}
+
+// CreateExperiment adds an experiment with a unique name
+func (s *RunStore) CreateExperiment(name string) (*Experiment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.experiments {
+		if e.Name == name {
+			return nil, errors.New("experiment already exists: " + name)
+		}
+	}
+	e := &Experiment{ID: newID(), Name: name, CreatedAt: time.Now()}
+	s.experiments[e.ID] = e
+	c := *e
+	return &c, s.save()
+}
+
+// GetExperiment looks an experiment up by id
+func (s *RunStore) GetExperiment(id string) (*Experiment, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.experiments[id]
+	if !ok {
+		return nil, false
+	}
+	c := *e
+	return &c, true
+}
+
+// ExperimentByName looks an experiment up by name
+func (s *RunStore) ExperimentByName(name string) (*Experiment, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.experiments {
+		if e.Name == name {
+			c := *e
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// Experiments returns all experiments ordered by creation time
+func (s *RunStore) Experiments() []*Experiment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*Experiment, 0, len(s.experiments))
+	for _, e := range s.experiments {
+		c := *e
+		out = append(out, &c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+	return out
+}
+
+// newID returns a random 32 character hex identifier
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// runTracker records an execution WebSocket session as a run by watching the
+// messages relayed in both directions
+type runTracker struct {
+	mu        sync.Mutex
+	runID     string
+	done      bool
+	cancelled bool
+	// queuedAt is when the run last went into the queue
+	queuedAt time.Time
+}
+
+// start records a new run for the execution request
+func (t *runTracker) start(req ExecRequest, target ExecTarget, requestID, user string) {
+	if store == nil {
+		return
+	}
+	params := map[string]string{
+		"script_path": req.ScriptPath,
+		"args":        strings.Join(req.Args, " "),
+		"executor":    target.Executor,
+	}
+	if target.Stage != "" {
+		params["stage"] = target.Stage
+	}
+	if req.Workspace != "" {
+		params["workspace"] = req.Workspace
+	}
+	if target.Priority != "" {
+		params["priority"] = target.Priority
+	}
+	if target.MaxDuration != "" {
+		params["max_duration"] = target.MaxDuration
+	}
+	if req.DatasetSize > 0 {
+		params["dataset_size"] = strconv.Itoa(req.DatasetSize)
+	}
+	// Lineage of the models the run writes
+	for key, value := range map[string]string{
+		"pipeline":         req.Pipeline,
+		"pipeline_version": target.PipelineVersion,
+		"dataset":          req.Dataset,
+		"dataset_version":  req.DatasetVersion,
+		"code_version":     req.CodeVersion,
+	} {
+		if value != "" {
+			params[key] = value
+		}
+	}
+	tags := map[string]string{"request_id": requestID}
+	if hash := snapshotPipeline(); hash != "" {
+		tags["pipeline_snapshot"] = hash
+	}
+	if user != "" {
+		// The tag MLflow clients show as the run's user
+		tags["mlflow.user"] = user
+	}
+	run, err := store.Create(&Run{
+		Name:   filepath.Base(req.ScriptPath),
+		Script: req.ScriptPath,
+		Args:   req.Args,
+		Params: params,
+		Tags:   tags,
+	})
+	if err != nil {
+		log.Printf("Error recording run: %v", err)
+		return
+	}
+	t.runID = run.ID
+	log.Printf("Run %s started: %s (request %s)", run.ID, req.ScriptPath, requestID)
+}
+
+// setStatus moves a live run between queued and running, adding the time it
+// waited to its queued_seconds tag
+func (t *runTracker) setStatus(status string) {
+	if store == nil || t.runID == "" {
+		return
+	}
+	var waited time.Duration
+	if status == RunQueued {
+		t.queuedAt = time.Now()
+	} else if !t.queuedAt.IsZero() {
+		waited, t.queuedAt = time.Since(t.queuedAt), time.Time{}
+	}
+	if _, err := store.Update(t.runID, func(r *Run) {
+		r.Status = status
+		if waited > 0 {
+			setMapValue(&r.Tags, "queued_seconds", strconv.FormatFloat(runQueuedTime(r).Seconds()+waited.Seconds(), 'f', 1, 64))
+		}
+	}); err != nil {
+		log.Printf("Error updating run %s: %v", t.runID, err)
+	}
+}
+
+// runQueuedTime is how long a run waited for a slot in all
+func runQueuedTime(r *Run) time.Duration {
+	seconds, _ := strconv.ParseFloat(r.Tags["queued_seconds"], 64)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// preempted puts a run that gave up its slot back in the queue
+func (t *runTracker) preempted(count int) {
+	if store == nil || t.runID == "" {
+		return
+	}
+	t.queuedAt = time.Now()
+	if _, err := store.Update(t.runID, func(r *Run) {
+		r.Status = RunQueued
+		setMapValue(&r.Tags, "preemptions", strconv.Itoa(count))
+	}); err != nil {
+		log.Printf("Error updating run %s: %v", t.runID, err)
+	}
+}
+
+// timedOut ends a run that ran past its maximum duration, unless it already
+// ended; messages the script sends while it stops no longer change the outcome
+func (t *runTracker) timedOut(limit time.Duration) bool {
+	return t.finish(RunTimedOut, "exceeded its maximum duration of "+limit.String())
+}
+
+// retry ends the run as failed and records a new one for its next attempt.
+// Retries are tagged with the first run (retry_of), the run they retry
+// (retry_previous) and their number (retry_attempt); the retried run gets
+// retried_by.
+func (t *runTracker) retry(failure string, attempt int, args []string) {
+	t.finish(RunFailed, failure)
+	if store == nil || t.runID == "" {
+		return
+	}
+	prev, ok := store.Get(t.runID)
+	if !ok {
+		return
+	}
+	tags := cloneStringMap(prev.Tags)
+	// Set again by the executor and scheduler for the new attempt
+	delete(tags, "preemptions")
+	delete(tags, "upstream")
+	delete(tags, "upstream_target")
+	delete(tags, "retried_by")
+	delete(tags, "queued_seconds")
+	if tags["retry_of"] == "" {
+		tags["retry_of"] = prev.ID
+	}
+	tags["retry_previous"] = prev.ID
+	tags["retry_attempt"] = strconv.Itoa(attempt)
+	run, err := store.Create(&Run{
+		ExperimentID: prev.ExperimentID,
+		Name:         prev.Name,
+		Script:       prev.Script,
+		Args:         args,
+		Status:       RunQueued,
+		Params:       cloneStringMap(prev.Params),
+		Tags:         tags,
+	})
+	if err != nil {
+		log.Printf("Error recording retry of run %s: %v", prev.ID, err)
+		return
+	}
+	if _, err := store.Update(prev.ID, func(r *Run) { setMapValue(&r.Tags, "retried_by", run.ID) }); err != nil {
+		log.Printf("Error updating run %s: %v", prev.ID, err)
+	}
+	t.mu.Lock()
+	t.runID, t.done = run.ID, false
+	t.mu.Unlock()
+	t.queuedAt = time.Now()
+	log.Printf("Run %s retries run %s (attempt %d)", run.ID, prev.ID, attempt)
+}
+
+// handleRun returns a run, with a completion estimate while it has not ended
+func handleRun(w http.ResponseWriter, runID string) {
+	run, ok := store.Get(runID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		*Run
+		ETA *runETA `json:"eta,omitempty"`
+	}{run, estimateRun(runID, time.Now())})
+}
+
+// handleRunRetries lists the first run of an execution and its retries, in
+// order, given any of them
+func handleRunRetries(w http.ResponseWriter, runID string) {
+	run, ok := store.Get(runID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+		return
+	}
+	first := run.ID
+	if id := run.Tags["retry_of"]; id != "" {
+		first = id
+	}
+	runs := []*Run{}
+	for _, r := range store.List() {
+		if r.ID == first || r.Tags["retry_of"] == first {
+			runs = append(runs, r)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartTime.Before(runs[j].StartTime) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"run_id": first, "runs": runs})
+}
+
+// cancelRequested reports whether the client asked to cancel the run
+func (t *runTracker) cancelRequested() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cancelled
+}
+
+// clientMessage inspects a browser-to-service message for cancellation
+func (t *runTracker) clientMessage(message []byte) {
+	if string(message) == "CANCEL" {
+		t.mu.Lock()
+		t.cancelled = true
+		t.mu.Unlock()
+	}
+}
+
+// terminal reports whether a completion marker has been seen
+func (t *runTracker) terminal() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+// serviceMessage inspects a service-to-browser message for completion markers
+// without copying it, as it sees every log line
+func (t *runTracker) serviceMessage(message []byte) {
+	switch {
+	case bytes.Equal(message, []byte("EXECUTION_FINISHED")):
+		t.finish(RunFinished, "")
+	case bytes.HasPrefix(message, []byte("EXECUTION_ERROR:")):
+		t.finish(RunFailed, strings.TrimSpace(string(message[len("EXECUTION_ERROR:"):])))
+	}
+}
+
+// close finalizes a run whose session ended without a completion marker
+func (t *runTracker) close() {
+	t.mu.Lock()
+	cancelled := t.cancelled
+	t.mu.Unlock()
+	if cancelled {
+		t.finish(RunCancelled, "")
+	} else {
+		t.finish(RunFailed, "connection closed before the script finished")
+	}
+}
+
+// finish records the outcome once and reports whether this call did
+func (t *runTracker) finish(status, errMsg string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return false
+	}
+	t.done = true
+	if t.runID == "" {
+		return true
+	}
+	if _, err := store.Update(t.runID, func(r *Run) {
+		r.Finish(status)
+		r.Error = errMsg
+	}); err != nil {
+		log.Printf("Error updating run %s: %v", t.runID, err)
+	}
+	if status == RunFinished {
+		linkRunModel(t.runID)
+		if run, ok := store.Get(t.runID); ok {
+			recordModels(run.StartTime)
+		}
+	}
+	// Training runs write new models
+	responses.Invalidate("/api/models")
+	return true
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Execution scheduling. With MAX_CONCURRENT_RUNS set, at most that many
+// scripts run at once (one per GPU, typically) and further executions wait,
+// still connected, in a queue ordered by priority class and then arrival.
+// The "concurrency" section of CONFIG_FILE also caps the runs of each
+// pipeline (the pipeline config's "name", else the stage, else the script)
+// and workspace (the stage's or pipeline's "workspace", else "default"); a
+// run held by such a cap lets the runs behind it go first. Waiting clients
+// are told their place and why they wait with "EXECUTION_QUEUED: ...". The
+// class comes from the request's "priority", else the "priority" of the
+// stage that owns the script or of the pipeline, else normal.
+//
+// With SCHEDULER_PREEMPT=true, a run that has to wait stops the newest
+// running run of a lower class. The script gets CANCEL, which the executors
+// turn into SIGTERM so it can save a checkpoint, its client gets
+// "EXECUTION_PREEMPTED: ..." and the run goes back to the queue. When it
+// gets a slot again the script restarts with the stage's or pipeline's
+// "resume_args" appended, e.g. ["--resume"].
+//
+// A run may also be limited in time by "max_duration" on the request, stage
+// or pipeline, else RUN_MAX_DURATION, which none of them may exceed. Time
+// spent in the queue does not count. Past the limit the script gets CANCEL
+// and the run is marked timed_out; if it has not stopped RUN_TIMEOUT_GRACE
+// later, the attempt is cancelled, which closes the upstream connection or
+// deletes the job.
+//
+// A failed run is retried under the "retry" policy of its stage or pipeline:
+// {"max_retries": 2, "backoff": "30s", "max_backoff": "10m", "on": "any"}.
+// By default only infrastructure failures are retried: the executor could
+// not run the script or lost it before it finished. With "on": "any" a
+// failing script is retried too. Each retry is a new run, tagged with the
+// run it retries, that waits out the backoff (doubled on every retry) on the
+// scheduler's retrying list and then goes through the queue like any other.
+// Once retrying, a run no longer needs its client: it goes on when the
+// client leaves, and only CANCEL, an administrator or the retry limit end
+// it. Timed-out, cancelled and killed runs are never retried.
+
+// Priority classes, lowest first
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityNames = []string{"low", "normal", "high"}
+
+// parsePriority reads a priority class name; empty is normal
+func parsePriority(name string) (int, error) {
+	if name == "" {
+		return priorityNormal, nil
+	}
+	if i := slices.Index(priorityNames, name); i >= 0 {
+		return i, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q (low, normal or high)", name)
+}
+
+// schedJob is one attempt of a run to get a slot
+type schedJob struct {
+	RunID     string     `json:"run_id"`
+	Script    string     `json:"script"`
+	Pipeline  string     `json:"pipeline,omitempty"`
+	Workspace string     `json:"workspace"`
+	Priority  string     `json:"priority"`
+	Queued    time.Time  `json:"queued_at"`
+	Started   *time.Time `json:"started_at,omitempty"`
+	// RetryAt is when a retrying job joins the queue
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+	// Reason says what a waiting job waits for
+	Reason string `json:"reason,omitempty"`
+
+	priority int
+	seq      uint64
+	// granted is closed when the job gets a slot, preempt when it must give
+	// it up; moved is signalled when its place in the queue may have changed
+	granted   chan struct{}
+	preempt   chan struct{}
+	moved     chan struct{}
+	preempted bool
+}
+
+type runScheduler struct {
+	// slots is the number of runs at once, 0 for no limit
+	slots      int
+	preemption bool
+	// maxDuration is the default limit on a run's running time, 0 for none
+	maxDuration  time.Duration
+	timeoutGrace time.Duration
+
+	mu sync.Mutex
+	// limits are the pipeline and workspace caps from CONFIG_FILE
+	limits  ConcurrencyConfig
+	seq     uint64
+	running []*schedJob
+	waiting []*schedJob
+	// retrying are failed runs waiting out their backoff
+	retrying []*schedJob
+}
+
+// scheduler is replaced in serve with the MAX_CONCURRENT_RUNS settings
+var scheduler = &runScheduler{}
+
+func newRunSchedulerFromEnv() (*runScheduler, error) {
+	s := &runScheduler{
+		slots:        envInt("MAX_CONCURRENT_RUNS", 0),
+		preemption:   os.Getenv("SCHEDULER_PREEMPT") == "true",
+		maxDuration:  envDuration("RUN_MAX_DURATION", 0),
+		timeoutGrace: envDuration("RUN_TIMEOUT_GRACE", 30*time.Second),
+	}
+	if s.slots < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_RUNS must not be negative")
+	}
+	return s, nil
+}
+
+// maxRunDuration reads a run's "max_duration"; empty takes RUN_MAX_DURATION
+// and "0" means no limit. RUN_MAX_DURATION is also the ceiling: a longer
+// value, or "0", gets RUN_MAX_DURATION.
+func (s *runScheduler) maxRunDuration(raw string) (time.Duration, error) {
+	if raw == "" {
+		return s.maxDuration, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid max_duration %q (e.g. 90m or 6h)", raw)
+	}
+	if s.maxDuration > 0 && (d == 0 || d > s.maxDuration) {
+		return s.maxDuration, nil
+	}
+	return d, nil
+}
+
+// watchDeadline calls expire once an attempt has run for d and, when it
+// reports the attempt is to be stopped, cancel timeoutGrace later, unless
+// stop was called first
+func (s *runScheduler) watchDeadline(d time.Duration, expire func() bool, cancel context.CancelFunc) (stop func()) {
+	var mu sync.Mutex
+	stopped := false
+	var kill *time.Timer
+	timer := time.AfterFunc(d, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		if expire() {
+			kill = time.AfterFunc(s.timeoutGrace, cancel)
+		}
+	})
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		timer.Stop()
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
+
+// Retry policy "on" values
+const (
+	retryOnInfrastructure = "infrastructure"
+	retryOnAny            = "any"
+)
+
+// retryPolicy is the "retry" block of a stage or pipeline
+type retryPolicy struct {
+	MaxRetries int    `json:"max_retries"`
+	Backoff    string `json:"backoff"`
+	MaxBackoff string `json:"max_backoff"`
+	On         string `json:"on"`
+}
+
+// runRetries is a parsed retry policy; the zero value never retries
+type runRetries struct {
+	max        int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	any        bool
+}
+
+// parseRetryPolicy reads a "retry" block, empty for none
+func parseRetryPolicy(raw json.RawMessage) (runRetries, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return runRetries{}, nil
+	}
+	var p retryPolicy
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return runRetries{}, fmt.Errorf("invalid retry policy: %w", err)
+	}
+	if p.MaxRetries < 0 {
+		return runRetries{}, fmt.Errorf("invalid retry policy: max_retries must not be negative")
+	}
+	r := runRetries{max: p.MaxRetries, backoff: 30 * time.Second, maxBackoff: 10 * time.Minute}
+	for _, d := range []struct {
+		name, raw string
+		to        *time.Duration
+	}{{"backoff", p.Backoff, &r.backoff}, {"max_backoff", p.MaxBackoff, &r.maxBackoff}} {
+		if d.raw == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.raw)
+		if err != nil || v < 0 {
+			return runRetries{}, fmt.Errorf("invalid retry policy: %s %q (e.g. 30s or 5m)", d.name, d.raw)
+		}
+		*d.to = v
+	}
+	switch p.On {
+	case "", retryOnInfrastructure:
+	case retryOnAny:
+		r.any = true
+	default:
+		return runRetries{}, fmt.Errorf("invalid retry policy: on %q (infrastructure or any)", p.On)
+	}
+	return r, nil
+}
+
+// delay is the backoff before the given retry, counting from 1
+func (r runRetries) delay(retry int) time.Duration {
+	d := r.backoff
+	for i := 1; i < retry && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, r.maxBackoff)
+}
+
+// setLimits applies the concurrency section of a (re)loaded config
+func (s *runScheduler) setLimits(cfg *ConcurrencyConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = ConcurrencyConfig{}
+	if cfg != nil {
+		s.limits = *cfg
+	}
+	s.dispatch()
+	s.notifyWaiting()
+}
+
+// newJob describes a run asking for a slot; an empty workspace is "default"
+func (s *runScheduler) newJob(runID, script, pipeline, workspace string, priority int) *schedJob {
+	if workspace == "" {
+		workspace = "default"
+	}
+	return &schedJob{
+		RunID:     runID,
+		Script:    script,
+		Pipeline:  pipeline,
+		Workspace: workspace,
+		Priority:  priorityNames[priority],
+		priority:  priority,
+		granted:   make(chan struct{}),
+		preempt:   make(chan struct{}),
+		moved:     make(chan struct{}, 1),
+	}
+}
+
+// acquire waits for a slot for job, calling queued with its place in the
+// queue and what it waits for whenever they change, until ctx is done
+func (s *runScheduler) acquire(ctx context.Context, job *schedJob, queued func(position, total int, reason string)) error {
+	s.mu.Lock()
+	s.seq++
+	job.seq, job.Queued = s.seq, time.Now()
+	s.waiting = append(s.waiting, job)
+	sort.SliceStable(s.waiting, func(i, j int) bool {
+		a, b := s.waiting[i], s.waiting[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.seq < b.seq
+	})
+	s.dispatch()
+	s.preemptFor(job)
+	s.mu.Unlock()
+
+	last, lastReason := 0, ""
+	for {
+		select {
+		case <-job.granted:
+			return nil
+		default:
+		}
+		s.mu.Lock()
+		position, total, reason := slices.Index(s.waiting, job)+1, len(s.waiting), job.Reason
+		s.mu.Unlock()
+		if position > 0 && (position != last || reason != lastReason) {
+			last, lastReason = position, reason
+			queued(position, total, reason)
+		}
+		select {
+		case <-job.granted:
+			return nil
+		case <-job.moved:
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			select {
+			case <-job.granted:
+				// Granted meanwhile; hand the slot on
+				s.remove(job)
+			default:
+				s.waiting = slices.DeleteFunc(s.waiting, func(j *schedJob) bool { return j == job })
+				s.notifyWaiting()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// retryAfter holds job back for delay before it is queued as a retry; ready
+// fires when the backoff is over and stop takes the job off the list
+func (s *runScheduler) retryAfter(job *schedJob, delay time.Duration) (ready <-chan time.Time, stop func()) {
+	at := time.Now().Add(delay)
+	timer := time.NewTimer(delay)
+	s.mu.Lock()
+	job.Queued, job.RetryAt, job.Reason = time.Now(), &at, "waiting out the retry backoff"
+	s.retrying = append(s.retrying, job)
+	s.mu.Unlock()
+	return timer.C, func() {
+		timer.Stop()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.retrying = slices.DeleteFunc(s.retrying, func(j *schedJob) bool { return j == job })
+		job.Reason = ""
+	}
+}
+
+// release gives up job's slot
+func (s *runScheduler) release(job *schedJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(job)
+}
+
+// remove drops a running job and fills its slot; callers hold s.mu
+func (s *runScheduler) remove(job *schedJob) {
+	s.running = slices.DeleteFunc(s.running, func(j *schedJob) bool { return j == job })
+	s.dispatch()
+}
+
+// runLimit is a cap on running jobs: MAX_CONCURRENT_RUNS or the limit of a
+// pipeline or workspace
+type runLimit struct {
+	max    int
+	reason string
+	counts func(*schedJob) bool
+}
+
+// fullLimit returns the limit that keeps job from starting now, nil when it
+// can start; pipeline and workspace limits come first, as preempting other
+// runs does not help with them. Callers hold s.mu.
+func (s *runScheduler) fullLimit(job *schedJob) *runLimit {
+	var limits []runLimit
+	if job.Pipeline != "" {
+		if n := groupLimit(s.limits.Pipelines, job.Pipeline); n > 0 {
+			limits = append(limits, runLimit{n, fmt.Sprintf("pipeline %s is at its limit of %d running", job.Pipeline, n),
+				func(r *schedJob) bool { return r.Pipeline == job.Pipeline }})
+		}
+	}
+	if n := groupLimit(s.limits.Workspaces, job.Workspace); n > 0 {
+		limits = append(limits, runLimit{n, fmt.Sprintf("workspace %s is at its limit of %d running", job.Workspace, n),
+			func(r *schedJob) bool { return r.Workspace == job.Workspace }})
+	}
+	if s.slots > 0 {
+		limits = append(limits, runLimit{s.slots, fmt.Sprintf("all %d slots are busy", s.slots),
+			func(*schedJob) bool { return true }})
+	}
+	for i := range limits {
+		running := 0
+		for _, r := range s.running {
+			if limits[i].counts(r) {
+				running++
+			}
+		}
+		if running >= limits[i].max {
+			return &limits[i]
+		}
+	}
+	return nil
+}
+
+// groupLimit is the limit of a pipeline or workspace, else that of "*"; 0
+// means none
+func groupLimit(limits map[string]int, name string) int {
+	if n, ok := limits[name]; ok {
+		return n
+	}
+	return limits["*"]
+}
+
+// dispatch starts the waiting jobs that fit, in queue order, and records
+// what the others wait for; callers hold s.mu
+func (s *runScheduler) dispatch() {
+	started := false
+	for i := 0; i < len(s.waiting); {
+		job := s.waiting[i]
+		if limit := s.fullLimit(job); limit != nil {
+			job.Reason = limit.reason
+			i++
+			continue
+		}
+		s.waiting = slices.Delete(s.waiting, i, i+1)
+		job.Reason = ""
+		now := time.Now()
+		job.Started = &now
+		s.running = append(s.running, job)
+		close(job.granted)
+		started = true
+	}
+	if started {
+		s.notifyWaiting()
+	}
+}
+
+func (s *runScheduler) notifyWaiting() {
+	for _, j := range s.waiting {
+		select {
+		case j.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// preemptFor stops the newest running job of the lowest class below job's
+// among those counting against the limit it waits for, unless slots being
+// given up already cover the jobs ahead of it; callers hold s.mu
+func (s *runScheduler) preemptFor(job *schedJob) {
+	if !s.preemption || !slices.Contains(s.waiting, job) {
+		return
+	}
+	limit := s.fullLimit(job)
+	if limit == nil {
+		return
+	}
+	ahead := 0
+	for _, w := range s.waiting {
+		if limit.counts(w) {
+			ahead++
+		}
+		if w == job {
+			break
+		}
+	}
+	freeing := 0
+	var victim *schedJob
+	for _, r := range s.running {
+		if !limit.counts(r) {
+			continue
+		}
+		if r.preempted {
+			freeing++
+			continue
+		}
+		if r.priority >= job.priority {
+			continue
+		}
+		if victim == nil || r.priority < victim.priority || (r.priority == victim.priority && r.Started.After(*victim.Started)) {
+			victim = r
+		}
+	}
+	if victim == nil || freeing >= ahead {
+		return
+	}
+	victim.preempted = true
+	close(victim.preempt)
+}
+
+// queueSnapshot is the scheduler state shown by /admin/queue
+type queueSnapshot struct {
+	Slots      int               `json:"slots"`
+	Limits     ConcurrencyConfig `json:"limits"`
+	Preemption bool              `json:"preemption"`
+	Running    []*schedJob       `json:"running"`
+	Waiting    []*schedJob       `json:"waiting"`
+	Retrying   []*schedJob       `json:"retrying"`
+}
+
+func (s *runScheduler) snapshot() queueSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := queueSnapshot{Slots: s.slots, Limits: s.limits, Preemption: s.preemption, Running: []*schedJob{}, Waiting: []*schedJob{}, Retrying: []*schedJob{}}
+	for _, j := range s.running {
+		c := *j
+		snap.Running = append(snap.Running, &c)
+	}
+	for _, j := range s.waiting {
+		c := *j
+		snap.Waiting = append(snap.Waiting, &c)
+	}
+	for _, j := range s.retrying {
+		c := *j
+		snap.Retrying = append(snap.Retrying, &c)
+	}
+	return snap
+}
+
+// resumeRequest returns the request message with the resume arguments added
+// to "args", for a preempted run starting over
+func resumeRequest(raw []byte, args []string) ([]byte, error) {
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	msg["args"] = encoded
+	return json.Marshal(msg)
+}
+
+// registerQueueRoutes shows the running and waiting executions to operators
+func registerQueueRoutes() {
+	http.HandleFunc("/admin/queue", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, scheduler.snapshot())
+	}))
+}
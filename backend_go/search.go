@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// GET /api/search?q= finds runs by name, script, arguments, parameters,
+// tags, status and error, and models by name, config and metrics; with
+// SEARCH_LOGS=true also runs by the contents of their stored logs. The index
+// is kept in memory and rebuilt from the run store and models directory when
+// a query finds it older than SEARCH_REFRESH_INTERVAL; a run's log is only
+// read again when its files changed.
+//
+// Queries are matched word by word and each word also matches as a prefix,
+// so "cos" finds "cosine". A result needs one of the words; results with more
+// of them rank first, then by where the words were found, then newest first.
+
+const (
+	searchPageSize    = 20
+	searchMaxPageSize = 100
+	// searchMaxLogLines is how many matching log lines a run result shows
+	searchMaxLogLines = 3
+	// searchMaxFieldText bounds the matched field values in a result
+	searchMaxFieldText = 200
+)
+
+// searchStopWords are left out of queries so "the run where we tried cosine
+// LR" is about cosine and LR
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "from": true, "in": true, "is": true,
+	"it": true, "of": true, "on": true, "or": true, "that": true, "the": true,
+	"this": true, "to": true, "tried": true, "used": true, "was": true,
+	"we": true, "were": true, "where": true, "which": true, "with": true,
+}
+
+// searchFieldWeight scores a match by the field it is in: names are worth
+// more than parameters and tags, which are worth more than log output
+func searchFieldWeight(field string) int {
+	switch {
+	case field == "name" || field == "id":
+		return 4
+	case strings.HasPrefix(field, "params.") || strings.HasPrefix(field, "tags.") || strings.HasPrefix(field, "config."):
+		return 3
+	case field == "log":
+		return 1
+	}
+	return 2
+}
+
+// searchTokens splits text into lower case words of letters and digits
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func isNumber(token string) bool {
+	for _, r := range token {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+type searchField struct {
+	name, text string
+}
+
+type searchDoc struct {
+	kind   string
+	id     string
+	title  string
+	status string
+	time   time.Time
+	fields []searchField
+}
+
+type searchPosting struct {
+	doc   int
+	field int // index into fields, -1 for the log
+}
+
+// searchLogTerms are the distinct words of a run's log files, and the sizes
+// and modification times they were read at
+type searchLogTerms struct {
+	stamp string
+	terms []string
+}
+
+type searchIndex struct {
+	mu       sync.Mutex
+	refresh  time.Duration
+	logs     bool
+	built    time.Time
+	docs     []searchDoc
+	postings map[string][]searchPosting
+	// words are the keys of postings, sorted for prefix lookups
+	words   []string
+	logTerm map[string]searchLogTerms
+}
+
+// searcher is replaced in serve with the SEARCH_* settings
+var searcher = &searchIndex{refresh: 30 * time.Second, logTerm: map[string]searchLogTerms{}}
+
+func newSearchIndexFromEnv() *searchIndex {
+	return &searchIndex{
+		refresh: envDuration("SEARCH_REFRESH_INTERVAL", 30*time.Second),
+		logs:    os.Getenv("SEARCH_LOGS") == "true",
+		logTerm: map[string]searchLogTerms{},
+	}
+}
+
+// current rebuilds the index if it is stale; the caller holds mu
+func (x *searchIndex) current() {
+	if !x.built.IsZero() && time.Since(x.built) < x.refresh {
+		return
+	}
+	start := time.Now()
+	x.docs = x.docs[:0]
+	x.postings = map[string][]searchPosting{}
+	runIDs := map[string]bool{}
+	if store != nil {
+		experiments := map[string]string{}
+		for _, e := range store.Experiments() {
+			experiments[e.ID] = e.Name
+		}
+		for _, run := range store.List() {
+			runIDs[run.ID] = true
+			x.add(runSearchDoc(run, experiments[run.ExperimentID]))
+		}
+	}
+	if models, err := listModels(); err == nil {
+		for _, m := range models {
+			x.add(modelSearchDoc(m))
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Search: error listing models: %v", err)
+	}
+	for id := range x.logTerm {
+		if !runIDs[id] {
+			delete(x.logTerm, id)
+		}
+	}
+	x.words = x.words[:0]
+	for word := range x.postings {
+		x.words = append(x.words, word)
+	}
+	sort.Strings(x.words)
+	x.built = time.Now()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		log.Printf("Search index rebuilt in %s: %d documents, %d words", elapsed.Round(time.Millisecond), len(x.docs), len(x.words))
+	}
+}
+
+// add indexes a document and, for runs, its log
+func (x *searchIndex) add(doc searchDoc) {
+	i := len(x.docs)
+	seen := map[string]bool{}
+	for f, field := range doc.fields {
+		for _, word := range searchTokens(field.text) {
+			key := fmt.Sprintf("%s %d", word, f)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			x.postings[word] = append(x.postings[word], searchPosting{doc: i, field: f})
+		}
+	}
+	if doc.kind == "run" && x.logs && runLogs != nil {
+		for _, word := range x.logTerms(doc.id) {
+			x.postings[word] = append(x.postings[word], searchPosting{doc: i, field: -1})
+		}
+	}
+	x.docs = append(x.docs, doc)
+}
+
+// logTerms returns the words of a run's log, reading it only if its files
+// changed since the last rebuild
+func (x *searchIndex) logTerms(runID string) []string {
+	files := runLogs.files(runID)
+	var stamp strings.Builder
+	for _, name := range files {
+		if info, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&stamp, "%s %d %d;", name, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	if cached, ok := x.logTerm[runID]; ok && cached.stamp == stamp.String() {
+		return cached.terms
+	}
+	words := map[string]bool{}
+	reader := &runLogReader{files: files}
+	defer reader.close()
+	for {
+		raw, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Search: error reading log of run %s: %v", runID, err)
+			break
+		}
+		// Numbers in training output (steps, losses) are not worth a word each
+		for _, word := range searchTokens(parseRunLogLine(0, raw).Text) {
+			if !isNumber(word) {
+				words[word] = true
+			}
+		}
+	}
+	terms := make([]string, 0, len(words))
+	for word := range words {
+		terms = append(terms, word)
+	}
+	x.logTerm[runID] = searchLogTerms{stamp: stamp.String(), terms: terms}
+	return terms
+}
+
+func runSearchDoc(run *Run, experiment string) searchDoc {
+	doc := searchDoc{kind: "run", id: run.ID, title: run.Name, status: run.Status, time: run.StartTime}
+	doc.fields = append(doc.fields,
+		searchField{"id", run.ID},
+		searchField{"name", run.Name},
+		searchField{"script", run.Script},
+		searchField{"args", strings.Join(run.Args, " ")},
+		searchField{"status", run.Status},
+		searchField{"error", run.Error},
+		searchField{"experiment", experiment},
+	)
+	for _, key := range sortedKeys(run.Params) {
+		doc.fields = append(doc.fields, searchField{"params." + key, key + " " + run.Params[key]})
+	}
+	for _, key := range sortedKeys(run.Tags) {
+		doc.fields = append(doc.fields, searchField{"tags." + key, key + " " + run.Tags[key]})
+	}
+	doc.fields = append(doc.fields, searchField{"metrics", strings.Join(sortedKeys(run.Metrics), " ")})
+	return doc
+}
+
+func modelSearchDoc(m *Model) searchDoc {
+	doc := searchDoc{kind: "model", id: m.ID, title: m.ID, time: m.ModifiedAt}
+	doc.fields = append(doc.fields, searchField{"name", m.ID})
+	for _, key := range sortedKeys(m.Config) {
+		doc.fields = append(doc.fields, searchField{"config." + key, key + " " + m.Config[key]})
+	}
+	doc.fields = append(doc.fields, searchField{"metrics", strings.Join(sortedKeys(m.Metrics), " ")})
+	return doc
+}
+
+// searchMatch is a field that matched, as shown in a result
+type searchMatch struct {
+	Field string `json:"field"`
+	Text  string `json:"text"`
+}
+
+// searchResult is one run or model found by a query
+type searchResult struct {
+	Type   string        `json:"type"`
+	ID     string        `json:"id"`
+	Title  string        `json:"title"`
+	Status string        `json:"status,omitempty"`
+	Time   time.Time     `json:"time"`
+	Score  int           `json:"score"`
+	Terms  []string      `json:"matched_terms"`
+	Fields []searchMatch `json:"matches"`
+	// LogLines are the first lines of the run's log with a query word
+	LogLines []runLogLine `json:"log_lines,omitempty"`
+
+	doc   int
+	terms map[string]bool
+	logs  bool
+}
+
+// query finds the documents containing the query words, kind "" meaning any
+func (x *searchIndex) query(terms []string, kind string) []*searchResult {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.current()
+	hits := map[int]*searchResult{}
+	// scored keeps one score per word and field of a document
+	scored := map[string]bool{}
+	for _, term := range terms {
+		for i := sort.SearchStrings(x.words, term); i < len(x.words) && strings.HasPrefix(x.words[i], term); i++ {
+			for _, p := range x.postings[x.words[i]] {
+				doc := &x.docs[p.doc]
+				if kind != "" && doc.kind != kind {
+					continue
+				}
+				res := hits[p.doc]
+				if res == nil {
+					res = &searchResult{
+						Type: doc.kind, ID: doc.id, Title: doc.title, Status: doc.status, Time: doc.time,
+						Fields: []searchMatch{}, doc: p.doc, terms: map[string]bool{},
+					}
+					hits[p.doc] = res
+				}
+				res.terms[term] = true
+				key := fmt.Sprintf("%s %d %d", term, p.doc, p.field)
+				if scored[key] {
+					continue
+				}
+				scored[key] = true
+				if p.field < 0 {
+					res.Score += searchFieldWeight("log")
+					res.logs = true
+					continue
+				}
+				field := doc.fields[p.field]
+				res.Score += searchFieldWeight(field.name)
+				if !containsMatch(res.Fields, field.name) {
+					res.Fields = append(res.Fields, searchMatch{Field: field.name, Text: truncateText(field.text, searchMaxFieldText)})
+				}
+			}
+		}
+	}
+	results := make([]*searchResult, 0, len(hits))
+	for _, res := range hits {
+		for _, term := range terms {
+			if res.terms[term] {
+				res.Terms = append(res.Terms, term)
+			}
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if len(a.Terms) != len(b.Terms) {
+			return len(a.Terms) > len(b.Terms)
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.Time.After(b.Time)
+	})
+	return results
+}
+
+func containsMatch(matches []searchMatch, field string) bool {
+	for _, m := range matches {
+		if m.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func truncateText(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	for limit > 0 && !utf8.RuneStart(text[limit]) {
+		limit--
+	}
+	return text[:limit] + "…"
+}
+
+// searchLogLines returns the first lines of a run's log containing one of terms
+func searchLogLines(runID string, terms []string) []runLogLine {
+	reader := &runLogReader{files: runLogs.files(runID)}
+	defer reader.close()
+	var lines []runLogLine
+	for len(lines) < searchMaxLogLines {
+		raw, err := reader.next()
+		if err != nil {
+			break
+		}
+		line := parseRunLogLine(reader.n, raw)
+		if hasSearchTerm(line.Text, terms) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func hasSearchTerm(text string, terms []string) bool {
+	for _, word := range searchTokens(text) {
+		for _, term := range terms {
+			if strings.HasPrefix(word, term) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleSearch serves GET /api/search?q=&type=&limit=&label_selector=
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q is required"})
+		return
+	}
+	kind := query.Get("type")
+	if kind != "" && kind != "run" && kind != "model" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "type must be run or model"})
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), searchPageSize, 1)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: " + err.Error()})
+		return
+	}
+	limit = min(limit, searchMaxPageSize)
+	sel, err := parseLabelSelector(query.Get("label_selector"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var terms []string
+	seen := map[string]bool{}
+	for _, word := range searchTokens(q) {
+		if !searchStopWords[word] && !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	if len(terms) == 0 {
+		// A query of stop words only still searches for them
+		terms = searchTokens(q)
+	}
+
+	results := searcher.query(terms, kind)
+	if len(sel) > 0 {
+		runLabels, modelLabels := labels.All(labelKindRun), labels.All(labelKindModel)
+		matched := results[:0]
+		for _, res := range results {
+			set := runLabels[res.ID]
+			if res.Type == labelKindModel {
+				set = modelLabels[res.ID]
+			}
+			if sel.Matches(set) {
+				matched = append(matched, res)
+			}
+		}
+		results = matched
+	}
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	for _, res := range results {
+		if res.logs {
+			res.LogLines = searchLogLines(res.ID, res.Terms)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"query":   q,
+		"terms":   terms,
+		"results": results,
+		"total":   total,
+	})
+}
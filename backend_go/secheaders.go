@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Security response headers on everything the backend serves. The defaults
+// suit the embedded frontend, which uses inline event handlers and styles,
+// data: images and a same-origin WebSocket, and shows model reports in an
+// iframe of the same origin. The security_headers section of CONFIG_FILE
+// changes them, globally or per route, and is re-applied on reload.
+
+// defaultSecurityHeaders apply unless security_headers says otherwise.
+// Strict-Transport-Security is only sent on HTTPS requests.
+var defaultSecurityHeaders = map[string]string{
+	"Content-Security-Policy": "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data: blob:; connect-src 'self'; frame-ancestors 'self'; object-src 'none'; base-uri 'self'",
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "SAMEORIGIN",
+	"Referrer-Policy":           "strict-origin-when-cross-origin",
+	"Strict-Transport-Security": "max-age=31536000",
+}
+
+// securityHeaders is the resolved policy of one config
+type securityHeaders struct {
+	base map[string]string
+	// routes are sorted longest path first, so the most specific rule wins
+	routes []SecurityHeaderRule
+}
+
+func newSecurityHeaders(cfg *SecurityHeadersConfig) *securityHeaders {
+	s := &securityHeaders{base: map[string]string{}}
+	if cfg != nil && cfg.Disabled {
+		return s
+	}
+	for name, value := range defaultSecurityHeaders {
+		s.base[name] = value
+	}
+	if cfg == nil {
+		return s
+	}
+	for name, value := range cfg.Headers {
+		s.base[http.CanonicalHeaderKey(name)] = value
+	}
+	s.routes = append(s.routes, cfg.Routes...)
+	sort.SliceStable(s.routes, func(i, j int) bool { return len(s.routes[i].Path) > len(s.routes[j].Path) })
+	return s
+}
+
+// forPath returns the headers for a request path; empty values are omitted
+func (s *securityHeaders) forPath(path string) map[string]string {
+	out := map[string]string{}
+	for name, value := range s.base {
+		out[name] = value
+	}
+	for _, rule := range s.routes {
+		if rule.Path == path || (strings.HasSuffix(rule.Path, "/") && strings.HasPrefix(path, rule.Path)) {
+			for name, value := range rule.Headers {
+				out[http.CanonicalHeaderKey(name)] = value
+			}
+			break
+		}
+	}
+	for name, value := range out {
+		if value == "" {
+			delete(out, name)
+		}
+	}
+	return out
+}
+
+// withSecurityHeaders sets the current policy's headers on every response
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		https := requestProto(r) == "https"
+		for name, value := range currentSettings().securityHeaders().forPath(r.URL.Path) {
+			if name == "Strict-Transport-Security" && !https {
+				continue
+			}
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stripUpstreamSecurityHeaders drops the Python service's own copies of the
+// headers set here, so proxied responses carry one value of each
+func stripUpstreamSecurityHeaders(resp *http.Response) {
+	for name := range currentSettings().securityHeaders().forPath(resp.Request.URL.Path) {
+		resp.Header.Del(name)
+	}
+}
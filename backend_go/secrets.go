@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets for pipelines, such as S3 keys or API tokens. They are kept in
+// DATA_DIR/secrets.json encrypted with SECRETS_KEY, or in Vault when
+// VAULT_ADDR is set (see vault.go). /api/secrets manages them without ever
+// returning a value, and the pipeline config maps them to environment
+// variables of the scripts that need them:
+//
+//	"pipeline": { "secrets": { "AWS_SECRET_ACCESS_KEY": "s3-secret" }, ... }
+//
+// Stages may add or override entries with a "secrets" block of their own.
+// Pipeline configs are not trusted to pick any secret: the operator grants
+// each secret to scripts and variables in CONFIG_FILE "secret_grants", and
+// only ADMIN_TOKEN or the users in SECRETS_ADMINS may manage them.
+
+// secretMeta describes a secret; the value never leaves the store this way.
+// Dates are nil when the backend does not report them.
+type secretMeta struct {
+	Name      string     `json:"name"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// secretStore is where secret values live
+type secretStore interface {
+	Backend() string
+	List(ctx context.Context) ([]secretMeta, error)
+	Get(ctx context.Context, name string) (string, error)
+	// Put creates or replaces a secret and reports whether it was new
+	Put(ctx context.Context, name, value string) (secretMeta, bool, error)
+	Delete(ctx context.Context, name string) error
+}
+
+var errSecretNotFound = errors.New("secret not found")
+
+// secrets is nil unless SECRETS_KEY or VAULT_ADDR is configured
+var secrets secretStore
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+var secretEnvPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// newSecretStoreFromEnv picks Vault when VAULT_ADDR is set, else the local
+// encrypted file when SECRETS_KEY is set; nil when neither is
+func newSecretStoreFromEnv(dataDir string) (secretStore, error) {
+	if os.Getenv("VAULT_ADDR") != "" {
+		return newVaultSecretStoreFromEnv()
+	}
+	key := os.Getenv("SECRETS_KEY")
+	if key == "" {
+		return nil, nil
+	}
+	return newFileSecretStore(filepath.Join(dataDir, "secrets.json"), key)
+}
+
+// fileSecretStore keeps AES-GCM sealed values in a JSON file
+type fileSecretStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu sync.Mutex
+}
+
+type storedSecret struct {
+	// Value is base64 of nonce and ciphertext, sealed with the name as
+	// additional data so entries cannot be swapped
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s storedSecret) meta(name string) secretMeta {
+	return secretMeta{Name: name, CreatedAt: &s.CreatedAt, UpdatedAt: &s.UpdatedAt}
+}
+
+func newFileSecretStore(path, key string) (*fileSecretStore, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSecretStore{path: path, aead: aead}
+	// Fail at startup, not on first use, when the key does not fit the file
+	all, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for name, stored := range all {
+		if _, err := s.open(name, stored.Value); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *fileSecretStore) Backend() string { return "file" }
+
+func (s *fileSecretStore) load() (map[string]storedSecret, error) {
+	all := map[string]storedSecret{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return all, nil
+}
+
+// save replaces the file in one step so a crash never leaves half of it
+func (s *fileSecretStore) save(all map[string]storedSecret) error {
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileSecretStore) seal(name, value string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), []byte(name))), nil
+}
+
+func (s *fileSecretStore) open(name, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return "", fmt.Errorf("secret %q is corrupt", name)
+	}
+	n := s.aead.NonceSize()
+	plain, err := s.aead.Open(nil, data[:n], data[n:], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %q cannot be decrypted, is SECRETS_KEY right?", name)
+	}
+	return string(plain), nil
+}
+
+func (s *fileSecretStore) List(ctx context.Context) ([]secretMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]secretMeta, 0, len(all))
+	for name, stored := range all {
+		out = append(out, stored.meta(name))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (s *fileSecretStore) Get(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	stored, ok := all[name]
+	if !ok {
+		return "", errSecretNotFound
+	}
+	return s.open(name, stored.Value)
+}
+
+func (s *fileSecretStore) Put(ctx context.Context, name, value string) (secretMeta, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load()
+	if err != nil {
+		return secretMeta{}, false, err
+	}
+	sealed, err := s.seal(name, value)
+	if err != nil {
+		return secretMeta{}, false, err
+	}
+	now := time.Now().UTC()
+	stored, exists := all[name]
+	if !exists {
+		stored.CreatedAt = now
+	}
+	stored.Value, stored.UpdatedAt = sealed, now
+	all[name] = stored
+	if err := s.save(all); err != nil {
+		return secretMeta{}, false, err
+	}
+	return stored.meta(name), !exists, nil
+}
+
+func (s *fileSecretStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := all[name]; !ok {
+		return errSecretNotFound
+	}
+	delete(all, name)
+	return s.save(all)
+}
+
+// handleSecrets serves /api/secrets (list, create) and /api/secrets/{name}
+// (metadata, replace, delete). Values go in and never come out.
+func handleSecrets(w http.ResponseWriter, r *http.Request) {
+	if secrets == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "secrets are not configured, set SECRETS_KEY or VAULT_ADDR"})
+		return
+	}
+	if !canManageSecrets(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "managing secrets needs ADMIN_TOKEN or a user in SECRETS_ADMINS"})
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/secrets"), "/")
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := secrets.List(r.Context())
+			if err != nil {
+				writeSecretError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"backend": secrets.Backend(), "secrets": list})
+		case http.MethodPost:
+			putSecret(w, r, "")
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if !secretNamePattern.MatchString(name) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "secret names are 1-128 letters, digits, '_', '.' or '-'"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list, err := secrets.List(r.Context())
+		if err != nil {
+			writeSecretError(w, err)
+			return
+		}
+		for _, meta := range list {
+			if meta.Name == name {
+				writeJSON(w, http.StatusOK, meta)
+				return
+			}
+		}
+		writeSecretError(w, errSecretNotFound)
+	case http.MethodPut:
+		putSecret(w, r, name)
+	case http.MethodDelete:
+		if err := secrets.Delete(r.Context(), name); err != nil {
+			writeSecretError(w, err)
+			return
+		}
+		log.Printf("Secret %s deleted by %s (request %s)", name, secretActor(r), requestID(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// putSecret stores {"value": ...} under name, or under the body's "name"
+// when posted to the collection
+func putSecret(w http.ResponseWriter, r *http.Request, name string) {
+	var body struct {
+		Name  string  `json:"name"`
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"value": "..."}`})
+		return
+	}
+	if name == "" {
+		name = body.Name
+	}
+	if !secretNamePattern.MatchString(name) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "secret names are 1-128 letters, digits, '_', '.' or '-'"})
+		return
+	}
+	meta, created, err := secrets.Put(r.Context(), name, *body.Value)
+	if err != nil {
+		writeSecretError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	log.Printf("Secret %s stored by %s (request %s)", name, secretActor(r), requestID(r))
+	writeJSON(w, status, meta)
+}
+
+func writeSecretError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSecretNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Secret store error: %v", err)
+	writeJSON(w, http.StatusBadGateway, map[string]string{"error": "secret store unavailable"})
+}
+
+// canManageSecrets reports whether the request carries ADMIN_TOKEN or comes
+// from a user or "group:name" in SECRETS_ADMINS
+func canManageSecrets(r *http.Request) bool {
+	return isAdminToken(r) || identityListed(identityFrom(r), os.Getenv("SECRETS_ADMINS"))
+}
+
+// secretActor names who changed a secret in the log
+func secretActor(r *http.Request) string {
+	if id := identityFrom(r); id != nil {
+		return id.User()
+	}
+	return clientIP(r)
+}
+
+// pipelineSecrets returns the env var to secret mapping of a pipeline or stage block
+func pipelineSecrets(raw json.RawMessage) map[string]string {
+	var m map[string]string
+	json.Unmarshal(raw, &m)
+	return m
+}
+
+// validateSecretGrants checks the secret_grants of CONFIG_FILE
+func validateSecretGrants(grants map[string]SecretGrant) error {
+	for name, grant := range grants {
+		if !secretNamePattern.MatchString(name) {
+			return fmt.Errorf("%q is not a secret name", name)
+		}
+		for _, variable := range grant.Env {
+			if !secretEnvPattern.MatchString(variable) {
+				return fmt.Errorf("%s: %q is not an environment variable name", name, variable)
+			}
+		}
+		for _, pattern := range grant.Scripts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: script pattern %q: %w", name, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether the grant covers setting variable for script
+func (g SecretGrant) allows(variable, script string) bool {
+	if len(g.Env) > 0 && !slices.Contains(g.Env, variable) {
+		return false
+	}
+	if len(g.Scripts) == 0 {
+		return true
+	}
+	for _, pattern := range g.Scripts {
+		if ok, _ := path.Match(pattern, script); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecretEnv reads the secrets a run of script needs into environment
+// variables, refusing mappings the secret grants do not cover
+func resolveSecretEnv(ctx context.Context, mapping map[string]string, script string) (map[string]string, error) {
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+	if secrets == nil {
+		return nil, errors.New("the pipeline uses secrets but no secret store is configured")
+	}
+	grants := currentSettings().secretGrants
+	for variable, name := range mapping {
+		if !secretEnvPattern.MatchString(variable) {
+			return nil, fmt.Errorf("secret %s: %q is not an environment variable name", name, variable)
+		}
+		grant, ok := grants[name]
+		if !ok || !grant.allows(variable, script) {
+			return nil, fmt.Errorf("secret %s is not granted to %s as %s, see secret_grants in CONFIG_FILE", name, script, variable)
+		}
+	}
+	env := make(map[string]string, len(mapping))
+	for variable, name := range mapping {
+		value, err := secrets.Get(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s for %s: %w", name, variable, err)
+		}
+		env[variable] = value
+	}
+	return env, nil
+}
+
+// secretRedactor masks secret values in script output before it reaches the
+// client, the run log or a recording. Very short values are left alone, as
+// masking them would mangle ordinary output.
+func secretRedactor(env map[string]string) *strings.Replacer {
+	var values []string
+	for _, value := range env {
+		if len(value) >= 4 {
+			values = append(values, value)
+		}
+	}
+	// Longest first, so a value containing another is masked whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	var pairs []string
+	for _, value := range values {
+		pairs = append(pairs, value, "********")
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	return strings.NewReplacer(pairs...)
+}
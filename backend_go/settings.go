@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Runtime settings from CONFIG_FILE that can change on reload: the WebSocket
+// origin allowlist, the API rate limit, the log level, the security headers,
+// the per-route timeouts, the feature flags, the IP access rules, the UI
+// branding, the notebook servers and the secret grants. Handlers read the
+// current value on every request, so a reload never drops a running session.
+
+// Log levels for log_level / LOG_LEVEL
+const (
+	LogInfo  = "info"
+	LogDebug = "debug"
+)
+
+type runtimeSettings struct {
+	allowedOrigins []string
+	rateLimit      *RateLimitConfig
+	debug          bool
+	security       *securityHeaders
+	timeouts       []timeoutRule
+	features       map[string]bool
+	ipAccess       []ipAccessScope
+	ui             *UIConfig
+	notebooks      map[string]*notebookServer
+	secretGrants   map[string]SecretGrant
+}
+
+var settings atomic.Pointer[runtimeSettings]
+
+// applySettings switches to the reloadable settings of cfg. LOG_LEVEL (or
+// DEBUG=true) applies when the file sets no log level.
+func applySettings(cfg *Config) {
+	level := cfg.LogLevel
+	if level == "" {
+		level = getEnv("LOG_LEVEL", LogInfo)
+		if os.Getenv("DEBUG") == "true" {
+			level = LogDebug
+		}
+	}
+	// Validate has rejected rules that do not parse
+	ipAccess, _ := parseIPAccess(cfg.IPAccess)
+	settings.Store(&runtimeSettings{
+		allowedOrigins: cfg.AllowedOrigins,
+		rateLimit:      cfg.RateLimit,
+		debug:          level == LogDebug,
+		security:       newSecurityHeaders(cfg.SecurityHeaders),
+		timeouts:       parseTimeoutRules(cfg.Timeouts),
+		features:       resolveFeatures(envFeatures, cfg.Features),
+		ipAccess:       ipAccess,
+		ui:             cfg.UI,
+		notebooks:      newNotebookServers(cfg.Notebooks),
+		secretGrants:   cfg.SecretGrants,
+	})
+}
+
+func currentSettings() *runtimeSettings {
+	if s := settings.Load(); s != nil {
+		return s
+	}
+	return &runtimeSettings{}
+}
+
+// securityHeaders returns the security header policy, the defaults before
+// the config is applied
+func (s *runtimeSettings) securityHeaders() *securityHeaders {
+	if s.security == nil {
+		return newSecurityHeaders(nil)
+	}
+	return s.security
+}
+
+// timeoutRule returns the timeout rule for a path: an exact match, else the
+// longest matching prefix
+func (s *runtimeSettings) timeoutRule(path string) (timeoutRule, bool) {
+	var best timeoutRule
+	found := false
+	for _, rule := range s.timeouts {
+		if rule.path == path {
+			return rule, true
+		}
+		if strings.HasSuffix(rule.path, "/") && strings.HasPrefix(path, rule.path) && len(rule.path) > len(best.path) {
+			best, found = rule, true
+		}
+	}
+	return best, found
+}
+
+// debugf logs only at log level debug
+func debugf(format string, args ...interface{}) {
+	if currentSettings().debug {
+		log.Printf(format, args...)
+	}
+}
+
+// checkOrigin is the WebSocket upgrader's origin check: requests without an
+// Origin header (non-browser clients) and same-host pages always pass, the
+// host being the one the client asked for when behind a trusted proxy
+func checkOrigin(r *http.Request) bool {
+	allowed := currentSettings().allowedOrigins
+	if len(allowed) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && (strings.EqualFold(u.Host, r.Host) || strings.EqualFold(u.Host, requestHost(r))) {
+		return true
+	}
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return true
+		}
+	}
+	log.Printf("Rejected WebSocket from origin %s", origin)
+	return false
+}
+
+// rateLimiter keeps a token bucket per client IP, sized by the current settings
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var apiLimiter = &rateLimiter{buckets: map[string]*tokenBucket{}}
+
+// Wrap answers 429 to clients over the configured rate
+func (l *rateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl := currentSettings().rateLimit
+		if rl == nil || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait, ok := l.allow(clientIP(r), rl); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"detail": "Rate limit exceeded"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow takes a token from the client's bucket, or reports how long until one is available
+func (l *rateLimiter) allow(client string, rl *RateLimitConfig) (time.Duration, bool) {
+	burst := float64(rl.Burst)
+	if burst <= 0 {
+		burst = rl.RequestsPerSecond
+	}
+	burst = max(burst, 1)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Forget idle clients once a minute
+	if now.Sub(l.swept) > time.Minute {
+		for ip, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, ip)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rl.RequestsPerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rl.RequestsPerSecond * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
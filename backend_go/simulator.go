@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Simulator mode (--simulate): an in-process stand-in for the Python training
+// service, listening on a loopback port and used as the default upstream. Runs
+// print fake epochs and metrics, training scripts leave a model with its info
+// file and report behind, so the frontend and integrations work offline.
+
+// simulator serves the subset of the Python service API the frontend uses
+type simulator struct {
+	dir        string
+	epochDelay time.Duration
+
+	mu       sync.Mutex
+	loaded   string
+	pipeline []byte
+	active   int
+}
+
+// startSimulator serves the simulated service on a loopback port and returns its URL
+func startSimulator(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	sim := &simulator{dir: dir, epochDelay: envDuration("SIMULATE_EPOCH_DELAY", time.Second)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/models", sim.handleModels)
+	mux.HandleFunc("/api/models", sim.handleModels)
+	mux.HandleFunc("/api/model/report/", sim.handleReport)
+	mux.HandleFunc("/api/model/delete", sim.handleDelete)
+	mux.HandleFunc("/api/model/load", sim.handleLoad)
+	mux.HandleFunc("/api/model/loaded", sim.handleLoaded)
+	mux.HandleFunc("/api/pipeline/load", sim.handlePipelineLoad)
+	mux.HandleFunc("/api/pipeline/save", sim.handlePipelineSave)
+	mux.HandleFunc("/api/process/active", sim.handleActive)
+	mux.HandleFunc("/api/script/ws/execute", sim.handleExecute)
+	mux.HandleFunc("/api/dataset/", sim.handleDataset)
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"version": Version + "-simulated", "api_version": APIVersion})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"detail": "Not available in simulator mode: " + r.URL.Path})
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Simulator stopped: %v", err)
+		}
+	}()
+	url := "http://" + listener.Addr().String()
+	log.Printf("Simulator mode: synthetic training service on %s, models in %s", url, dir)
+	return url, nil
+}
+
+// simModel is an entry of /api/models
+type simModel struct {
+	Path         string  `json:"path"`
+	LastModified float64 `json:"last_modified"`
+	P            float64 `json:"p"`
+	R            float64 `json:"r"`
+	MAP50        float64 `json:"map50"`
+	MAP50_95     float64 `json:"map50_95"`
+	HasReport    bool    `json:"has_report"`
+}
+
+func (s *simulator) handleModels(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"detail": err.Error()})
+		return
+	}
+	models := []simModel{}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".pt" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ".pt")
+		m := readSimMetrics(filepath.Join(s.dir, base+".txt"))
+		m.Path = e.Name()
+		m.LastModified = float64(info.ModTime().UnixNano()) / 1e9
+		_, err = os.Stat(filepath.Join(s.dir, base+".html"))
+		m.HasReport = err == nil
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].LastModified > models[j].LastModified })
+	writeJSON(w, http.StatusOK, models)
+}
+
+// readSimMetrics parses the info file format the training scripts write
+func readSimMetrics(path string) simModel {
+	var m simModel
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Precision (P)":
+			m.P = v
+		case "Recall (R)":
+			m.R = v
+		case "mAP50":
+			m.MAP50 = v
+		case "mAP50-95":
+			m.MAP50_95 = v
+		}
+	}
+	return m
+}
+
+func (s *simulator) handleReport(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(filepath.Base(r.URL.Path), ".pt")
+	path := filepath.Join(s.dir, name+".html")
+	if _, err := os.Stat(path); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "HTML report not found for this model"})
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+func (s *simulator) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"detail": "name is required"})
+		return
+	}
+	name := filepath.Base(req.Name)
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": fmt.Sprintf("Model %s not found", name)})
+		return
+	}
+	base := strings.TrimSuffix(name, ".pt")
+	os.Remove(filepath.Join(s.dir, base+".html"))
+	os.Remove(filepath.Join(s.dir, base+".txt"))
+	writeJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("Model %s and related files deleted successfully", name)})
+}
+
+func (s *simulator) handleLoad(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"detail": "path is required"})
+		return
+	}
+	name := filepath.Base(req.Path)
+	if _, err := os.Stat(filepath.Join(s.dir, name)); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "Model not found: " + name})
+		return
+	}
+	s.mu.Lock()
+	s.loaded = name
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"message":    fmt.Sprintf("Model %s loaded successfully", name),
+		"model_path": name,
+		"load_time":  0.1,
+	})
+}
+
+func (s *simulator) handleLoaded(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	loaded := s.loaded
+	s.mu.Unlock()
+	if loaded == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"loaded": false, "model_path": nil})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"loaded": true, "model_path": loaded})
+}
+
+// handlePipelineLoad serves the last saved config, or the frontend's own
+func (s *simulator) handlePipelineLoad(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data := s.pipeline
+	s.mu.Unlock()
+	if data == nil {
+		var err error
+		if data, err = readPipelineConfig(); err != nil {
+			data = []byte(`{"pipeline": {"stages": [], "variables": {}}}`)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handlePipelineSave keeps the config in memory; the frontend files are left alone
+func (s *simulator) handlePipelineSave(w http.ResponseWriter, r *http.Request) {
+	var config map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"detail": err.Error()})
+		return
+	}
+	data, _ := json.Marshal(config)
+	s.mu.Lock()
+	s.pipeline = data
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Pipeline configuration saved successfully", "config": config})
+}
+
+func (s *simulator) handleActive(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	count := s.active
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"active_processes": map[string]interface{}{}, "count": count})
+}
+
+// handleDataset answers every dataset listing as empty
+func (s *simulator) handleDataset(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info"):
+		writeJSON(w, http.StatusOK, map[string]interface{}{"total_images": 0, "dataset_exists": false})
+	case strings.HasSuffix(r.URL.Path, "/images"):
+		writeJSON(w, http.StatusOK, map[string]interface{}{"images": []string{}, "total": 0, "page": 1, "page_size": 25, "total_pages": 0})
+	case strings.HasSuffix(r.URL.Path, "/backgrounds"):
+		writeJSON(w, http.StatusOK, map[string]interface{}{"backgrounds": []string{}})
+	case strings.HasSuffix(r.URL.Path, "/targets"):
+		writeJSON(w, http.StatusOK, map[string]interface{}{"targets": []string{}})
+	default:
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"detail": "Datasets are not available in simulator mode"})
+	}
+}
+
+// handleExecute plays a synthetic run. Scripts with "train" in their name
+// log epochs with improving metrics and save a model; others log a few
+// steps. A CANCEL message stops the run, like the real service.
+func (s *simulator) handleExecute(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var req ExecRequest
+	if err := conn.ReadJSON(&req); err != nil {
+		return
+	}
+	if req.ScriptPath == "" {
+		conn.WriteMessage(websocket.TextMessage, []byte("EXECUTION_ERROR: No script path provided"))
+		return
+	}
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	cancelled := make(chan struct{})
+	go func() {
+		defer close(cancelled)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil || string(msg) == "CANCEL" {
+				return
+			}
+		}
+	}()
+	send := func(text string) bool {
+		return conn.WriteMessage(websocket.TextMessage, []byte(text)) == nil
+	}
+	wait := func() bool {
+		select {
+		case <-cancelled:
+			return false
+		case <-time.After(s.epochDelay):
+			return true
+		}
+	}
+
+	send(fmt.Sprintf("[simulator] Running %s %s", req.ScriptPath, strings.Join(req.Args, " ")))
+	if !strings.Contains(strings.ToLower(filepath.Base(req.ScriptPath)), "train") {
+		for step := 1; step <= 3; step++ {
+			if !wait() {
+				return
+			}
+			send(fmt.Sprintf("[simulator] Step %d/3 done", step))
+		}
+		send("EXECUTION_FINISHED")
+		return
+	}
+
+	epochs := simEpochs(req.Args)
+	var p, rec, map50, map5095 float64
+	for epoch := 1; epoch <= epochs; epoch++ {
+		if !wait() {
+			return
+		}
+		progress := float64(epoch) / float64(epochs)
+		noise := func() float64 { return (rand.Float64() - 0.5) * 0.02 }
+		loss := 1.8*math.Exp(-3*progress) + 0.05 + noise()
+		p = 0.55 + 0.4*progress + noise()
+		rec = 0.5 + 0.42*progress + noise()
+		map50 = 0.5 + 0.45*progress + noise()
+		map5095 = 0.25 + 0.4*progress + noise()
+		send(fmt.Sprintf("Epoch %d/%d: box_loss=%.4f cls_loss=%.4f", epoch, epochs, loss, loss*0.6))
+		send(fmt.Sprintf("  P=%.3f R=%.3f mAP50=%.3f mAP50-95=%.3f", p, rec, map50, map5095))
+	}
+
+	name, err := s.saveModel(req, epochs, p, rec, map50, map5095)
+	if err != nil {
+		send("EXECUTION_ERROR: " + err.Error())
+		return
+	}
+	send("Model saved: " + name)
+	send("EXECUTION_FINISHED")
+}
+
+// simEpochs reads --epochs from the script arguments (default 5)
+func simEpochs(args []string) int {
+	for i, arg := range args {
+		value := ""
+		if strings.HasPrefix(arg, "--epochs=") {
+			value = strings.TrimPrefix(arg, "--epochs=")
+		} else if arg == "--epochs" && i+1 < len(args) {
+			value = args[i+1]
+		}
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 5
+}
+
+// saveModel writes a placeholder model with the info file and report the
+// real training scripts produce
+func (s *simulator) saveModel(req ExecRequest, epochs int, p, r, map50, map5095 float64) (string, error) {
+	stamp := time.Now().Format("20060102_150405")
+	base := "simulated_model_" + stamp
+	if err := os.WriteFile(filepath.Join(s.dir, base+".pt"), []byte("simulated model, not loadable by YOLO\n"), 0644); err != nil {
+		return "", err
+	}
+	info := fmt.Sprintf(`Simulated Model Training Results - %s
+==================================================
+
+Training Configuration:
+  Epochs: %d
+  Script: %s %s
+
+Final Training Metrics:
+  Precision (P):    %.3f
+  Recall (R):       %.3f
+  mAP50:            %.3f
+  mAP50-95:         %.3f
+`, stamp, epochs, req.ScriptPath, strings.Join(req.Args, " "), p, r, map50, map5095)
+	if err := os.WriteFile(filepath.Join(s.dir, base+".txt"), []byte(info), 0644); err != nil {
+		return "", err
+	}
+	report := fmt.Sprintf("<html><head><title>%s</title></head><body><h1>Simulated training report</h1><pre>%s</pre></body></html>\n", base, info)
+	if err := os.WriteFile(filepath.Join(s.dir, base+".html"), []byte(report), 0644); err != nil {
+		return "", err
+	}
+	return base + ".pt", nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// SSH executor: runs the training script on a remote GPU workstation through
+// the system ssh client, so existing keys, agents and ~/.ssh/config apply.
+
+// sshSettings is the "ssh" block of a pipeline or stage config
+type sshSettings struct {
+	Host    string            `json:"host"`
+	User    string            `json:"user"`
+	Port    string            `json:"port"`
+	KeyFile string            `json:"key_file"`
+	WorkDir string            `json:"workdir"`
+	Python  string            `json:"python"`
+	Env     map[string]string `json:"env"`
+}
+
+type sshExecutor struct {
+	defaults sshSettings
+}
+
+// newSSHExecutorFromEnv returns nil unless SSH_HOST is configured
+func newSSHExecutorFromEnv() *sshExecutor {
+	host := os.Getenv("SSH_HOST")
+	if host == "" {
+		return nil
+	}
+	log.Printf("SSH executor enabled (%s)", host)
+	return &sshExecutor{defaults: sshSettings{
+		Host:    host,
+		User:    os.Getenv("SSH_USER"),
+		Port:    getEnv("SSH_PORT", "22"),
+		KeyFile: os.Getenv("SSH_KEY_FILE"),
+		WorkDir: getEnv("SSH_WORKDIR", "."),
+		Python:  getEnv("SSH_PYTHON", "python3"),
+	}}
+}
+
+func (e *sshExecutor) Name() string { return "ssh" }
+
+func (e *sshExecutor) Execute(ctx context.Context, s *ExecSession) error {
+	settings := e.defaults
+	if len(s.Target.Settings) > 0 {
+		if err := json.Unmarshal(s.Target.Settings, &settings); err != nil {
+			return fmt.Errorf("invalid ssh settings: %w", err)
+		}
+	}
+
+	// -tt gives the remote script a PTY (line-buffered output, like the Python
+	// service) and makes sshd hang up the script when we disconnect
+	args := []string{"-tt", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new", "-p", settings.Port}
+	if settings.KeyFile != "" {
+		args = append(args, "-i", settings.KeyFile)
+	}
+	dest := settings.Host
+	if settings.User != "" {
+		dest = settings.User + "@" + settings.Host
+	}
+	args = append(args, dest, remoteCommand(settings, s.Request, len(s.Env) > 0))
+
+	cmd := exec.Command("ssh", args...)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("starting ssh: %w", err)
+	}
+	s.SetUpstream(upstreamConnecting)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting ssh: %w", err)
+	}
+	s.SendText(fmt.Sprintf("Executing: %s -u %s %s (ssh %s)", settings.Python, s.Request.ScriptPath, strings.Join(s.Request.Args, " "), dest))
+
+	// Stop the remote script when the user cancels or disconnects
+	cancelled := make(chan struct{})
+	go func() {
+		for msg := range s.Input {
+			if string(msg.Data) == "CANCEL" {
+				close(cancelled)
+				break
+			}
+		}
+		cmd.Process.Signal(syscall.SIGTERM)
+	}()
+	go func() {
+		<-ctx.Done()
+		cmd.Process.Signal(syscall.SIGTERM)
+	}()
+
+	waitErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		writer.Close()
+		waitErr <- err
+	}()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(scanLinesOrCR)
+	connected := false
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			// The remote shell is ready for the secrets
+			if line == sshSecretsPrompt && len(s.Env) > 0 {
+				stdin.Write(secretInput(s.Env))
+				continue
+			}
+			// The remote script's first line means the connection is up
+			if !connected {
+				connected = true
+				s.SetUpstream(upstreamConnected)
+			}
+			s.SendText(line)
+		}
+	}
+	err = <-waitErr
+
+	select {
+	case <-cancelled:
+		return nil
+	default:
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.ExitCode() == 255 {
+			return fmt.Errorf("ssh connection to %s failed", dest)
+		}
+		return s.SendText(fmt.Sprintf("EXECUTION_ERROR: Script failed with exit code %d", exitErr.ExitCode()))
+	}
+	if err != nil {
+		return err
+	}
+	return s.SendText("EXECUTION_FINISHED")
+}
+
+// sshSecretsPrompt is printed by the remote shell when it waits for secrets
+const sshSecretsPrompt = "__TRAINING_SECRETS__"
+
+// remoteCommand builds the shell command run on the remote host. Secrets do
+// not go in it, as process listings on both hosts would show them: the shell
+// turns off the terminal's echo, prints sshSecretsPrompt and reads them from
+// stdin, one NAME=<base64 value> line each until an empty line, into its
+// environment before it starts the script.
+func remoteCommand(st sshSettings, req ExecRequest, withSecrets bool) string {
+	parts := []string{"cd", shellQuote(st.WorkDir), "&&"}
+	if withSecrets {
+		parts = append(parts, `{ stty -echo 2>/dev/null; echo `+sshSecretsPrompt+`;`,
+			`while IFS= read -r line && [ -n "$line" ]; do export "${line%%=*}=$(printf %s "${line#*=}" | base64 -d)" || exit 1; done; }`, "&&")
+	}
+	parts = append(parts, "exec", "env", "PYTHONUNBUFFERED=1")
+	keys := make([]string, 0, len(st.Env))
+	for k := range st.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, shellQuote(k+"="+st.Env[k]))
+	}
+	parts = append(parts, shellQuote(st.Python), "-u", shellQuote(req.ScriptPath))
+	for _, a := range req.Args {
+		parts = append(parts, shellQuote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+// secretInput is what the remote shell of remoteCommand reads from stdin
+func secretInput(env map[string]string) []byte {
+	var b strings.Builder
+	for _, k := range sortedKeys(env) {
+		b.WriteString(k + "=" + base64.StdEncoding.EncodeToString([]byte(env[k])) + "\n")
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// shellQuote wraps s in single quotes for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// scanLinesOrCR splits on \n and on bare \r so PTY progress bars stream as separate lines
+func scanLinesOrCR(data []byte, atEOF bool) (int, []byte, error) {
+	for i, b := range data {
+		if b == '\n' || b == '\r' {
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
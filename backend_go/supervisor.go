@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supervisor mode: the backend launches the Python training service itself and
+// restarts it with exponential backoff when it exits, so a single box only
+// needs this binary and its environment.
+
+// Supervised process states
+const (
+	ProcessStarting = "starting"
+	ProcessRunning  = "running"
+	ProcessBackoff  = "backoff"
+	ProcessStopped  = "stopped"
+)
+
+const (
+	supervisorMinBackoff = time.Second
+	supervisorMaxBackoff = time.Minute
+	// A process that stays up this long resets the backoff
+	supervisorStableAfter = time.Minute
+)
+
+// supervisorStatus is reported under python_process in /health
+type supervisorStatus struct {
+	State      string     `json:"state"`
+	PID        int        `json:"pid,omitempty"`
+	Command    string     `json:"command"`
+	Restarts   int        `json:"restarts"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	LastExit   string     `json:"last_exit,omitempty"`
+	LastExitAt *time.Time `json:"last_exit_at,omitempty"`
+	NextStart  *time.Time `json:"next_start,omitempty"`
+}
+
+type pythonSupervisor struct {
+	command []string
+	dir     string
+	env     []string
+
+	mu     sync.Mutex
+	status supervisorStatus
+	done   chan struct{}
+}
+
+// newPythonSupervisorFromEnv returns nil unless PYTHON_SUPERVISE=true
+func newPythonSupervisorFromEnv() (*pythonSupervisor, error) {
+	if os.Getenv("PYTHON_SUPERVISE") != "true" {
+		return nil, nil
+	}
+	command := strings.Fields(getEnv("PYTHON_COMMAND", "uvicorn main_v8:app --host 127.0.0.1 --port 3001"))
+	if len(command) == 0 {
+		return nil, errors.New("PYTHON_COMMAND is empty")
+	}
+	extra, err := parsePythonEnv(os.Getenv("PYTHON_ENV"))
+	if err != nil {
+		return nil, err
+	}
+	return &pythonSupervisor{
+		command: command,
+		dir:     getEnv("PYTHON_WORKDIR", "../training_service_python"),
+		env:     append(os.Environ(), extra...),
+		status:  supervisorStatus{State: ProcessStopped, Command: strings.Join(command, " ")},
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// parsePythonEnv reads PYTHON_ENV, KEY=value pairs separated by commas. A
+// comma starts a new pair only when a KEY= follows it, so values may hold
+// commas themselves, as in CUDA_VISIBLE_DEVICES=0,1.
+func parsePythonEnv(raw string) ([]string, error) {
+	var env []string
+	for _, part := range strings.Split(raw, ",") {
+		key, _, ok := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case ok && secretEnvPattern.MatchString(key):
+			env = append(env, strings.TrimLeft(part, " \t"))
+		case len(env) > 0:
+			env[len(env)-1] += "," + part
+		case strings.TrimSpace(part) != "":
+			return nil, fmt.Errorf("PYTHON_ENV: %q is not KEY=value", part)
+		}
+	}
+	for i := range env {
+		env[i] = strings.TrimRight(env[i], ", \t")
+	}
+	return env, nil
+}
+
+// Run keeps the Python service running until ctx is cancelled
+func (s *pythonSupervisor) Run(ctx context.Context) {
+	defer close(s.done)
+	backoff := supervisorMinBackoff
+
+	for {
+		cmd := exec.Command(s.command[0], s.command[1:]...)
+		cmd.Dir = s.dir
+		cmd.Env = s.env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		setProcessGroup(cmd)
+
+		s.setState(ProcessStarting, nil)
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			log.Printf("Supervisor: failed to start Python service: %v", err)
+			s.exited(err.Error())
+		} else {
+			s.mu.Lock()
+			s.status.PID = cmd.Process.Pid
+			s.status.StartedAt = &started
+			s.mu.Unlock()
+			s.setState(ProcessRunning, nil)
+			log.Printf("Supervisor: started Python service (pid %d): %s", cmd.Process.Pid, s.status.Command)
+
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			select {
+			case err := <-exited:
+				reason := "exited with status 0"
+				if err != nil {
+					reason = err.Error()
+				}
+				log.Printf("Supervisor: Python service %s", reason)
+				s.exited(reason)
+			case <-ctx.Done():
+				terminateProcess(cmd, 10*time.Second, exited)
+				s.setState(ProcessStopped, nil)
+				log.Println("Supervisor: Python service stopped")
+				return
+			}
+		}
+
+		if time.Since(started) > supervisorStableAfter {
+			backoff = supervisorMinBackoff
+		}
+		next := time.Now().Add(backoff)
+		s.setState(ProcessBackoff, &next)
+		log.Printf("Supervisor: restarting Python service in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			s.setState(ProcessStopped, nil)
+			return
+		}
+		backoff *= 2
+		if backoff > supervisorMaxBackoff {
+			backoff = supervisorMaxBackoff
+		}
+		s.mu.Lock()
+		s.status.Restarts++
+		s.mu.Unlock()
+	}
+}
+
+// Wait blocks until Run has returned
+func (s *pythonSupervisor) Wait() {
+	<-s.done
+}
+
+// Status returns a snapshot of the supervised process state
+func (s *pythonSupervisor) Status() supervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *pythonSupervisor) setState(state string, nextStart *time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = state
+	s.status.NextStart = nextStart
+	if state != ProcessRunning {
+		s.status.PID = 0
+	}
+}
+
+func (s *pythonSupervisor) exited(reason string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.PID = 0
+	s.status.LastExit = reason
+	s.status.LastExitAt = &now
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup starts the child in its own process group so uvicorn
+// workers are signalled together with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcess sends SIGTERM to the process group, escalating to SIGKILL after grace
+func terminateProcess(cmd *exec.Cmd, grace time.Duration, exited <-chan error) {
+	pgid := -cmd.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(grace):
+		syscall.Kill(pgid, syscall.SIGKILL)
+		<-exited
+	}
+}
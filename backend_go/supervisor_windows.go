@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcess kills the process; Windows has no SIGTERM equivalent for console apps
+func terminateProcess(cmd *exec.Cmd, grace time.Duration, exited <-chan error) {
+	cmd.Process.Kill()
+	<-exited
+}
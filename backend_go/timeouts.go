@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Server timeouts. READ_HEADER_TIMEOUT, READ_TIMEOUT, WRITE_TIMEOUT and
+// IDLE_TIMEOUT apply to every connection; routes that stream large bodies get
+// longer (or no) read and write deadlines from the timeouts rules of
+// CONFIG_FILE, or the built-in ones below. Execution WebSockets have no
+// deadline once upgraded. Requests slower than SLOW_REQUEST_THRESHOLD
+// (default 5s, "off" to disable) are logged, except on those routes.
+
+// defaultTimeoutRules apply when the config file has no "timeouts" section
+var defaultTimeoutRules = []TimeoutRule{
+	// Dataset uploads and generation
+	{Path: "/api/dataset/", Read: "30m", Write: "30m"},
+	// Artifact uploads and downloads
+	{Path: mlflowArtifactsPrefix + "/", Read: "30m", Write: "30m"},
+	{Path: "/api/batch/download", Write: "30m"},
+	// Inference on uploaded images
+	{Path: "/api/model/test", Write: "5m"},
+	{Path: "/api/model/detect", Write: "5m"},
+	// Run logs can be followed until the run ends
+	{Path: "/api/runs/", Write: "0"},
+	// Notebooks save and download whole files
+	{Path: notebooksPrefix, Read: "30m", Write: "30m"},
+	// CPU profiles and traces run for ?seconds=
+	{Path: "/debug/pprof/", Write: "0"},
+}
+
+// timeoutRule is a parsed TimeoutRule; nil keeps the server default
+type timeoutRule struct {
+	path        string
+	read, write *time.Duration
+}
+
+// parseTimeoutRules parses validated rules, falling back to the built-in ones
+func parseTimeoutRules(rules []TimeoutRule) []timeoutRule {
+	if rules == nil {
+		rules = defaultTimeoutRules
+	}
+	out := make([]timeoutRule, 0, len(rules))
+	for _, rule := range rules {
+		r := timeoutRule{path: rule.Path}
+		if rule.Read != "" {
+			d, _ := time.ParseDuration(rule.Read)
+			r.read = &d
+		}
+		if rule.Write != "" {
+			d, _ := time.ParseDuration(rule.Write)
+			r.write = &d
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// newServer returns the HTTP server with the configured timeouts
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", time.Minute),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 2*time.Minute),
+	}
+}
+
+// withTimeouts applies the route's deadlines and logs slow requests
+func withTimeouts(next http.Handler) http.Handler {
+	slow := time.Duration(0)
+	if !strings.EqualFold(os.Getenv("SLOW_REQUEST_THRESHOLD"), "off") {
+		slow = envDuration("SLOW_REQUEST_THRESHOLD", 5*time.Second)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := currentSettings().timeoutRule(r.URL.Path)
+		if ok {
+			rc := http.NewResponseController(w)
+			if rule.read != nil {
+				rc.SetReadDeadline(deadline(*rule.read))
+			}
+			if rule.write != nil {
+				rc.SetWriteDeadline(deadline(*rule.write))
+			}
+		}
+		// Long by design: WebSockets and the routes given longer deadlines
+		if ok || slow == 0 || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if took := time.Since(start); took > slow {
+			log.Printf("Slow request: %s %s -> %d in %s (request %s)", r.Method, r.URL.Path, rec.status, took.Round(time.Millisecond), requestID(r))
+		}
+	})
+}
+
+// deadline is d from now; zero means none
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UI branding from the "ui" section of CONFIG_FILE, so embedders can match
+// their product without forking the frontend. The modal HTML served by
+// /api/model/modal-html, the web component and /embed is rewritten with the
+// title, the logo, a style block for the theme and rules hiding the actions
+// turned off. GET /api/ui/config returns the settings for frontends that
+// render their own chrome. Changes apply on reload.
+
+// uiFeatures are the actions that can be hidden, by the element they are
+var uiFeatures = map[string]string{
+	"train":              "mt-train-model-btn",
+	"configure_pipeline": "mt-configure-pipeline-btn",
+	"manage_dataset":     "mt-manage-dataset-btn",
+	"test_model":         "mt-test-model-btn",
+}
+
+// uiThemeKeys are the theme settings; each becomes a --mt-<key> custom property
+var uiThemeKeys = []string{"primary", "secondary", "background", "text", "font_family"}
+
+// uiThemeRules apply the theme properties that are set
+var uiThemeRules = map[string]string{
+	"primary": "#mt-open-model-modal-btn, .mt-train-model-btn, .mt-train-model-btn:hover { background-color: var(--mt-primary); }\n" +
+		"#mt-open-model-modal-btn:hover, .mt-train-model-btn:hover { filter: brightness(0.9); }",
+	"secondary": ".mt-configure-pipeline-btn, .mt-manage-dataset-btn, .mt-test-model-btn," +
+		" .mt-configure-pipeline-btn:hover, .mt-manage-dataset-btn:hover, .mt-test-model-btn:hover { background-color: var(--mt-secondary); }\n" +
+		".mt-configure-pipeline-btn:hover, .mt-manage-dataset-btn:hover, .mt-test-model-btn:hover { filter: brightness(0.9); }",
+	"background":  ".mt-modal-content { background-color: var(--mt-background); }",
+	"text":        ".mt-modal-content { color: var(--mt-text); }",
+	"font_family": ".mt-modal-content { font-family: var(--mt-font-family); }",
+}
+
+// uiDefaultTitle is the heading the frontend ships with
+const uiDefaultTitle = "Model Training Pipeline"
+
+func validateUIConfig(ui *UIConfig) error {
+	if ui == nil {
+		return nil
+	}
+	for key, value := range ui.Theme {
+		if uiThemeRules[key] == "" {
+			return fmt.Errorf("unknown theme setting %q, expected one of %s", key, strings.Join(uiThemeKeys, ", "))
+		}
+		// Values end up in a style block
+		if value == "" || strings.ContainsAny(value, ";{}<>\\") {
+			return fmt.Errorf("theme %s: invalid value %q", key, value)
+		}
+	}
+	for name := range ui.Features {
+		if uiFeatures[name] == "" {
+			return fmt.Errorf("unknown feature %q, expected one of %s", name, strings.Join(sortedKeys(uiFeatures), ", "))
+		}
+	}
+	if ui.LogoURL != "" {
+		u, err := url.Parse(ui.LogoURL)
+		if err != nil || !(u.Scheme == "https" || u.Scheme == "http" || (u.Scheme == "" && strings.HasPrefix(ui.LogoURL, "/"))) {
+			return fmt.Errorf("logo_url %q: expected an http(s) URL or a path", ui.LogoURL)
+		}
+	}
+	return nil
+}
+
+// featureEnabled reports whether an action is shown; all are by default
+func (ui *UIConfig) featureEnabled(name string) bool {
+	if ui == nil {
+		return true
+	}
+	enabled, ok := ui.Features[name]
+	return !ok || enabled
+}
+
+// css returns the style block for the theme and the hidden actions
+func (ui *UIConfig) css() string {
+	if ui == nil {
+		return ""
+	}
+	var b strings.Builder
+	if len(ui.Theme) > 0 {
+		b.WriteString(":root {")
+		for _, key := range uiThemeKeys {
+			if value := ui.Theme[key]; value != "" {
+				fmt.Fprintf(&b, " --mt-%s: %s;", strings.ReplaceAll(key, "_", "-"), value)
+			}
+		}
+		b.WriteString(" }\n")
+		for _, key := range uiThemeKeys {
+			if ui.Theme[key] != "" {
+				b.WriteString(uiThemeRules[key] + "\n")
+			}
+		}
+	}
+	if ui.LogoURL != "" {
+		b.WriteString(".mt-modal-header .mt-logo { display: block; max-height: 40px; margin: 0 auto 10px; }\n")
+	}
+	for _, name := range sortedKeys(uiFeatures) {
+		if !ui.featureEnabled(name) {
+			fmt.Fprintf(&b, "#%s { display: none !important; }\n", uiFeatures[name])
+		}
+	}
+	return b.String()
+}
+
+// brandModal rewrites the modal HTML with the current UI settings
+func brandModal(markup string) string {
+	ui := currentSettings().ui
+	if ui == nil || markup == "" {
+		return markup
+	}
+	if ui.Title != "" || ui.LogoURL != "" {
+		heading := `<h3 data-i18n="title">` + uiDefaultTitle + "</h3>"
+		branded := heading
+		if ui.Title != "" {
+			branded = "<h3>" + html.EscapeString(ui.Title) + "</h3>"
+		}
+		if ui.LogoURL != "" {
+			branded = `<img class="mt-logo" src="` + html.EscapeString(ui.LogoURL) + `" alt="">` + branded
+		}
+		markup = strings.Replace(markup, heading, branded, 1)
+	}
+	if css := ui.css(); css != "" {
+		markup = "<style id=\"mt-ui-theme\">\n" + css + "</style>\n" + markup
+	}
+	return markup
+}
+
+// handleUIConfig returns the UI settings, with every feature listed
+func handleUIConfig(w http.ResponseWriter, r *http.Request) {
+	ui := currentSettings().ui
+	locale := negotiateLocale(r)
+	out := map[string]interface{}{"title": uiString(locale, "title"), "locale": locale, "theme": map[string]string{}}
+	features := map[string]bool{}
+	for name := range uiFeatures {
+		features[name] = ui.featureEnabled(name)
+	}
+	out["features"] = features
+	if ui != nil {
+		if ui.Title != "" {
+			out["title"] = ui.Title
+		}
+		if ui.LogoURL != "" {
+			out["logo_url"] = ui.LogoURL
+		}
+		if ui.Theme != nil {
+			out["theme"] = ui.Theme
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept-Language")
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Unix domain sockets, for when the backend and the Python service share a
+// pod or container. LISTEN_ADDR=unix:///var/run/backend.sock serves on a
+// socket instead of TCP, and an upstream URL such as
+// unix:///var/run/trainer.sock is dialed over one.
+
+const unixScheme = "unix://"
+
+// unixSocketPath returns the socket path of a unix:// address
+func unixSocketPath(addr string) (string, bool) {
+	path, ok := strings.CutPrefix(addr, unixScheme)
+	return path, ok && path != ""
+}
+
+// unixBaseURL is where requests to a socket upstream are addressed; the host
+// only ends up in the Host header
+var unixBaseURL = &url.URL{Scheme: "http", Host: "localhost"}
+
+// dialUnix ignores the address it is asked for and connects to the socket
+func dialUnix(path string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
+
+// unixTransport sends every request to the socket, over HTTP/1.1 or h2c
+func unixTransport(path, mode string) http.RoundTripper {
+	if mode == HTTP2H2C {
+		return newH2CTransport(dialUnix(path))
+	}
+	t := http1Transport.Clone()
+	t.DialContext = dialUnix(path)
+	return t
+}
+
+// listen opens the server's listener: a TCP address such as ":3000", or a
+// Unix socket given as unix:///path. A socket left behind by a previous run
+// is replaced, and LISTEN_SOCKET_MODE (e.g. 0660) sets its permissions.
+func listen(addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if raw := os.Getenv("LISTEN_SOCKET_MODE"); raw != "" {
+		mode, err := strconv.ParseUint(raw, 8, 32)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("LISTEN_SOCKET_MODE %q: expected an octal mode such as 0660", raw)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,181 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Zero-downtime upgrades. On SIGUSR2 the backend starts its executable again
+// (the deploy has replaced it on disk) and passes it the listening socket.
+// Once the new process is serving, this one stops accepting connections,
+// finishes its requests and exits when its running executions are done, so
+// hours-long training streams are not cut. The socket is never closed, so
+// no connection is refused in between.
+
+// upgradeEnv tells the new process that fd 3 is the listener and fd 4 the
+// pipe to report readiness on
+const upgradeEnv = "TRAINING_BACKEND_UPGRADE"
+
+// upgradeReadyPipe is set in a process started by an upgrade
+var upgradeReadyPipe *os.File
+
+// inheritedListener returns the listener passed by the process being
+// replaced, or nil when this process was started normally
+func inheritedListener() (net.Listener, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+	f := os.NewFile(3, "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener: %w", err)
+	}
+	upgradeReadyPipe = os.NewFile(4, "upgrade-ready")
+	return ln, nil
+}
+
+// writePIDFile records this process in PID_FILE, so process managers and
+// deploy scripts follow the upgrade
+func writePIDFile() {
+	if path := os.Getenv("PID_FILE"); path != "" {
+		if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			log.Printf("PID_FILE: %v", err)
+		}
+	}
+}
+
+// upgradeReady tells the process being replaced that this one is serving
+func upgradeReady() {
+	writePIDFile()
+	if upgradeReadyPipe != nil {
+		upgradeReadyPipe.Write([]byte("ready"))
+		upgradeReadyPipe.Close()
+		upgradeReadyPipe = nil
+	}
+}
+
+// watchUpgrades upgrades on SIGUSR2. The returned channel is closed once the
+// server has been handed over and drained, and the process should exit.
+// With PYTHON_SUPERVISE the Python service is a child of this process and
+// would be stopped with it, so upgrades are refused.
+func watchUpgrades(server *http.Server, ln net.Listener, supervised bool) <-chan struct{} {
+	done := make(chan struct{})
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if supervised {
+				log.Println("Upgrade refused: the supervised Python service would stop with this process")
+				continue
+			}
+			if err := startUpgrade(ln); err != nil {
+				log.Printf("Upgrade failed, still serving: %v", err)
+				continue
+			}
+			signal.Stop(usr2)
+			drainAfterUpgrade(server, ln)
+			close(done)
+			return
+		}
+	}()
+	return done
+}
+
+// startUpgrade starts the new process with the listener and waits until it serves
+func startUpgrade(ln net.Listener) error {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("cannot pass a %T to another process", ln)
+	}
+	lnFile, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Upgrade: started process %d, waiting for it to serve", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	served := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(ready, make([]byte, len("ready")))
+		served <- err
+	}()
+	select {
+	case err := <-served:
+		if err == nil {
+			return nil
+		}
+		// The pipe closed without a word: the new process exited
+		cmd.Process.Kill()
+		return fmt.Errorf("process %d exited before serving: %v", cmd.Process.Pid, <-exited)
+	case <-time.After(envDuration("UPGRADE_TIMEOUT", time.Minute)):
+		cmd.Process.Kill()
+		return fmt.Errorf("process %d not serving after UPGRADE_TIMEOUT", cmd.Process.Pid)
+	}
+}
+
+// drainAfterUpgrade stops accepting connections, then waits for requests and
+// executions to finish, at most UPGRADE_DRAIN_TIMEOUT when set
+func drainAfterUpgrade(server *http.Server, ln net.Listener) {
+	ctx := context.Background()
+	if timeout := envDuration("UPGRADE_DRAIN_TIMEOUT", 0); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// The new process keeps the socket; don't remove it when closing ours
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	log.Printf("Upgrade: handed over, draining %d execution(s)", liveSessions.count())
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Upgrade: requests still running after UPGRADE_DRAIN_TIMEOUT: %v", err)
+		return
+	}
+	// Execution WebSockets are hijacked, so Shutdown does not wait for them
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for liveSessions.count() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("Upgrade: %d execution(s) still running after UPGRADE_DRAIN_TIMEOUT", liveSessions.count())
+			return
+		case <-ticker.C:
+		}
+	}
+	log.Println("Upgrade: drained, exiting")
+}
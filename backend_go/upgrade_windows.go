@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// Windows cannot pass a listening socket to another process; upgrades are
+// a restart there
+
+func inheritedListener() (net.Listener, error) { return nil, nil }
+
+func upgradeReady() {}
+
+func watchUpgrades(server *http.Server, ln net.Listener, supervised bool) <-chan struct{} {
+	return nil
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Multi-backend routing: several Python training services, chosen per
+// request by workspace or pipeline. An upstream may have several replicas;
+// API calls are balanced across the healthy ones and run streams stick to one.
+
+const upstreamHealthInterval = 15 * time.Second
+
+// Balancing strategies for stateless API calls
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+)
+
+// Upstream is a named Python training service with one or more replicas
+type Upstream struct {
+	Name       string
+	HealthPath string
+	Balance    string
+	next       atomic.Uint64
+	// config is what the upstream was built from, to keep it across reloads
+	config UpstreamConfig
+	// tls is the client config for https:// replicas, nil for the defaults
+	tls *tls.Config
+
+	// static replicas are fixed; resolvers add replicas found by service discovery
+	static    []string
+	resolvers []resolver
+
+	mu      sync.RWMutex
+	targets []*Target
+}
+
+// Target is one replica of an upstream
+type Target struct {
+	URL *url.URL
+	// base is where requests are addressed; it differs from URL for sockets
+	base   *url.URL
+	socket string
+	proxy  *httputil.ReverseProxy
+	tls    *tls.Config
+	// active counts in-flight proxied requests and execution streams
+	active atomic.Int64
+	// draining replicas were dropped by discovery and only finish what they have
+	draining atomic.Bool
+
+	mu          sync.RWMutex
+	healthy     bool
+	checkedAt   time.Time
+	lastLatency time.Duration
+	lastError   string
+}
+
+// upstreamStatus is the health snapshot reported in /health
+type upstreamStatus struct {
+	Name    string         `json:"name"`
+	Healthy bool           `json:"healthy"`
+	Balance string         `json:"balance"`
+	Targets []targetStatus `json:"targets"`
+}
+
+type targetStatus struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Draining  bool      `json:"draining,omitempty"`
+	Active    int64     `json:"active"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Router picks the upstream for HTTP and WebSocket traffic. Its routing
+// table is swapped as a whole on reload, so requests never see a mix.
+type Router struct {
+	table  atomic.Pointer[routingTable]
+	client *http.Client
+	// checked is set once every replica has been health checked
+	checked atomic.Bool
+}
+
+// routingTable is the upstreams and routes of one config
+type routingTable struct {
+	upstreams map[string]*Upstream
+	routes    []RouteRule
+	fallback  string
+}
+
+// newRouter builds upstream proxies from a validated config
+func newRouter(cfg *Config) (*Router, error) {
+	rt := &Router{client: &http.Client{Timeout: 5 * time.Second}}
+	rt.Reload(cfg)
+	return rt, nil
+}
+
+// current returns the routing table in use
+func (rt *Router) current() *routingTable {
+	return rt.table.Load()
+}
+
+// Reload switches to the upstreams and routes of a validated config.
+// Upstreams whose settings did not change are kept with their replicas and
+// health state; running requests and execution streams finish on the replica
+// they started on either way.
+func (rt *Router) Reload(cfg *Config) {
+	old := rt.current()
+	table := &routingTable{
+		upstreams: map[string]*Upstream{},
+		routes:    cfg.Routes,
+		fallback:  cfg.DefaultUpstream,
+	}
+	var added []*Upstream
+	for name, uc := range cfg.Upstreams {
+		if old != nil {
+			if up, ok := old.upstreams[name]; ok && reflect.DeepEqual(up.config, uc) {
+				table.upstreams[name] = up
+				continue
+			}
+		}
+		up := newUpstream(name, uc)
+		table.upstreams[name] = up
+		added = append(added, up)
+	}
+
+	// Resolve discovered replicas before serving traffic
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resolveUpstreams(ctx, added)
+	rt.table.Store(table)
+}
+
+func newUpstream(name string, uc UpstreamConfig) *Upstream {
+	up := &Upstream{
+		Name:       name,
+		HealthPath: uc.HealthPath,
+		Balance:    uc.Balance,
+		config:     uc,
+	}
+	if up.HealthPath == "" {
+		up.HealthPath = "/api/process/active"
+	}
+	if up.Balance == "" {
+		up.Balance = BalanceRoundRobin
+	}
+	if uc.TLS != nil {
+		// Validate loaded the files already; they may have changed since
+		cfg, err := uc.TLS.clientConfig()
+		if err != nil {
+			log.Printf("Upstream %s: tls: %v, using default TLS settings", name, err)
+		}
+		up.tls = cfg
+	}
+	for _, raw := range uc.targetURLs() {
+		if res, ok := parseDiscoveryURL(raw); ok {
+			up.resolvers = append(up.resolvers, res)
+		} else {
+			up.static = append(up.static, raw)
+		}
+	}
+	up.setTargets(up.static)
+	return up
+}
+
+// Upstreams returns the upstreams of the current routing table
+func (rt *Router) Upstreams() []*Upstream {
+	table := rt.current()
+	out := make([]*Upstream, 0, len(table.upstreams))
+	for _, up := range table.upstreams {
+		out = append(out, up)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func newTarget(u *url.URL, http2Mode string, tlsConfig *tls.Config) *Target {
+	t := &Target{
+		URL:  u,
+		base: u,
+		// Assume healthy until the first check says otherwise
+		healthy: true,
+	}
+	transport := upstreamTransport(http2Mode)
+	if tlsConfig != nil {
+		transport = tlsTransport(http2Mode, tlsConfig)
+	}
+	t.tls = tlsConfig
+	if path, ok := unixSocketPath(u.String()); ok {
+		t.base, t.socket = unixBaseURL, path
+		transport = unixTransport(path, http2Mode)
+	}
+	t.proxy = httputil.NewSingleHostReverseProxy(t.base)
+	t.proxy.Transport = transport
+	// Chunked and event-stream responses are flushed as they arrive; others at
+	// least this often, so the client sees a slow download progress
+	t.proxy.FlushInterval = envDuration("PROXY_FLUSH_INTERVAL", 100*time.Millisecond)
+	// Tell the Python service how the client reached us
+	director := t.proxy.Director
+	t.proxy.Director = func(req *http.Request) {
+		director(req)
+		setForwardedHeaders(req.Header, req)
+	}
+	// The response already carries this request's ID and security headers;
+	// don't repeat the Python service's
+	t.proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Del(requestIDHeader)
+		stripUpstreamSecurityHeaders(resp)
+		return nil
+	}
+	// A replica that refuses connections is taken out of rotation right away
+	// rather than waiting for the next health check
+	t.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// The client sent too much, the replica is fine
+		if limit, ok := tooLarge(err); ok {
+			writeTooLarge(w, r, limit)
+			return
+		}
+		// The client went away, which says nothing about the replica
+		if r.Context().Err() != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		log.Printf("Proxy error from %s: %v (request %s)", t.Addr(), err, requestID(r))
+		t.markFailed(err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return t
+}
+
+// Default returns the upstream unrouted traffic goes to
+func (rt *Router) Default() *Upstream {
+	table := rt.current()
+	return table.upstreams[table.fallback]
+}
+
+// Match returns the upstream for a workspace/pipeline pair
+func (rt *Router) Match(workspace, pipeline string) *Upstream {
+	table := rt.current()
+	for _, rule := range table.routes {
+		if rule.Workspace != "" && rule.Workspace != workspace {
+			continue
+		}
+		if rule.Pipeline != "" && rule.Pipeline != pipeline {
+			continue
+		}
+		if up, ok := table.upstreams[rule.Upstream]; ok {
+			return up
+		}
+	}
+	return table.upstreams[table.fallback]
+}
+
+// ServeHTTP proxies the request to a replica of the upstream chosen by its routing keys
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	workspace, pipeline := routingKeys(r)
+	up := rt.Match(workspace, pipeline)
+	if up == nil {
+		http.Error(w, "No training service configured", http.StatusBadGateway)
+		return
+	}
+	target := up.Pick()
+	if target == nil {
+		http.Error(w, "No training service instance available", http.StatusBadGateway)
+		return
+	}
+	debugf("Proxying request %s: %s -> %s (%s)", requestID(r), r.URL.Path, up.Name, target.Addr())
+	target.active.Add(1)
+	defer target.active.Add(-1)
+	target.proxy.ServeHTTP(w, r)
+}
+
+// routingKeys reads the workspace and pipeline from headers or query parameters
+func routingKeys(r *http.Request) (workspace, pipeline string) {
+	workspace = r.Header.Get("X-Workspace")
+	if workspace == "" {
+		workspace = r.URL.Query().Get("workspace")
+	}
+	pipeline = r.Header.Get("X-Pipeline")
+	if pipeline == "" {
+		pipeline = r.URL.Query().Get("pipeline")
+	}
+	return workspace, pipeline
+}
+
+// Pick chooses a replica for a stateless API call. Unhealthy replicas are
+// skipped; when none are healthy every replica is a candidate.
+func (u *Upstream) Pick() *Target {
+	candidates := u.healthyTargets()
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	if u.Balance == BalanceLeastConnections {
+		best := candidates[0]
+		for _, t := range candidates[1:] {
+			if t.active.Load() < best.active.Load() {
+				best = t
+			}
+		}
+		return best
+	}
+	n := u.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// Sticky orders the replicas for a run-scoped stream: the same key always
+// prefers the same replica (rendezvous hashing), healthy replicas first, so
+// callers fail over by trying the rest in order.
+func (u *Upstream) Sticky(key string) []*Target {
+	ordered := u.serving()
+	score := func(t *Target) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(t.URL.String()))
+		return h.Sum64()
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		hi, hj := ordered[i].Healthy(), ordered[j].Healthy()
+		if hi != hj {
+			return hi
+		}
+		return score(ordered[i]) > score(ordered[j])
+	})
+	return ordered
+}
+
+func (u *Upstream) healthyTargets() []*Target {
+	serving := u.serving()
+	var out []*Target
+	for _, t := range serving {
+		if t.Healthy() {
+			out = append(out, t)
+		}
+	}
+	if len(out) == 0 {
+		return serving
+	}
+	return out
+}
+
+// serving returns the replicas that accept new traffic
+func (u *Upstream) serving() []*Target {
+	var out []*Target
+	for _, t := range u.allTargets() {
+		if !t.draining.Load() {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (u *Upstream) allTargets() []*Target {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return append([]*Target(nil), u.targets...)
+}
+
+// setTargets replaces the replica set. New URLs are added, replicas that
+// disappeared start draining and are dropped once their connections finish.
+func (u *Upstream) setTargets(urls []string) {
+	want := map[string]*url.URL{}
+	var order []string
+	for _, raw := range urls {
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			log.Printf("Upstream %s: ignoring invalid target %q: %v", u.Name, raw, err)
+			continue
+		}
+		if _, dup := want[parsed.String()]; !dup {
+			want[parsed.String()] = parsed
+			order = append(order, parsed.String())
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var kept []*Target
+	have := map[string]bool{}
+	for _, t := range u.targets {
+		key := t.URL.String()
+		have[key] = true
+		if want[key] != nil {
+			if t.draining.Swap(false) {
+				log.Printf("Upstream %s target %s is back in service", u.Name, t.Addr())
+			}
+			kept = append(kept, t)
+			continue
+		}
+		if !t.draining.Swap(true) {
+			log.Printf("Upstream %s target %s removed, draining", u.Name, t.Addr())
+		}
+		if t.active.Load() > 0 {
+			kept = append(kept, t)
+		} else {
+			log.Printf("Upstream %s target %s drained", u.Name, t.Addr())
+		}
+	}
+	for _, key := range order {
+		if have[key] {
+			continue
+		}
+		kept = append(kept, newTarget(want[key], u.config.HTTP2, u.tls))
+		if len(u.resolvers) > 0 {
+			log.Printf("Upstream %s target %s added", u.Name, want[key].Host)
+		}
+	}
+	u.targets = kept
+}
+
+// Healthy reports whether any replica passed its last health check
+func (u *Upstream) Healthy() bool {
+	for _, t := range u.serving() {
+		if t.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns a health snapshot of the upstream and its replicas
+func (u *Upstream) Status() upstreamStatus {
+	status := upstreamStatus{Name: u.Name, Healthy: u.Healthy(), Balance: u.Balance}
+	for _, t := range u.allTargets() {
+		status.Targets = append(status.Targets, t.Status())
+	}
+	return status
+}
+
+// Statuses returns health snapshots for every upstream ordered by name
+func (rt *Router) Statuses() []upstreamStatus {
+	upstreams := rt.Upstreams()
+	out := make([]upstreamStatus, 0, len(upstreams))
+	for _, up := range upstreams {
+		out = append(out, up.Status())
+	}
+	return out
+}
+
+// Addr names the replica in logs: its host, or its socket path
+func (t *Target) Addr() string {
+	if t.socket != "" {
+		return t.socket
+	}
+	return t.URL.Host
+}
+
+// Endpoint returns the http:// or https:// URL for a path on the replica
+func (t *Target) Endpoint(path string) string {
+	return strings.TrimRight(t.base.String(), "/") + path
+}
+
+// Client returns an HTTP client that reaches the replica the way it is proxied
+func (t *Target) Client(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: t.proxy.Transport}
+}
+
+// WebSocketURL returns the ws:// or wss:// URL for a path on the replica
+func (t *Target) WebSocketURL(path string) string {
+	scheme := "ws"
+	if t.base.Scheme == "https" {
+		scheme = "wss"
+	}
+	return scheme + "://" + t.base.Host + strings.TrimRight(t.base.Path, "/") + path
+}
+
+// WebSocketDialer returns the dialer for execution streams to the replica
+func (t *Target) WebSocketDialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.WriteBufferPool = wsWriteBufferPool
+	d.EnableCompression = wsCompression
+	if t.socket != "" {
+		d.NetDialContext = dialUnix(t.socket)
+	}
+	d.TLSClientConfig = t.tls
+	return &d
+}
+
+// Healthy reports the result of the last health check
+func (t *Target) Healthy() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.healthy
+}
+
+// Status returns a health snapshot
+func (t *Target) Status() targetStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return targetStatus{
+		URL:       t.URL.String(),
+		Healthy:   t.healthy,
+		Draining:  t.draining.Load(),
+		Active:    t.active.Load(),
+		CheckedAt: t.checkedAt,
+		LatencyMS: t.lastLatency.Milliseconds(),
+		Error:     t.lastError,
+	}
+}
+
+// markFailed takes the replica out of rotation until the next successful check
+func (t *Target) markFailed(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.healthy {
+		log.Printf("Upstream target %s is unhealthy: %s", t.Addr(), reason)
+	}
+	t.healthy = false
+	t.lastError = reason
+}
+
+// RunHealthChecks polls every replica until ctx is cancelled
+func (rt *Router) RunHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(upstreamHealthInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, up := range rt.Upstreams() {
+			for _, t := range up.allTargets() {
+				wg.Add(1)
+				go func(up *Upstream, t *Target) {
+					defer wg.Done()
+					rt.check(ctx, up, t)
+				}(up, t)
+			}
+		}
+		wg.Wait()
+		rt.checked.Store(true)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rt *Router) check(ctx context.Context, up *Upstream, t *Target) {
+	start := time.Now()
+	errMsg := ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.Endpoint(up.HealthPath), nil)
+	if err == nil {
+		// Check over the protocol the replica is proxied with
+		var resp *http.Response
+		resp, err = t.Client(rt.client.Timeout).Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				errMsg = resp.Status
+			}
+		}
+	}
+	if err != nil {
+		errMsg = err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wasHealthy := t.healthy
+	t.healthy = errMsg == ""
+	t.checkedAt = time.Now()
+	t.lastLatency = time.Since(start)
+	t.lastError = errMsg
+	if wasHealthy != t.healthy {
+		if t.healthy {
+			log.Printf("Upstream %s target %s is healthy again", up.Name, t.Addr())
+		} else {
+			log.Printf("Upstream %s target %s is unhealthy: %s", up.Name, t.Addr(), errMsg)
+		}
+	}
+}
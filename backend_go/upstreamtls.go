@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLS towards the Python service, for deployments where it sits across a
+// network boundary. An upstream's "tls" block in CONFIG_FILE trusts the
+// service by a private CA bundle and authenticates the backend with a client
+// certificate (mutual TLS). It applies to proxied calls, health checks and
+// execution WebSockets alike. Certificates are read when the upstream is
+// built, so rotated files take effect on restart or when its config changes.
+
+// UpstreamTLS configures how the backend dials an https:// upstream
+type UpstreamTLS struct {
+	// CAFile is a PEM bundle to verify the service with instead of the system roots
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are the client certificate presented to the service
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName overrides the name the service certificate is checked against
+	ServerName string `json:"server_name"`
+	// InsecureSkipVerify accepts any service certificate, for testing only
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// clientConfig loads the files into a TLS client config
+func (t *UpstreamTLS) clientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s: no PEM certificates found", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// tlsTransport is upstreamTransport with a TLS client config of its own
+func tlsTransport(mode string, cfg *tls.Config) http.RoundTripper {
+	var t *http.Transport
+	if mode == HTTP2Off {
+		t = http1Transport.Clone()
+	} else {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	// A copy: the transport adds "h2" to NextProtos, which the WebSocket
+	// dialer sharing cfg must not offer
+	t.TLSClientConfig = cfg.Clone()
+	return t
+}
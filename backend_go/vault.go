@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Minimal HashiCorp Vault client for the secret store: KV version 2 under
+// VAULT_KV_MOUNT (default "secret"), one entry per secret below
+// VAULT_SECRETS_PATH, authenticated with VAULT_TOKEN. Like the S3 client it
+// speaks the HTTP API directly instead of pulling in the Vault SDK.
+
+type vaultSecretStore struct {
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	prefix    string
+	http      *http.Client
+}
+
+func newVaultSecretStoreFromEnv() (*vaultSecretStore, error) {
+	v := &vaultSecretStore{
+		addr:      strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		mount:     strings.Trim(getEnv("VAULT_KV_MOUNT", "secret"), "/"),
+		prefix:    strings.Trim(getEnv("VAULT_SECRETS_PATH", "training-module"), "/"),
+		http:      &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.token == "" {
+		if file := os.Getenv("VAULT_TOKEN_FILE"); file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("VAULT_TOKEN_FILE: %w", err)
+			}
+			v.token = strings.TrimSpace(string(data))
+		}
+	}
+	if v.token == "" {
+		return nil, errors.New("VAULT_ADDR is set but VAULT_TOKEN or VAULT_TOKEN_FILE is not")
+	}
+	return v, nil
+}
+
+func (v *vaultSecretStore) Backend() string { return "vault" }
+
+// do calls the Vault API; a nil out discards the response
+func (v *vaultSecretStore) do(ctx context.Context, method, kind, name string, query url.Values, body, out interface{}) error {
+	path := "/v1/" + v.mount + "/" + kind + "/" + v.prefix
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	endpoint := v.addr + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errSecretNotFound
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+		return fmt.Errorf("vault %s %s: %s %s", method, path, resp.Status, strings.Join(e.Errors, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (v *vaultSecretStore) List(ctx context.Context) ([]secretMeta, error) {
+	var resp struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	err := v.do(ctx, http.MethodGet, "metadata", "", url.Values{"list": {"true"}}, nil, &resp)
+	if errors.Is(err, errSecretNotFound) {
+		// Vault answers 404 for an empty path
+		return []secretMeta{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]secretMeta, 0, len(resp.Data.Keys))
+	for _, key := range resp.Data.Keys {
+		// Keys ending in / are folders, not secrets of ours
+		if !strings.HasSuffix(key, "/") {
+			out = append(out, secretMeta{Name: key})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (v *vaultSecretStore) Get(ctx context.Context, name string) (string, error) {
+	var resp struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, "data", name, nil, nil, &resp); err != nil {
+		return "", err
+	}
+	value, ok := resp.Data.Data["value"]
+	if !ok {
+		return "", fmt.Errorf("vault entry %s has no \"value\" key", name)
+	}
+	return value, nil
+}
+
+func (v *vaultSecretStore) Put(ctx context.Context, name, value string) (secretMeta, bool, error) {
+	var resp struct {
+		Data struct {
+			CreatedTime time.Time `json:"created_time"`
+			Version     int       `json:"version"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"data": map[string]string{"value": value}}
+	if err := v.do(ctx, http.MethodPost, "data", name, nil, body, &resp); err != nil {
+		return secretMeta{}, false, err
+	}
+	// Each version is created when the secret is written
+	meta := secretMeta{Name: name, UpdatedAt: &resp.Data.CreatedTime}
+	return meta, resp.Data.Version == 1, nil
+}
+
+// Delete removes every version of the secret, not just the latest
+func (v *vaultSecretStore) Delete(ctx context.Context, name string) error {
+	if _, err := v.Get(ctx, name); err != nil {
+		return err
+	}
+	return v.do(ctx, http.MethodDelete, "metadata", name, nil, nil, nil)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Version is the backend release, overridden at build time with
+// -ldflags "-X main.Version=..."
+var Version = "1.1.0"
+
+// Commit is the git commit the binary was built from, set with
+// -ldflags "-X main.Commit=..." where the build has no .git (Docker);
+// otherwise it comes from the Go toolchain's VCS stamp
+var Commit = ""
+
+// BuildDate is when the binary was built, set with
+// -ldflags "-X main.BuildDate=..." (RFC 3339)
+var BuildDate = ""
+
+// APIVersion is the version of the HTTP/WebSocket API the backend serves.
+// Bump it on breaking changes together with API_VERSION in the Python
+// service and frontend/js/pipeline-config.js.
+const APIVersion = 1
+
+var frontendAPIVersionPattern = regexp.MustCompile(`API_VERSION\s*=\s*(\d+)`)
+
+// frontendAPIVersion reads the API version the served frontend JS expects, 0 if unknown
+func frontendAPIVersion() int {
+	data, err := fs.ReadFile(frontendAssets, "js/pipeline-config.js")
+	if err != nil {
+		return 0
+	}
+	m := frontendAPIVersionPattern.FindSubmatch(data)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
+
+// versionInfo describes the binary for the version command
+type versionInfo struct {
+	Version    string `json:"version"`
+	APIVersion int    `json:"api_version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	BuildDate  string `json:"build_date,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	GoVersion  string `json:"go_version"`
+	Platform   string `json:"platform"`
+}
+
+// buildInfo returns the release and the VCS stamp the binary was built with
+func buildInfo() versionInfo {
+	info := versionInfo{
+		Version:    Version,
+		APIVersion: APIVersion,
+		Commit:     Commit,
+		BuildDate:  BuildDate,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			info.CommitTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// pythonVersion is what the Python service reports at /api/version
+type pythonVersion struct {
+	Version    string `json:"version"`
+	APIVersion int    `json:"api_version"`
+	Error      string `json:"error,omitempty"`
+}
+
+// handleVersion reports the backend, frontend and Python service versions so
+// clients can check compatibility before embedding the module
+func handleVersion(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		python := pythonVersion{Version: "unknown"}
+		workspace, pipeline := routingKeys(r)
+		if up := router.Match(workspace, pipeline); up != nil {
+			if target := up.Pick(); target != nil {
+				python = fetchPythonVersion(target.Client(5*time.Second), target.Endpoint("/api/version"))
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"backend":              Version,
+			"api_version":          APIVersion,
+			"frontend_api_version": frontendAPIVersion(),
+			"python_service":       python,
+		})
+	}
+}
+
+func fetchPythonVersion(client *http.Client, url string) pythonVersion {
+	v := pythonVersion{Version: "unknown"}
+	resp, err := client.Get(url)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Services older than the version endpoint answer 404
+		v.Error = resp.Status
+		return v
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		v.Error = err.Error()
+	}
+	return v
+}
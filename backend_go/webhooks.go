@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Outgoing webhooks. Events are POSTed as JSON to every URL in WEBHOOK_URLS:
+//
+//	{"event": "promotion.approved", "time": "...", "data": {...}}
+//
+// With WEBHOOK_SECRET each request carries X-Webhook-Signature:
+// sha256=<hex HMAC-SHA256 of the body>, so receivers can check the sender.
+// Delivery runs in the background and is retried webhookAttempts times.
+
+const webhookAttempts = 3
+
+type webhookEvent struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+type webhookSender struct {
+	urls   []string
+	secret []byte
+	http   *http.Client
+}
+
+// webhooks is set in serve, nil when WEBHOOK_URLS is empty
+var webhooks *webhookSender
+
+func newWebhookSenderFromEnv() *webhookSender {
+	var urls []string
+	for _, u := range strings.Split(getEnv("WEBHOOK_URLS", ""), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	return &webhookSender{
+		urls:   urls,
+		secret: []byte(getEnv("WEBHOOK_SECRET", "")),
+		http:   &http.Client{Timeout: envDuration("WEBHOOK_TIMEOUT", 10*time.Second)},
+	}
+}
+
+// Send delivers an event to every URL in the background; a nil sender drops it
+func (s *webhookSender) Send(event string, data interface{}) {
+	if s == nil {
+		return
+	}
+	body, err := json.Marshal(webhookEvent{Event: event, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Printf("Error encoding webhook %s: %v", event, err)
+		return
+	}
+	for _, url := range s.urls {
+		go s.deliver(url, event, body)
+	}
+}
+
+func (s *webhookSender) deliver(url, event string, body []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * 5 * time.Second)
+		}
+		if err = s.post(url, event, body); err == nil {
+			return
+		}
+	}
+	log.Printf("Webhook %s to %s failed after %d attempts: %v", event, url, webhookAttempts, err)
+}
+
+func (s *webhookSender) post(url, event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The training UI as a web component, for frontends that are not Go apps.
+// GET /widget/training-module.js redirects to /widget/<hash>/training-module.js,
+// a single script built from module.html, the CSS and the JS modules that
+// defines the <training-module> custom element:
+//
+//	<script src="/training/widget/training-module.js"></script>
+//	<training-module api-base="/training"></training-module>
+//
+// api-base is the path the host app proxies the backend under. The frontend
+// calls root-relative URLs such as '/api/models', so the bundle puts the
+// attribute in front of them at runtime; the trainingmodule Go client does
+// the same by rewriting assets it proxies. The hashed URL changes whenever an
+// asset does and is cached for good; the redirect is always revalidated.
+
+const widgetScript = "training-module.js"
+
+// widgetMaxAge is how long browsers keep a hashed bundle
+const widgetMaxAge = 365 * 24 * time.Hour
+
+// widgetSources are the frontend assets the bundle is built from
+var widgetSources = []string{"module.html", "css/training-module.css", "js/pipeline-config.js", "js/model.js"}
+
+var (
+	widgetExport = regexp.MustCompile(`(?m)^export (async function|function|class|const|let) `)
+	widgetImport = regexp.MustCompile(`(?m)^import .*\n`)
+	// The stylesheet's page rule applies to the element instead
+	widgetBodyRule = regexp.MustCompile(`(?m)^body\s*\{`)
+	// Quoted and template literals starting with a module path, and the
+	// `${host}/api/...` of the execution WebSocket
+	widgetURLs = strings.NewReplacer(
+		"'/api/", "__mtmBase + '/api/", `"/api/`, `__mtmBase + "/api/`, "`/api/", "`${__mtmBase}/api/", "}/api/", "}${__mtmBase}/api/",
+		"'/config/", "__mtmBase + '/config/", `"/config/`, `__mtmBase + "/config/`, "`/config/", "`${__mtmBase}/config/",
+	)
+)
+
+// widgetCache holds the bundle built from the current assets
+var widgetCache struct {
+	sync.Mutex
+	key   string
+	asset *cachedAsset
+}
+
+// modalMarkup cuts the modal components out of module.html, everything from
+// the modal comment to the module script; empty when they are not found
+func modalMarkup(html string) string {
+	start := strings.Index(html, `<!-- Model Info Modal -->`)
+	end := strings.Index(html, `<script type="module"`)
+	if start == -1 || end == -1 || end < start {
+		return ""
+	}
+	return html[start:end]
+}
+
+// widgetBundle returns the bundle, building it again when an asset changed
+func widgetBundle() (*cachedAsset, error) {
+	sources := map[string]*cachedAsset{}
+	var key strings.Builder
+	var modTime time.Time
+	for _, name := range widgetSources {
+		asset, err := loadAsset(frontendAssets, name, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		sources[name] = asset
+		key.WriteString(asset.hash)
+		if asset.modTime.After(modTime) {
+			modTime = asset.modTime
+		}
+	}
+
+	markup := modalMarkup(string(sources["module.html"].body))
+	if markup == "" {
+		return nil, fmt.Errorf("module.html: modal components not found")
+	}
+	// The UI branding changes the markup on reload; the bundle is in UI_LOCALE
+	markup = translateModal(brandModal(markup), defaultLocale)
+	sum := sha256.Sum256([]byte(markup))
+	key.WriteString(hex.EncodeToString(sum[:8]))
+
+	widgetCache.Lock()
+	defer widgetCache.Unlock()
+	if widgetCache.asset != nil && widgetCache.key == key.String() {
+		return widgetCache.asset, nil
+	}
+	style := widgetBodyRule.ReplaceAllString(string(sources["css/training-module.css"].body), "training-module {")
+	markupJSON, _ := json.Marshal(markup)
+	styleJSON, _ := json.Marshal(style)
+
+	var code strings.Builder
+	for _, name := range widgetSources[2:] {
+		src := string(sources[name].body)
+		src = widgetImport.ReplaceAllString(src, "")
+		src = widgetExport.ReplaceAllString(src, "$1 ")
+		// The element is in the document by the time the code runs
+		src = strings.Replace(src, "document.addEventListener('DOMContentLoaded', ", "__mtmReady(", 1)
+		fmt.Fprintf(&code, "\n// %s\n%s", name, widgetURLs.Replace(src))
+	}
+
+	body := []byte(fmt.Sprintf(widgetTemplate, Version, styleJSON, markupJSON, code.String()))
+	widgetCache.key = key.String()
+	widgetCache.asset = newCachedAsset(body, modTime)
+	return widgetCache.asset, nil
+}
+
+// handleWidget serves /widget/training-module.js and its hashed versions
+func handleWidget(w http.ResponseWriter, r *http.Request) {
+	hash, name, versioned := strings.Cut(strings.TrimPrefix(r.URL.Path, "/widget/"), "/")
+	if !versioned {
+		hash, name = "", hash
+	}
+	if name != widgetScript {
+		http.NotFound(w, r)
+		return
+	}
+	asset, err := widgetBundle()
+	if err != nil {
+		log.Printf("Error building web component bundle: %v", err)
+		http.Error(w, "Failed to build web component", http.StatusInternalServerError)
+		return
+	}
+	if hash != asset.hash {
+		// Relative, so the redirect also works under a proxy prefix
+		target := asset.hash + "/" + widgetScript
+		if versioned {
+			target = "../" + target
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		// http.Redirect would make the target absolute
+		w.Header().Set("Location", target)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	serveAsset(w, r, widgetScript, asset, widgetMaxAge)
+}
+
+// widgetTemplate wraps the frontend modules; they share one scope, and the
+// module code starts when the first element is connected
+const widgetTemplate = `// Model Training Module web component, backend %s
+(function () {
+    'use strict';
+
+    const STYLE = %s;
+    const MARKUP = %s;
+    let started = false;
+
+    function start(__mtmBase) {
+        const __mtmReady = (callback) => callback();
+%s
+        return { openModal, closeModal };
+    }
+
+    class TrainingModuleElement extends HTMLElement {
+        connectedCallback() {
+            if (this.module) {
+                return;
+            }
+            if (started) {
+                console.warn('<training-module>: only one element per page is supported');
+                return;
+            }
+            started = true;
+            if (!document.getElementById('mt-training-module-style')) {
+                const style = document.createElement('style');
+                style.id = 'mt-training-module-style';
+                style.textContent = STYLE;
+                document.head.appendChild(style);
+            }
+            const base = (this.getAttribute('api-base') || '').replace(/\/+$/, '');
+            this.innerHTML = MARKUP;
+            if (!this.hasAttribute('no-button')) {
+                const button = document.createElement('button');
+                button.id = 'mt-open-model-modal-btn';
+                button.className = 'btn-primary';
+                button.textContent = this.getAttribute('label') || 'Manage Models';
+                this.prepend(button);
+            }
+            this.module = start(base);
+            this.dispatchEvent(new CustomEvent('training-module-ready', { bubbles: true }));
+        }
+
+        open() {
+            if (this.module) {
+                this.module.openModal();
+            }
+        }
+
+        close() {
+            if (this.module) {
+                this.module.closeModal();
+            }
+        }
+    }
+
+    if (!customElements.get('training-module')) {
+        customElements.define('training-module', TrainingModuleElement);
+    }
+})();
+`
+
+// registerWidgetRoutes adds the web component bundle
+func registerWidgetRoutes() {
+	http.HandleFunc("GET /widget/", handleWidget)
+}
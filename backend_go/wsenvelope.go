@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Structured execution messages. A client that opens the execution WebSocket
+// with ?envelope=1 gets every message as a JSON envelope carrying its type,
+// run ID, sequence number and time, and may send its own messages as
+// envelopes too. Executors and the Python service keep speaking the
+// free-form text protocol; messages are converted at the client's end of the
+// connection, so clients that do not ask for envelopes see no change.
+
+// wsEnvelopeVersion is the envelope format a client asks for with ?envelope=
+const wsEnvelopeVersion = 1
+
+// wsEnvelope is a message of the execution WebSocket in envelope form
+type wsEnvelope struct {
+	V     int    `json:"v"`
+	Type  string `json:"type"`
+	RunID string `json:"run_id,omitempty"`
+	// Ref is the seq of the client's envelope that started the session or
+	// follow a message belongs to; on a client's envelope, the session it is for
+	Ref int64 `json:"ref,omitempty"`
+	// Seq numbers the messages of a connection from 1, in the order sent
+	Seq       int64           `json:"seq,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsEnvelopeTypes are the envelope types of free-form control messages, by
+// prefix. Other EXECUTION_ messages get their name in lower case.
+var wsEnvelopeTypes = []struct{ prefix, typ string }{
+	{"EXECUTION_FINISHED", "finished"},
+	{"EXECUTION_ERROR:", "error"},
+	{"REQUEST_ID:", "request_id"},
+	{"MEMORY_INITIAL:", "memory_initial"},
+	{"MEMORY_FINAL:", "memory_final"},
+	{"MEMORY_ERROR:", "memory_error"},
+	{"LOG_DROPPED:", "log_dropped"},
+	{"BINARY_FRAME:", "binary_frame"},
+	{"BINARY_DROPPED:", "binary_dropped"},
+}
+
+// wsEnvelopeFromRequest returns whether an execution upgrade asks for
+// envelopes, or an error for a version this server does not speak
+func wsEnvelopeFromRequest(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("envelope")
+	switch v {
+	case "", "0":
+		return false, nil
+	case fmt.Sprint(wsEnvelopeVersion):
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported envelope version %q, this server speaks %d", v, wsEnvelopeVersion)
+}
+
+// wsEnvelopeConn writes the envelopes of one connection. Writes are
+// serialized, so the sessions multiplexed over it can share it, and numbered
+// in the order they go out.
+type wsEnvelopeConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+	seq  int64
+}
+
+// send numbers, stamps and writes an envelope as a text frame
+func (w *wsEnvelopeConn) send(env wsEnvelope) error {
+	return w.write(env, false, nil)
+}
+
+// sendBinary writes an envelope as a binary frame, followed by a newline and
+// data, so binary payloads are not inflated by base64
+func (w *wsEnvelopeConn) sendBinary(env wsEnvelope, data []byte) error {
+	return w.write(env, true, data)
+}
+
+func (w *wsEnvelopeConn) write(env wsEnvelope, binary bool, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seq++
+	env.V, env.Seq, env.Timestamp = wsEnvelopeVersion, w.seq, time.Now().UTC()
+	header, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if !binary {
+		if err := w.conn.WriteMessage(websocket.TextMessage, header); err != nil {
+			return err
+		}
+		tapeOf(w.conn).message("out", websocket.TextMessage, header)
+		return nil
+	}
+	frame := append(append(header, '\n'), data...)
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		return err
+	}
+	tapeOf(w.conn).message("out", websocket.BinaryMessage, frame)
+	return nil
+}
+
+// wsEnveloper wraps the messages of one session in envelopes; a nil one
+// sends them as they are
+type wsEnveloper struct {
+	wire *wsEnvelopeConn
+	// ref is the seq of the execute envelope that started the session
+	ref int64
+
+	mu    sync.Mutex
+	runID string
+}
+
+// setRun sets the run ID of further envelopes; a retry is a new run
+func (e *wsEnveloper) setRun(runID string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.runID = runID
+}
+
+// run is the run ID the session's envelopes carry
+func (e *wsEnveloper) run() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.runID
+}
+
+// write sends a frame of the session to conn. Text frames are control
+// messages or log lines, several of them when batched; binary frames stay
+// binary, behind their envelope.
+func (e *wsEnveloper) write(conn *websocket.Conn, messageType int, data []byte) error {
+	if e == nil {
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return err
+		}
+		tapeOf(conn).message("out", messageType, data)
+		return nil
+	}
+	if messageType != websocket.TextMessage {
+		return e.wire.sendBinary(wsEnvelope{Type: "binary", RunID: e.run(), Ref: e.ref}, data)
+	}
+	typ, payload := envelopePayload(data)
+	return e.wire.send(wsEnvelope{Type: typ, RunID: e.run(), Ref: e.ref, Payload: payload})
+}
+
+// writeText sends a text message straight to conn, before the session's
+// outbox takes over
+func (e *wsEnveloper) writeText(conn *websocket.Conn, text string) error {
+	return e.write(conn, websocket.TextMessage, []byte(text))
+}
+
+// envelopePayload is the type and payload of a free-form text frame
+func envelopePayload(data []byte) (string, json.RawMessage) {
+	text := string(data)
+	// A status report's payload is its JSON as is
+	if rest, ok := strings.CutPrefix(text, "STATUS:"); ok && json.Valid([]byte(rest)) {
+		return "status", json.RawMessage(strings.TrimSpace(rest))
+	}
+	for _, t := range wsEnvelopeTypes {
+		if rest, ok := strings.CutPrefix(text, t.prefix); ok {
+			return t.typ, messagePayload(rest)
+		}
+	}
+	if rest, ok := strings.CutPrefix(text, "EXECUTION_"); ok {
+		if name, message, ok := strings.Cut(rest, ":"); ok {
+			return strings.ToLower(name), messagePayload(message)
+		}
+	}
+	// Batched or coalesced log lines share a frame, one per line
+	payload, _ := json.Marshal(map[string][]string{"lines": strings.Split(text, "\n")})
+	return "log", payload
+}
+
+// messagePayload is the payload of a control message, nil when it has no text
+func messagePayload(message string) json.RawMessage {
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return nil
+	}
+	payload, _ := json.Marshal(map[string]string{"message": message})
+	return payload
+}
+
+// parseClientEnvelope reads a client's message as an envelope; false when
+// it is a free-form one
+func parseClientEnvelope(data []byte) (wsEnvelope, bool) {
+	var env wsEnvelope
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return env, false
+	}
+	if err := json.Unmarshal(data, &env); err != nil || env.V == 0 {
+		return env, false
+	}
+	return env, true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Several runs over one envelope connection. Every execute envelope starts a
+// session of its own, also while others are running; its messages carry its
+// run_id and, as ref, the seq of the execute envelope. A cancel or other
+// client message goes to the session its run_id or ref names, or to all of
+// them when it names none. follow streams the events of any run, such as
+// those started by other users, for a dashboard of the trainings in progress,
+// until the run ends or the client sends unfollow. The connection stays open
+// between runs; closing it ends the client's runs, as it does for a
+// single-run connection. A connection runs and follows at most
+// WS_MAX_SESSIONS at a time; a client message a busy run cannot take yet is
+// dropped with an error envelope rather than holding up the others.
+
+// wsMuxSession is a run multiplexed over an envelope connection
+type wsMuxSession struct {
+	envelope *wsEnveloper
+	input    chan wsMessage
+	// done is closed when the session ends
+	done <-chan struct{}
+}
+
+// named reports whether a client envelope is for the session: it names the
+// session, or none
+func (s *wsMuxSession) named(env wsEnvelope) bool {
+	if env.RunID == "" && env.Ref == 0 {
+		return true
+	}
+	return (env.RunID != "" && env.RunID == s.envelope.run()) || (env.Ref != 0 && env.Ref == s.envelope.ref)
+}
+
+// serveEnvelopes reads an envelope client's messages until it leaves,
+// starting a session for every execute envelope
+func (x *execClient) serveEnvelopes() {
+	wire := &wsEnvelopeConn{conn: x.conn}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	var mu sync.Mutex
+	sessions := map[*wsMuxSession]bool{}
+	follows := map[string]context.CancelFunc{}
+	for {
+		messageType, data, err := x.conn.ReadMessage()
+		if err != nil {
+			log.Println("Error reading from client:", err)
+			tapeOf(x.conn).end(err)
+			return
+		}
+		tapeOf(x.conn).message("in", messageType, data)
+		env, ok := parseClientEnvelope(data)
+		if ok && (env.Type == "execute" || env.Type == "follow") {
+			mu.Lock()
+			open := len(sessions) + len(follows)
+			mu.Unlock()
+			if open >= wsQueue.maxSessions {
+				wire.send(wsEnvelope{Type: "error", RunID: env.RunID, Ref: env.Seq, Payload: messagePayload(fmt.Sprintf("%d runs and follows already open on this connection (WS_MAX_SESSIONS)", open))})
+				continue
+			}
+		}
+		switch {
+		case ok && env.Type == "execute":
+			sctx, scancel := context.WithCancel(ctx)
+			s := &wsMuxSession{
+				envelope: &wsEnveloper{wire: wire, ref: env.Seq},
+				input:    make(chan wsMessage, 16),
+				done:     sctx.Done(),
+			}
+			mu.Lock()
+			sessions[s] = true
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer scancel()
+				x.runExecution(sctx, s.envelope, env.Payload, s.input, scancel)
+				mu.Lock()
+				delete(sessions, s)
+				mu.Unlock()
+			}()
+
+		case ok && env.Type == "follow":
+			mu.Lock()
+			_, following := follows[env.RunID]
+			mu.Unlock()
+			if env.RunID == "" || following {
+				continue
+			}
+			var opts struct {
+				Offset int `json:"offset"`
+			}
+			if len(env.Payload) > 0 {
+				json.Unmarshal(env.Payload, &opts)
+			}
+			fctx, fcancel := context.WithCancel(ctx)
+			mu.Lock()
+			follows[env.RunID] = fcancel
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer fcancel()
+				err := followRunEvents(fctx, env.RunID, max(opts.Offset, 0), func(event any) error {
+					typ, payload, err := followedPayload(event)
+					if err != nil {
+						return err
+					}
+					return wire.send(wsEnvelope{Type: typ, RunID: env.RunID, Ref: env.Seq, Payload: payload})
+				})
+				if errors.Is(err, errRunGone) {
+					wire.send(wsEnvelope{Type: "error", RunID: env.RunID, Ref: env.Seq, Payload: messagePayload(err.Error())})
+				}
+				mu.Lock()
+				delete(follows, env.RunID)
+				mu.Unlock()
+			}()
+
+		case ok && env.Type == "unfollow":
+			mu.Lock()
+			if stop, found := follows[env.RunID]; found {
+				stop()
+			}
+			mu.Unlock()
+
+		default:
+			if ok && env.Type == "cancel" {
+				messageType, data = websocket.TextMessage, []byte("CANCEL")
+			}
+			mu.Lock()
+			var targets []*wsMuxSession
+			for s := range sessions {
+				if !ok || s.named(env) {
+					targets = append(targets, s)
+				}
+			}
+			mu.Unlock()
+			for _, s := range targets {
+				select {
+				case s.input <- wsMessage{Type: messageType, Data: data}:
+				case <-s.done:
+				default:
+					wire.send(wsEnvelope{Type: "error", RunID: s.envelope.run(), Ref: s.envelope.ref, Payload: messagePayload("run is busy, message dropped; send it again")})
+				}
+			}
+		}
+	}
+}
+
+// followedPayload is the envelope type and payload of an event of
+// followRunEvents: the event without its type
+func followedPayload(event any) (string, json.RawMessage, error) {
+	var typ string
+	var v any
+	switch e := event.(type) {
+	case runLogEvent:
+		typ, v = e.Type, e.runLogLine
+	case runMetricEvent:
+		typ, v = e.Type, struct {
+			Key string `json:"key"`
+			MetricPoint
+		}{e.Key, e.MetricPoint}
+	case runStateEvent:
+		typ, v = e.Type, struct {
+			Status string `json:"status"`
+			Error  string `json:"error,omitempty"`
+		}{e.Status, e.Error}
+	}
+	payload, err := json.Marshal(v)
+	return typ, payload, err
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Outbound queue of an execution session. The executor hands frames to the
+// queue and a writer goroutine sends them to the client, so a client that
+// falls behind (a backgrounded tab, a slow VPN) holds at most WS_QUEUE_SIZE
+// frames in memory. When the queue is full, log lines are dropped or merged
+// according to WS_QUEUE_POLICY; control messages, which carry the run's
+// state, wait for room and so hold back the executor instead.
+//
+// With WS_BATCH_INTERVAL set, log lines are also batched: lines queued
+// within the interval share one frame, separated by newlines, until it holds
+// WS_BATCH_SIZE bytes. A control message sends the batch before it at once.
+// Trainings that print per-step progress then cost a frame per interval
+// rather than one per line.
+//
+// Binary frames wait for room like control messages, but the bytes they hold
+// are bounded too: one that would take the queued binary frames of a session
+// past WS_QUEUE_BINARY_SIZE is dropped. Its BINARY_FRAME: header is held back
+// until the frame comes, so the two are queued together, or both replaced by
+// a BINARY_DROPPED: notice, and nothing gets between them.
+
+const (
+	// wsQueueBlock makes log lines wait for room like control messages
+	wsQueueBlock = "block"
+	// wsQueueDrop drops the oldest queued log line to make room
+	wsQueueDrop = "drop"
+	// wsQueueCoalesce appends log lines to the last queued one while it is
+	// under wsInspectLimit, then drops like wsQueueDrop
+	wsQueueCoalesce = "coalesce"
+)
+
+// wsDrainTimeout is how long a finished session waits for its client to take
+// the queued frames before the connection is closed
+const wsDrainTimeout = 10 * time.Second
+
+var errWSQueueClosed = errors.New("session output closed")
+
+// wsBinaryHeader announces the binary frame that follows it
+var wsBinaryHeader = []byte("BINARY_FRAME:")
+
+// wsControlPrefixes mark messages the client must see: run state, errors,
+// the request ID, binary frame headers and status reports. Anything else is
+// a log line.
+var wsControlPrefixes = [][]byte{
+	[]byte("EXECUTION_"),
+	[]byte("REQUEST_ID:"),
+	// The header of a binary frame must stay right before it
+	[]byte("BINARY_FRAME:"),
+	[]byte("BINARY_DROPPED:"),
+	[]byte("MEMORY_INITIAL:"),
+	[]byte("MEMORY_FINAL:"),
+	[]byte("MEMORY_ERROR:"),
+	[]byte("STATUS:"),
+}
+
+type wsQueueConfig struct {
+	size   int
+	policy string
+	// batchInterval is how long a batch of log lines stays open, 0 for no batching
+	batchInterval time.Duration
+	batchBytes    int
+	// maxBinary is the largest binary frame relayed to a client; larger ones
+	// are dropped, and it also bounds the client's messages
+	maxBinary int64
+	// binaryBytes bounds the bytes of the binary frames queued for a session
+	binaryBytes int64
+	// maxSessions is how many runs and follows an envelope connection may
+	// have open at once
+	maxSessions int
+}
+
+var wsQueue = wsQueueConfig{size: 1024, policy: wsQueueCoalesce, batchBytes: 16 << 10, maxBinary: 8 << 20, binaryBytes: 32 << 20, maxSessions: 16}
+
+// Totals over all sessions, reported by /debug/runtime
+var wsFramesDropped, wsFramesCoalesced atomic.Int64
+
+func wsQueueConfigFromEnv() (wsQueueConfig, error) {
+	cfg := wsQueueConfig{
+		size:        envInt("WS_QUEUE_SIZE", 1024),
+		policy:      getEnv("WS_QUEUE_POLICY", wsQueueCoalesce),
+		maxSessions: envInt("WS_MAX_SESSIONS", 16),
+	}
+	if cfg.size < 1 {
+		return cfg, errors.New("WS_QUEUE_SIZE must be at least 1")
+	}
+	if cfg.maxSessions < 1 {
+		return cfg, errors.New("WS_MAX_SESSIONS must be at least 1")
+	}
+	switch cfg.policy {
+	case wsQueueBlock, wsQueueDrop, wsQueueCoalesce:
+	default:
+		return cfg, fmt.Errorf("WS_QUEUE_POLICY: unknown policy %q (block, drop or coalesce)", cfg.policy)
+	}
+	if raw := os.Getenv("WS_BATCH_INTERVAL"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("WS_BATCH_INTERVAL: invalid duration %q", raw)
+		}
+		cfg.batchInterval = d
+	}
+	size, err := envByteSize("WS_BATCH_SIZE", 16<<10)
+	if err != nil {
+		return cfg, err
+	}
+	if size < 1 || size > wsInspectLimit {
+		return cfg, fmt.Errorf("WS_BATCH_SIZE must be between 1 byte and %s", formatByteSize(wsInspectLimit))
+	}
+	cfg.batchBytes = int(size)
+	if cfg.maxBinary, err = envByteSize("WS_MAX_BINARY_SIZE", 8<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.maxBinary < wsInspectLimit {
+		return cfg, fmt.Errorf("WS_MAX_BINARY_SIZE must be at least %s", formatByteSize(wsInspectLimit))
+	}
+	if cfg.binaryBytes, err = envByteSize("WS_QUEUE_BINARY_SIZE", 32<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.binaryBytes < cfg.maxBinary {
+		return cfg, fmt.Errorf("WS_QUEUE_BINARY_SIZE must be at least WS_MAX_BINARY_SIZE (%s)", formatByteSize(cfg.maxBinary))
+	}
+	return cfg, nil
+}
+
+func isControlMessage(messageType int, data []byte) bool {
+	if messageType != websocket.TextMessage {
+		return true
+	}
+	for _, prefix := range wsControlPrefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type wsFrame struct {
+	messageType int
+	data        []byte
+	control     bool
+	// batch frames take further log lines until sent; opened is when the
+	// first one was queued
+	batch  bool
+	opened time.Time
+}
+
+// wsQueueStats is a session's queue as shown by /admin/sessions
+type wsQueueStats struct {
+	Policy    string `json:"policy"`
+	Queued    int    `json:"queued"`
+	Dropped   int64  `json:"dropped"`
+	Coalesced int64  `json:"coalesced"`
+	// BinaryDropped counts binary frames dropped for the byte limit
+	BinaryDropped int64 `json:"binary_dropped"`
+}
+
+type wsOutbox struct {
+	conn *websocket.Conn
+	cfg  wsQueueConfig
+	// envelope wraps frames as they are sent; nil for free-form clients
+	envelope *wsEnveloper
+
+	mu sync.Mutex
+	// cond is signalled whenever frames, writing, closed or err change
+	cond    *sync.Cond
+	frames  []wsFrame
+	writing bool
+	closed  bool
+	err     error
+	// unreported counts drops the client has not been told about yet
+	unreported         int64
+	reported           time.Time
+	dropped, coalesced int64
+	// header is a BINARY_FRAME: line held until its binary frame is queued
+	header []byte
+	// binaryBytes is the size of the queued binary frames
+	binaryBytes   int64
+	binaryDropped int64
+	// timer wakes the writer when the open batch is due
+	timer *time.Timer
+	done  chan struct{}
+}
+
+// newWSOutbox starts the writer for conn; nothing else may write to conn
+// until close returns
+func newWSOutbox(conn *websocket.Conn, cfg wsQueueConfig, envelope *wsEnveloper) *wsOutbox {
+	q := &wsOutbox{conn: conn, cfg: cfg, envelope: envelope, done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+func (q *wsOutbox) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		for !q.sendable() {
+			q.cond.Wait()
+		}
+		if q.err != nil || len(q.frames) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		f := q.frames[0]
+		q.frames[0] = wsFrame{}
+		q.frames = q.frames[1:]
+		if f.messageType == websocket.BinaryMessage {
+			q.binaryBytes -= int64(len(f.data))
+		}
+		// Drops are reported at most once a second, and before the run ends
+		var unreported int64
+		if q.unreported > 0 && (f.control || time.Since(q.reported) >= time.Second) {
+			unreported, q.unreported, q.reported = q.unreported, 0, time.Now()
+		}
+		q.writing = true
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		var err error
+		if unreported > 0 {
+			notice := fmt.Sprintf("LOG_DROPPED: %d log lines skipped, the connection is too slow", unreported)
+			err = q.envelope.writeText(q.conn, notice)
+		}
+		if err == nil {
+			err = q.envelope.write(q.conn, f.messageType, f.data)
+		}
+		q.doneWriting(err)
+	}
+}
+
+// sendable reports whether the writer has something to do: send the first
+// frame, or stop. An open batch is held until it is full, followed by another
+// frame or due, or the queue closes.
+func (q *wsOutbox) sendable() bool {
+	switch {
+	case q.err != nil:
+		return true
+	case q.writing:
+		return false
+	case len(q.frames) == 0:
+		return q.closed
+	}
+	f := q.frames[0]
+	if !f.batch || len(q.frames) > 1 || q.closed || len(f.data) >= q.cfg.batchBytes {
+		return true
+	}
+	wait := q.cfg.batchInterval - time.Since(f.opened)
+	if wait <= 0 {
+		return true
+	}
+	if q.timer == nil {
+		q.timer = time.AfterFunc(wait, func() {
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		})
+	} else {
+		q.timer.Reset(wait)
+	}
+	return false
+}
+
+func (q *wsOutbox) doneWriting(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.writing = false
+	if err != nil && q.err == nil {
+		q.err = err
+		q.frames, q.header, q.binaryBytes = nil, nil, 0
+	}
+	q.cond.Broadcast()
+}
+
+// push queues a copy of data. Log lines are dropped or merged when the queue
+// is full; control messages wait for room. A binary frame is queued with the
+// header before it, or both are replaced by a notice when the binary frames
+// queued would go over their byte limit.
+func (q *wsOutbox) push(messageType int, data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.closedErr(); err != nil {
+		return err
+	}
+	if messageType == websocket.TextMessage && bytes.HasPrefix(data, wsBinaryHeader) {
+		q.header = bytes.Clone(data)
+		return nil
+	}
+	// A header is only sent with its frame; other messages go ahead of it
+	var header []byte
+	switch {
+	case messageType == websocket.BinaryMessage:
+		header, q.header = q.header, nil
+		if q.binaryBytes+int64(len(data)) > q.cfg.binaryBytes {
+			q.binaryDropped++
+			messageType, data, header = websocket.TextMessage, binaryDroppedNotice(header), nil
+		}
+	case bytes.HasPrefix(data, []byte("BINARY_DROPPED:")):
+		// The frame was dropped before the queue, the notice replaces it
+		q.header = nil
+	}
+	control := isControlMessage(messageType, data)
+	if !control && q.batch(data) {
+		return nil
+	}
+	if !control && len(q.frames) >= q.cfg.size {
+		if q.cfg.policy == wsQueueCoalesce && q.coalesce(data) {
+			return nil
+		}
+		if q.cfg.policy != wsQueueBlock {
+			q.dropOldestLog()
+		}
+	}
+	for len(q.frames) >= q.cfg.size && !q.closed && q.err == nil {
+		q.cond.Wait()
+	}
+	if err := q.closedErr(); err != nil {
+		return err
+	}
+	f := wsFrame{messageType: messageType, data: bytes.Clone(data), control: control}
+	if !control && q.cfg.batchInterval > 0 {
+		f.batch, f.opened = true, time.Now()
+	}
+	if header != nil {
+		q.frames = append(q.frames, wsFrame{messageType: websocket.TextMessage, data: header, control: true})
+	}
+	if messageType == websocket.BinaryMessage {
+		q.binaryBytes += int64(len(data))
+	}
+	q.frames = append(q.frames, f)
+	q.cond.Broadcast()
+	return nil
+}
+
+// binaryDroppedNotice tells the client the binary frame header announced was
+// dropped for a slow connection
+func binaryDroppedNotice(header []byte) []byte {
+	// "BINARY_FRAME: <content-type> <size> <name>"
+	fields := strings.SplitN(strings.TrimSpace(string(bytes.TrimPrefix(header, wsBinaryHeader))), " ", 3)
+	name := "a binary frame"
+	if len(fields) == 3 {
+		name = fields[2]
+	}
+	return []byte(fmt.Sprintf("BINARY_DROPPED: %s was skipped, the connection is too slow (WS_QUEUE_BINARY_SIZE)", name))
+}
+
+// pushStatus queues a STATUS: report without waiting for room: it replaces
+// a report still queued, as only the latest matters, or goes past the limit
+func (q *wsOutbox) pushStatus(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.closedErr(); err != nil {
+		return err
+	}
+	for i := range q.frames {
+		if q.frames[i].messageType == websocket.TextMessage && bytes.HasPrefix(q.frames[i].data, []byte("STATUS:")) {
+			q.frames[i].data = bytes.Clone(data)
+			return nil
+		}
+	}
+	q.frames = append(q.frames, wsFrame{messageType: websocket.TextMessage, data: bytes.Clone(data), control: true})
+	q.cond.Broadcast()
+	return nil
+}
+
+// batch adds a log line to the open batch, if there is one with room left
+func (q *wsOutbox) batch(data []byte) bool {
+	if len(q.frames) == 0 {
+		return false
+	}
+	last := &q.frames[len(q.frames)-1]
+	if !last.batch || len(last.data)+1+len(data) > q.cfg.batchBytes || time.Since(last.opened) >= q.cfg.batchInterval {
+		return false
+	}
+	last.data = append(append(last.data, '\n'), data...)
+	return true
+}
+
+// closedErr is why frames can no longer be queued, nil while they can
+func (q *wsOutbox) closedErr() error {
+	if q.err != nil {
+		return q.err
+	}
+	if q.closed {
+		return errWSQueueClosed
+	}
+	return nil
+}
+
+// coalesce appends a log line to the last queued frame if that is a log line
+// with room left
+func (q *wsOutbox) coalesce(data []byte) bool {
+	last := &q.frames[len(q.frames)-1]
+	if last.control || len(last.data)+1+len(data) > wsInspectLimit {
+		return false
+	}
+	last.data = append(append(last.data, '\n'), data...)
+	q.coalesced++
+	wsFramesCoalesced.Add(1)
+	return true
+}
+
+// dropOldestLog removes the oldest queued log line, if there is one
+func (q *wsOutbox) dropOldestLog() {
+	for i, f := range q.frames {
+		if !f.control {
+			q.frames = append(q.frames[:i], q.frames[i+1:]...)
+			q.dropped++
+			q.unreported++
+			wsFramesDropped.Add(1)
+			return
+		}
+	}
+}
+
+// stream writes a frame read from r once the queued ones are sent, without
+// holding it in memory unless it goes out as an envelope
+func (q *wsOutbox) stream(messageType int, r io.Reader) error {
+	q.mu.Lock()
+	for (len(q.frames) > 0 || q.writing) && !q.closed && q.err == nil {
+		q.cond.Wait()
+	}
+	if err := q.closedErr(); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.writing = true
+	q.mu.Unlock()
+	var err error
+	if q.envelope != nil {
+		var data []byte
+		if data, err = io.ReadAll(r); err == nil {
+			err = q.envelope.write(q.conn, messageType, data)
+		}
+	} else if tape := tapeOf(q.conn); tape != nil {
+		var recorded bytes.Buffer
+		if err = copyFrame(q.conn, messageType, io.TeeReader(r, &recorded)); err == nil {
+			tape.message("out", messageType, recorded.Bytes())
+		}
+	} else {
+		err = copyFrame(q.conn, messageType, r)
+	}
+	q.doneWriting(err)
+	return err
+}
+
+// close stops accepting frames and waits up to wsDrainTimeout for the queued
+// ones to be sent
+func (q *wsOutbox) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+	case <-time.After(wsDrainTimeout):
+	}
+	q.mu.Lock()
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.mu.Unlock()
+}
+
+// abort replaces the queued log lines with a final control message and
+// closes the queue, so a killed session's client learns why without first
+// reading a backlog
+func (q *wsOutbox) abort(message string) {
+	q.mu.Lock()
+	frames := q.frames[:0]
+	for _, f := range q.frames {
+		if f.control {
+			frames = append(frames, f)
+		}
+	}
+	q.frames = append(frames, wsFrame{messageType: websocket.TextMessage, data: []byte(message), control: true})
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.close()
+}
+
+func (q *wsOutbox) stats() wsQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return wsQueueStats{
+		Policy:        q.cfg.policy,
+		Queued:        len(q.frames),
+		Dropped:       q.dropped,
+		Coalesced:     q.coalesced,
+		BinaryDropped: q.binaryDropped,
+	}
+}
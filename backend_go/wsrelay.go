@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Buffers for relaying execution streams. Log-heavy trainings send thousands
+// of lines a second, and reading each into a fresh slice makes as much
+// garbage. Frames are read into pooled buffers instead. Frames over
+// wsInspectLimit, which are never completion markers, are streamed through
+// without being held whole, unless secrets must be masked or the stream is
+// recorded.
+
+// wsInspectLimit is how much of a frame is buffered before it is streamed
+const wsInspectLimit = 64 << 10
+
+var wsBufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// wsCopyPool holds the chunks large frames are streamed through
+var wsCopyPool = sync.Pool{New: func() any {
+	b := make([]byte, 32<<10)
+	return &b
+}}
+
+// wsCompression negotiates permessage-deflate on both legs of the execution
+// proxy (WS_COMPRESSION=true). Verbose logs shrink several times over, which
+// pays for the CPU when users watch trainings over a VPN. Each leg only
+// compresses if its peer agrees.
+var wsCompression = os.Getenv("WS_COMPRESSION") == "true"
+
+// wsWriteBufferPool shares write buffers between connections, which only
+// need one while writing a frame
+var wsWriteBufferPool = &sync.Pool{}
+
+func getWSBuffer() *bytes.Buffer {
+	return wsBufferPool.Get().(*bytes.Buffer)
+}
+
+// putWSBuffer returns a buffer to the pool; one grown by a huge frame is
+// left to the GC rather than pinned
+func putWSBuffer(b *bytes.Buffer) {
+	if b.Cap() > 1<<20 {
+		return
+	}
+	b.Reset()
+	wsBufferPool.Put(b)
+}
+
+// readFrame reads the next frame into a pooled buffer, up to limit bytes.
+// rest is nil when the frame fit, and otherwise reads the remainder, valid
+// until the next read on conn. The caller puts the buffer back.
+func readFrame(conn *websocket.Conn, limit int64) (messageType int, buf *bytes.Buffer, rest io.Reader, err error) {
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	buf = getWSBuffer()
+	n, err := buf.ReadFrom(io.LimitReader(r, limit))
+	if err != nil {
+		putWSBuffer(buf)
+		return 0, nil, nil, err
+	}
+	if n == limit {
+		rest = r
+	}
+	return messageType, buf, rest, nil
+}
+
+// copyFrame writes one frame to conn from r without holding it in memory
+func copyFrame(conn *websocket.Conn, messageType int, r io.Reader) error {
+	w, err := conn.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	chunk := wsCopyPool.Get().(*[]byte)
+	_, err = io.CopyBuffer(w, r, *chunk)
+	wsCopyPool.Put(chunk)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Liveness of execution sessions. Every WS_STATUS_INTERVAL (default 15s,
+// "off" disables it) a session sends its client a STATUS: line holding a JSON
+// report: the run's state, how long the session has been going, how long
+// since the script last printed and the state of the executor's connection.
+// Reports keep coming while a training is quiet, so a client that sees none
+// for two intervals can take the connection as dead, and one that sees
+// last_output_seconds grow knows the script is just quiet.
+
+// wsStatusInterval is how often sessions report their status, 0 when they do not
+var wsStatusInterval = 15 * time.Second
+
+func wsStatusIntervalFromEnv() time.Duration {
+	if strings.EqualFold(os.Getenv("WS_STATUS_INTERVAL"), "off") {
+		return 0
+	}
+	return envDuration("WS_STATUS_INTERVAL", 15*time.Second)
+}
+
+// Session states of a status report
+const (
+	sessionQueued   = "queued"
+	sessionRunning  = "running"
+	sessionRetrying = "retrying"
+)
+
+// Upstream states of a status report: the executor's connection to where the
+// script runs, such as the Python service or the ssh host
+const (
+	upstreamConnecting   = "connecting"
+	upstreamConnected    = "connected"
+	upstreamReconnecting = "reconnecting"
+)
+
+// sessionStatus is what a session knows about its run's liveness; safe for
+// concurrent use
+type sessionStatus struct {
+	mu       sync.Mutex
+	started  time.Time
+	state    string
+	upstream string
+	// lastOutput is when the script last printed, lastUpstream when anything
+	// came from the executor, heartbeats included
+	lastOutput, lastUpstream time.Time
+	// ended is set once the client was sent the run's end
+	ended bool
+}
+
+// statusReport is the payload of a STATUS: line, also shown by /admin/sessions
+type statusReport struct {
+	State          string `json:"state"`
+	ElapsedSeconds int64  `json:"elapsed_seconds"`
+	// Unset until the script has printed anything
+	LastOutputSeconds *int64 `json:"last_output_seconds,omitempty"`
+	Upstream          string `json:"upstream,omitempty"`
+	// Unset until anything came from the executor
+	LastUpstreamSeconds *int64 `json:"last_upstream_seconds,omitempty"`
+	// IntervalSeconds is WS_STATUS_INTERVAL, for clients to tell when a
+	// report is overdue
+	IntervalSeconds int64 `json:"interval_seconds,omitempty"`
+}
+
+func newSessionStatus() *sessionStatus {
+	return &sessionStatus{started: time.Now(), state: sessionQueued}
+}
+
+// setState sets the session state; the upstream state is cleared whenever
+// the run is not running
+func (st *sessionStatus) setState(state string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state = state
+	if state != sessionRunning {
+		st.upstream = ""
+	}
+}
+
+func (st *sessionStatus) setUpstream(state string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.upstream = state
+}
+
+// seen records a message on its way to the client. The session's own
+// EXECUTION_ notices do not come from the executor, and heartbeats are not
+// output.
+func (st *sessionStatus) seen(messageType int, data []byte) {
+	text := messageType == websocket.TextMessage
+	if text && bytes.HasPrefix(data, []byte("EXECUTION_")) {
+		return
+	}
+	now := time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastUpstream = now
+	if !text || !bytes.HasPrefix(data, []byte("HEARTBEAT:")) {
+		st.lastOutput = now
+	}
+}
+
+// end stops the reports once the client knows the run is over
+func (st *sessionStatus) end() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.ended = true
+}
+
+func (st *sessionStatus) hasEnded() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.ended
+}
+
+func (st *sessionStatus) report() statusReport {
+	now := time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rep := statusReport{
+		State:           st.state,
+		ElapsedSeconds:  int64(now.Sub(st.started).Seconds()),
+		Upstream:        st.upstream,
+		IntervalSeconds: int64(wsStatusInterval.Seconds()),
+	}
+	if !st.lastOutput.IsZero() {
+		since := int64(now.Sub(st.lastOutput).Seconds())
+		rep.LastOutputSeconds = &since
+	}
+	if !st.lastUpstream.IsZero() {
+		since := int64(now.Sub(st.lastUpstream).Seconds())
+		rep.LastUpstreamSeconds = &since
+	}
+	return rep
+}
+
+// message is the STATUS: line of the current report
+func (st *sessionStatus) message() []byte {
+	payload, _ := json.Marshal(st.report())
+	return append([]byte("STATUS: "), payload...)
+}
+
+// reportStatus sends the session's status to outbox every WS_STATUS_INTERVAL
+// until the run ended, stop is closed or the outbox is
+func reportStatus(st *sessionStatus, outbox *wsOutbox, stop <-chan struct{}) {
+	if wsStatusInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(wsStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if st.hasEnded() || outbox.pushStatus(st.message()) != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
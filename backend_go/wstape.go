@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+)
+
+// Recording of execution WebSocket sessions as the client saw them. With
+// --record-sessions DIR every message of every execution connection, in both
+// directions, is appended to DIR/<id>.jsonl with its time as it happens, so a
+// session that froze the UI can be looked at afterwards, or played back at
+// its original or a faster pace with GET /admin/recordings/{id}/replay or
+// "training-backend sessions replay". Unlike --record, which keeps the Python
+// service's side to stand in for it, this keeps what reached the browser:
+// queueing, batching, dropped lines and envelopes included.
+//
+// Recordings are readable by the backend's user only. One stops at
+// SESSION_RECORD_MAX_SIZE, and those older than SESSION_RECORD_RETENTION_DAYS
+// (default 7) are deleted, so recording left on does not fill the disk.
+
+// wsTapeHeader is the first line of a session recording
+type wsTapeHeader struct {
+	RequestID  string    `json:"request_id"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Envelope   bool      `json:"envelope"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// wsTapeEvent is a message of a session recording, or its end
+type wsTapeEvent struct {
+	OffsetMS int64 `json:"offset_ms"`
+	// Dir is "in" for the client's messages, "out" for those sent to it and
+	// "close" when the connection ended
+	Dir  string `json:"dir"`
+	Type int    `json:"type,omitempty"`
+	Data string `json:"data,omitempty"`
+	// Binary holds binary messages and text that is not UTF-8, base64-encoded
+	Binary []byte `json:"binary,omitempty"`
+	// Error is why the connection ended, if it failed
+	Error string `json:"error,omitempty"`
+}
+
+// payload is the message's bytes
+func (e *wsTapeEvent) payload() []byte {
+	if e.Binary != nil {
+		return e.Binary
+	}
+	return []byte(e.Data)
+}
+
+// wsTapeRecorder writes session recordings; nil when recording is off
+type wsTapeRecorder struct {
+	dir string
+	// maxSize is the largest recording in bytes, 0 for no limit
+	maxSize   int64
+	retention time.Duration
+
+	mu    sync.Mutex
+	tapes map[*websocket.Conn]*wsTape
+}
+
+// tapes is the process-wide session recorder, set by --record-sessions
+var tapes *wsTapeRecorder
+
+func newWSTapeRecorder(dir string) (*wsTapeRecorder, error) {
+	maxSize, err := envByteSize("SESSION_RECORD_MAX_SIZE", 100<<20)
+	if err != nil {
+		return nil, err
+	}
+	retention := 7 * 24 * time.Hour
+	if os.Getenv("SESSION_RECORD_RETENTION_DAYS") != "" {
+		retention = envDays("SESSION_RECORD_RETENTION_DAYS")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	log.Printf("Recording execution sessions to %s", dir)
+	return &wsTapeRecorder{dir: dir, maxSize: maxSize, retention: retention, tapes: map[*websocket.Conn]*wsTape{}}, nil
+}
+
+// sweep deletes the recordings last written before the retention period
+func (t *wsTapeRecorder) sweep() {
+	names, err := filepath.Glob(filepath.Join(t.dir, "*.jsonl"))
+	if err != nil {
+		log.Printf("Error listing session recordings: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-t.retention)
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil || info.ModTime().After(cutoff) || t.recording(name) {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			log.Printf("Error removing session recording %s: %v", filepath.Base(name), err)
+		}
+	}
+}
+
+// recording reports whether a file is the recording of a connection still open
+func (t *wsTapeRecorder) recording(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tape := range t.tapes {
+		if tape.f.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runSweeper applies the retention period hourly until ctx is done
+func (t *wsTapeRecorder) runSweeper(ctx context.Context) {
+	if t == nil || t.retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		t.sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// wsTape is the recording of one connection
+type wsTape struct {
+	start time.Time
+
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	ended bool
+	// size is what was written so far, maxSize its limit (0 for none)
+	size, maxSize int64
+}
+
+// Write counts what the encoder writes to the file
+func (t *wsTape) Write(p []byte) (int, error) {
+	n, err := t.f.Write(p)
+	t.size += int64(n)
+	return n, err
+}
+
+// open starts recording a connection until close
+func (t *wsTapeRecorder) open(conn *websocket.Conn, header wsTapeHeader) {
+	if t == nil {
+		return
+	}
+	name := filepath.Join(t.dir, newID()+".jsonl")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Session recording: %v", err)
+		return
+	}
+	tape := &wsTape{start: time.Now(), f: f, maxSize: t.maxSize}
+	tape.enc = json.NewEncoder(tape)
+	if err := tape.enc.Encode(header); err != nil {
+		log.Printf("Session recording: writing %s: %v", name, err)
+	}
+	t.mu.Lock()
+	t.tapes[conn] = tape
+	t.mu.Unlock()
+}
+
+// close ends the recording of a connection
+func (t *wsTapeRecorder) close(conn *websocket.Conn) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	tape := t.tapes[conn]
+	delete(t.tapes, conn)
+	t.mu.Unlock()
+	if tape == nil {
+		return
+	}
+	tape.end(nil)
+	tape.mu.Lock()
+	defer tape.mu.Unlock()
+	tape.f.Close()
+}
+
+// tapeOf is the recording of a connection, nil when it is not recorded
+func tapeOf(conn *websocket.Conn) *wsTape {
+	if tapes == nil {
+		return nil
+	}
+	tapes.mu.Lock()
+	defer tapes.mu.Unlock()
+	return tapes.tapes[conn]
+}
+
+// message records a message; dir is "in" or "out"
+func (t *wsTape) message(dir string, messageType int, data []byte) {
+	if t == nil {
+		return
+	}
+	e := wsTapeEvent{Dir: dir, Type: messageType}
+	if messageType == websocket.TextMessage && utf8.Valid(data) {
+		e.Data = string(data)
+	} else {
+		e.Binary = data
+	}
+	t.write(e)
+}
+
+// end records how the connection ended; only the first call counts
+func (t *wsTape) end(err error) {
+	if t == nil {
+		return
+	}
+	e := wsTapeEvent{Dir: "close"}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.write(e)
+}
+
+func (t *wsTape) write(e wsTapeEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended {
+		return
+	}
+	t.ended = e.Dir == "close"
+	e.OffsetMS = time.Since(t.start).Milliseconds()
+	if t.maxSize > 0 && t.size+int64(len(e.Data)+base64.StdEncoding.EncodedLen(len(e.Binary))) > t.maxSize {
+		// The recording ends here, the connection may go on
+		t.ended = true
+		e = wsTapeEvent{OffsetMS: e.OffsetMS, Dir: "close", Error: fmt.Sprintf("recording stopped at %s (SESSION_RECORD_MAX_SIZE)", formatByteSize(t.maxSize))}
+	}
+	if err := t.enc.Encode(e); err != nil {
+		log.Printf("Session recording: writing %s: %v", t.f.Name(), err)
+	}
+}
+
+// readWSTape reads a session recording
+func readWSTape(r io.Reader) (wsTapeHeader, []wsTapeEvent, error) {
+	var header wsTapeHeader
+	var events []wsTapeEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*int(wsQueue.maxBinary))
+	for scanner.Scan() {
+		if header.StartedAt.IsZero() {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				return header, nil, fmt.Errorf("recording header: %w", err)
+			}
+			continue
+		}
+		var e wsTapeEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return header, nil, fmt.Errorf("recording line %d: %w", len(events)+2, err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, err
+	}
+	if header.StartedAt.IsZero() {
+		return header, nil, errors.New("not a session recording")
+	}
+	return header, events, nil
+}
+
+// path is the file of a recording ID, false for one that cannot be
+func (t *wsTapeRecorder) path(id string) (string, bool) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return "", false
+	}
+	return filepath.Join(t.dir, id+".jsonl"), true
+}
+
+// wsTapeInfo describes a recording in GET /admin/recordings
+type wsTapeInfo struct {
+	ID string `json:"id"`
+	wsTapeHeader
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// list describes the recordings on disk, newest first
+func (t *wsTapeRecorder) list() ([]wsTapeInfo, error) {
+	names, err := filepath.Glob(filepath.Join(t.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	out := []wsTapeInfo{}
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		info := wsTapeInfo{ID: strings.TrimSuffix(filepath.Base(name), ".jsonl")}
+		line, _ := bufio.NewReader(f).ReadBytes('\n')
+		if st, err := f.Stat(); err == nil {
+			info.SizeBytes = st.Size()
+		}
+		f.Close()
+		if json.Unmarshal(line, &info.wsTapeHeader) != nil {
+			continue
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out, nil
+}
+
+// playWSTape calls send with the outgoing messages of a recording, or all of
+// them with both, spaced as recorded and sped up by speed; 0 sends them
+// without delays. It stops at the first error of send, or when stop closes.
+func playWSTape(events []wsTapeEvent, speed float64, both bool, stop <-chan struct{}, send func(e *wsTapeEvent) error) error {
+	start := time.Now()
+	for i := range events {
+		e := &events[i]
+		if !both && e.Dir == "in" {
+			continue
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(e.OffsetMS)/speed) * time.Millisecond)
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(time.Until(due)):
+			}
+		}
+		if err := send(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerRecordingRoutes mounts the session recordings on the admin API
+func registerRecordingRoutes() {
+	// GET /admin/recordings lists the recorded sessions, newest first
+	http.HandleFunc("/admin/recordings", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		if tapes == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session recording is off, see --record-sessions"})
+			return
+		}
+		list, err := tapes.list()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"recordings": list})
+	}))
+
+	// GET /admin/recordings/{id} downloads a recording; /replay?speed=
+	// plays it back over a WebSocket as the client received it
+	http.HandleFunc("/admin/recordings/", adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		if tapes == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session recording is off, see --record-sessions"})
+			return
+		}
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/recordings/"), "/")
+		name, ok := tapes.path(id)
+		if !ok || (action != "" && action != "replay") {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		if action == "" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".jsonl"))
+			io.Copy(w, f)
+			return
+		}
+
+		speed := 1.0
+		if s := r.URL.Query().Get("speed"); s != "" {
+			if speed, err = strconv.ParseFloat(s, 64); err != nil || speed < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "speed must be a number of 0 or more"})
+				return
+			}
+		}
+		_, events, err := readWSTape(f)
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Messages from the viewer are dropped; leaving stops the replay
+		left := make(chan struct{})
+		go func() {
+			defer close(left)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		reason := "replay ended"
+		playWSTape(events, speed, false, left, func(e *wsTapeEvent) error {
+			if e.Dir == "close" {
+				if e.Error != "" {
+					reason = "recorded session ended: " + e.Error
+				}
+				return nil
+			}
+			return conn.WriteMessage(e.Type, e.payload())
+		})
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, truncateCloseReason(reason)), time.Now().Add(time.Second))
+	}))
+}
+
+// truncateCloseReason keeps a close reason within the 123 bytes a close frame allows
+func truncateCloseReason(reason string) string {
+	for len(reason) > 123 {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	return reason
+}
+
+func newSessionsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sessions",
+		Short: "Inspect recorded execution sessions",
+		Args:  cobra.NoArgs,
+	}
+	var speed float64
+	var both bool
+	replay := &cobra.Command{
+		Use:   "replay FILE",
+		Short: "Play back a recorded execution session in the terminal",
+		Long: `Prints the messages of a session recorded with --record-sessions (a
+file of its directory, or one downloaded from GET /admin/recordings/{id}) as
+the client received them, spaced as they were and sped up by --speed. --both
+adds the client's own messages. Each line starts with its offset from the
+start of the session; > marks messages to the client and < its own.`,
+		Example: `  training-backend sessions replay recordings/3f9c...e1.jsonl --speed 10
+  training-backend sessions replay session.jsonl --speed 0 --both`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if speed < 0 {
+				return errors.New("--speed must be 0 or more")
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			header, events, err := readWSTape(f)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			user := header.User
+			if user == "" {
+				user = "anonymous"
+			}
+			fmt.Fprintf(out, "Session %s of %s from %s, started %s\n", header.RequestID, user, header.RemoteAddr, header.StartedAt.Format(time.RFC3339))
+			return playWSTape(events, speed, both, cmd.Context().Done(), func(e *wsTapeEvent) error {
+				offset := fmt.Sprintf("%9.3fs", float64(e.OffsetMS)/1000)
+				switch {
+				case e.Dir == "close" && e.Error != "":
+					fmt.Fprintf(out, "%s closed: %s\n", offset, e.Error)
+				case e.Dir == "close":
+					fmt.Fprintf(out, "%s closed\n", offset)
+				case e.Binary != nil:
+					fmt.Fprintf(out, "%s %s [%d bytes binary]\n", offset, tapeArrow(e.Dir), len(e.Binary))
+				default:
+					for _, line := range strings.Split(e.Data, "\n") {
+						fmt.Fprintf(out, "%s %s %s\n", offset, tapeArrow(e.Dir), line)
+					}
+				}
+				return nil
+			})
+		},
+	}
+	replay.Flags().Float64Var(&speed, "speed", 1, "playback speed; 0 prints everything at once")
+	replay.Flags().BoolVar(&both, "both", false, "also print the client's messages")
+	cmd.AddCommand(replay)
+	return cmd
+}
+
+func tapeArrow(dir string) string {
+	if dir == "in" {
+		return "<"
+	}
+	return ">"
+}
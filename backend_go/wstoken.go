@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One-time tokens for the execution and run events WebSockets. The browser
+// WebSocket API cannot set an Authorization header, and a session cookie
+// alone would let any site open a socket with the user's session. So with
+// authentication on, the upgrade needs a token from POST /api/script/ws/token (itself CSRF
+// protected), passed as ?token= or as a "training-token.<token>"
+// subprotocol. Tokens are sealed like the session cookie, so any replica
+// sharing SESSION_SECRET accepts them, and expire after WS_TOKEN_TTL. Used
+// tokens are remembered in memory, so a token is accepted once per replica:
+// behind a load balancer it can be replayed on another replica until it
+// expires, which the short TTL bounds. Clients that can set headers may send
+// their bearer token instead.
+
+const (
+	executionPath     = "/api/script/ws/execute"
+	wsTokenPurpose    = "ws-token"
+	wsTokenProtocolID = "training-token."
+)
+
+// wsToken is the sealed content of a token
+type wsToken struct {
+	Identity Identity  `json:"identity"`
+	Session  string    `json:"session,omitempty"`
+	Nonce    string    `json:"nonce"`
+	Expires  time.Time `json:"exp"`
+}
+
+// wsTokensUsed remembers redeemed tokens until they expire
+var wsTokensUsed = struct {
+	sync.Mutex
+	nonces map[string]time.Time
+}{nonces: map[string]time.Time{}}
+
+func wsTokenTTL() time.Duration {
+	return envDuration("WS_TOKEN_TTL", 30*time.Second)
+}
+
+// handleWSToken mints a token for the caller's next execution or run events
+// WebSocket
+func handleWSToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if oidc == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "authentication is off, WebSockets need no token"})
+		return
+	}
+	id := identityFrom(r)
+	if id == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+		return
+	}
+	ttl := wsTokenTTL()
+	token, err := oidc.seal(wsTokenPurpose, wsToken{
+		Identity: *id,
+		Session:  id.session,
+		Nonce:    randomToken(),
+		Expires:  time.Now().Add(ttl),
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":       token,
+		"expires_in":  int(ttl.Seconds()),
+		"subprotocol": wsTokenProtocolID + token,
+	})
+}
+
+// redeemWSToken checks a token and marks it used
+func redeemWSToken(token string) (*Identity, error) {
+	var t wsToken
+	if !oidc.open(wsTokenPurpose, token, &t) {
+		return nil, errors.New("invalid token")
+	}
+	now := time.Now()
+	if now.After(t.Expires) {
+		return nil, errors.New("token expired")
+	}
+	wsTokensUsed.Lock()
+	defer wsTokensUsed.Unlock()
+	for nonce, expires := range wsTokensUsed.nonces {
+		if now.After(expires) {
+			delete(wsTokensUsed.nonces, nonce)
+		}
+	}
+	if _, used := wsTokensUsed.nonces[t.Nonce]; used {
+		return nil, errors.New("token already used")
+	}
+	wsTokensUsed.nonces[t.Nonce] = t.Expires
+	id := t.Identity
+	id.session = t.Session
+	return &id, nil
+}
+
+// wsTokenFromRequest returns the token of an upgrade request, from the query
+// or the subprotocols
+func wsTokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if proto := wsTokenProtocol(r); proto != "" {
+		return strings.TrimPrefix(proto, wsTokenProtocolID)
+	}
+	return ""
+}
+
+// wsTokenProtocol returns the token subprotocol the client offered, which
+// the server must select for browsers to accept the connection
+func wsTokenProtocol(r *http.Request) string {
+	for _, proto := range websocketSubprotocols(r) {
+		if strings.HasPrefix(proto, wsTokenProtocolID) {
+			return proto
+		}
+	}
+	return ""
+}
+
+func websocketSubprotocols(r *http.Request) []string {
+	var out []string
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, proto := range strings.Split(v, ",") {
+			if proto = strings.TrimSpace(proto); proto != "" {
+				out = append(out, proto)
+			}
+		}
+	}
+	return out
+}
+
+// tokenSocketPath reports whether path is a WebSocket that needs a one-time
+// token: the execution socket or the events of a run
+func tokenSocketPath(path string) bool {
+	if path == executionPath {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, "/api/runs/")
+	if !ok {
+		return false
+	}
+	id, ok := strings.CutSuffix(rest, "/events")
+	return ok && id != "" && !strings.Contains(id, "/")
+}
+
+// authenticateExecution authenticates an execution or run events WebSocket
+// upgrade by its one-time token; bearer tokens go through the usual check
+func authenticateExecution(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return oidc.authenticate(w, r)
+	}
+	token := wsTokenFromRequest(r)
+	if token == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "this WebSocket needs a token from POST /api/script/ws/token"})
+		return nil, false
+	}
+	id, err := redeemWSToken(token)
+	if err != nil {
+		debugf("WebSocket token rejected (request %s): %v", requestID(r), err)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "WebSocket token " + err.Error()})
+		return nil, false
+	}
+	return id, true
+}
@@ -1,7 +1,7 @@
 // This file handles the logic for the model info modal.
 
 // Import pipeline configuration
-import { PipelineConfig, PipelineExecutor } from './pipeline-config.js';
+import { PipelineConfig, PipelineExecutor, apiFetch } from './pipeline-config.js';
 
 // Global pipeline configuration instance
 let pipelineConfig = null;
@@ -54,6 +54,21 @@ function removeNotification(notification) {
 let activeModelPath = '';
 let models = []; // Store models at a higher scope
 
+// Button labels: the backend may serve the markup translated, so a button
+// goes back to the label it was served with rather than an English one
+function setLabel(element, text) {
+    if (element.dataset.servedLabel === undefined) {
+        element.dataset.servedLabel = element.textContent;
+    }
+    element.textContent = text;
+}
+
+function resetLabel(element) {
+    if (element.dataset.servedLabel !== undefined) {
+        element.textContent = element.dataset.servedLabel;
+    }
+}
+
 // Function to render the list of models
 function renderModelList() {
     const modelListContainer = document.getElementById('mt-model-list-container');
@@ -167,7 +182,7 @@ function renderModelList() {
                     event.target.disabled = true;
                     
                     // Load the model for testing via new API
-                    const loadResponse = await fetch('/api/model/load', {
+                    const loadResponse = await apiFetch('/api/model/load', {
                         method: 'POST',
                         headers: {
                             'Content-Type': 'application/json',
@@ -190,7 +205,7 @@ function renderModelList() {
                             
                             // Save the updated configuration
                             try {
-                                const response = await fetch('/api/pipeline/save', {
+                                const response = await apiFetch('/api/pipeline/save', {
                                     method: 'POST',
                                     headers: {
                                         'Content-Type': 'application/json',
@@ -255,7 +270,7 @@ function renderModelList() {
             button.addEventListener('click', async (event) => {
                 const modelPath = event.target.dataset.modelPath;
                 try {
-                    const response = await fetch(`/api/model/delete`, {
+                    const response = await apiFetch(`/api/model/delete`, {
                         method: 'POST',
                         headers: {
                             'Content-Type': 'application/json',
@@ -271,7 +286,7 @@ function renderModelList() {
                         window.addLogMessage(`Model ${modelPath} deleted: ${result.message}`);
                     }
                     // Fetch models again and re-render
-                    const modelsResponse = await fetch('/api/models');
+                    const modelsResponse = await apiFetch('/api/models');
                     models = await modelsResponse.json();
                     renderModelList();
                 } catch (error) {
@@ -309,7 +324,7 @@ async function initializePipelineConfig() {
         let configLoaded = false;
         
         try {
-            const serverResponse = await fetch('/api/pipeline/load');
+            const serverResponse = await apiFetch('/api/pipeline/load');
             if (serverResponse.ok) {
                 const serverConfig = await serverResponse.json();
                 if (serverConfig && serverConfig.pipeline) {
@@ -954,12 +969,12 @@ async function savePipelineConfiguration() {
         const saveBtn = document.getElementById('mt-save-pipeline-config-btn');
         const originalText = saveBtn ? saveBtn.textContent : '';
         if (saveBtn) {
-            saveBtn.textContent = 'Saving...';
+            setLabel(saveBtn, 'Saving...');
             saveBtn.disabled = true;
         }
 
         // Save configuration to server
-        const response = await fetch('/api/pipeline/save', {
+        const response = await apiFetch('/api/pipeline/save', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
@@ -995,7 +1010,7 @@ async function savePipelineConfiguration() {
         // Restore button state
         const saveBtn = document.getElementById('mt-save-pipeline-config-btn');
         if (saveBtn) {
-            saveBtn.textContent = 'Save Configuration';
+            resetLabel(saveBtn);
             saveBtn.disabled = false;
         }
     }
@@ -1243,7 +1258,7 @@ export async function openModal() {
         }
 
         // Fetch models
-        const modelsResponse = await fetch('/api/models');
+        const modelsResponse = await apiFetch('/api/models');
         if (!modelsResponse.ok) {
             throw new Error(`HTTP error fetching models! status: ${modelsResponse.status}`);
         }
@@ -1253,7 +1268,7 @@ export async function openModal() {
         let selectedModel = '';
         let backendHasLoadedModel = false;
         try {
-            const loadedModelResponse = await fetch('/api/model/loaded');
+            const loadedModelResponse = await apiFetch('/api/model/loaded');
             if (loadedModelResponse.ok) {
                 const loadedModelData = await loadedModelResponse.json();
                 if (loadedModelData.loaded && loadedModelData.model_path) {
@@ -1375,7 +1390,7 @@ document.addEventListener('DOMContentLoaded', () => {
                     }
                     
                     // Reset button state
-                    trainModelBtn.textContent = 'Train New Model';
+                    resetLabel(trainModelBtn);
                     trainModelBtn.classList.remove('cancel-mode');
                     trainModelBtn.disabled = false;
                     
@@ -1394,7 +1409,7 @@ document.addEventListener('DOMContentLoaded', () => {
                 }
                 
                 // Start training mode
-                trainModelBtn.textContent = 'Cancel Pipeline';
+                setLabel(trainModelBtn, 'Cancel Pipeline');
                 trainModelBtn.classList.add('cancel-mode');
                 trainModelBtn.disabled = false; // Keep enabled for cancellation
                 
@@ -1547,7 +1562,7 @@ document.addEventListener('DOMContentLoaded', () => {
                 if (progressSteps.train) progressSteps.train.classList.remove('active');
             } finally {
                 // Reset button state
-                trainModelBtn.textContent = 'Train New Model';
+                resetLabel(trainModelBtn);
                 trainModelBtn.classList.remove('cancel-mode');
                 trainModelBtn.disabled = false;
                 currentExecutor = null; // Clear executor reference
@@ -1620,7 +1635,7 @@ async function updateTestModelButtonState() {
     if (!testModelBtn) return;
     
     try {
-        const response = await fetch('/api/model/loaded');
+        const response = await apiFetch('/api/model/loaded');
         const data = await response.json();
         
         if (data.loaded) {
@@ -1646,7 +1661,7 @@ async function openTestModelModal() {
     
     // Check if a model is loaded
     try {
-        const response = await fetch('/api/model/loaded');
+        const response = await apiFetch('/api/model/loaded');
         const data = await response.json();
         
         if (!data.loaded) {
@@ -1721,7 +1736,7 @@ function resetTestModelForm() {
     const testBtn = document.getElementById('mt-run-test-btn');
     if (testBtn) {
         testBtn.disabled = true;
-        testBtn.textContent = 'Detect';
+        resetLabel(testBtn);
         testBtn.classList.remove('loading', 'reset');
     }
     
@@ -1737,7 +1752,7 @@ async function loadTestModelOptions() {
     if (!modelSelect) return;
     
     try {
-        const response = await fetch('/api/models');
+        const response = await apiFetch('/api/models');
         if (!response.ok) {
             throw new Error(`HTTP error! status: ${response.status}`);
         }
@@ -1817,7 +1832,7 @@ function setupTestModelEventListeners() {
 
 async function loadConfidenceThreshold() {
     try {
-        const response = await fetch('/api/pipeline/load');
+        const response = await apiFetch('/api/pipeline/load');
         if (!response.ok) {
             throw new Error(`HTTP error! status: ${response.status}`);
         }
@@ -1854,7 +1869,7 @@ async function saveConfidenceThreshold() {
     
     try {
         // Load current config
-        const response = await fetch('/api/pipeline/load');
+        const response = await apiFetch('/api/pipeline/load');
         if (!response.ok) {
             throw new Error(`HTTP error! status: ${response.status}`);
         }
@@ -1866,7 +1881,7 @@ async function saveConfidenceThreshold() {
         config.pipeline.confidence_threshold = value;
         
         // Save updated config
-        const saveResponse = await fetch('/api/pipeline/save', {
+        const saveResponse = await apiFetch('/api/pipeline/save', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json'
@@ -2006,7 +2021,7 @@ async function runModelTest() {
     
     // Update UI to show loading
     testBtn.classList.add('loading');
-    testBtn.textContent = 'Detecting...';
+    setLabel(testBtn, 'Detecting...');
     testBtn.disabled = true;
     
     try {
@@ -2019,7 +2034,7 @@ async function runModelTest() {
         formData.append('image', selectedFile);
         formData.append('confidence', confidence.toString());
         
-        const response = await fetch('/api/model/test', {
+        const response = await apiFetch('/api/model/test', {
             method: 'POST',
             body: formData
         });
@@ -2039,7 +2054,7 @@ async function runModelTest() {
         // Change button to reset mode
         testBtn.classList.remove('loading');
         testBtn.classList.add('reset');
-        testBtn.textContent = 'Reset';
+        setLabel(testBtn, 'Reset');
         testBtn.disabled = false;
         
     } catch (error) {
@@ -2055,7 +2070,7 @@ async function runModelTest() {
         
         // Reset button to original state on error
         testBtn.classList.remove('loading');
-        testBtn.textContent = 'Detect';
+        resetLabel(testBtn);
         testBtn.disabled = false;
     }
 }
@@ -2245,7 +2260,7 @@ async function initializeDatasetModal() {
             updateDatasetLoadingState(true);
             
             // Get dataset info
-            const response = await fetch(getDatasetApiUrl('info'));
+            const response = await apiFetch(getDatasetApiUrl('info'));
             const datasetInfo = await response.json();
             
             if (!datasetInfo.dataset_exists || datasetInfo.total_images === 0) {
@@ -2274,7 +2289,7 @@ async function loadDatasetPage(page) {
         
         updateDatasetLoadingState(true);
         
-        const response = await fetch(getDatasetApiUrl(`images?page=${page}&page_size=${datasetState.pageSize}`));
+        const response = await apiFetch(getDatasetApiUrl(`images?page=${page}&page_size=${datasetState.pageSize}`));
         const data = await response.json();
         
         datasetState.currentPage = page;
@@ -2532,7 +2547,7 @@ async function loadBoundingBoxZoom(imageName) {
         if (!zoomContainer || !zoomCanvas) return;
         
         // Load the labels for this image
-        const response = await fetch(getDatasetApiUrl(`image/${imageName}/labels`));
+        const response = await apiFetch(getDatasetApiUrl(`image/${imageName}/labels`));
         if (!response.ok) {
             hideBoundingBoxZoom();
             return;
@@ -2701,7 +2716,7 @@ async function deleteCurrentImage() {
     }
     
     try {
-        const response = await fetch(getDatasetApiUrl(`image/${currentImage.name}`), {
+        const response = await apiFetch(getDatasetApiUrl(`image/${currentImage.name}`), {
             method: 'DELETE'
         });
         
@@ -2747,7 +2762,7 @@ function setupDatasetModalEventListeners() {
                         // Reload synthetic dataset
                         try {
                             updateDatasetLoadingState(true);
-                            const response = await fetch(getDatasetApiUrl('info'));
+                            const response = await apiFetch(getDatasetApiUrl('info'));
                             const datasetInfo = await response.json();
                             
                             if (!datasetInfo.dataset_exists || datasetInfo.total_images === 0) {
@@ -2871,7 +2886,7 @@ function setupDatasetModalEventListeners() {
                 // Reload dataset with new source
                 try {
                     updateDatasetLoadingState(true);
-                    const response = await fetch(getDatasetApiUrl('info'));
+                    const response = await apiFetch(getDatasetApiUrl('info'));
                     const datasetInfo = await response.json();
                     
                     if (!datasetInfo.dataset_exists || datasetInfo.total_images === 0) {
@@ -2928,7 +2943,7 @@ async function loadCustomBackgrounds() {
     if (imageElement) imageElement.style.display = 'none';
     
     try {
-        const response = await fetch('/api/dataset/custom/backgrounds');
+        const response = await apiFetch('/api/dataset/custom/backgrounds');
         if (!response.ok) throw new Error('Failed to fetch backgrounds');
         
         const data = await response.json();
@@ -2961,7 +2976,7 @@ async function loadCustomTargets() {
     if (loadingElement) loadingElement.style.display = 'block';
     
     try {
-        const response = await fetch('/api/dataset/custom/targets');
+        const response = await apiFetch('/api/dataset/custom/targets');
         if (!response.ok) throw new Error('Failed to fetch targets');
         
         const data = await response.json();
@@ -3190,7 +3205,7 @@ async function deleteCurrentCustomBackground() {
     }
     
     try {
-        const response = await fetch(`/api/dataset/custom/backgrounds/${currentBackground.filename}`, {
+        const response = await apiFetch(`/api/dataset/custom/backgrounds/${currentBackground.filename}`, {
             method: 'DELETE'
         });
         
@@ -3236,7 +3251,7 @@ async function deleteCustomCursor(index) {
     }
     
     try {
-        const response = await fetch(`/api/dataset/custom/targets/${cursor.filename}`, {
+        const response = await apiFetch(`/api/dataset/custom/targets/${cursor.filename}`, {
             method: 'DELETE'
         });
         
@@ -3312,7 +3327,7 @@ async function generateCustomDataset() {
         showNotification(`Generating ${numImages} images with ${selectedTarget.filename}...`, 'info');
         
         // Make API call
-        const response = await fetch('/api/dataset/custom/generate', {
+        const response = await apiFetch('/api/dataset/custom/generate', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json'
@@ -3364,7 +3379,7 @@ function handleTargetUpload(event) {
     const formData = new FormData();
     formData.append('file', file);
 
-    fetch('/api/dataset/custom/upload/target', {
+    apiFetch('/api/dataset/custom/upload/target', {
         method: 'POST',
         body: formData
     })
@@ -3391,7 +3406,7 @@ function handleBackgroundUpload(event) {
     const formData = new FormData();
     formData.append('file', file);
 
-    fetch('/api/dataset/custom/upload/background', {
+    apiFetch('/api/dataset/custom/upload/background', {
         method: 'POST',
         body: formData
     })
@@ -1,3 +1,43 @@
+// Version of the backend API this frontend is written against (see /api/version)
+export const API_VERSION = 1;
+
+// When the backend uses login sessions it issues a CSRF token in the
+// training_csrf cookie, which state-changing requests must send back
+const CSRF_COOKIE = 'training_csrf';
+const SAFE_METHODS = ['GET', 'HEAD', 'OPTIONS'];
+
+// fetch for API calls, adding the CSRF header when there is a token
+export function apiFetch(url, options = {}) {
+    const method = (options.method || 'GET').toUpperCase();
+    const match = document.cookie.match(new RegExp('(?:^|; )' + CSRF_COOKIE + '=([^;]*)'));
+    if (match && !SAFE_METHODS.includes(method)) {
+        const headers = new Headers(options.headers || {});
+        headers.set('X-CSRF-Token', decodeURIComponent(match[1]));
+        options = { ...options, headers };
+    }
+    return fetch(url, options);
+}
+
+// A backend with login sessions only opens execution sockets with a one-time
+// token; without authentication the endpoint does not exist and none is needed
+async function fetchWebSocketToken() {
+    try {
+        const response = await apiFetch('/api/script/ws/token', { method: 'POST' });
+        if (!response.ok) {
+            return null;
+        }
+        return (await response.json()).token;
+    } catch (error) {
+        return null;
+    }
+}
+
+// Runs started and ended from the UI are announced as mt:run-started and
+// mt:run-completed events on window, for pages embedding the module
+function emitRunEvent(name, detail) {
+    window.dispatchEvent(new CustomEvent(`mt:${name}`, { detail }));
+}
+
 // Pipeline Configuration Manager
 export class PipelineConfig {
     constructor() {
@@ -355,7 +395,8 @@ export class PipelineExecutor {
         }
     }
 
-    executeScript(scriptPath, args) {
+    async executeScript(scriptPath, args) {
+        const token = await fetchWebSocketToken();
         return new Promise((resolve, reject) => {
             if (this.isCancelled) {
                 reject(new Error('Script execution cancelled'));
@@ -363,8 +404,13 @@ export class PipelineExecutor {
             }
             
             const wsProtocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-            const wsUrl = `${wsProtocol}//${window.location.host}/api/script/ws/execute`;
+            let wsUrl = `${wsProtocol}//${window.location.host}/api/script/ws/execute`;
+            if (token) {
+                wsUrl += `?token=${encodeURIComponent(token)}`;
+            }
             const socket = new WebSocket(wsUrl);
+            // Sample images and other files come as binary frames
+            socket.binaryType = 'blob';
             
             // Store reference to active socket for cancellation
             this.activeSocket = socket;
@@ -457,10 +503,89 @@ export class PipelineExecutor {
                 socket.send(JSON.stringify({ script_path: scriptPath, args: args }));
             };
 
-            socket.onmessage = (event) => {
-                const message = event.data;
+            // Backend request ID, shown with errors so a failed run can be traced in the logs
+            let requestId = null;
+            // Content type and name of the binary frame announced by the last BINARY_FRAME: line
+            let pendingFile = null;
+
+            // Run state from the server's STATUS: reports, shown above the log. A
+            // report overdue by two intervals means the connection is dead rather
+            // than the training quiet.
+            let statusDiv = null;
+            let lastStatus = null;
+            let lastStatusAt = 0;
+            const formatSeconds = (seconds) => {
+                const m = Math.floor(seconds / 60);
+                return m > 0 ? `${m}m ${seconds % 60}s` : `${seconds}s`;
+            };
+            const renderStatus = () => {
+                if (!lastStatus) {
+                    return;
+                }
+                if (!statusDiv) {
+                    statusDiv = document.createElement('div');
+                    statusDiv.style.fontSize = '0.9em';
+                    statusDiv.style.padding = '2px 4px';
+                    this.logContainer.parentNode.insertBefore(statusDiv, this.logContainer);
+                }
+                const overdue = (Date.now() - lastStatusAt) / 1000 > 2 * (lastStatus.interval_seconds || 15);
+                const parts = [];
+                if (overdue) {
+                    statusDiv.style.color = 'red';
+                    parts.push(`🔴 No status from the server for ${formatSeconds(Math.round((Date.now() - lastStatusAt) / 1000))}, the connection may be dead`);
+                } else if (lastStatus.upstream === 'reconnecting') {
+                    statusDiv.style.color = 'orange';
+                    parts.push('🟠 Reconnecting to the training service');
+                } else if (lastStatus.state !== 'running') {
+                    statusDiv.style.color = 'orange';
+                    parts.push(`🟡 ${lastStatus.state === 'queued' ? 'Queued' : 'Waiting to retry'}`);
+                } else {
+                    statusDiv.style.color = 'green';
+                    parts.push(lastStatus.upstream === 'connecting' ? '🟡 Starting' : '🟢 Running');
+                }
+                parts.push(formatSeconds(lastStatus.elapsed_seconds));
+                if (lastStatus.last_output_seconds !== undefined && lastStatus.state === 'running') {
+                    // Quiet for over a minute, e.g. while validating or saving a checkpoint
+                    const quiet = lastStatus.last_output_seconds >= 60 ? ' (training is quiet)' : '';
+                    parts.push(`last output ${formatSeconds(lastStatus.last_output_seconds)} ago${quiet}`);
+                }
+                statusDiv.textContent = parts.join(' · ');
+            };
+            const statusWatch = setInterval(renderStatus, 5000);
+
+            // Show a binary frame, as an image when it is one
+            const handleBinary = (blob) => {
+                const file = pendingFile || { type: 'application/octet-stream', name: 'file' };
+                pendingFile = null;
+                const typed = new Blob([blob], { type: file.type });
+                const fileDiv = document.createElement('div');
+                if (file.type.startsWith('image/')) {
+                    const img = document.createElement('img');
+                    img.src = URL.createObjectURL(typed);
+                    img.alt = file.name;
+                    img.title = file.name;
+                    img.style.maxWidth = '100%';
+                    img.style.maxHeight = '320px';
+                    img.style.display = 'block';
+                    fileDiv.appendChild(img);
+                } else {
+                    const link = document.createElement('a');
+                    link.href = URL.createObjectURL(typed);
+                    link.download = file.name;
+                    link.textContent = `📎 ${file.name} (${typed.size} bytes)`;
+                    fileDiv.appendChild(link);
+                }
+                this.logContainer.appendChild(fileDiv);
+                lastTrainingProgressDiv = null;
+                lastValidationProgressDiv = null;
+                this.logContainer.scrollTop = this.logContainer.scrollHeight;
+            };
 
-                if (message === 'EXECUTION_FINISHED') {
+            const handleMessage = (message) => {
+                if (message.startsWith('REQUEST_ID:')) {
+                    requestId = message.substring('REQUEST_ID:'.length).trim();
+                    emitRunEvent('run-started', { script: scriptPath, args, requestId });
+                } else if (message === 'EXECUTION_FINISHED') {
                     this.logContainer.innerHTML += `<div style="color: green;"><em>✅ Finished: ${scriptPath}</em></div><hr>`;
                     lastTrainingProgressDiv = null; // Reset progress tracking
                     lastValidationProgressDiv = null; // Reset progress tracking
@@ -469,12 +594,32 @@ export class PipelineExecutor {
                     executionCompleted = true;
                     socket.close(1000, 'Execution finished');
                 } else if (message.startsWith('EXECUTION_ERROR:')) {
-                    this.logContainer.innerHTML += `<div style="color: red; font-weight: bold;">❌ ${message}</div>`;
-                    console.error('Script execution error:', message);
+                    const requestNote = requestId ? ` (request ${requestId})` : '';
+                    this.logContainer.innerHTML += `<div style="color: red; font-weight: bold;">❌ ${message}${requestNote}</div>`;
+                    console.error('Script execution error:', message, requestNote);
                     lastTrainingProgressDiv = null; // Reset progress tracking
                     lastValidationProgressDiv = null; // Reset progress tracking
                     executionFailed = true;
                     socket.close(4000, 'Execution error');
+                } else if (message.startsWith('BINARY_FRAME:')) {
+                    // "BINARY_FRAME: <content-type> <size> <name>" announces the next binary frame
+                    const [type, , ...name] = message.substring('BINARY_FRAME:'.length).trim().split(' ');
+                    pendingFile = { type: type || 'application/octet-stream', name: name.join(' ') || 'file' };
+                } else if (message.startsWith('BINARY_DROPPED:')) {
+                    pendingFile = null;
+                    const droppedDiv = document.createElement('div');
+                    droppedDiv.style.color = 'orange';
+                    droppedDiv.textContent = `⚠️ ${message}`;
+                    this.logContainer.appendChild(droppedDiv);
+                } else if (message.startsWith('STATUS:')) {
+                    try {
+                        lastStatus = JSON.parse(message.substring('STATUS:'.length));
+                        lastStatusAt = Date.now();
+                        renderStatus();
+                    } catch (e) {
+                        console.warn('Invalid status report:', message);
+                    }
+                    return;
                 } else if (message.startsWith('HEARTBEAT:')) {
                     // Filter out heartbeat messages from display
                 } else if (message.startsWith('MEMORY_MONITOR:') || message.startsWith('MEMORY_ERROR:') || message.startsWith('MEMORY_FINAL:') || message.startsWith('MEMORY_INITIAL:')) {
@@ -506,6 +651,15 @@ export class PipelineExecutor {
                 this.logContainer.scrollTop = this.logContainer.scrollHeight;
             };
 
+            // The backend may batch log lines into one message, one per line
+            socket.onmessage = (event) => {
+                if (typeof event.data !== 'string') {
+                    handleBinary(event.data);
+                    return;
+                }
+                event.data.split('\n').forEach(handleMessage);
+            };
+
             socket.onerror = (error) => {
                 console.error('WebSocket error:', error);
                 this.logContainer.innerHTML += `<div style="color: orange;">⚠️ WebSocket connection error - script continues running on server...</div>`;
@@ -517,18 +671,29 @@ export class PipelineExecutor {
                 if (this.activeSocket === socket) {
                     this.activeSocket = null;
                 }
+                clearInterval(statusWatch);
+                if (statusDiv) {
+                    statusDiv.remove();
+                }
+                const completed = (status, error) => {
+                    emitRunEvent('run-completed', { script: scriptPath, args, requestId, status, error });
+                };
                 
                 if (event.code === 4001) {
                     // User cancelled execution
+                    completed('cancelled');
                     reject(new Error('Script execution was cancelled by user'));
                 } else if (event.code === 1000 && executionCompleted) {
+                    completed('finished');
                     resolve();
                 } else if (event.code === 1006 && executionCompleted) {
                     // Code 1006 (abnormal closure) but we already received EXECUTION_FINISHED
+                    completed('finished');
                     resolve();
                 } else if (event.code === 4000 || executionFailed) {
                     // Extract error message from the last EXECUTION_ERROR message
                     const errorMessage = event.reason || 'Script execution failed with unknown error';
+                    completed('failed', errorMessage);
                     reject(new Error(errorMessage));
                 } else {
                     // For any other disconnection, show a message but continue
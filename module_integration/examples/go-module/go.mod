@@ -1,7 +1,28 @@
+// Deprecated: the package moved to github.com/aikeymouse/model-training-module/trainingmodule
 module github.com/aikeymouse/model-training-module/module_integration/examples/go-module
 
-go 1.21
+go 1.23
 
-require github.com/gorilla/websocket v1.5.1
+require github.com/aikeymouse/model-training-module/trainingmodule v1.3.0
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/coder/websocket v1.8.12 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/prometheus/client_golang v1.19.1 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/otel v1.35.0 // indirect
+	go.opentelemetry.io/otel/metric v1.35.0 // indirect
+	go.opentelemetry.io/otel/trace v1.35.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
+
+// The forwarding packages build against the module in this repository
+replace github.com/aikeymouse/model-training-module/trainingmodule => ../../../trainingmodule
@@ -0,0 +1,69 @@
+//go:build !js
+
+// Package trainingmodule forwards to
+// github.com/aikeymouse/model-training-module/trainingmodule, where the
+// package moved in v1.2.0. Every identifier is an alias of the one there,
+// so values pass freely between code using either import path.
+//
+// Deprecated: import github.com/aikeymouse/model-training-module/trainingmodule
+// instead. This forwarding package is kept for one release and then removed.
+package trainingmodule
+
+import tm "github.com/aikeymouse/model-training-module/trainingmodule"
+
+// Types
+type (
+	Client            = tm.Client
+	Compatibility     = tm.Compatibility
+	Config            = tm.Config
+	DependencyStatus  = tm.DependencyStatus
+	ErrUpstreamStatus = tm.ErrUpstreamStatus
+	HealthStatus      = tm.HealthStatus
+	PatternStyle      = tm.PatternStyle
+	Route             = tm.Route
+	TransportConfig   = tm.TransportConfig
+	WSConn            = tm.WSConn
+	WSDirection       = tm.WSDirection
+	WSOptions         = tm.WSOptions
+	WebSocket         = tm.WebSocket
+)
+
+// Constants
+const (
+	APIVersion                 = tm.APIVersion
+	BackendToClient            = tm.BackendToClient
+	BinaryMessage              = tm.BinaryMessage
+	ClientToBackend            = tm.ClientToBackend
+	DefaultDialTimeout         = tm.DefaultDialTimeout
+	DefaultFlushInterval       = tm.DefaultFlushInterval
+	DefaultIdleConnTimeout     = tm.DefaultIdleConnTimeout
+	DefaultMaxIdleConnsPerHost = tm.DefaultMaxIdleConnsPerHost
+	DefaultModalCacheTTL       = tm.DefaultModalCacheTTL
+	DefaultPathPrefix          = tm.DefaultPathPrefix
+	DefaultTLSHandshakeTimeout = tm.DefaultTLSHandshakeTimeout
+	DependencyDegraded         = tm.DependencyDegraded
+	DependencyDisabled         = tm.DependencyDisabled
+	DependencyDown             = tm.DependencyDown
+	DependencyOK               = tm.DependencyOK
+	RequestIDHeader            = tm.RequestIDHeader
+	TextMessage                = tm.TextMessage
+)
+
+// Errors and route pattern styles; the errors are the same values, so
+// errors.Is matches across both import paths
+var (
+	ErrIncompatible       = tm.ErrIncompatible
+	ErrModalNotFound      = tm.ErrModalNotFound
+	ErrNoWebSocket        = tm.ErrNoWebSocket
+	ErrNotFound           = tm.ErrNotFound
+	ErrServiceUnavailable = tm.ErrServiceUnavailable
+
+	GinStyle      = tm.GinStyle
+	ServeMuxStyle = tm.ServeMuxStyle
+	WildcardStyle = tm.WildcardStyle
+)
+
+// TrainingModuleClient creates a client, see tm.TrainingModuleClient
+func TrainingModuleClient(config Config) *Client {
+	return tm.TrainingModuleClient(config)
+}
@@ -0,0 +1,29 @@
+// Package trainingmoduletest forwards to
+// github.com/aikeymouse/model-training-module/trainingmodule/trainingmoduletest.
+//
+// Deprecated: import github.com/aikeymouse/model-training-module/trainingmodule/trainingmoduletest
+// instead. This forwarding package is kept for one release and then removed.
+package trainingmoduletest
+
+import tmt "github.com/aikeymouse/model-training-module/trainingmodule/trainingmoduletest"
+
+// Types
+type (
+	Model  = tmt.Model
+	Run    = tmt.Run
+	Server = tmt.Server
+)
+
+// Canned answers of a new server, copied from tmt at startup; NewServer
+// reads tmt's, so change them there
+var (
+	DefaultModalHTML      = tmt.DefaultModalHTML
+	DefaultModels         = tmt.DefaultModels
+	DefaultPipelineConfig = tmt.DefaultPipelineConfig
+	DefaultRunScript      = tmt.DefaultRunScript
+)
+
+// NewServer starts a fake training backend, see tmt.NewServer
+func NewServer() *Server {
+	return tmt.NewServer()
+}
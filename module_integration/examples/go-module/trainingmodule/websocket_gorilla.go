@@ -0,0 +1,10 @@
+//go:build !trainingmodule_nogorilla && !js
+
+package trainingmodule
+
+import tm "github.com/aikeymouse/model-training-module/trainingmodule"
+
+// GorillaWebSocket proxies with gorilla/websocket, see tm.GorillaWebSocket
+func GorillaWebSocket() WebSocket {
+	return tm.GorillaWebSocket()
+}
@@ -0,0 +1,18 @@
+//go:build !js
+
+// Package wscoder forwards to
+// github.com/aikeymouse/model-training-module/trainingmodule/wscoder.
+//
+// Deprecated: import github.com/aikeymouse/model-training-module/trainingmodule/wscoder
+// instead. This forwarding package is kept for one release and then removed.
+package wscoder
+
+import (
+	"github.com/aikeymouse/model-training-module/module_integration/examples/go-module/trainingmodule"
+	"github.com/aikeymouse/model-training-module/trainingmodule/wscoder"
+)
+
+// New proxies with coder/websocket, see wscoder.New
+func New() trainingmodule.WebSocket {
+	return wscoder.New()
+}
@@ -12,12 +12,14 @@ import random
 import shutil
 from PIL import Image
 import numpy as np
-from fastapi import FastAPI, BackgroundTasks, HTTPException, WebSocket, File, UploadFile, Form
+from fastapi import FastAPI, Request, BackgroundTasks, HTTPException, WebSocket, File, UploadFile, Form
 from fastapi.responses import JSONResponse, FileResponse, StreamingResponse
 from pydantic import BaseModel
 import subprocess
 import datetime
 import json
+import mimetypes
+from collections import deque
 from contextlib import asynccontextmanager
 
 # Optional import - YOLO might not be available during development
@@ -39,17 +41,48 @@ async def lifespan(app: FastAPI):
 
 app = FastAPI(lifespan=lifespan)
 
+@app.middleware("http")
+async def request_id_middleware(request: Request, call_next):
+    """Echo the X-Request-ID set by the Go backend and log it with failed requests"""
+    request_id = request.headers.get("x-request-id") or str(uuid.uuid4())
+    response = await call_next(request)
+    response.headers["X-Request-ID"] = request_id
+    if response.status_code >= 400:
+        print(f"[{request_id}] {request.method} {request.url.path} -> {response.status_code}")
+    return response
+
+# Service version and the version of the HTTP/WebSocket API it implements
+SERVICE_VERSION = os.getenv("SERVICE_VERSION", "1.1.0")
+API_VERSION = 1
+
+# Largest file a script may send as a binary frame with SEND_FILE:; keep it
+# at most the backend's WS_MAX_BINARY_SIZE
+MAX_BINARY_SIZE = int(os.getenv("MAX_BINARY_SIZE", str(8 << 20)))
+
 MODELS_DIR = "models"
 LOGS_DIR = "logs"
 os.makedirs(MODELS_DIR, exist_ok=True)
 os.makedirs(LOGS_DIR, exist_ok=True)
 
+# Each backend run gets RUNS_DIR/<run_id> for its output, passed to the script
+# as RUN_OUTPUT_DIR; the backend serves it as /api/runs/{id}/files
+RUNS_DIR = os.getenv("RUNS_DIR", "runs")
+os.makedirs(RUNS_DIR, exist_ok=True)
+
 # In-memory tracking of training tasks
 tasks = {}
 
 # Track active processes for cancellation
 active_processes = {}
 
+# How long a resumable run keeps going without a backend connection, waiting
+# for it to re-attach, and how many of its messages are kept for that
+RESUME_GRACE_SECONDS = float(os.getenv("RESUME_GRACE_SECONDS", "120"))
+RESUME_BUFFER_MESSAGES = int(os.getenv("RESUME_BUFFER_MESSAGES", "10000"))
+
+# Resumable runs by the backend's run ID, see RunChannel
+resumable_runs = {}
+
 # Global model instance for testing
 loaded_model = None
 loaded_model_path = None
@@ -344,6 +377,14 @@ async def execute_script(req: ExecuteScriptRequest, background_tasks: Background
     
     return JSONResponse(status_code=202, content={"message": "Script execution started", "task_id": task_id})
 
+def run_output_dir(run_id: str):
+    """Create the output directory of a backend run, None for an invalid ID"""
+    if not run_id or not all(c.isalnum() or c in "-_" for c in run_id):
+        return None
+    path = os.path.abspath(os.path.join(RUNS_DIR, run_id))
+    os.makedirs(path, exist_ok=True)
+    return path
+
 def run_script_execution(task_id: str, log_path: str, script: str, args: list):
     """
     Execute a Python script with arguments and capture output directly in the container.
@@ -447,6 +488,127 @@ def finalize_pipeline_log(success: bool = True):
     finally:
         pipeline_log_active = False
 
+class RunChannel:
+    """The execution WebSocket of a run, as seen by the code that runs it.
+
+    Every message sent is numbered from 1 and the last RESUME_BUFFER_MESSAGES
+    are kept. For a resumable run (the backend sends "resumable" and its
+    "run_id") a dropped connection does not cancel the script: messages are
+    kept while it is detached, and the backend re-attaches through
+    /api/script/ws/attach/{run_id}?after=<n> within RESUME_GRACE_SECONDS to
+    get the ones after the last it received. Otherwise failures are raised,
+    so the run is cancelled as before.
+    """
+
+    def __init__(self, websocket):
+        self.websocket = websocket
+        self.run_id = None
+        self.resumable = False
+        self.sent = 0
+        self.buffer = deque(maxlen=RESUME_BUFFER_MESSAGES)
+        self.detached_at = None
+        self.done = asyncio.Event()
+        self.lock = asyncio.Lock()
+
+    def make_resumable(self, run_id):
+        self.run_id = run_id
+        self.resumable = True
+        resumable_runs[run_id] = self
+
+    async def _send(self, kind, payload):
+        async with self.lock:
+            await self._send_locked(kind, payload)
+
+    async def _send_locked(self, kind, payload):
+        self.sent += 1
+        self.buffer.append((self.sent, kind, payload))
+        if self.websocket is None:
+            if not self.resumable:
+                raise ConnectionError("WebSocket connection lost")
+            return
+        try:
+            if kind == "bytes":
+                await self.websocket.send_bytes(payload)
+            else:
+                await self.websocket.send_text(payload)
+        except Exception:
+            if not self.resumable:
+                raise
+            self._detach()
+
+    async def send_text(self, message: str):
+        await self._send("text", message)
+
+    async def send_bytes(self, data: bytes):
+        await self._send("bytes", data)
+
+    async def send_binary_frame(self, header: str, data: bytes):
+        """Send a BINARY_FRAME: header and its binary frame, with no message
+        of the memory monitor or heartbeat between them"""
+        async with self.lock:
+            await self._send_locked("text", header)
+            await self._send_locked("bytes", data)
+
+    def _detach(self):
+        if self.websocket is not None:
+            self.websocket = None
+            self.detached_at = time.time()
+            log_pipeline_message("Backend connection lost - waiting for it to re-attach")
+
+    async def receive_text(self):
+        """Receive from the backend. While detached this times out at once,
+        until the grace period is over."""
+        websocket = self.websocket
+        if websocket is None:
+            if time.time() - self.detached_at > RESUME_GRACE_SECONDS:
+                raise ConnectionError("backend did not re-attach")
+            raise asyncio.TimeoutError()
+        try:
+            return await websocket.receive_text()
+        except (asyncio.TimeoutError, asyncio.CancelledError):
+            raise
+        except Exception:
+            if not self.resumable:
+                raise
+            async with self.lock:
+                if self.websocket is websocket:
+                    self._detach()
+            raise asyncio.TimeoutError()
+
+    async def attach(self, websocket, after: int):
+        """Replay the messages after the given one on a new connection and
+        send further ones to it"""
+        async with self.lock:
+            missed = [m for m in self.buffer if m[0] > after]
+            first = missed[0][0] if missed else self.sent + 1
+            # Not counted: tells the backend whether messages were lost
+            await websocket.send_text(f"RESUMED: {first}")
+            for _, kind, payload in missed:
+                if kind == "bytes":
+                    await websocket.send_bytes(payload)
+                else:
+                    await websocket.send_text(payload)
+            if self.websocket is not None:
+                try:
+                    await self.websocket.close()
+                except Exception:
+                    pass
+            self.websocket = websocket
+            self.detached_at = None
+        log_pipeline_message(f"Backend re-attached, {len(missed)} messages replayed")
+
+    async def close(self):
+        """End the run. A resumable run that is detached can still be
+        attached for RESUME_GRACE_SECONDS to collect its last messages."""
+        self.done.set()
+        if self.resumable:
+            asyncio.get_running_loop().call_later(RESUME_GRACE_SECONDS, resumable_runs.pop, self.run_id, None)
+        if self.websocket is not None:
+            try:
+                await self.websocket.close()
+            except Exception:
+                pass
+
 async def send_and_log(websocket, message: str):
     """Send message to WebSocket and log it to pipeline log"""
     try:
@@ -457,6 +619,31 @@ async def send_and_log(websocket, message: str):
         log_pipeline_message(message)
         raise
 
+async def send_output_line(websocket, line: str):
+    """Send a line of script output. A "SEND_FILE: <path>" line sends the file
+    as a binary frame, announced by a "BINARY_FRAME: <type> <size> <name>" line,
+    so scripts can show sample predictions without base64 inflation."""
+    if not line.startswith("SEND_FILE:"):
+        await send_and_log(websocket, line)
+        return
+    path = line[len("SEND_FILE:"):].strip()
+    try:
+        size = os.path.getsize(path)
+        if size > MAX_BINARY_SIZE:
+            await send_and_log(websocket, f"BINARY_DROPPED: {os.path.basename(path)} is {size} bytes, over MAX_BINARY_SIZE")
+            return
+        with open(path, "rb") as f:
+            data = f.read()
+    except OSError as e:
+        await send_and_log(websocket, f"BINARY_DROPPED: {e}")
+        return
+    content_type = mimetypes.guess_type(path)[0] or "application/octet-stream"
+    header = f"BINARY_FRAME: {content_type} {len(data)} {os.path.basename(path)}"
+    try:
+        await websocket.send_binary_frame(header, data)
+    finally:
+        log_pipeline_message(header)
+
 def get_memory_status():
     """Get current memory status and training process info"""
     try:
@@ -546,14 +733,18 @@ async def memory_monitoring_task(websocket, stop_event):
                 pass
 
 @app.websocket("/api/script/ws/execute")
-async def websocket_execute_script(websocket: WebSocket):
-    await websocket.accept()
+async def websocket_execute_script(connection: WebSocket):
+    await connection.accept()
+    # Messages go through the run's channel, which outlives the connection
+    # for resumable runs
+    websocket = RunChannel(connection)
     
     # Create stop event for memory monitoring
     memory_stop_event = asyncio.Event()
     memory_task = None
     process = None
     session_id = str(uuid.uuid4())
+    request_id = websocket.headers.get("x-request-id", session_id)
     
     try:
         # Initialize pipeline log on first connection (start of pipeline)
@@ -566,6 +757,15 @@ async def websocket_execute_script(websocket: WebSocket):
         request_data = json.loads(data)
         script_path = request_data.get('script_path')
         args = request_data.get('args', [])
+        # Secrets injected by the backend; never log these
+        extra_env = {str(k): str(v) for k, v in (request_data.get('env') or {}).items()}
+        print(f"[{request_id}] Execution request: {script_path}")
+        if request_data.get('resumable') and request_data.get('run_id'):
+            websocket.make_resumable(str(request_data['run_id']))
+        output_dir = run_output_dir(str(request_data.get('run_id') or ''))
+        if output_dir:
+            extra_env["RUN_ID"] = str(request_data['run_id'])
+            extra_env["RUN_OUTPUT_DIR"] = output_dir
         
         if not script_path:
             await send_and_log(websocket, "EXECUTION_ERROR: No script path provided")
@@ -593,7 +793,8 @@ async def websocket_execute_script(websocket: WebSocket):
                 cmd,
                 stdout=slave,
                 stderr=slave,
-                stdin=slave
+                stdin=slave,
+                env={**os.environ, **extra_env}
             )
             
             # Store process reference for potential cancellation
@@ -619,7 +820,8 @@ async def websocket_execute_script(websocket: WebSocket):
                 except asyncio.TimeoutError:
                     pass  # No message received, continue
                 except Exception:
-                    # WebSocket connection lost
+                    # WebSocket connection lost, and not re-attached in time
+                    # for a resumable run
                     cancelled = True
                     log_pipeline_message("WebSocket connection lost - treating as cancellation")
                     break
@@ -634,7 +836,7 @@ async def websocket_execute_script(websocket: WebSocket):
                                 for line in lines.split('\n'):
                                     if line.strip():
                                         try:
-                                            await send_and_log(websocket, line.strip())
+                                            await send_output_line(websocket, line.strip())
                                         except:
                                             # Connection lost, but continue process and logging
                                             log_pipeline_message(line.strip())
@@ -692,7 +894,7 @@ async def websocket_execute_script(websocket: WebSocket):
                                 for line in lines.split('\n'):
                                     if line.strip():
                                         try:
-                                            await send_and_log(websocket, line.strip())
+                                            await send_output_line(websocket, line.strip())
                                         except:
                                             # Connection lost, just log but continue
                                             log_pipeline_message(line.strip())
@@ -718,7 +920,7 @@ async def websocket_execute_script(websocket: WebSocket):
                     log_pipeline_message(f"MEMORY_FINAL: Container {final_mem['container_memory_gb']}GB/{final_mem['container_total_gb']}GB ({final_mem['container_percent']}%) - Execution completed")
             
             # Log completion regardless of WebSocket status
-            print(f"Process completed: {script_path}, exit code: {return_code}")
+            print(f"[{request_id}] Process completed: {script_path}, exit code: {return_code}")
             
             # Try to send completion message, but don't fail if connection is lost
             try:
@@ -790,6 +992,29 @@ async def websocket_execute_script(websocket: WebSocket):
         except:
             pass
 
+@app.websocket("/api/script/ws/attach/{run_id}")
+async def websocket_attach_run(websocket: WebSocket, run_id: str, after: int = 0):
+    """Re-attach the backend to a resumable run whose connection dropped. The
+    first message is "RESUMED: <n>", the number of the first message that
+    follows; a gap after `after` means messages were lost."""
+    channel = resumable_runs.get(run_id)
+    if channel is None:
+        # Refused before the handshake, so the backend stops trying
+        await websocket.close(code=1008)
+        return
+    await websocket.accept()
+    await channel.attach(websocket, after)
+    await channel.done.wait()
+    try:
+        await websocket.close()
+    except Exception:
+        pass
+
+@app.get("/api/version")
+async def get_version():
+    """Report the service version and the API version it implements"""
+    return {"version": SERVICE_VERSION, "api_version": API_VERSION}
+
 @app.get("/api/process/active")
 async def get_active_processes():
     """Get information about currently active processes"""
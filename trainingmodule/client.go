@@ -0,0 +1,245 @@
+// Package trainingmodule provides easy integration with the Model Training Module
+// for Go applications. It handles API proxying, WebSocket connections, and
+// provides a simple interface to embed training capabilities.
+package trainingmodule
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPathPrefix is where the training module's assets and routes are mounted
+	DefaultPathPrefix = "/model-training"
+	// DefaultFlushInterval is how long proxied bytes of a fixed-length response
+	// may sit in the server's write buffer before being flushed to the client
+	DefaultFlushInterval = 100 * time.Millisecond
+	// DefaultModalCacheTTL is how long LoadModalHTML reuses a fetched copy
+	DefaultModalCacheTTL = 5 * time.Minute
+)
+
+// Client represents a training module integration client
+type Client struct {
+	// ServiceURL is the first backend of Config.ServiceURLs
+	ServiceURL string
+	// backends tracks which of the backends are up
+	backends *backendPool
+	// websocket proxies the execution WebSocket; nil when none is available
+	websocket WebSocket
+	wsOptions WSOptions
+	// httpClient has no timeout of its own; requests are bounded by their
+	// context, see callContext
+	httpClient *http.Client
+	prefix     string
+	noCompat   bool
+	config     Config
+	// instruments of the proxy; empty in js/wasm builds
+	instruments
+
+	modalMu       sync.Mutex
+	modalHTML     string
+	modalLoadedAt time.Time
+	modalTTL      time.Duration
+}
+
+// Config holds configuration options for the training module client
+type Config struct {
+	ServiceURL string
+	// ServiceURLs are backend replicas in order of preference, used in place
+	// of ServiceURL. Requests go to the first one that is up; see
+	// HealthCheckInterval and StickyWebSockets.
+	ServiceURLs []string
+	// HealthCheckInterval is how often a backend of ServiceURLs that could
+	// not be reached is probed on /health to bring it back (default 10s)
+	HealthCheckInterval time.Duration
+	// StickyWebSockets sends a browser's execution WebSocket back to the
+	// backend it used before, remembered in a cookie, and keeps Subscribe on
+	// the backend it started on, while that backend is up. Use it when
+	// replicas do not share their runs.
+	StickyWebSockets bool
+	AllowAllOrigins  bool
+	// DefaultTimeout bounds short calls to the backend, such as CheckHealth,
+	// ListModels or the modal, unless WithTimeout sets another (default 10s;
+	// negative for none). Transfers and streams are only bounded by
+	// WithTimeout and their context.
+	DefaultTimeout time.Duration
+	// ModalCacheTTL is how long LoadModalHTML reuses a fetched copy (default 5m)
+	ModalCacheTTL time.Duration
+	// PathPrefix is where routes and assets are mounted (default "/model-training").
+	// URLs inside the served JavaScript and HTML are rewritten to use it.
+	PathPrefix string
+	// DisableCompatRoutes keeps RegisterAssetProxies from registering the
+	// un-prefixed /api/* and /config/* routes, so they do not collide with the
+	// host application's own. Call RegisterCompatRoutes to add them explicitly.
+	DisableCompatRoutes bool
+	// Locale forces the language of the UI, e.g. "de". It is sent as
+	// Accept-Language on every request to the backend, in place of the
+	// browser's. Empty leaves the choice to the browser; LoadModalHTML then
+	// gets the backend's UI_LOCALE.
+	Locale string
+	// PrepareRequest is called on every request sent to the training backend
+	// (proxied calls, health checks, modal loads and WebSocket dials), e.g. to
+	// attach service-to-service auth headers or a tenant ID
+	PrepareRequest func(*http.Request)
+	// TLSConfig is used for https:// and wss:// connections to the backend,
+	// e.g. to present a client certificate for mTLS
+	TLSConfig *tls.Config
+	// Transport tunes the pooled connections to the backend, shared by
+	// proxied calls, health checks and modal loads
+	Transport TransportConfig
+	// FlushInterval is how often a proxied response with a Content-Length is
+	// flushed to the caller while it is copied (default 100ms). Responses
+	// without one, such as chunked downloads, NDJSON progress or event
+	// streams, are flushed after every write; a negative value does that for
+	// all responses.
+	FlushInterval time.Duration
+	// WSCompression negotiates permessage-deflate with the browser and with
+	// the backend, which must set WS_COMPRESSION=true for its leg. Verbose
+	// training logs shrink several times over at some CPU cost; off by default.
+	WSCompression bool
+	// WSMaxMessageSize is the largest execution WebSocket message relayed in
+	// either direction, such as a sample image the backend sends as a binary
+	// frame; a larger one closes the connection (1009, message too big). Zero
+	// for no limit; keep it at least the backend's WS_MAX_BINARY_SIZE.
+	WSMaxMessageSize int64
+	// WebSocket is the library the execution WebSocket is proxied with:
+	// GorillaWebSocket (the default) or wscoder.New() for coder/websocket
+	WebSocket WebSocket
+
+	// TrustedProxies are the load balancers or ingresses in front of the host
+	// app whose X-Forwarded-* and Forwarded headers are passed on to the
+	// backend. Those headers from other clients are replaced, so they cannot
+	// spoof their address. Example: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	TrustedProxies []netip.Prefix
+
+	// OnProxyRequest sees every request before it is proxied to the backend,
+	// including WebSocket handshakes. It may log or modify the request;
+	// returning an error rejects it (403, or the error's StatusCode() if it has one).
+	OnProxyRequest func(r *http.Request) error
+	// OnProxyResponse sees every backend response before it is copied to the
+	// caller, e.g. to strip internal headers. Returning an error answers 502.
+	OnProxyResponse func(resp *http.Response) error
+	// OnWSMessage sees every execution WebSocket message and returns the
+	// message to forward; keep=false drops it. Log lines batched by the
+	// backend arrive as one message, separated by newlines.
+	OnWSMessage func(dir WSDirection, messageType int, data []byte) (out []byte, keep bool)
+}
+
+// TrainingModuleClient creates a new training module integration client
+func TrainingModuleClient(config Config) *Client {
+	if len(config.ServiceURLs) == 0 {
+		if config.ServiceURL == "" {
+			config.ServiceURL = "http://localhost:3000"
+		}
+		config.ServiceURLs = []string{config.ServiceURL}
+	}
+	urls := make([]string, len(config.ServiceURLs))
+	for i, u := range config.ServiceURLs {
+		urls[i] = strings.TrimRight(u, "/")
+	}
+	config.ServiceURL = urls[0]
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if config.DefaultTimeout == 0 {
+		config.DefaultTimeout = DefaultCallTimeout
+	}
+	if config.ModalCacheTTL == 0 {
+		config.ModalCacheTTL = DefaultModalCacheTTL
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+	prefix := "/" + strings.Trim(config.PathPrefix, "/")
+	if prefix == "/" {
+		prefix = DefaultPathPrefix
+	}
+
+	ws := config.WebSocket
+	if ws == nil && defaultWebSocket != nil {
+		ws = defaultWebSocket()
+	}
+
+	transport := newTransport(config.Transport, config.TLSConfig)
+	// Probes go straight to their backend, without failing over
+	probeClient := &http.Client{Timeout: 5 * time.Second, Transport: transport}
+	backends := newBackendPool(urls, config.HealthCheckInterval, func(base string) bool {
+		req, err := http.NewRequest(http.MethodGet, base+"/health", nil)
+		if err != nil {
+			return false
+		}
+		if config.PrepareRequest != nil {
+			config.PrepareRequest(req)
+		}
+		resp, err := probeClient.Do(req)
+		if err != nil {
+			return false
+		}
+		defer discardBody(resp)
+		return resp.StatusCode == http.StatusOK
+	})
+	var roundTripper http.RoundTripper = transport
+	if len(urls) > 1 {
+		roundTripper = &failoverTransport{next: transport, pool: backends}
+	}
+
+	return &Client{
+		ServiceURL: config.ServiceURL,
+		backends:   backends,
+		websocket:  ws,
+		wsOptions: WSOptions{
+			AllowAllOrigins: config.AllowAllOrigins,
+			Compression:     config.WSCompression,
+			TLSConfig:       config.TLSConfig,
+			ReadLimit:       config.WSMaxMessageSize,
+		},
+		httpClient:  &http.Client{Transport: roundTripper},
+		modalTTL:    config.ModalCacheTTL,
+		prefix:      prefix,
+		noCompat:    config.DisableCompatRoutes,
+		config:      config,
+		instruments: newInstruments(),
+	}
+}
+
+// newUpstreamRequest builds a request to the training backend with
+// Config.PrepareRequest applied
+func (c *Client) newUpstreamRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	c.prepare(req)
+	return req, nil
+}
+
+// wsURL returns the WebSocket URL of a path on a backend
+func (c *Client) wsURL(base, path string) string {
+	backendURL := base
+	if strings.HasPrefix(backendURL, "http://") {
+		backendURL = strings.Replace(backendURL, "http://", "ws://", 1)
+	} else if strings.HasPrefix(backendURL, "https://") {
+		backendURL = strings.Replace(backendURL, "https://", "wss://", 1)
+	} else {
+		// If no protocol, assume ws://
+		backendURL = "ws://" + backendURL
+	}
+	return backendURL + path
+}
+
+// prepare sets Config.Locale and runs Config.PrepareRequest, after any
+// headers copied from the incoming request so the hook has the last word
+func (c *Client) prepare(req *http.Request) {
+	if c.config.Locale != "" {
+		req.Header.Set("Accept-Language", c.config.Locale)
+	}
+	if c.config.PrepareRequest != nil {
+		c.config.PrepareRequest(req)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build js
+
+package trainingmodule
+
+// In js/wasm builds, for Go frontends running in the browser, the client has
+// only its typed API: there is no proxy to instrument, and the browser's
+// fetch and WebSocket reach the backend. Config.WebSocket must be set, e.g.
+// to wscoder.New(), for Subscribe.
+
+type instruments struct{}
+
+func newInstruments() instruments {
+	return instruments{}
+}
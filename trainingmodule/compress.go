@@ -0,0 +1,123 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"compress/gzip"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// compressibleAssets are the asset types gzipped when the backend sent them uncompressed
+var compressibleAssets = map[string]bool{
+	".css": true, ".js": true, ".json": true, ".html": true, ".svg": true, ".map": true,
+}
+
+// gzipResponseWriter compresses a proxied asset on the fly unless the backend
+// already encoded it. ETag, Cache-Control and 304 responses pass through.
+// It also fills in a Content-Type the backend left out.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz   *gzip.Writer
+	name string
+	// sniff holds back the status of a response without a known type until
+	// the first write, whose bytes decide the type
+	sniff       int
+	wroteHeader bool
+}
+
+// newAssetWriter wraps w with gzip when the client accepts it and the asset is text
+func newAssetWriter(w http.ResponseWriter, r *http.Request) *gzipResponseWriter {
+	aw := &gzipResponseWriter{ResponseWriter: w, name: r.URL.Path}
+	if compressibleAssets[path.Ext(r.URL.Path)] && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		aw.gz = gzip.NewWriter(w)
+	}
+	return aw
+}
+
+func (aw *gzipResponseWriter) WriteHeader(status int) {
+	if aw.wroteHeader || aw.sniff != 0 {
+		return
+	}
+	if status == http.StatusOK && aw.Header().Get("Content-Type") == "" {
+		if t := assetContentType(aw.name); t != "" {
+			aw.Header().Set("Content-Type", t)
+		} else {
+			aw.sniff = status
+			return
+		}
+	}
+	aw.writeHeader(status)
+}
+
+func (aw *gzipResponseWriter) writeHeader(status int) {
+	aw.wroteHeader = true
+	h := aw.Header()
+	if aw.gz != nil {
+		if status != http.StatusOK || h.Get("Content-Encoding") != "" {
+			aw.gz = nil
+		} else {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			h.Add("Vary", "Accept-Encoding")
+			// The encoded body differs from the one the backend hashed
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !aw.wroteHeader && aw.sniff == 0 {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.sniff != 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		aw.Header().Set("Content-Type", http.DetectContentType(p))
+		status := aw.sniff
+		aw.sniff = 0
+		aw.writeHeader(status)
+	}
+	if aw.gz != nil {
+		return aw.gz.Write(p)
+	}
+	return aw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been compressed so far, so streamed assets are not
+// held back by the gzip writer
+func (aw *gzipResponseWriter) Flush() {
+	if aw.sniff != 0 {
+		// Nothing to send before the type is known
+		return
+	}
+	if aw.gz != nil {
+		aw.gz.Flush()
+	}
+	http.NewResponseController(aw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (aw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// Close flushes the gzip stream, if any, and sends the header of an empty
+// response still waiting for its type
+func (aw *gzipResponseWriter) Close() error {
+	if aw.sniff != 0 {
+		status := aw.sniff
+		aw.sniff = 0
+		aw.gz = nil
+		aw.writeHeader(status)
+	}
+	if aw.gz != nil {
+		return aw.gz.Close()
+	}
+	return nil
+}
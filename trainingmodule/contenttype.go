@@ -0,0 +1,39 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// Proxied assets keep the backend's Content-Type. When it sent none, the type
+// comes from the file extension, and failing that from sniffing the body.
+
+// assetTypes are types missing from the system MIME tables on some hosts
+var assetTypes = map[string]string{
+	".js":    "text/javascript; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".map":   "application/json",
+	".wasm":  "application/wasm",
+	".svg":   "image/svg+xml",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".ico":   "image/x-icon",
+}
+
+// assetContentType returns the type of an asset by its extension, empty
+// when it is not known
+func assetContentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := assetTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,173 @@
+package trainingmodule
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DownloadOptions tune DownloadModel
+type DownloadOptions struct {
+	// Offset is how many bytes of the weights the writer already holds from
+	// an earlier attempt; the download goes on after them
+	Offset int64
+	// Progress is told the bytes written so far, Offset included
+	Progress ProgressFunc
+	// SkipVerify leaves out the SHA-256 check, for backends that keep no
+	// checksums
+	SkipVerify bool
+}
+
+// modelInfo is what DownloadModel needs of /api/model/{id}/info
+type modelInfo struct {
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	SHA256     string    `json:"sha256"`
+}
+
+// DownloadModel writes the weights of a model to w and checks them against
+// the SHA-256 in the backend's checksum manifest, returning an error matching
+// ErrChecksumMismatch when they differ. A connection that drops is resumed
+// with a Range request, up to three times in a row. To resume an earlier
+// download, set opts.Offset to the bytes w already holds; with verification
+// w must then be an io.ReaderAt, such as the *os.File being written, so those
+// bytes are hashed too. Unknown models give an error matching ErrNotFound.
+func (c *Client) DownloadModel(ctx context.Context, id string, w io.Writer, opts DownloadOptions) error {
+	ctx, cancel := c.callContext(ctx, true)
+	defer cancel()
+	path := "/api/model/" + url.PathEscape(id)
+	info, err := c.modelInfo(ctx, path)
+	if err != nil {
+		return err
+	}
+	if opts.Offset < 0 || opts.Offset > info.Size {
+		return fmt.Errorf("trainingmodule: offset %d is outside model %s of %d bytes", opts.Offset, id, info.Size)
+	}
+	var sum hash.Hash
+	if !opts.SkipVerify {
+		if info.SHA256 == "" {
+			return fmt.Errorf("trainingmodule: the backend has no checksum of model %s", id)
+		}
+		sum = sha256.New()
+		if opts.Offset > 0 {
+			ra, ok := w.(io.ReaderAt)
+			if !ok {
+				return errors.New("trainingmodule: resuming a verified download needs a writer that is an io.ReaderAt")
+			}
+			if _, err := io.Copy(sum, io.NewSectionReader(ra, 0, opts.Offset)); err != nil {
+				return fmt.Errorf("trainingmodule: reading the downloaded part of model %s: %w", id, err)
+			}
+		}
+		w = io.MultiWriter(w, sum)
+	}
+
+	offset := opts.Offset
+	for attempt := 1; offset < info.Size; attempt++ {
+		n, retry, err := c.downloadFrom(ctx, path, info, offset, w, opts.Progress)
+		offset += n
+		if n > 0 {
+			attempt = 1
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retry || attempt > transferRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+		}
+	}
+	if sum != nil {
+		if got := hex.EncodeToString(sum.Sum(nil)); got != info.SHA256 {
+			return fmt.Errorf("%w: model %s has SHA-256 %s, the backend recorded %s", ErrChecksumMismatch, id, got, info.SHA256)
+		}
+	}
+	return nil
+}
+
+// modelInfo reads a model's size, modification time and checksum
+func (c *Client) modelInfo(ctx context.Context, path string) (*modelInfo, error) {
+	ctx, cancel := c.callContext(ctx, false)
+	defer cancel()
+	req, err := c.newUpstreamRequest(ctx, http.MethodGet, c.backendURL()+path+"/info", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer discardBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, upstreamStatusError(resp)
+	}
+	var info modelInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("trainingmodule: decoding model info: %w", err)
+	}
+	return &info, nil
+}
+
+// downloadFrom writes the weights from offset on to w. It reports the bytes
+// written and whether a failure is worth another try; failing to write to w
+// is not.
+func (c *Client) downloadFrom(ctx context.Context, path string, info *modelInfo, offset int64, w io.Writer, progress ProgressFunc) (int64, bool, error) {
+	req, err := c.newUpstreamRequest(ctx, http.MethodGet, c.backendURL()+path+"/download", nil)
+	if err != nil {
+		return 0, false, err
+	}
+	want := http.StatusOK
+	if offset > 0 {
+		want = http.StatusPartialContent
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		// A model replaced since comes whole instead of in part
+		req.Header.Set("If-Range", info.ModifiedAt.UTC().Format(http.TimeFormat))
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, true, unavailable(err)
+	}
+	defer discardBody(resp)
+	if resp.StatusCode == http.StatusOK && want == http.StatusPartialContent {
+		return 0, false, errors.New("trainingmodule: the model changed on the backend since the download started")
+	}
+	if resp.StatusCode != want {
+		err := upstreamStatusError(resp)
+		return 0, isRetryable(err), err
+	}
+
+	body := &progressReader{r: resp.Body, sent: offset, total: info.Size, fn: progress}
+	buf := make([]byte, 32<<10)
+	var written int64
+	for written < info.Size-offset {
+		n, rerr := body.Read(buf[:min(int64(len(buf)), info.Size-offset-written)])
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return written, false, fmt.Errorf("trainingmodule: writing model: %w", err)
+			}
+			written += int64(n)
+		}
+		if rerr != nil && written < info.Size-offset {
+			if rerr == io.EOF {
+				rerr = io.ErrUnexpectedEOF
+			}
+			return written, true, unavailable(rerr)
+		}
+	}
+	return written, false, nil
+}
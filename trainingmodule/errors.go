@@ -0,0 +1,139 @@
+package trainingmodule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrServiceUnavailable means the training backend could not be reached
+	// or answered 502/503/504
+	ErrServiceUnavailable = errors.New("trainingmodule: training service unavailable")
+	// ErrNotFound means the backend answered but has no such endpoint or resource
+	ErrNotFound = errors.New("trainingmodule: not found")
+	// ErrChecksumMismatch means a download does not match the SHA-256 the
+	// backend recorded for it
+	ErrChecksumMismatch = errors.New("trainingmodule: checksum mismatch")
+)
+
+// ErrUpstreamStatus is returned when the backend answers with an unexpected
+// status. It matches ErrNotFound for 404 and ErrServiceUnavailable for
+// 502/503/504 with errors.Is.
+type ErrUpstreamStatus struct {
+	Code int
+	// Body is the start of the response body, for diagnostics
+	Body string
+}
+
+func (e *ErrUpstreamStatus) Error() string {
+	msg := fmt.Sprintf("trainingmodule: backend returned %d %s", e.Code, http.StatusText(e.Code))
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// Is lets errors.Is classify the status
+func (e *ErrUpstreamStatus) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Code == http.StatusNotFound
+	case ErrServiceUnavailable:
+		return e.Code == http.StatusBadGateway || e.Code == http.StatusServiceUnavailable || e.Code == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+// upstreamStatusError builds an ErrUpstreamStatus from a response, reading a
+// little of the body
+func upstreamStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &ErrUpstreamStatus{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
+
+// unavailable wraps a transport error as ErrServiceUnavailable
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
+}
+
+// HealthStatus is the result of CheckHealth
+type HealthStatus struct {
+	// Healthy is true when the backend answered 200 with status "ok"
+	Healthy bool
+	// Status is the backend's own status ("ok", "degraded") or "unavailable"
+	Status    string
+	Latency   time.Duration
+	CheckedAt time.Time
+	// Dependencies is the backend's view of the Python service, storage,
+	// object store and queue, keyed by name; empty for backends older than 1.2
+	Dependencies map[string]DependencyStatus
+	// Details is the backend's /health response
+	Details map[string]interface{}
+}
+
+// Dependency states reported in HealthStatus.Dependencies
+const (
+	DependencyOK       = "ok"
+	DependencyDegraded = "degraded"
+	DependencyDown     = "down"
+	DependencyDisabled = "disabled"
+)
+
+// DependencyStatus is one dependency of the backend at its last check
+type DependencyStatus struct {
+	Status    string    `json:"status"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// Detail is dependency specific, such as upstream replicas or the bucket
+	Detail json.RawMessage `json:"detail,omitempty"`
+}
+
+// CheckHealth queries the backend's /health endpoint. The error is
+// ErrServiceUnavailable (wrapped) when the backend is down and an
+// *ErrUpstreamStatus for other unexpected answers; HealthStatus is filled in either way.
+func (c *Client) CheckHealth(ctx context.Context) (HealthStatus, error) {
+	status := HealthStatus{Status: "unavailable", CheckedAt: time.Now()}
+	ctx, cancel := c.callContext(ctx, false)
+	defer cancel()
+	req, err := c.newUpstreamRequest(ctx, http.MethodGet, c.backendURL()+"/health", nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := c.httpClient.Do(req)
+	status.Latency = time.Since(status.CheckedAt)
+	if err != nil {
+		return status, unavailable(err)
+	}
+	defer discardBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return status, upstreamStatusError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return status, unavailable(err)
+	}
+	var deps struct {
+		Dependencies map[string]DependencyStatus `json:"dependencies"`
+	}
+	if err := json.Unmarshal(body, &status.Details); err != nil {
+		return status, fmt.Errorf("trainingmodule: decoding health response: %w", err)
+	}
+	if err := json.Unmarshal(body, &deps); err == nil {
+		status.Dependencies = deps.Dependencies
+	}
+	if s, ok := status.Details["status"].(string); ok {
+		status.Status = s
+	} else {
+		status.Status = "ok"
+	}
+	status.Healthy = status.Status == "ok"
+	return status, nil
+}
@@ -0,0 +1,308 @@
+package trainingmodule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Subscribe follows a run through the backend's /api/runs/{id}/events
+// WebSocket, so Go services can react to training progress:
+//
+//	err := client.Subscribe(ctx, runID, trainingmodule.EventHandlers{
+//		OnMetric: func(m trainingmodule.MetricEvent) { db.SaveMetric(runID, m.Key, m.Step, m.Value) },
+//		OnStateChange: func(s trainingmodule.StateEvent) { db.SetStatus(runID, s.Status) },
+//	})
+
+// Run states reported in StateEvent.Status
+const (
+	RunQueued    = "queued"
+	RunRunning   = "running"
+	RunFinished  = "finished"
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+	RunTimedOut  = "timed_out"
+)
+
+// Reconnection backoff of Subscribe
+const (
+	subscribeMinBackoff = 500 * time.Millisecond
+	subscribeMaxBackoff = 30 * time.Second
+)
+
+// LogLine is a line of a run's log
+type LogLine struct {
+	// Line counts from the oldest line the backend still keeps
+	Line int64
+	// Time is when the line was written; zero when the backend did not record it
+	Time time.Time
+	Text string
+}
+
+// MetricEvent is a metric point logged by a run, e.g. a loss per epoch
+type MetricEvent struct {
+	Key   string
+	Value float64
+	Step  int64
+	Time  time.Time
+}
+
+// StateEvent is a change of a run's status
+type StateEvent struct {
+	Status string
+	// Error is why a failed run failed
+	Error string
+}
+
+// Ended reports whether the run has reached a final state
+func (e StateEvent) Ended() bool {
+	switch e.Status {
+	case RunFinished, RunFailed, RunCancelled, RunTimedOut:
+		return true
+	}
+	return false
+}
+
+// EventHandlers are called by Subscribe, one at a time on its goroutine; nil
+// handlers are skipped
+type EventHandlers struct {
+	OnLog         func(LogLine)
+	OnMetric      func(MetricEvent)
+	OnStateChange func(StateEvent)
+}
+
+// runEvent is a message of the events WebSocket
+type runEvent struct {
+	Type string `json:"type"`
+	// log
+	N    int64      `json:"n"`
+	Time *time.Time `json:"time"`
+	Text string     `json:"text"`
+	// metric
+	Key       string  `json:"key"`
+	Value     float64 `json:"value"`
+	Step      int64   `json:"step"`
+	Timestamp int64   `json:"timestamp"`
+	// state
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// subscription is what Subscribe has delivered, so a reconnect goes on
+// where the last connection stopped
+type subscription struct {
+	handlers EventHandlers
+	lastLine int64
+	metrics  map[string]int
+	state    StateEvent
+	// backend is where the run was followed last, kept with StickyWebSockets
+	backend string
+}
+
+// Subscribe calls the handlers for a run's log lines, metric points and
+// state changes until the run ends (nil), ctx is done (ctx.Err()) or the run
+// is not known (an error matching ErrNotFound). A connection that drops is
+// reopened with backoff and goes on after the last event delivered, so
+// handlers see every log line and metric point once. The first state event
+// is the run's status when Subscribe starts.
+func (c *Client) Subscribe(ctx context.Context, runID string, handlers EventHandlers) error {
+	if c.websocket == nil {
+		return ErrNoWebSocket
+	}
+	ctx, cancel := c.callContext(ctx, true)
+	defer cancel()
+	sub := &subscription{handlers: handlers, metrics: map[string]int{}}
+	backoff := subscribeMinBackoff
+	for {
+		delivered, err := c.followRun(ctx, runID, sub)
+		switch {
+		case sub.state.Ended():
+			return nil
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil && !isRetryable(err):
+			return err
+		}
+		if delivered {
+			backoff = subscribeMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, subscribeMaxBackoff)
+	}
+}
+
+// isRetryable reports whether Subscribe should try again after err
+func isRetryable(err error) bool {
+	var status *ErrUpstreamStatus
+	if errors.As(err, &status) {
+		return status.Is(ErrServiceUnavailable)
+	}
+	return true
+}
+
+// followRun checks the run exists, then reads events until the connection
+// ends; it reports whether any event was delivered
+func (c *Client) followRun(ctx context.Context, runID string, sub *subscription) (bool, error) {
+	path := "/api/runs/" + url.PathEscape(runID)
+	base := c.backendURL()
+	if c.config.StickyWebSockets && sub.backend != "" {
+		// The run may only be known there; wait for it to come back
+		if !c.backends.isUp(sub.backend) {
+			return false, unavailable(fmt.Errorf("backend %s is down", sub.backend))
+		}
+		base = sub.backend
+	}
+	checkCtx, cancel := c.callContext(ctx, false)
+	defer cancel()
+	req, err := c.newUpstreamRequest(checkCtx, http.MethodGet, base+path, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, unavailable(err)
+	}
+	// The request may have failed over to another backend
+	if b, _ := c.backends.split(resp.Request.URL.String()); b != "" {
+		base = b
+	}
+	switch {
+	case !c.onSubscribedBackend(sub, base):
+		discardBody(resp)
+		return false, unavailable(fmt.Errorf("backend %s is down", sub.backend))
+	case resp.StatusCode != http.StatusOK:
+		defer discardBody(resp)
+		return false, upstreamStatusError(resp)
+	}
+	discardBody(resp)
+
+	// With authentication on, the backend wants a one-time token on the
+	// upgrade; any replica sharing its session secret takes it
+	query := "?offset=" + strconv.FormatInt(sub.lastLine, 10)
+	token, err := c.wsToken(ctx, base)
+	if err != nil {
+		return false, err
+	}
+	if token != "" {
+		query += "&token=" + url.QueryEscape(token)
+	}
+	conn, base, err := c.dialBackend(ctx, base, path+"/events"+query, func(target string) (*http.Request, error) {
+		return c.newUpstreamRequest(ctx, http.MethodGet, target, nil)
+	})
+	if err != nil {
+		return false, unavailable(err)
+	}
+	if !c.onSubscribedBackend(sub, base) {
+		conn.Close()
+		return false, unavailable(fmt.Errorf("backend %s is down", sub.backend))
+	}
+	sub.backend = base
+	defer conn.Close()
+	// Not every library stops reading when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Metrics come in full on every connection
+	seen := map[string]int{}
+	delivered := false
+	for {
+		_, data, err := readWSMessage(ctx, conn)
+		if err != nil {
+			return delivered, err
+		}
+		var ev runEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return delivered, fmt.Errorf("trainingmodule: decoding run event: %w", err)
+		}
+		delivered = true
+		sub.deliver(ev, seen)
+	}
+}
+
+// wsTokenPath is where the backend mints one-time WebSocket tokens
+const wsTokenPath = "/api/script/ws/token"
+
+// wsToken gets a one-time token for a WebSocket to base, "" when the backend
+// has authentication off
+func (c *Client) wsToken(ctx context.Context, base string) (string, error) {
+	ctx, cancel := c.callContext(ctx, false)
+	defer cancel()
+	req, err := c.newUpstreamRequest(ctx, http.MethodPost, base+wsTokenPath, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", unavailable(err)
+	}
+	defer discardBody(resp)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", upstreamStatusError(resp)
+	}
+	var answer struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", fmt.Errorf("trainingmodule: decoding WebSocket token: %w", err)
+	}
+	return answer.Token, nil
+}
+
+// onSubscribedBackend reports whether base is the backend a sticky
+// subscription is kept on, or the subscription is not kept on one
+func (c *Client) onSubscribedBackend(sub *subscription, base string) bool {
+	return !c.config.StickyWebSockets || sub.backend == "" || sub.backend == base
+}
+
+// deliver passes an event to its handler unless it was delivered before
+func (s *subscription) deliver(ev runEvent, seen map[string]int) {
+	switch ev.Type {
+	case "log":
+		if ev.N <= s.lastLine {
+			return
+		}
+		s.lastLine = ev.N
+		if s.handlers.OnLog != nil {
+			line := LogLine{Line: ev.N, Text: ev.Text}
+			if ev.Time != nil {
+				line.Time = *ev.Time
+			}
+			s.handlers.OnLog(line)
+		}
+	case "metric":
+		seen[ev.Key]++
+		if seen[ev.Key] <= s.metrics[ev.Key] {
+			return
+		}
+		s.metrics[ev.Key] = seen[ev.Key]
+		if s.handlers.OnMetric != nil {
+			metric := MetricEvent{Key: ev.Key, Value: ev.Value, Step: ev.Step}
+			if ev.Timestamp != 0 {
+				metric.Time = time.UnixMilli(ev.Timestamp)
+			}
+			s.handlers.OnMetric(metric)
+		}
+	case "state":
+		state := StateEvent{Status: ev.Status, Error: ev.Error}
+		if state == s.state {
+			return
+		}
+		s.state = state
+		if s.handlers.OnStateChange != nil {
+			s.handlers.OnStateChange(state)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package trainingmodule
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failover across backend replicas, set with Config.ServiceURLs. Requests go
+// to the first backend in the list that is up. One that cannot be reached is
+// marked down and skipped, and a request that failed on it is sent to the
+// next when that is safe: it has no body or one that can be sent again, and
+// it is idempotent or never left. A backend marked down is probed on /health
+// every HealthCheckInterval while the client is in use and takes traffic
+// again once it answers 200, so traffic returns to the first backend after an
+// upgrade. With StickyWebSockets a browser's execution WebSocket goes back to
+// the backend it used before, and Subscribe stays on the backend it started
+// on, while that backend is up.
+
+// DefaultHealthCheckInterval is how often a backend marked down is probed
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// stickyCookie holds the index of the backend a browser's execution
+// WebSocket went to
+const stickyCookie = "trainingmodule_backend"
+
+// backendPool tracks which backends are up
+type backendPool struct {
+	mu       sync.Mutex
+	backends []*backendState
+	interval time.Duration
+	// probe reports whether a backend answers /health with 200
+	probe func(base string) bool
+}
+
+type backendState struct {
+	url      string
+	down     bool
+	probing  bool
+	probedAt time.Time
+}
+
+func newBackendPool(urls []string, interval time.Duration, probe func(string) bool) *backendPool {
+	p := &backendPool{interval: interval, probe: probe}
+	for _, u := range urls {
+		p.backends = append(p.backends, &backendState{url: u})
+	}
+	return p
+}
+
+// current returns the first backend that is up, or the first of all when
+// none is
+func (p *backendPool) current() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probeDue()
+	for _, b := range p.backends {
+		if !b.down {
+			return b.url
+		}
+	}
+	return p.backends[0].url
+}
+
+// preferred returns backend i when it is up, or else the current one
+func (p *backendPool) preferred(i int) string {
+	p.mu.Lock()
+	if i >= 0 && i < len(p.backends) && !p.backends[i].down {
+		defer p.mu.Unlock()
+		return p.backends[i].url
+	}
+	p.mu.Unlock()
+	return p.current()
+}
+
+// index returns the position of a backend in the list, or -1
+func (p *backendPool) index(base string) int {
+	for i, b := range p.backends {
+		if b.url == base {
+			return i
+		}
+	}
+	return -1
+}
+
+// isUp reports whether a backend is not marked down
+func (p *backendPool) isUp(base string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.index(base)
+	return i >= 0 && !p.backends[i].down
+}
+
+// markDown takes a backend out of rotation until a probe finds it up
+func (p *backendPool) markDown(base string) {
+	if len(p.backends) < 2 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i := p.index(base); i >= 0 && !p.backends[i].down {
+		p.backends[i].down = true
+		p.backends[i].probedAt = time.Now()
+	}
+}
+
+// probeDue starts a probe of every backend that has been down for an
+// interval since it was last probed; p.mu is held
+func (p *backendPool) probeDue() {
+	for _, b := range p.backends {
+		if !b.down || b.probing || time.Since(b.probedAt) < p.interval {
+			continue
+		}
+		b.probing = true
+		go func() {
+			up := p.probe(b.url)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			b.probing, b.probedAt = false, time.Now()
+			b.down = !up
+		}()
+	}
+}
+
+// split returns the backend a URL points at and the rest of it
+func (p *backendPool) split(target string) (string, string) {
+	for _, b := range p.backends {
+		if rest, ok := strings.CutPrefix(target, b.url); ok && (rest == "" || rest[0] == '/' || rest[0] == '?') {
+			return b.url, rest
+		}
+	}
+	return "", ""
+}
+
+// unreachable reports whether err means a backend could not be connected to,
+// as opposed to one that answered
+func unreachable(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// failoverTransport sends a request that failed on one backend to the next
+type failoverTransport struct {
+	next http.RoundTripper
+	pool *backendPool
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for tries := 1; ; tries++ {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil || req.Context().Err() != nil {
+			return resp, err
+		}
+		base, rest := t.pool.split(req.URL.String())
+		if base == "" {
+			return nil, err
+		}
+		t.pool.markDown(base)
+		rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if tries >= len(t.pool.backends) || !rewindable || !(idempotent(req.Method) || unreachable(err)) {
+			return nil, err
+		}
+		alt := t.pool.current()
+		if alt == base {
+			return nil, err
+		}
+		retry := req.Clone(req.Context())
+		if retry.URL, err = url.Parse(alt + rest); err != nil {
+			return nil, err
+		}
+		retry.Host = ""
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
+
+// idempotent reports whether a request may be sent twice
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// dialBackend opens a WebSocket to a backend path, starting with the given
+// backend and going on to the next one up while backends cannot be reached.
+// handshake builds the handshake request for a URL. It returns the backend
+// it connected to.
+func (c *Client) dialBackend(ctx context.Context, base, pathAndQuery string, handshake func(target string) (*http.Request, error)) (WSConn, string, error) {
+	for tries := 1; ; tries++ {
+		target := c.wsURL(base, pathAndQuery)
+		req, err := handshake(target)
+		if err != nil {
+			return nil, base, err
+		}
+		conn, err := c.websocket.Dial(ctx, target, req.Header, c.wsOptions)
+		if err == nil || ctx.Err() != nil || !unreachable(err) {
+			return conn, base, err
+		}
+		c.backends.markDown(base)
+		alt := c.backends.current()
+		if tries >= len(c.backends.backends) || alt == base {
+			return nil, base, err
+		}
+		base = alt
+	}
+}
+
+// backendURL returns the backend requests go to now
+func (c *Client) backendURL() string {
+	return c.backends.current()
+}
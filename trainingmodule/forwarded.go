@@ -0,0 +1,84 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// setForwardedHeaders tells the backend who the client is: the caller's
+// address is appended to X-Forwarded-For and Forwarded, and X-Forwarded-Proto
+// and -Host carry the scheme and host the client used. Forwarding headers on
+// the incoming request are kept only when it comes from Config.TrustedProxies.
+func (c *Client) setForwardedHeaders(dst http.Header, r *http.Request) {
+	peer := stripPort(r.RemoteAddr)
+	trusted := c.isTrustedProxy(peer)
+	var priorFor, priorForwarded string
+	proto, host := "http", r.Host
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if trusted {
+		priorFor = strings.Join(r.Header.Values("X-Forwarded-For"), ", ")
+		priorForwarded = strings.Join(r.Header.Values("Forwarded"), ", ")
+		if p := firstValue(r.Header.Get("X-Forwarded-Proto")); p != "" {
+			proto = strings.ToLower(p)
+		}
+		if h := firstValue(r.Header.Get("X-Forwarded-Host")); h != "" {
+			host = h
+		}
+	}
+	for _, h := range forwardingHeaders {
+		dst.Del(h)
+	}
+
+	if priorFor != "" {
+		priorFor += ", "
+	}
+	dst.Set("X-Forwarded-For", priorFor+peer)
+	dst.Set("X-Forwarded-Proto", proto)
+	dst.Set("X-Forwarded-Host", host)
+	node := peer
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	elem := fmt.Sprintf("for=%s;host=%q;proto=%s", node, host, proto)
+	if priorForwarded != "" {
+		elem = priorForwarded + ", " + elem
+	}
+	dst.Set("Forwarded", elem)
+}
+
+func (c *Client) isTrustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range c.config.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort removes the port from host:port or [v6]:port
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// firstValue is the first entry of a comma separated header
+func firstValue(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.TrimSpace(first)
+}
@@ -0,0 +1,47 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"html/template"
+)
+
+// Template helpers so host pages include the module without hand-written
+// asset paths:
+//
+//	tmpl := template.New("").Funcs(client.FuncMap())
+//
+//	<head>{{trainingStyles}}</head>
+//	<body>{{trainingModal}} {{trainingScripts}}</body>
+
+// StyleTags returns the <link> tags for the module's stylesheets
+func (c *Client) StyleTags() template.HTML {
+	return template.HTML(`<link rel="stylesheet" href="` + template.HTMLEscapeString(c.assetURL("css/training-module.css")) + `">`)
+}
+
+// ScriptTags returns the <script> tags that load the module's JavaScript
+func (c *Client) ScriptTags() template.HTML {
+	return template.HTML(`<script type="module" src="` + template.HTMLEscapeString(c.assetURL("js/model.js")) + `"></script>`)
+}
+
+// Modal returns the modal container markup. It uses LoadModalHTML, so the
+// result is cached and falls back to the built-in copy when the backend is down.
+func (c *Client) Modal() template.HTML {
+	html, _ := c.LoadModalHTML()
+	return template.HTML(html)
+}
+
+// FuncMap exposes the helpers to html/template as trainingStyles,
+// trainingScripts and trainingModal
+func (c *Client) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"trainingStyles":  c.StyleTags,
+		"trainingScripts": c.ScriptTags,
+		"trainingModal":   c.Modal,
+	}
+}
+
+// assetURL returns the public URL of a frontend asset
+func (c *Client) assetURL(name string) string {
+	return c.prefix + "/" + name
+}
@@ -0,0 +1,45 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"net/http"
+)
+
+// checkProxyRequest runs Config.OnProxyRequest and writes the rejection when
+// it returns an error. The status is 403 unless the error has a StatusCode() int.
+func (c *Client) checkProxyRequest(w http.ResponseWriter, r *http.Request) bool {
+	if c.config.OnProxyRequest == nil {
+		return true
+	}
+	err := c.config.OnProxyRequest(r)
+	if err == nil {
+		return true
+	}
+	status := http.StatusForbidden
+	if coded, ok := err.(interface{ StatusCode() int }); ok {
+		status = coded.StatusCode()
+	}
+	http.Error(w, err.Error(), status)
+	return false
+}
+
+// checkProxyResponse runs Config.OnProxyResponse, answering 502 when it fails
+func (c *Client) checkProxyResponse(w http.ResponseWriter, resp *http.Response) bool {
+	if c.config.OnProxyResponse == nil {
+		return true
+	}
+	if err := c.config.OnProxyResponse(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return false
+	}
+	return true
+}
+
+// filterWSMessage runs Config.OnWSMessage; keep is false when the message is dropped
+func (c *Client) filterWSMessage(dir WSDirection, messageType int, data []byte) ([]byte, bool) {
+	if c.config.OnWSMessage == nil {
+		return data, true
+	}
+	return c.config.OnWSMessage(dir, messageType, data)
+}
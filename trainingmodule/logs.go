@@ -0,0 +1,81 @@
+package trainingmodule
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// StreamLogs reads a run's log from the first line and follows it, through
+// the backend's /api/runs/{id}/logs?follow=true, until the run has ended:
+//
+//	for line, err := range client.StreamLogs(ctx, runID) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(line.Text)
+//	}
+//
+// A failure is yielded as the last element, with a zero LogLine: an error
+// matching ErrNotFound for unknown runs, ctx.Err() once ctx is done.
+// Breaking out of the loop closes the stream.
+func (c *Client) StreamLogs(ctx context.Context, runID string) iter.Seq2[LogLine, error] {
+	return func(yield func(LogLine, error) bool) {
+		ctx, cancel := c.callContext(ctx, true)
+		defer cancel()
+		target := c.backendURL() + "/api/runs/" + url.PathEscape(runID) + "/logs?follow=true"
+		req, err := c.newUpstreamRequest(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			yield(LogLine{}, err)
+			return
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			} else {
+				err = unavailable(err)
+			}
+			yield(LogLine{}, err)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer discardBody(resp)
+			yield(LogLine{}, upstreamStatusError(resp))
+			return
+		}
+		defer resp.Body.Close()
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var raw struct {
+				N    int64      `json:"n"`
+				Time *time.Time `json:"time"`
+				Text string     `json:"text"`
+			}
+			if err := dec.Decode(&raw); err != nil {
+				if err == io.EOF {
+					return
+				}
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				} else {
+					err = unavailable(err)
+				}
+				yield(LogLine{}, err)
+				return
+			}
+			line := LogLine{Line: raw.N, Text: raw.Text}
+			if raw.Time != nil {
+				line.Time = *raw.Time
+			}
+			if !yield(line, nil) {
+				return
+			}
+		}
+	}
+}
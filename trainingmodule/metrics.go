@@ -0,0 +1,128 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clientMetrics is the prometheus.Collector behind WithMetricsRegistry. Every
+// series carries a "prefix" label so several clients can share a registry.
+type clientMetrics struct {
+	requests       *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	wsActive       prometheus.Gauge
+	wsSessions     prometheus.Counter
+	upstreamErrors *prometheus.CounterVec
+}
+
+func newClientMetrics(prefix string) *clientMetrics {
+	labels := prometheus.Labels{"prefix": prefix}
+	return &clientMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "trainingmodule_proxy_requests_total",
+			Help:        "Requests proxied to the training backend, by kind (api, asset, health, websocket), method and status code.",
+			ConstLabels: labels,
+		}, []string{"kind", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "trainingmodule_proxy_request_duration_seconds",
+			Help:        "Time until the training backend answered a proxied request, by kind.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"kind"}),
+		wsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "trainingmodule_websocket_sessions_active",
+			Help:        "Execution WebSocket sessions currently proxied.",
+			ConstLabels: labels,
+		}),
+		wsSessions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "trainingmodule_websocket_sessions_total",
+			Help:        "Execution WebSocket sessions proxied since start.",
+			ConstLabels: labels,
+		}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "trainingmodule_upstream_errors_total",
+			Help:        "Training backend failures: unreachable, or answering 502/503/504, by kind.",
+			ConstLabels: labels,
+		}, []string{"kind"}),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *clientMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+	m.wsActive.Describe(ch)
+	m.wsSessions.Describe(ch)
+	m.upstreamErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *clientMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+	m.wsActive.Collect(ch)
+	m.wsSessions.Collect(ch)
+	m.upstreamErrors.Collect(ch)
+}
+
+// WithMetricsRegistry registers a collector for the client's proxied
+// requests, WebSocket sessions and upstream errors with reg, e.g.
+// prometheus.DefaultRegisterer. Call it before serving and before Handler,
+// so derived handlers share the collector.
+func (c *Client) WithMetricsRegistry(reg prometheus.Registerer) error {
+	m := newClientMetrics(c.prefix)
+	if err := reg.Register(m); err != nil {
+		return err
+	}
+	c.metrics = m
+	return nil
+}
+
+// requestKind groups proxied paths for metric labels
+func (c *Client) requestKind(r *http.Request) string {
+	p := strings.TrimPrefix(r.URL.Path, c.prefix)
+	switch {
+	case p == "/health":
+		return "health"
+	case strings.HasPrefix(p, "/api/"):
+		return "api"
+	}
+	return "asset"
+}
+
+// observeResponse records a backend answer received start after sending
+func (m *clientMetrics) observeResponse(kind, method string, code int, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(kind, method, strconv.Itoa(code)).Inc()
+	m.duration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	if code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout {
+		m.upstreamErrors.WithLabelValues(kind).Inc()
+	}
+}
+
+// observeError records a backend that could not be reached
+func (m *clientMetrics) observeError(kind, method string) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(kind, method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+	m.upstreamErrors.WithLabelValues(kind).Inc()
+}
+
+// sessionStarted counts an execution WebSocket and returns its end callback
+func (m *clientMetrics) sessionStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.wsSessions.Inc()
+	m.wsActive.Inc()
+	return m.wsActive.Dec
+}
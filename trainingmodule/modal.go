@@ -0,0 +1,90 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrModalNotFound is returned when the backend has no modal HTML to serve.
+// It matches ErrNotFound with errors.Is.
+var ErrModalNotFound = fmt.Errorf("%w: modal HTML", ErrNotFound)
+
+// fallbackModalHTML is the modal shipped with this package, used when the
+// backend cannot be reached and nothing has been loaded yet
+//
+//go:generate sh -c "awk '/<!-- Model Info Modal -->/{p=1} /<script type=\"module\"/{p=0} p' ../../../../frontend/module.html > modal_fallback.html"
+//go:embed modal_fallback.html
+var fallbackModalHTML string
+
+// LoadModalHTML returns the modal HTML, fetching it from the training service
+// when the cached copy is older than Config.ModalCacheTTL.
+//
+// On error the returned HTML is still usable: the last good copy if there is
+// one, otherwise the fallback embedded in this package. The error tells the
+// caller why it was not fresh, ErrModalNotFound when the backend has no modal.
+func (c *Client) LoadModalHTML() (string, error) {
+	c.modalMu.Lock()
+	defer c.modalMu.Unlock()
+	if c.modalHTML != "" && time.Since(c.modalLoadedAt) < c.modalTTL {
+		return c.modalHTML, nil
+	}
+	return c.fetchModalLocked()
+}
+
+// ReloadModalHTML fetches the modal HTML now, ignoring the cache
+func (c *Client) ReloadModalHTML() (string, error) {
+	c.modalMu.Lock()
+	defer c.modalMu.Unlock()
+	return c.fetchModalLocked()
+}
+
+func (c *Client) fetchModalLocked() (string, error) {
+	html, err := c.fetchModalHTML()
+	if err != nil {
+		if c.modalHTML != "" {
+			return c.modalHTML, err
+		}
+		return fallbackModalHTML, err
+	}
+	c.modalHTML = html
+	c.modalLoadedAt = time.Now()
+	return html, nil
+}
+
+func (c *Client) fetchModalHTML() (string, error) {
+	ctx, cancel := c.callContext(context.Background(), false)
+	defer cancel()
+	req, err := c.newUpstreamRequest(ctx, http.MethodGet, c.backendURL()+"/api/model/modal-html", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", unavailable(err)
+	}
+	defer discardBody(resp)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrModalNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", upstreamStatusError(resp)
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// The backend answers an empty body when module.html has no modal section
+	if strings.TrimSpace(string(content)) == "" {
+		return "", ErrModalNotFound
+	}
+	return c.rewriteURLs(string(content)), nil
+}
@@ -0,0 +1,269 @@
+package trainingmodule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// executionPath is the backend's execution WebSocket, which StartTraining
+// speaks envelopes on
+const executionPath = "/api/script/ws/execute"
+
+// ErrRunFailed is returned by TrainingRun.Wait for a run that failed or was
+// cancelled, wrapped with the backend's reason
+var ErrRunFailed = errors.New("trainingmodule: run failed")
+
+// Model is a trained model, as the backend lists it
+type Model struct {
+	// Path is the weights' file name, e.g. "best_model.pt"
+	Path         string
+	LastModified time.Time
+	// Precision, Recall, MAP50 and MAP50_95 are the validation metrics of
+	// the model's training summary; zero when it has none
+	Precision float64
+	Recall    float64
+	MAP50     float64
+	MAP50_95  float64
+	// HasReport tells whether the backend serves an HTML training report
+	HasReport bool
+}
+
+// ListModels returns the trained models, newest first as the backend sorts
+// them
+func (c *Client) ListModels(ctx context.Context) ([]Model, error) {
+	ctx, cancel := c.callContext(ctx, false)
+	defer cancel()
+	req, err := c.newUpstreamRequest(ctx, http.MethodGet, c.backendURL()+"/api/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer discardBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, upstreamStatusError(resp)
+	}
+	var raw []struct {
+		Path         string  `json:"path"`
+		LastModified float64 `json:"last_modified"`
+		P            float64 `json:"p"`
+		R            float64 `json:"r"`
+		MAP50        float64 `json:"map50"`
+		MAP50_95     float64 `json:"map50_95"`
+		HasReport    bool    `json:"has_report"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("trainingmodule: decoding model list: %w", err)
+	}
+	models := make([]Model, len(raw))
+	for i, m := range raw {
+		sec, frac := math.Modf(m.LastModified)
+		models[i] = Model{
+			Path:         m.Path,
+			LastModified: time.Unix(int64(sec), int64(frac*1e9)),
+			Precision:    m.P,
+			Recall:       m.R,
+			MAP50:        m.MAP50,
+			MAP50_95:     m.MAP50_95,
+			HasReport:    m.HasReport,
+		}
+	}
+	return models, nil
+}
+
+// TrainingRequest is a script for the backend to run, as the modal's run
+// dialog sends it
+type TrainingRequest struct {
+	// ScriptPath is the script to run, e.g. "train.py"
+	ScriptPath string   `json:"script_path"`
+	Args       []string `json:"args"`
+	// Executor, Workspace, Pipeline, Priority ("low", "normal" or "high")
+	// and MaxDuration (e.g. "6h") are left to the backend when empty
+	Executor    string `json:"executor,omitempty"`
+	Workspace   string `json:"workspace,omitempty"`
+	Pipeline    string `json:"pipeline,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+	MaxDuration string `json:"max_duration,omitempty"`
+}
+
+// TrainingRun is a run started by StartTraining. The backend cancels a run
+// when its client leaves, so the run goes on while the TrainingRun is open:
+// Wait for it or Cancel it, then Close it.
+type TrainingRun struct {
+	// ID is the run's ID, for Subscribe, StreamLogs and the backend's run API
+	ID string
+	// RequestID traces the run in the backend's logs
+	RequestID string
+
+	conn WSConn
+	// writeMu serializes Cancel's writes
+	writeMu sync.Mutex
+	// ended is set once the run's final message was read, with its outcome
+	ended bool
+	err   error
+}
+
+// execEnvelope is a message of the execution WebSocket in envelope form
+type execEnvelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	RunID   string          `json:"run_id,omitempty"`
+	Ref     int64           `json:"ref,omitempty"`
+	Seq     int64           `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// message is the text of a control envelope's payload
+func (e execEnvelope) message() string {
+	var p struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(e.Payload, &p)
+	return p.Message
+}
+
+// StartTraining starts a run on the backend's execution WebSocket and
+// returns once the backend has accepted it, queued or running. A run the
+// backend refuses (unknown script or executor, a draining server) returns an
+// error matching ErrRunFailed.
+//
+//	run, err := client.StartTraining(ctx, trainingmodule.TrainingRequest{ScriptPath: "train.py", Args: []string{"--epochs", "50"}})
+//	if err != nil {
+//		return err
+//	}
+//	defer run.Close()
+//	go client.Subscribe(ctx, run.ID, handlers)
+//	return run.Wait(ctx)
+func (c *Client) StartTraining(ctx context.Context, req TrainingRequest) (*TrainingRun, error) {
+	if c.websocket == nil {
+		return nil, ErrNoWebSocket
+	}
+	if req.ScriptPath == "" {
+		return nil, errors.New("trainingmodule: no script path")
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	start, err := json.Marshal(execEnvelope{V: 1, Type: "execute", Seq: 1, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := c.callContext(ctx, false)
+	defer cancel()
+	conn, _, err := c.dialBackend(ctx, c.backendURL(), executionPath+"?envelope=1", func(target string) (*http.Request, error) {
+		return c.newUpstreamRequest(ctx, http.MethodGet, target, nil)
+	})
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	run := &TrainingRun{conn: conn}
+	// Not every library stops reading when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err = writeWSMessage(ctx, conn, TextMessage, start)
+	// The run is accepted once its messages carry its ID
+	for err == nil && run.ID == "" {
+		var env execEnvelope
+		env, err = run.next(ctx)
+		if err == nil && run.end(env) && run.ID == "" {
+			err = run.err
+		}
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if errors.Is(err, ErrRunFailed) || ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, unavailable(err)
+	}
+	return run, nil
+}
+
+// next reads the run's next envelope, skipping binary frames such as sample
+// images
+func (r *TrainingRun) next(ctx context.Context) (execEnvelope, error) {
+	for {
+		messageType, data, err := readWSMessage(ctx, r.conn)
+		if err != nil {
+			return execEnvelope{}, err
+		}
+		if messageType != TextMessage {
+			continue
+		}
+		var env execEnvelope
+		if err := json.Unmarshal(bytes.TrimSpace(data), &env); err != nil {
+			return env, fmt.Errorf("trainingmodule: decoding execution message: %w", err)
+		}
+		if env.RunID != "" && r.ID == "" {
+			r.ID = env.RunID
+		}
+		if env.Type == "request_id" {
+			r.RequestID = env.message()
+		}
+		return env, nil
+	}
+}
+
+// end records the outcome of a final envelope; false for other envelopes
+func (r *TrainingRun) end(env execEnvelope) bool {
+	switch env.Type {
+	case "finished":
+		r.ended = true
+	case "error":
+		r.ended, r.err = true, fmt.Errorf("%w: %s (request %s)", ErrRunFailed, env.message(), r.RequestID)
+	}
+	return r.ended
+}
+
+// Wait reads the run's messages until it ends: nil when it finished, an
+// error matching ErrRunFailed when it failed or was cancelled, and ctx.Err()
+// when ctx is done first. ctx being done closes the connection, which
+// cancels the run.
+func (r *TrainingRun) Wait(ctx context.Context) error {
+	if r.ended {
+		return r.err
+	}
+	stop := context.AfterFunc(ctx, func() { r.conn.Close() })
+	defer stop()
+	for {
+		env, err := r.next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return unavailable(err)
+		}
+		if r.end(env) {
+			return r.err
+		}
+	}
+}
+
+// Cancel asks the backend to cancel the run; Wait then returns an error
+// matching ErrRunFailed
+func (r *TrainingRun) Cancel(ctx context.Context) error {
+	msg, err := json.Marshal(execEnvelope{V: 1, Type: "cancel", Ref: 1})
+	if err != nil {
+		return err
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return writeWSMessage(ctx, r.conn, TextMessage, msg)
+}
+
+// Close closes the connection, which cancels the run unless it has ended
+func (r *TrainingRun) Close() error {
+	return r.conn.Close()
+}
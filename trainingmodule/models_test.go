@@ -0,0 +1,107 @@
+package trainingmodule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newExecutionBackend answers the execution WebSocket in envelope form: it
+// sends the request ID, then runs the script as script says, with the
+// client's first envelope and the conn to answer on
+func newExecutionBackend(t *testing.T, script func(conn *websocket.Conn, start execEnvelope)) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != executionPath || r.URL.Query().Get("envelope") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var start execEnvelope
+		if err := conn.ReadJSON(&start); err != nil {
+			return
+		}
+		conn.WriteJSON(execEnvelope{V: 1, Type: "request_id", Ref: start.Seq, Payload: json.RawMessage(`{"message":"req-1"}`)})
+		script(conn, start)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStartTraining(t *testing.T) {
+	got := make(chan TrainingRequest, 1)
+	srv := newExecutionBackend(t, func(conn *websocket.Conn, start execEnvelope) {
+		var req TrainingRequest
+		json.Unmarshal(start.Payload, &req)
+		got <- req
+		conn.WriteJSON(execEnvelope{V: 1, Type: "status", RunID: "run-1", Ref: start.Seq, Payload: json.RawMessage(`{"state":"running"}`)})
+		conn.WriteMessage(websocket.BinaryMessage, []byte(`{"v":1,"type":"binary","run_id":"run-1"}`+"\n\x89PNG"))
+		conn.WriteJSON(execEnvelope{V: 1, Type: "log", RunID: "run-1", Ref: start.Seq, Payload: json.RawMessage(`{"lines":["epoch 1"]}`)})
+		conn.WriteJSON(execEnvelope{V: 1, Type: "finished", RunID: "run-1", Ref: start.Seq})
+	})
+	c := TrainingModuleClient(Config{ServiceURL: srv.URL})
+
+	run, err := c.StartTraining(context.Background(), TrainingRequest{ScriptPath: "train.py", Args: []string{"--epochs", "2"}, Priority: "high"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer run.Close()
+	if run.ID != "run-1" || run.RequestID != "req-1" {
+		t.Errorf("run %q, request %q, want run-1, req-1", run.ID, run.RequestID)
+	}
+	if req := <-got; req.ScriptPath != "train.py" || len(req.Args) != 2 || req.Priority != "high" {
+		t.Errorf("backend got %+v", req)
+	}
+	if err := run.Wait(context.Background()); err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+}
+
+func TestStartTrainingRefused(t *testing.T) {
+	srv := newExecutionBackend(t, func(conn *websocket.Conn, start execEnvelope) {
+		conn.WriteJSON(execEnvelope{V: 1, Type: "error", Ref: start.Seq, Payload: json.RawMessage(`{"message":"Unknown executor gpu"}`)})
+	})
+	c := TrainingModuleClient(Config{ServiceURL: srv.URL})
+
+	_, err := c.StartTraining(context.Background(), TrainingRequest{ScriptPath: "train.py", Executor: "gpu"})
+	if !errors.Is(err, ErrRunFailed) {
+		t.Fatalf("err = %v, want ErrRunFailed", err)
+	}
+	if want := "trainingmodule: run failed: Unknown executor gpu (request req-1)"; err.Error() != want {
+		t.Errorf("err = %q, want %q", err, want)
+	}
+}
+
+func TestTrainingRunCancel(t *testing.T) {
+	srv := newExecutionBackend(t, func(conn *websocket.Conn, start execEnvelope) {
+		conn.WriteJSON(execEnvelope{V: 1, Type: "status", RunID: "run-2", Ref: start.Seq})
+		var cancel execEnvelope
+		if err := conn.ReadJSON(&cancel); err != nil || cancel.Type != "cancel" || cancel.Ref != start.Seq {
+			conn.WriteJSON(execEnvelope{V: 1, Type: "finished", RunID: "run-2"})
+			return
+		}
+		conn.WriteJSON(execEnvelope{V: 1, Type: "error", RunID: "run-2", Ref: start.Seq, Payload: json.RawMessage(`{"message":"Execution cancelled"}`)})
+	})
+	c := TrainingModuleClient(Config{ServiceURL: srv.URL})
+
+	run, err := c.StartTraining(context.Background(), TrainingRequest{ScriptPath: "train.py"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer run.Close()
+	if err := run.Cancel(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Wait(context.Background()); !errors.Is(err, ErrRunFailed) {
+		t.Errorf("Wait after Cancel = %v, want ErrRunFailed", err)
+	}
+}
@@ -0,0 +1,123 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Route is one entry of the client's route manifest
+type Route struct {
+	// Path is the URL path; when Prefix is true it also matches everything below it
+	Path   string
+	Prefix bool
+	// Method restricts the route to one method, GET including HEAD; empty for any
+	Method  string
+	Handler http.Handler
+}
+
+// PatternStyle turns a manifest route into a router's pattern syntax
+type PatternStyle func(Route) string
+
+var (
+	// ServeMuxStyle is net/http's ServeMux, where a trailing slash matches the
+	// subtree and a method goes in front of the path
+	ServeMuxStyle PatternStyle = func(r Route) string {
+		if r.Method != "" {
+			return r.Method + " " + r.Path
+		}
+		return r.Path
+	}
+	// WildcardStyle is chi, echo and fiber, where a trailing "*" matches the subtree
+	WildcardStyle PatternStyle = func(r Route) string {
+		if r.Prefix {
+			return r.Path + "*"
+		}
+		return r.Path
+	}
+	// GinStyle is gin (httprouter), which needs a named catch-all parameter
+	GinStyle PatternStyle = func(r Route) string {
+		if r.Prefix {
+			return r.Path + "*path"
+		}
+		return r.Path
+	}
+)
+
+// Routes returns every path the client serves: the whole prefixed tree as a
+// single route, plus the un-prefixed compatibility routes unless disabled.
+// Routes never overlap, so they can be registered on routers that reject
+// conflicting wildcards.
+func (c *Client) Routes() []Route {
+	routes := []Route{{Path: c.prefix + "/", Prefix: true, Handler: http.HandlerFunc(c.servePrefixed)}}
+	if !c.noCompat {
+		routes = append(routes, c.compatRoutes()...)
+	}
+	return routes
+}
+
+// Mount registers the route manifest on any router through its register
+// function, written in the router's pattern style:
+//
+//	client.Mount(r.Handle, trainingmodule.WildcardStyle) // chi
+//	client.Mount(func(p string, h http.Handler) { e.Any(p, echo.WrapHandler(h)) }, trainingmodule.WildcardStyle)
+//	client.Mount(func(p string, h http.Handler) { g.Any(p, gin.WrapH(h)) }, trainingmodule.GinStyle)
+//	client.Mount(func(p string, h http.Handler) { app.All(p, adaptor.HTTPHandler(h)) }, trainingmodule.WildcardStyle) // fiber
+func (c *Client) Mount(register func(pattern string, handler http.Handler), style PatternStyle) {
+	for _, route := range c.Routes() {
+		register(style(route), route.Handler)
+	}
+}
+
+// Handler returns a single handler for everything under prefix: assets,
+// API, health and the execution WebSocket. It replaces the Register* calls:
+//
+//	mux.Handle("/model-training/", client.Handler("/model-training"))
+//
+// An empty prefix uses Config.PathPrefix. A different prefix gets its own
+// URL rewriting; the client's template helpers keep using Config.PathPrefix.
+// The un-prefixed compatibility routes are not included, since the served
+// JavaScript already calls the prefixed API.
+func (c *Client) Handler(prefix string) http.Handler {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" || prefix == c.prefix {
+		return http.HandlerFunc(c.servePrefixed)
+	}
+	config := c.config
+	config.PathPrefix = prefix
+	derived := TrainingModuleClient(config)
+	derived.instruments = c.instruments
+	return http.HandlerFunc(derived.servePrefixed)
+}
+
+// compatRoutes are the un-prefixed routes older frontends call directly
+func (c *Client) compatRoutes() []Route {
+	return []Route{
+		{Path: "/api/script/ws/execute", Method: http.MethodGet, Handler: http.HandlerFunc(c.handleWebSocketProxy)},
+		{Path: "/api/models", Handler: http.HandlerFunc(c.handleAPIProxy)},
+		{Path: "/api/model/", Prefix: true, Handler: http.HandlerFunc(c.handleAPIProxy)},
+		{Path: "/api/pipeline/", Prefix: true, Handler: http.HandlerFunc(c.handleAPIProxy)},
+		{Path: "/api/dataset/", Prefix: true, Handler: http.HandlerFunc(c.handleAPIProxy)},
+		{Path: "/config/training-pipeline.json", Method: http.MethodGet, Handler: http.HandlerFunc(c.handleAssetProxy)},
+	}
+}
+
+// servePrefixed dispatches everything under the prefix: health, the execution
+// WebSocket, the API and frontend assets
+func (c *Client) servePrefixed(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, c.prefix)
+	switch {
+	case (path == "/health" || path == "/api/script/ws/execute") && r.Method != http.MethodGet && r.Method != http.MethodHead:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case path == "/health":
+		c.handleHealthCheck(w, r)
+	case path == "/api/script/ws/execute":
+		c.handleWebSocketProxy(w, r)
+	case strings.HasPrefix(path, "/api/"):
+		c.handleAPIProxy(w, r)
+	default:
+		c.handleAssetProxy(w, r)
+	}
+}
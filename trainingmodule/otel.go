@@ -0,0 +1,156 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// OpenTelemetry instrumentation, set up with WithTracerProvider and
+// WithMeterProvider. Every proxied request, health check and execution
+// WebSocket session gets a client span, a child of the span in the incoming
+// request's context, so it joins the host application's trace. The trace
+// context is passed on to the backend with the global propagator
+// (otel.SetTextMapPropagator). The instruments mirror the Prometheus
+// collector of WithMetricsRegistry.
+
+// instrumentationName names the client's tracer and meter
+const instrumentationName = "github.com/aikeymouse/model-training-module/trainingmodule"
+
+// otelMeters are the instruments behind WithMeterProvider
+type otelMeters struct {
+	requests       metric.Int64Counter
+	duration       metric.Float64Histogram
+	wsActive       metric.Int64UpDownCounter
+	wsSessions     metric.Int64Counter
+	upstreamErrors metric.Int64Counter
+}
+
+func newOtelMeters(mp metric.MeterProvider) (*otelMeters, error) {
+	meter := mp.Meter(instrumentationName, metric.WithInstrumentationVersion(Version))
+	m := &otelMeters{}
+	var err, e error
+	m.requests, e = meter.Int64Counter("trainingmodule.proxy.requests",
+		metric.WithDescription("Requests proxied to the training backend, by kind (api, asset, health, websocket), method and status code."))
+	err = errors.Join(err, e)
+	m.duration, e = meter.Float64Histogram("trainingmodule.proxy.request.duration", metric.WithUnit("s"),
+		metric.WithDescription("Time until the training backend answered a proxied request, by kind."))
+	err = errors.Join(err, e)
+	m.wsActive, e = meter.Int64UpDownCounter("trainingmodule.websocket.sessions.active",
+		metric.WithDescription("Execution WebSocket sessions currently proxied."))
+	err = errors.Join(err, e)
+	m.wsSessions, e = meter.Int64Counter("trainingmodule.websocket.sessions",
+		metric.WithDescription("Execution WebSocket sessions proxied since start."))
+	err = errors.Join(err, e)
+	m.upstreamErrors, e = meter.Int64Counter("trainingmodule.upstream.errors",
+		metric.WithDescription("Training backend failures: unreachable, or answering 502/503/504, by kind."))
+	err = errors.Join(err, e)
+	return m, err
+}
+
+// WithTracerProvider has the client record spans with tp, e.g.
+// otel.GetTracerProvider(). Call it before serving and before Handler, so
+// derived handlers share it.
+func (c *Client) WithTracerProvider(tp trace.TracerProvider) {
+	c.tracer = tp.Tracer(instrumentationName, trace.WithInstrumentationVersion(Version))
+}
+
+// WithMeterProvider has the client record metrics for its proxied requests,
+// WebSocket sessions and upstream errors with mp, e.g. otel.GetMeterProvider().
+// Call it before serving and before Handler, so derived handlers share them.
+func (c *Client) WithMeterProvider(mp metric.MeterProvider) error {
+	m, err := newOtelMeters(mp)
+	if err != nil {
+		return err
+	}
+	c.meters = m
+	return nil
+}
+
+// defaultTelemetry is what a client records to until the With options are called
+func defaultTelemetry() (trace.Tracer, *otelMeters) {
+	m, _ := newOtelMeters(metricnoop.NewMeterProvider())
+	return tracenoop.NewTracerProvider().Tracer(instrumentationName), m
+}
+
+// track starts observing a request to the backend. It returns the request to
+// send, which carries the span and its trace context, and done, which records
+// the backend's status code or the error that kept it from answering.
+func (c *Client) track(req *http.Request, kind string) (*http.Request, func(code int, err error)) {
+	start := time.Now()
+	method := req.Method
+	ctx, span := c.tracer.Start(req.Context(), "trainingmodule "+kind, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("url.path", req.URL.Path),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("trainingmodule.prefix", c.prefix),
+	))
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, func(code int, err error) {
+		defer span.End()
+		attrs := metric.WithAttributes(attribute.String("kind", kind), attribute.String("trainingmodule.prefix", c.prefix))
+		if err != nil {
+			c.metrics.observeError(kind, method)
+			c.meters.requests.Add(ctx, 1, attrs, metric.WithAttributes(attribute.String("http.request.method", method), attribute.Int("http.response.status_code", http.StatusServiceUnavailable)))
+			c.meters.upstreamErrors.Add(ctx, 1, attrs)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+		c.metrics.observeResponse(kind, method, code, start)
+		c.meters.requests.Add(ctx, 1, attrs, metric.WithAttributes(attribute.String("http.request.method", method), attribute.Int("http.response.status_code", code)))
+		c.meters.duration.Record(ctx, time.Since(start).Seconds(), attrs)
+		span.SetAttributes(attribute.Int("http.response.status_code", code))
+		if code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+		if code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout {
+			c.meters.upstreamErrors.Add(ctx, 1, attrs)
+		}
+	}
+}
+
+// trackSession starts observing an execution WebSocket session. The context
+// carries its span for the backend handshake. dialed records whether the
+// backend could be reached; end closes the span once the session is over.
+func (c *Client) trackSession(r *http.Request) (ctx context.Context, dialed func(err error), end func()) {
+	ctx, span := c.tracer.Start(r.Context(), "trainingmodule websocket", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("trainingmodule.prefix", c.prefix),
+	))
+	attrs := metric.WithAttributes(attribute.String("trainingmodule.prefix", c.prefix))
+	ended := func() {}
+	dialed = func(err error) {
+		if err != nil {
+			c.metrics.observeError("websocket", r.Method)
+			c.meters.upstreamErrors.Add(ctx, 1, attrs, metric.WithAttributes(attribute.String("kind", "websocket")))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+		done := c.metrics.sessionStarted()
+		c.meters.wsSessions.Add(ctx, 1, attrs)
+		c.meters.wsActive.Add(ctx, 1, attrs)
+		ended = func() {
+			done()
+			c.meters.wsActive.Add(context.WithoutCancel(ctx), -1, attrs)
+		}
+	}
+	return ctx, dialed, func() {
+		ended()
+		span.End()
+	}
+}
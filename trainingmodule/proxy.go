@@ -0,0 +1,317 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The server side of the client: the routes a host app mounts, and the
+// proxying of the API, assets, health check and execution WebSocket to the
+// backend. It is left out of js/wasm builds, where only the typed API is
+// compiled.
+
+// instruments record the proxy's metrics and spans
+type instruments struct {
+	// metrics is nil unless WithMetricsRegistry was called
+	metrics *clientMetrics
+	// tracer and meters record nothing unless WithTracerProvider and
+	// WithMeterProvider were called
+	tracer trace.Tracer
+	meters *otelMeters
+}
+
+func newInstruments() instruments {
+	tracer, meters := defaultTelemetry()
+	return instruments{tracer: tracer, meters: meters}
+}
+
+// upstreamURL returns the URL of a request on the backend: its path, still
+// escaped, without the prefix, and its query string. Fragments never reach
+// the server.
+func (c *Client) upstreamURL(r *http.Request) string {
+	prefix := (&url.URL{Path: c.prefix}).EscapedPath()
+	target := c.backendURL() + strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	return target
+}
+
+// PathPrefix returns the prefix routes and assets are mounted under
+func (c *Client) PathPrefix() string {
+	return c.prefix
+}
+
+// RegisterRoutes registers the training module routes with the provided mux.
+// Routes are mounted under Config.PathPrefix; pathPrefix is only kept for
+// compatibility and, when it differs, also gets the health check.
+// The patterns carry methods, so the host module needs go 1.22 or later in
+// its go.mod.
+func (c *Client) RegisterRoutes(mux *http.ServeMux, pathPrefix string) {
+	// Only register health check - API routes are handled by RegisterAssetProxies with specific patterns
+	mux.HandleFunc("GET "+c.prefix+"/health", c.handleHealthCheck)
+	if pathPrefix != "" && strings.TrimRight(pathPrefix, "/") != c.prefix {
+		mux.HandleFunc("GET "+strings.TrimRight(pathPrefix, "/")+"/health", c.handleHealthCheck)
+	}
+}
+
+// RegisterAssetProxies registers handlers for frontend assets (CSS, JS, config)
+func (c *Client) RegisterAssetProxies(mux *http.ServeMux) {
+	// Register WebSocket proxy for training execution
+	mux.HandleFunc("GET "+c.prefix+"/api/script/ws/execute", c.handleWebSocketProxy)
+
+	// Register frontend asset routes under the prefix; the catch-all takes
+	// every method, since a method-less route below it would conflict
+	mux.HandleFunc(c.prefix+"/", c.handleAssetProxy)
+	mux.HandleFunc("GET "+c.prefix+"/css/", c.handleAssetProxy)
+	mux.HandleFunc("GET "+c.prefix+"/js/", c.handleAssetProxy)
+	mux.HandleFunc("GET "+c.prefix+"/config/", c.handleAssetProxy)
+
+	// Prefixed API used by the served JavaScript once its URLs are rewritten;
+	// every method is forwarded and the backend answers 405 for wrong ones
+	mux.HandleFunc(c.prefix+"/api/", c.handleAPIProxy)
+
+	if !c.noCompat {
+		c.RegisterCompatRoutes(mux)
+	}
+}
+
+// RegisterCompatRoutes registers the un-prefixed routes older frontends call
+// directly. RegisterAssetProxies does this unless Config.DisableCompatRoutes is set.
+func (c *Client) RegisterCompatRoutes(mux *http.ServeMux) {
+	for _, route := range c.compatRoutes() {
+		mux.Handle(ServeMuxStyle(route), route.Handler)
+	}
+}
+
+// handleAPIProxy proxies API calls to the backend service
+func (c *Client) handleAPIProxy(w http.ResponseWriter, r *http.Request) {
+	// Don't proxy WebSocket upgrade requests - they should be handled by the WebSocket handler
+	if r.Header.Get("Upgrade") == "websocket" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Remove the pathPrefix and forward to Go backend service
+	c.proxyRequest(w, r, c.upstreamURL(r))
+}
+
+// handleHealthCheck proxies the backend's /health, adding a "backend"
+// dependency with the latency seen from the host app. An unreachable backend
+// gets the same shape with status "unavailable".
+func (c *Client) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	targetURL := c.backendURL() + "/health"
+
+	ctx, cancel := c.callContext(r.Context(), false)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		http.Error(w, "Failed to proxy request", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set(RequestIDHeader, ensureRequestID(w, r))
+	c.setForwardedHeaders(req.Header, r)
+	c.prepare(req)
+	req, done := c.track(req, "health")
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	backend := DependencyStatus{Status: DependencyOK, LatencyMS: time.Since(start).Milliseconds(), CheckedAt: time.Now()}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		done(0, err)
+		backend.Status, backend.Error = DependencyDown, err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":       "unavailable",
+			"error":        "Go backend service not reachable",
+			"dependencies": map[string]DependencyStatus{"backend": backend},
+		})
+		return
+	}
+	defer discardBody(resp)
+	done(resp.StatusCode, nil)
+
+	raw, err := io.ReadAll(resp.Body)
+	var body map[string]json.RawMessage
+	if err != nil || json.Unmarshal(raw, &body) != nil {
+		// Not JSON; pass it on untouched
+		w.WriteHeader(resp.StatusCode)
+		w.Write(raw)
+		return
+	}
+	deps := map[string]json.RawMessage{}
+	json.Unmarshal(body["dependencies"], &deps)
+	if resp.StatusCode != http.StatusOK {
+		backend.Status = DependencyDegraded
+	}
+	deps["backend"], _ = json.Marshal(backend)
+	body["dependencies"], _ = json.Marshal(deps)
+	w.WriteHeader(resp.StatusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+// handleAssetProxy proxies frontend assets from the backend service
+func (c *Client) handleAssetProxy(w http.ResponseWriter, r *http.Request) {
+	// Strip the prefix if present before forwarding to backend
+	targetURL := c.upstreamURL(r)
+
+	// Compress text assets the backend sent uncompressed, and type those it
+	// sent without a Content-Type
+	aw := newAssetWriter(w, r)
+	defer aw.Close()
+	if rewritableAssets[path.Ext(r.URL.Path)] {
+		c.proxyRewritten(aw, r, targetURL)
+		return
+	}
+	c.proxyRequest(aw, r, targetURL)
+}
+
+// handleWebSocketProxy proxies WebSocket connections to the backend service
+func (c *Client) handleWebSocketProxy(w http.ResponseWriter, r *http.Request) {
+	requestID := ensureRequestID(w, r)
+	if c.websocket == nil {
+		http.Error(w, ErrNoWebSocket.Error(), http.StatusNotImplemented)
+		return
+	}
+	if !c.checkProxyRequest(w, r) {
+		return
+	}
+
+	// Connect to the backend first, so the handshake can remember which one
+	ctx, dialed, end := c.trackSession(r)
+	defer end()
+	path := "/api/script/ws/execute"
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	// Let PrepareRequest add auth headers to the handshake
+	backendConn, base, dialErr := c.dialBackend(ctx, c.stickyBackend(r), path, func(target string) (*http.Request, error) {
+		handshake, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		handshake.Header.Set(RequestIDHeader, requestID)
+		c.setForwardedHeaders(handshake.Header, r)
+		c.prepare(handshake)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(handshake.Header))
+		return handshake, nil
+	})
+	dialed(dialErr)
+
+	// Upgrade the connection to WebSocket
+	header := http.Header{RequestIDHeader: {requestID}}
+	if dialErr == nil {
+		if cookie := c.stickyCookieFor(base); cookie != nil {
+			header.Add("Set-Cookie", cookie.String())
+		}
+	}
+	conn, err := c.websocket.Accept(w, r, header, c.wsOptions)
+	if err != nil {
+		if dialErr == nil {
+			backendConn.Close()
+		}
+		return
+	}
+	defer conn.Close()
+
+	if dialErr != nil {
+		writeWSMessage(ctx, conn, TextMessage, []byte("Failed to connect to backend service"))
+		return
+	}
+	defer backendConn.Close()
+
+	// Proxy messages between client and backend
+	go c.relay(ctx, backendConn, conn, ClientToBackend)
+	c.relay(ctx, conn, backendConn, BackendToClient)
+}
+
+// proxyRequest is a helper function to proxy HTTP requests
+func (c *Client) proxyRequest(w http.ResponseWriter, r *http.Request, targetURL string) {
+	ensureRequestID(w, r)
+	if !c.checkProxyRequest(w, r) {
+		return
+	}
+
+	// Create a new request to the backend service
+	ctx, cancel := c.callContext(r.Context(), true)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, r.Body)
+	if err != nil {
+		http.Error(w, "Failed to proxy request", http.StatusInternalServerError)
+		return
+	}
+
+	// Copy headers
+	for key, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	c.setForwardedHeaders(req.Header, r)
+
+	c.prepare(req)
+
+	// Make the request
+	req, done := c.track(req, c.requestKind(r))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		done(0, err)
+		http.Error(w, "Backend service not available", http.StatusServiceUnavailable)
+		return
+	}
+	defer discardBody(resp)
+	done(resp.StatusCode, nil)
+	if !c.checkProxyResponse(w, resp) {
+		return
+	}
+
+	copyResponseHeader(w, resp)
+	if resp.Uncompressed {
+		// The transport decoded the body, so the backend's ETag no longer matches it
+		w.Header().Del("Etag")
+	}
+
+	// Set status code and stream the response body
+	w.WriteHeader(resp.StatusCode)
+	c.copyResponse(w, resp)
+}
+
+// stickyBackend returns the backend a browser's execution WebSocket should
+// go to: the one it used before when that is up
+func (c *Client) stickyBackend(r *http.Request) string {
+	if c.config.StickyWebSockets {
+		if cookie, err := r.Cookie(stickyCookie); err == nil {
+			if i, err := strconv.Atoi(cookie.Value); err == nil {
+				return c.backends.preferred(i)
+			}
+		}
+	}
+	return c.backendURL()
+}
+
+// stickyCookieFor remembers the backend a browser's execution WebSocket went
+// to, or is nil without StickyWebSockets
+func (c *Client) stickyCookieFor(base string) *http.Cookie {
+	if !c.config.StickyWebSockets || len(c.backends.backends) < 2 {
+		return nil
+	}
+	return &http.Cookie{
+		Name:     stickyCookie,
+		Value:    strconv.Itoa(c.backends.index(base)),
+		Path:     c.prefix,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,114 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUpstreamURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		target string
+		want   string
+	}{
+		{"plain path", "", "/model-training/api/models", "/api/models"},
+		{"query kept", "", "/model-training/api/models?page=2&sort=-date&q=a%26b", "/api/models?page=2&sort=-date&q=a%26b"},
+		{"escaped path kept", "", "/model-training/api/model/my%20model%2Fv1.pt/report", "/api/model/my%20model%2Fv1.pt/report"},
+		{"escaped path and query", "", "/model-training/api/dataset/a%3Fb/files?cursor=x%2By", "/api/dataset/a%3Fb/files?cursor=x%2By"},
+		{"custom prefix", "/ml", "/ml/api/models?v=1", "/api/models?v=1"},
+		{"prefix needing escapes", "/ml tools", "/ml%20tools/api/models?v=1", "/api/models?v=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := TrainingModuleClient(Config{ServiceURL: "http://backend:3000/", PathPrefix: tt.prefix})
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if got := c.upstreamURL(r); got != "http://backend:3000"+tt.want {
+				t.Errorf("upstreamURL(%q) = %q, want %q", tt.target, got, "http://backend:3000"+tt.want)
+			}
+		})
+	}
+}
+
+// seen is what a test backend received
+type seen struct {
+	path, query string
+}
+
+// newRecordingBackend answers API calls and execution WebSockets, sending
+// what each request asked for on the returned channel
+func newRecordingBackend(t *testing.T) (*httptest.Server, <-chan seen) {
+	got := make(chan seen, 4)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{r.URL.EscapedPath(), r.URL.RawQuery}
+		if r.URL.Path == "/api/script/ws/execute" {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.WriteMessage(websocket.TextMessage, []byte("EXECUTION_FINISHED"))
+			conn.ReadMessage()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+// newHost mounts a client of backend in a host app server; the test dialer
+// sends no Origin, which the WebSocket proxy only takes with AllowAllOrigins
+func newHost(t *testing.T, backend string) *httptest.Server {
+	c := TrainingModuleClient(Config{ServiceURL: backend, AllowAllOrigins: true})
+	mux := http.NewServeMux()
+	c.RegisterAssetProxies(mux)
+	host := httptest.NewServer(mux)
+	t.Cleanup(host.Close)
+	return host
+}
+
+func TestAPIProxyKeepsQueryAndEscapedPath(t *testing.T) {
+	backend, got := newRecordingBackend(t)
+	host := newHost(t, backend.URL)
+
+	resp, err := http.Get(host.URL + "/model-training/api/model/my%20model%2Fv1.pt/report?page=2&q=a%26b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	want := seen{"/api/model/my%20model%2Fv1.pt/report", "page=2&q=a%26b"}
+	if s := <-got; s != want {
+		t.Errorf("backend got %+v, want %+v", s, want)
+	}
+}
+
+func TestWebSocketProxyKeepsQuery(t *testing.T) {
+	backend, got := newRecordingBackend(t)
+	host := newHost(t, backend.URL)
+
+	url := "ws" + strings.TrimPrefix(host.URL, "http") + "/model-training/api/script/ws/execute?envelope=1&token=a%2Bb"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "EXECUTION_FINISHED" {
+		t.Fatalf("read %q, %v", msg, err)
+	}
+	want := seen{"/api/script/ws/execute", "envelope=1&token=a%2Bb"}
+	if s := <-got; s != want {
+		t.Errorf("backend got %+v, want %+v", s, want)
+	}
+}
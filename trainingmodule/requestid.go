@@ -0,0 +1,26 @@
+package trainingmodule
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID that correlates a request across the host
+// app, the training backend and the Python service
+const RequestIDHeader = "X-Request-ID"
+
+// ensureRequestID keeps the caller's X-Request-ID or assigns a new one, on the
+// incoming request so proxies forward it and on the response so the host app
+// can log it
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		r.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
@@ -0,0 +1,119 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The frontend calls root-relative URLs such as '/api/models' and
+// '/config/training-pipeline.json'. Served JavaScript and HTML are rewritten
+// so those calls go through the client's prefix instead.
+
+// rewritableAssets are the asset types whose URLs are rewritten
+var rewritableAssets = map[string]bool{
+	".js":   true,
+	".html": true,
+}
+
+// rewriteURLs points root-relative module URLs at the prefix
+func (c *Client) rewriteURLs(body string) string {
+	var pairs []string
+	for _, root := range []string{"/api/", "/config/"} {
+		// Quoted string literals, template literals and `${host}/api/...`
+		for _, lead := range []string{"'", `"`, "`", "}"} {
+			pairs = append(pairs, lead+root, lead+c.prefix+root)
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(body)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly since compressed responses carry the weak form
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyRewritten fetches an asset uncompressed, rewrites its URLs and serves
+// it with an ETag of the rewritten content
+func (c *Client) proxyRewritten(w http.ResponseWriter, r *http.Request, targetURL string) {
+	ensureRequestID(w, r)
+	if !c.checkProxyRequest(w, r) {
+		return
+	}
+	// HEAD needs the body too, for the ETag of the rewritten content
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	ctx, cancel := c.callContext(r.Context(), false)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, nil)
+	if err != nil {
+		http.Error(w, "Failed to proxy request", http.StatusInternalServerError)
+		return
+	}
+	for key, values := range r.Header {
+		switch http.CanonicalHeaderKey(key) {
+		// The body is rewritten, so the backend's encoding and validators do not apply
+		case "Accept-Encoding", "If-None-Match", "If-Modified-Since", "Range":
+			continue
+		}
+		req.Header[key] = values
+	}
+	c.setForwardedHeaders(req.Header, r)
+	c.prepare(req)
+
+	req, done := c.track(req, "asset")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		done(0, err)
+		http.Error(w, "Backend service not available", http.StatusServiceUnavailable)
+		return
+	}
+	defer discardBody(resp)
+	done(resp.StatusCode, nil)
+	if !c.checkProxyResponse(w, resp) {
+		return
+	}
+
+	// The rewritten body gets its own length and validators
+	copyResponseHeader(w, resp)
+	for _, name := range []string{"Content-Length", "Etag", "Last-Modified", "Accept-Ranges"} {
+		w.Header().Del(name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		c.copyResponse(w, resp)
+		return
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Failed to read asset", http.StatusBadGateway)
+		return
+	}
+	body := c.rewriteURLs(string(raw))
+	sum := sha256.Sum256([]byte(body))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, body)
+	}
+}
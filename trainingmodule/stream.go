@@ -0,0 +1,129 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders describe the backend connection, not the response, and are not
+// passed on to the caller
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// copyResponseHeader copies the backend's response headers to w, replacing
+// any defaults set by the handler. Content-Length is only kept when the body
+// is passed through as sent; without one the server answers chunked.
+func copyResponseHeader(w http.ResponseWriter, resp *http.Response) {
+	h := w.Header()
+	for key, values := range resp.Header {
+		h[key] = values
+	}
+	for _, name := range strings.Split(resp.Header.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if resp.ContentLength < 0 || resp.Uncompressed {
+		h.Del("Content-Length")
+	}
+}
+
+// streamingResponse reports whether the caller is waiting on each write:
+// bodies of unknown length (chunked downloads, NDJSON progress) and event streams
+func streamingResponse(resp *http.Response) bool {
+	if resp.ContentLength < 0 {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	switch strings.TrimSpace(strings.ToLower(mediaType)) {
+	case "text/event-stream", "application/x-ndjson", "application/ndjson":
+		return true
+	}
+	return false
+}
+
+// copyResponse writes the backend's response body to w, flushing as it goes
+// so progress reaches the browser while the backend is still producing it
+func (c *Client) copyResponse(w http.ResponseWriter, resp *http.Response) error {
+	latency := c.config.FlushInterval
+	if streamingResponse(resp) {
+		latency = -1
+	}
+	fw := &flushWriter{w: w, rc: http.NewResponseController(w), latency: latency}
+	defer fw.stop()
+	chunk := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(chunk)
+	_, err := io.CopyBuffer(fw, resp.Body, *chunk)
+	return err
+}
+
+// flushWriter flushes after every write when latency is negative, otherwise
+// at most latency after the first unflushed write
+type flushWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	rc      *http.ResponseController
+	latency time.Duration
+	timer   *time.Timer
+	pending bool
+	stopped bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if f.latency < 0 {
+		return n, f.flushLocked()
+	}
+	if !f.pending {
+		f.pending = true
+		if f.timer == nil {
+			f.timer = time.AfterFunc(f.latency, f.delayedFlush)
+		} else {
+			f.timer.Reset(f.latency)
+		}
+	}
+	return n, nil
+}
+
+func (f *flushWriter) delayedFlush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The handler may have returned; the ResponseWriter is off limits then
+	if f.pending && !f.stopped {
+		f.flushLocked()
+	}
+}
+
+func (f *flushWriter) flushLocked() error {
+	f.pending = false
+	err := f.rc.Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+func (f *flushWriter) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = true
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
@@ -0,0 +1,47 @@
+package trainingmodule
+
+import (
+	"context"
+	"time"
+)
+
+// Requests to the backend are bounded by their context alone, so a deadline
+// set by the caller, or by the incoming request a proxied one is made for,
+// carries over to the backend and cancels the call when it passes. On top of
+// that, short calls of the typed API (CheckHealth, CheckCompatibility,
+// ListModels, model info, the modal and the run lookup of Subscribe) and the
+// proxied /health and rewritten assets time out after Config.DefaultTimeout.
+// Transfers and streams (uploads, downloads, StreamLogs, Subscribe, proxied
+// API calls) have no limit of their own. WithTimeout sets the limit of a
+// single call, of either kind.
+
+// DefaultCallTimeout is how long a short call to the backend may take
+const DefaultCallTimeout = 10 * time.Second
+
+// timeoutKey is the context key of WithTimeout
+type timeoutKey struct{}
+
+// WithTimeout returns a context that has the calls made with it time out
+// after d, in place of Config.DefaultTimeout, including transfers and streams.
+// A d of zero or less lifts the client's limit; deadlines of ctx still apply.
+// Host apps can set it on an incoming request's context to bound the proxied
+// call made for it.
+func WithTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, timeoutKey{}, d)
+}
+
+// callContext bounds a call with the timeout set by WithTimeout or, for
+// short calls, with Config.DefaultTimeout
+func (c *Client) callContext(ctx context.Context, stream bool) (context.Context, context.CancelFunc) {
+	d, ok := ctx.Value(timeoutKey{}).(time.Duration)
+	if !ok {
+		if stream {
+			return context.WithCancel(ctx)
+		}
+		d = c.config.DefaultTimeout
+	}
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
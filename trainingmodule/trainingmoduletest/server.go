@@ -0,0 +1,289 @@
+// Package trainingmoduletest provides a fake training backend that runs in
+// process, so applications embedding the training module can unit test their
+// integration without Docker:
+//
+//	srv := trainingmoduletest.NewServer()
+//	defer srv.Close()
+//	client := srv.Client(trainingmodule.Config{})
+//
+// The fake serves canned models, a pipeline config, the modal HTML, minimal
+// frontend assets and an execution WebSocket that plays back a scripted run.
+package trainingmoduletest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aikeymouse/model-training-module/trainingmodule"
+	"github.com/gorilla/websocket"
+)
+
+// Model is an entry of /api/models, as the Python service reports it
+type Model struct {
+	Path         string  `json:"path"`
+	LastModified float64 `json:"last_modified"`
+	P            float64 `json:"p"`
+	R            float64 `json:"r"`
+	MAP50        float64 `json:"map50"`
+	MAP50_95     float64 `json:"map50_95"`
+	HasReport    bool    `json:"has_report"`
+}
+
+// Run is an execution request received on the WebSocket
+type Run struct {
+	ScriptPath string   `json:"script_path"`
+	Args       []string `json:"args"`
+	Workspace  string   `json:"workspace,omitempty"`
+	Pipeline   string   `json:"pipeline,omitempty"`
+}
+
+// Defaults served until the test replaces them
+var (
+	DefaultModels = []Model{
+		{Path: "best.pt", LastModified: 1700000000, P: 0.91, R: 0.88, MAP50: 0.93, MAP50_95: 0.71, HasReport: true},
+		{Path: "baseline.pt", LastModified: 1690000000, P: 0.82, R: 0.79, MAP50: 0.85, MAP50_95: 0.58},
+	}
+	DefaultPipelineConfig = json.RawMessage(`{"pipeline":{"stages":[{"id":"train","name":"Train Model","scripts":[{"script":"train.py","args":[]}],"enabled":true}],"variables":{}}}`)
+	DefaultModalHTML      = `<!-- Model Info Modal --><div id="modelInfoModal" class="modal"></div>`
+	// DefaultRunScript is what an execution prints: log lines, then the final status
+	DefaultRunScript = []string{"Starting training...", "Epoch 1/1: loss 0.42", "EXECUTION_FINISHED"}
+)
+
+// Server is the fake training backend. The embedded httptest.Server's URL is
+// what trainingmodule.Config.ServiceURL should point at.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	models    []Model
+	pipeline  json.RawMessage
+	modalHTML string
+	script    []string
+	delay     time.Duration
+	healthy   bool
+	runs      []Run
+	requests  []string
+}
+
+// NewServer starts a fake backend serving the defaults. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		models:    DefaultModels,
+		pipeline:  DefaultPipelineConfig,
+		modalHTML: DefaultModalHTML,
+		script:    DefaultRunScript,
+		healthy:   true,
+	}
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// Client returns a trainingmodule client for the fake, with ServiceURL filled in
+func (s *Server) Client(config trainingmodule.Config) *trainingmodule.Client {
+	config.ServiceURL = s.URL
+	return trainingmodule.TrainingModuleClient(config)
+}
+
+// SetModels replaces the /api/models answer
+func (s *Server) SetModels(models ...Model) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.models = models
+}
+
+// SetPipelineConfig replaces the pipeline config served at /api/pipeline/load
+// and /config/training-pipeline.json
+func (s *Server) SetPipelineConfig(config json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pipeline = config
+}
+
+// SetModalHTML replaces /api/model/modal-html; an empty string answers 404
+func (s *Server) SetModalHTML(html string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modalHTML = html
+}
+
+// SetRunScript sets the messages an execution sends, in order, waiting delay
+// between them. End with "EXECUTION_FINISHED" or "EXECUTION_ERROR: <reason>"
+// to mimic the real service.
+func (s *Server) SetRunScript(delay time.Duration, messages ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+	s.script = messages
+}
+
+// SetHealthy makes /health answer 503 when false
+func (s *Server) SetHealthy(healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy = healthy
+}
+
+// Runs returns the execution requests received so far
+func (s *Server) Runs() []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Run(nil), s.runs...)
+}
+
+// Requests returns "METHOD /path" for every request received so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"backend":              "test",
+			"api_version":          trainingmodule.APIVersion,
+			"frontend_api_version": trainingmodule.APIVersion,
+			"python_service":       map[string]interface{}{"version": "test", "api_version": trainingmodule.APIVersion},
+		})
+	})
+	mux.HandleFunc("/api/models", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		models := s.models
+		s.mu.Unlock()
+		if models == nil {
+			models = []Model{}
+		}
+		writeJSON(w, http.StatusOK, models)
+	})
+	mux.HandleFunc("/api/pipeline/load", s.handlePipelineConfig)
+	mux.HandleFunc("/config/training-pipeline.json", s.handlePipelineConfig)
+	mux.HandleFunc("/api/model/modal-html", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		html := s.modalHTML
+		s.mu.Unlock()
+		if html == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(html))
+	})
+	mux.HandleFunc("/api/script/ws/execute", s.handleExecute)
+	mux.HandleFunc("/css/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		w.Write([]byte("/* trainingmoduletest */\n"))
+	})
+	mux.HandleFunc("/js/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte("// trainingmoduletest\nfetch('/api/models');\n"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/module.html" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><script type="module" src="/js/main.js"></script></body></html>`))
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	healthy := s.healthy
+	s.mu.Unlock()
+	python := trainingmodule.DependencyStatus{Status: trainingmodule.DependencyOK}
+	if !healthy {
+		python = trainingmodule.DependencyStatus{Status: trainingmodule.DependencyDown, Error: "unhealthy (SetHealthy(false))"}
+	}
+	deps := map[string]trainingmodule.DependencyStatus{
+		"python_service": python,
+		"storage":        {Status: trainingmodule.DependencyOK},
+		"object_store":   {Status: trainingmodule.DependencyDisabled},
+		"queue":          {Status: trainingmodule.DependencyOK},
+	}
+	if !healthy {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "dependencies": deps})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "service": "trainingmoduletest", "dependencies": deps})
+}
+
+func (s *Server) handlePipelineConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	config := s.pipeline
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(config)
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// handleExecute reads the run request and plays back the run script. A
+// CANCEL message ends the run with "EXECUTION_ERROR: cancelled".
+func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var run Run
+	if err := conn.ReadJSON(&run); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.runs = append(s.runs, run)
+	script, delay := s.script, s.delay
+	s.mu.Unlock()
+	if run.ScriptPath == "" {
+		conn.WriteMessage(websocket.TextMessage, []byte("EXECUTION_ERROR: No script path provided"))
+		return
+	}
+
+	cancelled := make(chan struct{})
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if strings.TrimSpace(string(msg)) == "CANCEL" {
+				close(cancelled)
+				return
+			}
+		}
+	}()
+
+	for i, msg := range script {
+		if i > 0 && delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-cancelled:
+				conn.WriteMessage(websocket.TextMessage, []byte("EXECUTION_ERROR: cancelled"))
+				return
+			}
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
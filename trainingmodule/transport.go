@@ -0,0 +1,75 @@
+package trainingmodule
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Transport defaults. Every proxied call goes to the one backend host, so the
+// per-host idle pool has to hold what a busy page keeps in flight; net/http's
+// default of 2 closes the rest after each call, and under load the host app
+// runs out of ephemeral ports to TIME_WAIT sockets.
+const (
+	DefaultMaxIdleConnsPerHost = 64
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultDialTimeout         = 10 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// TransportConfig tunes the connection pool shared by all requests to the
+// backend. Zero values use the defaults above.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is how many keep-alive connections stay open for reuse
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps connections to the backend, 0 for no cap; calls
+	// over the cap wait for a free connection
+	MaxConnsPerHost int
+	// IdleConnTimeout closes keep-alive connections unused for this long
+	IdleConnTimeout time.Duration
+	// DialTimeout bounds establishing a TCP connection
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with https:// backends
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for response headers of proxied
+	// calls, 0 for none; bodies may stream for as long as they need
+	ResponseHeaderTimeout time.Duration
+}
+
+// newTransport builds the one transport the client's HTTP clients share
+func newTransport(tc TransportConfig, tlsConfig *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	t.MaxIdleConnsPerHost = orDefault(tc.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost)
+	t.MaxIdleConns = max(t.MaxIdleConns, t.MaxIdleConnsPerHost)
+	t.MaxConnsPerHost = tc.MaxConnsPerHost
+	t.IdleConnTimeout = orDefault(tc.IdleConnTimeout, DefaultIdleConnTimeout)
+	t.TLSHandshakeTimeout = orDefault(tc.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout)
+	t.ResponseHeaderTimeout = tc.ResponseHeaderTimeout
+	dialer := &net.Dialer{
+		Timeout:   orDefault(tc.DialTimeout, DefaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+func orDefault[T int | time.Duration](v, def T) T {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// maxDrain is how much of an unread response body is read to keep its
+// connection; larger ones are cheaper to close than to read
+const maxDrain = 256 << 10
+
+// discardBody reads what is left of a small response body before closing it,
+// so the connection goes back to the pool instead of being closed
+func discardBody(resp *http.Response) {
+	io.CopyN(io.Discard, resp.Body, maxDrain)
+	resp.Body.Close()
+}
@@ -0,0 +1,74 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newCountingBackend serves a small JSON answer and counts the connections
+// it accepts
+func newCountingBackend(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	var conns atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"models":[]}`))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	tb.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+// BenchmarkProxyRequest proxies API calls from concurrent callers through the
+// client's shared transport and reports the backend connections opened per
+// call, which stays near zero while the pool keeps them alive
+func BenchmarkProxyRequest(b *testing.B) {
+	srv, conns := newCountingBackend(b)
+	c := TrainingModuleClient(Config{ServiceURL: srv.URL})
+
+	b.SetParallelism(4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := httptest.NewRequest(http.MethodGet, DefaultPathPrefix+"/api/models", nil)
+			w := httptest.NewRecorder()
+			c.proxyRequest(w, r, c.upstreamURL(r))
+			if w.Code != http.StatusOK {
+				b.Errorf("status %d: %s", w.Code, w.Body)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+}
+
+// TestProxyRequestReusesConnections checks that sequential proxied calls,
+// including ones whose body the caller never reads, share one connection
+func TestProxyRequestReusesConnections(t *testing.T) {
+	srv, conns := newCountingBackend(t)
+	c := TrainingModuleClient(Config{ServiceURL: srv.URL})
+
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest(http.MethodGet, DefaultPathPrefix+"/api/models", nil)
+		w := httptest.NewRecorder()
+		c.proxyRequest(w, r, c.upstreamURL(r))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "models") {
+			t.Fatalf("call %d: status %d: %s", i, w.Code, w.Body)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("50 calls opened %d connections, want 1", n)
+	}
+}
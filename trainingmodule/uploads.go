@@ -0,0 +1,180 @@
+package trainingmodule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Uploads stream from an io.Reader, so files of any size are sent without
+// holding them in memory, and report their progress as they go. Model
+// weights go in chunks to the backend's resumable /api/model/{id}/upload; a
+// chunk that fails on the way is sent again. Dataset images go to the Python
+// service as one multipart request, which cannot be resumed.
+
+// Dataset image kinds of UploadDataset
+const (
+	DatasetTarget     = "target"
+	DatasetBackground = "background"
+)
+
+// UploadChunkSize is the size of the chunks UploadModel sends
+const UploadChunkSize = 8 << 20
+
+// transferRetries is how often a failed chunk or download is tried again
+const transferRetries = 3
+
+// ProgressFunc is told how many bytes of an upload or download have been
+// moved and its size. It is called as the body is read, so it goes back when
+// a chunk is sent again.
+type ProgressFunc func(sent, total int64)
+
+// progressReader reports what has been read of an upload
+type progressReader struct {
+	r     io.Reader
+	sent  int64
+	total int64
+	fn    ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.fn != nil {
+		p.sent += int64(n)
+		p.fn(p.sent, p.total)
+	}
+	return n, err
+}
+
+// UploadDataset uploads an image of the custom dataset, kind DatasetTarget or
+// DatasetBackground, and returns the file name the service stored it under.
+// size is the body's length, or -1 when it is not known.
+func (c *Client) UploadDataset(ctx context.Context, kind, name string, body io.Reader, size int64, progress ProgressFunc) (string, error) {
+	if kind != DatasetTarget && kind != DatasetBackground {
+		return "", fmt.Errorf("trainingmodule: unknown dataset kind %q, want %s or %s", kind, DatasetTarget, DatasetBackground)
+	}
+	ctx, cancel := c.callContext(ctx, true)
+	defer cancel()
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	req, err := c.newUpstreamRequest(ctx, http.MethodPost, c.backendURL()+"/api/dataset/custom/upload/"+kind, pr)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if size >= 0 {
+		// The envelope around the file, so the backend can refuse an upload
+		// over its limit before it is sent
+		var envelope bytes.Buffer
+		ew := multipart.NewWriter(&envelope)
+		ew.SetBoundary(mw.Boundary())
+		ew.CreateFormFile("file", name)
+		ew.Close()
+		req.ContentLength = int64(envelope.Len()) + size
+	}
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, &progressReader{r: body, total: size, fn: progress})
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", unavailable(err)
+	}
+	defer discardBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", upstreamStatusError(resp)
+	}
+	var answer struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", fmt.Errorf("trainingmodule: decoding upload response: %w", err)
+	}
+	return answer.Filename, nil
+}
+
+// UploadModel uploads the weights of a model, size bytes read from body, in
+// UploadChunkSize chunks. A chunk that fails on the way or meets an
+// unavailable backend is sent again, up to three times, before the upload
+// fails. An existing model is not replaced: the backend answers 409
+// (ErrUpstreamStatus); delete the model first. Backends without model
+// uploads answer with an error matching ErrNotFound.
+func (c *Client) UploadModel(ctx context.Context, id string, body io.Reader, size int64, progress ProgressFunc) error {
+	if size < 0 {
+		return errors.New("trainingmodule: UploadModel needs the size of the weights")
+	}
+	ctx, cancel := c.callContext(ctx, true)
+	defer cancel()
+	target := c.backendURL() + "/api/model/" + url.PathEscape(id) + "/upload"
+	if size == 0 {
+		return c.putChunk(ctx, target, nil, 0, 0, progress)
+	}
+	buf := make([]byte, min(UploadChunkSize, size))
+	for offset := int64(0); offset < size; {
+		n, err := io.ReadFull(body, buf[:min(int64(len(buf)), size-offset)])
+		if err != nil {
+			return fmt.Errorf("trainingmodule: reading model at byte %d of %d: %w", offset, size, err)
+		}
+		for attempt := 1; ; attempt++ {
+			err = c.putChunk(ctx, target, buf[:n], offset, size, progress)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if attempt > transferRetries || !isRetryable(err) {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+			}
+		}
+		offset += int64(n)
+	}
+	return nil
+}
+
+// putChunk sends the chunk of an upload that starts at offset
+func (c *Client) putChunk(ctx context.Context, target string, chunk []byte, offset, size int64, progress ProgressFunc) error {
+	body := &progressReader{r: bytes.NewReader(chunk), sent: offset, total: size, fn: progress}
+	req, err := c.newUpstreamRequest(ctx, http.MethodPut, target, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(chunk))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if size > 0 {
+		req.Header.Set("Content-Range", "bytes "+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+int64(len(chunk))-1, 10)+"/"+strconv.FormatInt(size, 10))
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return unavailable(err)
+	}
+	defer discardBody(resp)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return upstreamStatusError(resp)
+	}
+	return nil
+}
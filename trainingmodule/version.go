@@ -0,0 +1,95 @@
+package trainingmodule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Version is the release of this module, tagged trainingmodule/v<Version>
+const Version = "1.3.0"
+
+// APIVersion is the backend API version this client is written against
+const APIVersion = 1
+
+// ErrIncompatible means the backend or Python service speaks a different API version
+var ErrIncompatible = errors.New("trainingmodule: incompatible API version")
+
+// Compatibility is the result of CheckCompatibility
+type Compatibility struct {
+	ClientAPIVersion   int
+	BackendAPIVersion  int
+	FrontendAPIVersion int
+	PythonAPIVersion   int
+	BackendVersion     string
+	PythonVersion      string
+	// Warnings lists versions that could not be determined
+	Warnings []string
+}
+
+// CheckCompatibility asks the backend's /api/version which API versions the
+// backend, its frontend and the Python service implement. A mismatch returns
+// an error wrapping ErrIncompatible; versions that cannot be determined (an
+// older backend without the endpoint, an unreachable Python service) are
+// reported in Warnings only.
+func (c *Client) CheckCompatibility(ctx context.Context) (Compatibility, error) {
+	compat := Compatibility{ClientAPIVersion: APIVersion}
+	ctx, cancel := c.callContext(ctx, false)
+	defer cancel()
+	req, err := c.newUpstreamRequest(ctx, http.MethodGet, c.backendURL()+"/api/version", nil)
+	if err != nil {
+		return compat, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return compat, unavailable(err)
+	}
+	defer discardBody(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		compat.Warnings = append(compat.Warnings, "backend does not report its version (older than 1.2)")
+		return compat, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return compat, upstreamStatusError(resp)
+	}
+
+	var body struct {
+		Backend            string `json:"backend"`
+		APIVersion         int    `json:"api_version"`
+		FrontendAPIVersion int    `json:"frontend_api_version"`
+		Python             struct {
+			Version    string `json:"version"`
+			APIVersion int    `json:"api_version"`
+			Error      string `json:"error"`
+		} `json:"python_service"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return compat, fmt.Errorf("trainingmodule: decoding version response: %w", err)
+	}
+	compat.BackendVersion = body.Backend
+	compat.BackendAPIVersion = body.APIVersion
+	compat.FrontendAPIVersion = body.FrontendAPIVersion
+	compat.PythonVersion = body.Python.Version
+	compat.PythonAPIVersion = body.Python.APIVersion
+
+	if compat.BackendAPIVersion != APIVersion {
+		return compat, fmt.Errorf("%w: client speaks %d, backend %s speaks %d", ErrIncompatible, APIVersion, compat.BackendVersion, compat.BackendAPIVersion)
+	}
+	if compat.FrontendAPIVersion == 0 {
+		compat.Warnings = append(compat.Warnings, "frontend API version unknown")
+	} else if compat.FrontendAPIVersion != APIVersion {
+		return compat, fmt.Errorf("%w: frontend assets expect API %d, client speaks %d", ErrIncompatible, compat.FrontendAPIVersion, APIVersion)
+	}
+	if compat.PythonAPIVersion == 0 {
+		warning := "python service version unknown"
+		if body.Python.Error != "" {
+			warning += ": " + body.Python.Error
+		}
+		compat.Warnings = append(compat.Warnings, warning)
+	} else if compat.PythonAPIVersion != APIVersion {
+		return compat, fmt.Errorf("%w: python service %s speaks %d, client speaks %d", ErrIncompatible, compat.PythonVersion, compat.PythonAPIVersion, APIVersion)
+	}
+	return compat, nil
+}
@@ -0,0 +1,101 @@
+package trainingmodule
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// The execution WebSocket is proxied through a WebSocket library chosen with
+// Config.WebSocket. GorillaWebSocket (gorilla/websocket) is the default; the
+// wscoder package adds coder/websocket. Building with the
+// trainingmodule_nogorilla tag leaves gorilla out, and Config.WebSocket must
+// then be set for the execution WebSocket to work.
+
+// Message types of WebSocket frames, as passed to OnWSMessage
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// WSDirection tells which way a WebSocket message is flowing
+type WSDirection int
+
+const (
+	// ClientToBackend messages come from the browser (the run request, CANCEL)
+	ClientToBackend WSDirection = iota
+	// BackendToClient messages are the script output streamed to the browser
+	BackendToClient
+)
+
+func (d WSDirection) String() string {
+	if d == ClientToBackend {
+		return "client->backend"
+	}
+	return "backend->client"
+}
+
+// ErrNoWebSocket is returned by Subscribe, and the execution WebSocket
+// answers 501, when no library is configured
+var ErrNoWebSocket = errors.New("trainingmodule: no WebSocket library configured, set Config.WebSocket")
+
+// WebSocket is a WebSocket library the client proxies the execution
+// WebSocket with
+type WebSocket interface {
+	// Accept upgrades a browser's request, answering with header added
+	Accept(w http.ResponseWriter, r *http.Request, header http.Header, opts WSOptions) (WSConn, error)
+	// Dial opens a connection to the backend, sending header with the handshake
+	Dial(ctx context.Context, url string, header http.Header, opts WSOptions) (WSConn, error)
+}
+
+// WSOptions are the client settings a WebSocket library applies
+type WSOptions struct {
+	// AllowAllOrigins accepts browsers on any origin (Config.AllowAllOrigins)
+	AllowAllOrigins bool
+	// Compression negotiates permessage-deflate (Config.WSCompression)
+	Compression bool
+	// TLSConfig is used for wss:// backends (Config.TLSConfig)
+	TLSConfig *tls.Config
+	// ReadLimit is the largest message read, in bytes; a larger one closes
+	// the connection. Zero for no limit (Config.WSMaxMessageSize).
+	ReadLimit int64
+}
+
+// WSConn is one WebSocket connection, read and written a message at a time
+type WSConn interface {
+	// NextReader returns the type of the next message and a reader of it
+	NextReader(ctx context.Context) (messageType int, r io.Reader, err error)
+	// NextWriter starts a message; closing the writer sends it
+	NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error)
+	// Close closes the connection without waiting for the peer
+	Close() error
+}
+
+// defaultWebSocket is used when Config.WebSocket is nil; nil when built
+// without gorilla
+var defaultWebSocket func() WebSocket
+
+// readWSMessage reads the next message whole
+func readWSMessage(ctx context.Context, conn WSConn) (int, []byte, error) {
+	messageType, r, err := conn.NextReader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := io.ReadAll(r)
+	return messageType, data, err
+}
+
+// writeWSMessage sends one message
+func writeWSMessage(ctx context.Context, conn WSConn, messageType int, data []byte) error {
+	w, err := conn.NextWriter(ctx, messageType)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
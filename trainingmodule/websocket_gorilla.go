@@ -0,0 +1,79 @@
+//go:build !trainingmodule_nogorilla && !js
+
+package trainingmodule
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+func init() {
+	defaultWebSocket = GorillaWebSocket
+}
+
+// wsWriteBufferPool shares write buffers between connections, which only
+// need one while writing a frame
+var wsWriteBufferPool = &sync.Pool{}
+
+// GorillaWebSocket returns the gorilla/websocket library, the default
+func GorillaWebSocket() WebSocket {
+	return gorillaWebSocket{}
+}
+
+type gorillaWebSocket struct{}
+
+func (gorillaWebSocket) Accept(w http.ResponseWriter, r *http.Request, header http.Header, opts WSOptions) (WSConn, error) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return opts.AllowAllOrigins
+		},
+		WriteBufferPool:   wsWriteBufferPool,
+		EnableCompression: opts.Compression,
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return nil, err
+	}
+	return newGorillaConn(conn, opts), nil
+}
+
+func (gorillaWebSocket) Dial(ctx context.Context, url string, header http.Header, opts WSOptions) (WSConn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = opts.TLSConfig
+	dialer.WriteBufferPool = wsWriteBufferPool
+	dialer.EnableCompression = opts.Compression
+	conn, _, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	return newGorillaConn(conn, opts), nil
+}
+
+// gorillaConn adapts a gorilla connection; it has no per-call context, the
+// relay ends when either connection is closed
+type gorillaConn struct {
+	conn *websocket.Conn
+}
+
+func newGorillaConn(conn *websocket.Conn, opts WSOptions) gorillaConn {
+	if opts.ReadLimit > 0 {
+		conn.SetReadLimit(opts.ReadLimit)
+	}
+	return gorillaConn{conn}
+}
+
+func (c gorillaConn) NextReader(ctx context.Context) (int, io.Reader, error) {
+	return c.conn.NextReader()
+}
+
+func (c gorillaConn) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	return c.conn.NextWriter(messageType)
+}
+
+func (c gorillaConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,28 @@
+//go:build !js
+
+package wscoder
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aikeymouse/model-training-module/trainingmodule"
+	"github.com/coder/websocket"
+)
+
+func (coderWebSocket) Dial(ctx context.Context, url string, header http.Header, opts trainingmodule.WSOptions) (trainingmodule.WSConn, error) {
+	dialOpts := &websocket.DialOptions{
+		HTTPHeader:      header,
+		CompressionMode: compression(opts.Compression),
+	}
+	if opts.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = opts.TLSConfig
+		dialOpts.HTTPClient = &http.Client{Transport: transport}
+	}
+	conn, _, err := websocket.Dial(ctx, url, dialOpts)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, opts), nil
+}
@@ -0,0 +1,22 @@
+//go:build js
+
+package wscoder
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aikeymouse/model-training-module/trainingmodule"
+	"github.com/coder/websocket"
+)
+
+// Dial opens the connection with the browser's WebSocket, which sets the
+// handshake headers, compression and TLS itself; header and opts other than
+// ReadLimit are ignored
+func (coderWebSocket) Dial(ctx context.Context, url string, header http.Header, opts trainingmodule.WSOptions) (trainingmodule.WSConn, error) {
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, opts), nil
+}
@@ -0,0 +1,77 @@
+// Package wscoder proxies the training module's execution WebSocket with
+// coder/websocket, for host apps that use it instead of gorilla/websocket:
+//
+//	client := trainingmodule.TrainingModuleClient(trainingmodule.Config{
+//		WebSocket: wscoder.New(),
+//	})
+//
+// Build with the trainingmodule_nogorilla tag to leave gorilla out. In js/wasm
+// builds Dial uses the browser's WebSocket, for Subscribe from a Go frontend.
+package wscoder
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/aikeymouse/model-training-module/trainingmodule"
+	"github.com/coder/websocket"
+)
+
+// New returns the coder/websocket library
+func New() trainingmodule.WebSocket {
+	return coderWebSocket{}
+}
+
+type coderWebSocket struct{}
+
+func compression(on bool) websocket.CompressionMode {
+	if on {
+		return websocket.CompressionNoContextTakeover
+	}
+	return websocket.CompressionDisabled
+}
+
+func (coderWebSocket) Accept(w http.ResponseWriter, r *http.Request, header http.Header, opts trainingmodule.WSOptions) (trainingmodule.WSConn, error) {
+	// Accept answers with the response writer's headers
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		InsecureSkipVerify: opts.AllowAllOrigins,
+		CompressionMode:    compression(opts.Compression),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, opts), nil
+}
+
+// conn adapts a coder connection
+type conn struct {
+	conn *websocket.Conn
+}
+
+func newConn(c *websocket.Conn, opts trainingmodule.WSOptions) conn {
+	// Batched training logs can exceed the default 32KB; like gorilla, there
+	// is no limit unless one is set
+	if opts.ReadLimit > 0 {
+		c.SetReadLimit(opts.ReadLimit)
+	} else {
+		c.SetReadLimit(-1)
+	}
+	return conn{c}
+}
+
+func (c conn) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, r, err := c.conn.Reader(ctx)
+	return int(messageType), r, err
+}
+
+func (c conn) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	return c.conn.Writer(ctx, websocket.MessageType(messageType))
+}
+
+func (c conn) Close() error {
+	return c.conn.CloseNow()
+}
@@ -0,0 +1,64 @@
+//go:build !js
+
+package trainingmodule
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Execution streams are relayed frame by frame from one connection's reader
+// to the other's writer through pooled chunks, so a log-heavy training does
+// not allocate a slice per line. Only an OnWSMessage hook, which needs whole
+// messages, makes the proxy read them into memory.
+
+// copyBufferPool holds the chunks WebSocket frames and proxied HTTP bodies
+// are copied through
+var copyBufferPool = sync.Pool{New: func() any {
+	b := make([]byte, 32<<10)
+	return &b
+}}
+
+// relayFrame copies the next frame of src to dst without holding it whole
+func relayFrame(ctx context.Context, dst, src WSConn) error {
+	messageType, r, err := src.NextReader(ctx)
+	if err != nil {
+		return err
+	}
+	w, err := dst.NextWriter(ctx, messageType)
+	if err != nil {
+		return err
+	}
+	chunk := copyBufferPool.Get().(*[]byte)
+	_, err = io.CopyBuffer(w, r, *chunk)
+	copyBufferPool.Put(chunk)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// relay copies frames from src to dst until either side fails, through
+// OnWSMessage when it is set
+func (c *Client) relay(ctx context.Context, dst, src WSConn, dir WSDirection) {
+	if c.config.OnWSMessage == nil {
+		for relayFrame(ctx, dst, src) == nil {
+		}
+		return
+	}
+	for {
+		messageType, message, err := readWSMessage(ctx, src)
+		if err != nil {
+			return
+		}
+		message, keep := c.filterWSMessage(dir, messageType, message)
+		if !keep {
+			continue
+		}
+		if err := writeWSMessage(ctx, dst, messageType, message); err != nil {
+			return
+		}
+	}
+}